@@ -0,0 +1,97 @@
+package golualib
+
+/*
+#include <stdlib.h>
+
+typedef void *(*golualib_Alloc)(void *ud, void *ptr, size_t osize, size_t nsize);
+typedef void (*golualib_Hook)(void *L, void *ar);
+
+extern golualib_Alloc lua_getallocf(void *L, void **ud);
+extern void lua_setallocf(void *L, golualib_Alloc f, void *ud);
+extern int lua_gc(void *L, int what, int data);
+extern void lua_sethook(void *L, golualib_Hook f, int mask, int count);
+
+// the allocator of the state wrapped with a cap on the bytes in use
+typedef struct {
+    golualib_Alloc f;
+    void *ud;
+    size_t used, limit;
+    int exceeded;
+} golualib_limit;
+
+static void *golualib_limit_alloc(void *ud, void *ptr, size_t osize, size_t nsize) {
+    golualib_limit *l = ud;
+    void *p;
+    if (ptr == NULL) {
+        // osize holds the type of the new object
+        osize = 0;
+    }
+    // shrinking and freeing must not fail
+    if (nsize > osize && l->used + (nsize - osize) > l->limit) {
+        l->exceeded = 1;
+        return NULL;
+    }
+    p = l->f(l->ud, ptr, osize, nsize);
+    if (p != NULL || nsize == 0) {
+        l->used = l->used - osize + nsize;
+    }
+    return p;
+}
+
+static golualib_limit *golualib_limit_memory(void *L, size_t limit) {
+    golualib_limit *l = malloc(sizeof(golualib_limit));
+    l->f = lua_getallocf(L, &l->ud);
+    // LUA_GCCOUNT and LUA_GCCOUNTB
+    l->used = (size_t)lua_gc(L, 3, 0) * 1024 + (size_t)lua_gc(L, 4, 0);
+    l->limit = limit;
+    l->exceeded = 0;
+    lua_setallocf(L, golualib_limit_alloc, l);
+    return l;
+}
+
+static void golualib_clear_hook(void *L) {
+    lua_sethook(L, NULL, 0, 0);
+}
+*/
+import "C"
+
+import (
+    "unsafe"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+// memoryLimit caps the bytes allocated by a Lua state, an allocation going
+// past it fails with a memory error
+type memoryLimit struct {
+    l *C.golualib_limit
+}
+
+// luaStatePtr returns the lua_State wrapped by L, its first field
+func luaStatePtr(L *lua.State) unsafe.Pointer {
+    return *(*unsafe.Pointer)(unsafe.Pointer(L))
+}
+
+func newMemoryLimit(L *lua.State, limit int64) *memoryLimit {
+    return &memoryLimit{l: C.golualib_limit_memory(luaStatePtr(L), C.size_t(limit))}
+}
+
+// exceeded tells whether an allocation failed since the last reset
+func (m *memoryLimit) exceeded() bool {
+    return m.l.exceeded != 0
+}
+
+func (m *memoryLimit) reset() {
+    m.l.exceeded = 0
+}
+
+// free releases the limit once its state is closed
+func (m *memoryLimit) free() {
+    C.free(unsafe.Pointer(m.l))
+    m.l = nil
+}
+
+// clearHook removes the debug hook of L
+func clearHook(L *lua.State) {
+    C.golualib_clear_hook(luaStatePtr(L))
+}
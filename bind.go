@@ -0,0 +1,633 @@
+package golualib
+
+import (
+    "fmt"
+    "math"
+    "reflect"
+    "strconv"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+const (
+    registryBind = "_golualib_bind_"
+    // the handle types of the types bound by RegisterType in the state, by
+    // typeKey of their pointer type
+    registryTypes = "_golualib_types_"
+)
+
+var contextType = reflect.TypeOf((*LuaContext)(nil)).Elem()
+
+// bindCode builds the Lua side of RegisterFunc. Go functions answer true
+// and their results, or false and an error raised in the caller, as Go
+// cannot raise Lua errors itself.
+const bindCode = `
+local wrap = GoWrap or function(f) return f end
+local pack, unpack, error = table.pack, table.unpack, error
+
+local function check(rs)
+    if not rs[1] then
+        error(rs[2], 2)
+    end
+    return unpack(rs, 2, rs.n)
+end
+
+local bind = {}
+
+function bind.func(fn)
+    fn = wrap(fn)
+    return function(...)
+        return check(pack(fn(...)))
+    end
+end
+
+return bind
+`
+
+// pushBind pushes the table built by bindCode, loading it the first time
+func pushBind(L *lua.State) error {
+    L.GetField(lua.LUA_REGISTRYINDEX, registryBind)
+    if !L.IsNil(-1) {
+        return nil
+    }
+    L.Pop(1)
+    if err := loadString(L, bindCode); err != nil {
+        return err
+    }
+    if err := L.Call(0, 1); err != nil {
+        return err
+    }
+    L.PushValue(-1)
+    L.SetField(lua.LUA_REGISTRYINDEX, registryBind)
+    return nil
+}
+
+// BindFunc pushes a Lua function calling fn, which can be any Go function.
+// Arguments are converted to the parameter types, a LuaContext parameter
+// receives the context of L. A trailing error result turns into the
+// nil, err convention of Lua, the other results are pushed as values, with
+// the types bound by RegisterType as objects.
+func BindFunc(L *lua.State, fn interface{}) error {
+    f, err := goFunction(reflect.ValueOf(fn), 0)
+    if err != nil {
+        return err
+    }
+    return pushBound(L, luaFunction(f))
+}
+
+// RegisterFunc sets the global name to a Lua function calling fn, see BindFunc
+func RegisterFunc(L *lua.State, name string, fn interface{}) error {
+    if err := BindFunc(L, fn); err != nil {
+        return err
+    }
+    L.SetGlobal(name)
+    return nil
+}
+
+func pushBound(L *lua.State, f lua.LuaGoFunction) error {
+    if err := pushBind(L); err != nil {
+        return err
+    }
+    L.GetField(-1, "func")
+    L.Remove(-2)
+    L.PushGoFunction(f)
+    return L.Call(1, 1)
+}
+
+// RegisterType binds the type of proto, a pointer to a struct, to scripts.
+// The global name gets a new(fields) function returning a copy of proto
+// updated with fields. Objects are handles, userdata exposing the exported
+// fields and the methods of the pointer type, obj:Method(...), and Go
+// functions taking or returning the type exchange the same objects.
+func RegisterType(L *lua.State, name string, proto interface{}) error {
+    pv := reflect.ValueOf(proto)
+    if pv.Kind() != reflect.Ptr || pv.Elem().Kind() != reflect.Struct {
+        return fmt.Errorf("RegisterType: %T is not a pointer to a struct", proto)
+    }
+    pt := pv.Type()
+    t := &HandleType{
+        Name:    name,
+        Methods: make(map[string]lua.LuaGoFunction, pt.NumMethod()),
+        Fields:  make(map[string]lua.LuaGoFunction),
+        Setters: make(map[string]lua.LuaGoFunction),
+    }
+    for i := 0; i < pt.NumMethod(); i++ {
+        m := pt.Method(i)
+        f, err := goFunction(m.Func, 1)
+        if err != nil {
+            return err
+        }
+        t.Methods[m.Name] = method(f)
+    }
+    for _, key := range fieldNames(pt.Elem(), nil) {
+        key := key
+        t.Fields[key] = func(L *lua.State) int {
+            // missing behind a nil embedded pointer
+            f, ok := structField(reflect.ValueOf(L.ToGoStruct(1)).Elem(), key)
+            if !ok || pushResult(L, f) != nil {
+                return 0
+            }
+            return 1
+        }
+        t.Setters[key] = func(L *lua.State) int {
+            f, ok := structField(reflect.ValueOf(L.ToGoStruct(1)).Elem(), key)
+            if !ok || !f.CanSet() {
+                return ArgError(L, 0, fmt.Sprintf("%s has no field %s", name, key))
+            }
+            rv, err := fromLua(L, 2, f.Type())
+            if err != nil {
+                return ArgError(L, 0, fmt.Sprintf("bad value for %s.%s (%v)", name, key, err))
+            }
+            f.Set(rv)
+            return 0
+        }
+    }
+    pushTypes(L)
+    L.PushGoStruct(t)
+    L.SetField(-2, typeKey(pt))
+    L.Pop(1)
+
+    // the global table with the constructor
+    L.CreateTable(0, 1)
+    err := pushBound(L, func(L *lua.State) int {
+        nv := reflect.New(pt.Elem())
+        nv.Elem().Set(pv.Elem())
+        if !L.IsNoneOrNil(1) {
+            if L.Type(1) != lua.LUA_TTABLE {
+                return failure(L, "bad argument #1 to 'new' (table expected)")
+            }
+            m, err := ToAny(L, 1)
+            if err == nil {
+                err = setFields(nv.Elem(), m)
+            }
+            if err != nil {
+                return failure(L, fmt.Sprintf("bad argument #1 to 'new' (%v)", err))
+            }
+        }
+        L.PushBoolean(true)
+        if err := pushResult(L, nv); err != nil {
+            L.Pop(1)
+            return failure(L, err.Error())
+        }
+        return 2
+    })
+    if err != nil {
+        L.Pop(1)
+        return err
+    }
+    L.SetField(-2, "new")
+    L.SetGlobal(name)
+    return nil
+}
+
+// fieldNames lists the names structField finds in the struct type t
+func fieldNames(t reflect.Type, seen map[reflect.Type]bool) []string {
+    if seen[t] {
+        return nil
+    }
+    if seen == nil {
+        seen = make(map[reflect.Type]bool)
+    }
+    seen[t] = true
+    var names []string
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        n, ok := fieldName(f)
+        if !ok {
+            continue
+        }
+        if f.Anonymous && n == "" {
+            ft := f.Type
+            if ft.Kind() == reflect.Ptr {
+                ft = ft.Elem()
+            }
+            if ft.Kind() == reflect.Struct {
+                names = append(names, fieldNames(ft, seen)...)
+            }
+            continue
+        }
+        if f.PkgPath == "" {
+            names = append(names, n)
+        }
+    }
+    return names
+}
+
+func failure(L *lua.State, msg string) int {
+    L.PushBoolean(false)
+    L.PushString(msg)
+    return 2
+}
+
+// boundFunc calls a Go function with the Lua arguments and pushes its
+// results. It returns their number, or the error of the argument narg, 0
+// when no argument is to blame.
+type boundFunc func(L *lua.State) (n, narg int, err error)
+
+// luaFunction answers true and the results of f, or false and its error
+func luaFunction(f boundFunc) lua.LuaGoFunction {
+    return func(L *lua.State) int {
+        n, narg, err := f(L)
+        if err != nil {
+            if narg > 0 {
+                return failure(L, fmt.Sprintf("bad argument #%d (%v)", narg, err))
+            }
+            return failure(L, err.Error())
+        }
+        L.PushBoolean(true)
+        L.Insert(-n - 1)
+        return n + 1
+    }
+}
+
+// method adapts f to the methods of a HandleType
+func method(f boundFunc) lua.LuaGoFunction {
+    return func(L *lua.State) int {
+        n, narg, err := f(L)
+        if err != nil {
+            return ArgError(L, narg, err.Error())
+        }
+        return n
+    }
+}
+
+// goFunction adapts fn, whose Lua arguments start at Lua index 1+skip for
+// methods called with their receiver
+func goFunction(fn reflect.Value, skip int) (boundFunc, error) {
+    if fn.Kind() != reflect.Func {
+        return nil, fmt.Errorf("BindFunc: %s is not a function", fn.Type())
+    }
+    t := fn.Type()
+    nout := t.NumOut()
+    withErr := nout > 0 && t.Out(nout-1) == errorType
+    return func(L *lua.State) (int, int, error) {
+        args := make([]reflect.Value, 0, t.NumIn())
+        idx := 1
+        if skip > 0 {
+            args = append(args, reflect.ValueOf(L.ToGoStruct(1)))
+            idx = 2
+        }
+        for i := skip; i < t.NumIn(); i++ {
+            pt := t.In(i)
+            if pt == contextType {
+                args = append(args, reflect.ValueOf(CheckLuaContext(L)))
+                continue
+            }
+            if t.IsVariadic() && i == t.NumIn()-1 {
+                for ; idx <= L.GetTop(); idx++ {
+                    v, err := fromLua(L, idx, pt.Elem())
+                    if err != nil {
+                        return 0, idx - skip, err
+                    }
+                    args = append(args, v)
+                }
+                break
+            }
+            v, err := fromLua(L, idx, pt)
+            if err != nil {
+                return 0, idx - skip, err
+            }
+            args = append(args, v)
+            idx++
+        }
+        rs := fn.Call(args)
+        if withErr {
+            if err, _ := rs[nout-1].Interface().(error); err != nil {
+                L.PushNil()
+                L.PushString(err.Error())
+                return 2, 0, nil
+            }
+            rs = rs[:nout-1]
+        }
+        for i, r := range rs {
+            if err := pushResult(L, r); err != nil {
+                L.Pop(i)
+                return 0, 0, err
+            }
+        }
+        return len(rs), 0, nil
+    }, nil
+}
+
+// typeKey names a Go type in the registry of the types, the package path
+// keeps apart the types of the same name from different packages
+func typeKey(t reflect.Type) string {
+    pkg := t
+    if pkg.Kind() == reflect.Ptr {
+        pkg = pkg.Elem()
+    }
+    return pkg.PkgPath() + " " + t.String()
+}
+
+// pushTypes pushes the registry table of the bound types, creating it the
+// first time
+func pushTypes(L *lua.State) {
+    L.GetField(lua.LUA_REGISTRYINDEX, registryTypes)
+    if L.IsNil(-1) {
+        L.Pop(1)
+        L.NewTable()
+        L.PushValue(-1)
+        L.SetField(lua.LUA_REGISTRYINDEX, registryTypes)
+    }
+}
+
+// boundType returns the handle type of the pointer type pt when it was
+// bound by RegisterType in L
+func boundType(L *lua.State, pt reflect.Type) *HandleType {
+    L.GetField(lua.LUA_REGISTRYINDEX, registryTypes)
+    if L.Type(-1) != lua.LUA_TTABLE {
+        L.Pop(1)
+        return nil
+    }
+    L.GetField(-1, typeKey(pt))
+    t, _ := L.ToGoStruct(-1).(*HandleType)
+    L.Pop(2)
+    return t
+}
+
+// pushResult pushes v as an object when its type was bound by RegisterType
+func pushResult(L *lua.State, v reflect.Value) error {
+    if v.Kind() == reflect.Struct && boundType(L, reflect.PtrTo(v.Type())) != nil {
+        p := reflect.New(v.Type())
+        p.Elem().Set(v)
+        v = p
+    }
+    if v.Kind() == reflect.Ptr && !v.IsNil() {
+        if t := boundType(L, v.Type()); t != nil {
+            PushHandle(L, t, v.Interface())
+            return nil
+        }
+    }
+    if v.IsValid() && v.CanInterface() {
+        return PushAny(L, v.Interface())
+    }
+    return PushAny(L, nil)
+}
+
+// fromLua converts the Lua value at idx into a value of type t, handles
+// give their Go value
+func fromLua(L *lua.State, idx int, t reflect.Type) (reflect.Value, error) {
+    if L.Type(idx) == lua.LUA_TUSERDATA {
+        if hv, ok := handleOf(L, idx); ok {
+            return goValue(reflect.ValueOf(hv.v), t)
+        }
+        if ud := L.ToGoStruct(idx); ud != nil {
+            return goValue(reflect.ValueOf(ud), t)
+        }
+        return reflect.Value{}, fmt.Errorf("%s expected, got %s", t, L.LTypename(idx))
+    }
+    v, err := ToAny(L, idx)
+    if err != nil {
+        return reflect.Value{}, err
+    }
+    return convertValue(v, t)
+}
+
+// goValue adapts a Go value held by Lua to type t
+func goValue(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+    switch {
+    case v.Type().AssignableTo(t):
+        return v, nil
+    case v.Kind() == reflect.Ptr && v.Elem().Type().AssignableTo(t):
+        return v.Elem(), nil
+    }
+    return reflect.Value{}, fmt.Errorf("%s expected, got %s", t, v.Type())
+}
+
+// convertValue converts a value returned by ToAny into type t
+func convertValue(v interface{}, t reflect.Type) (reflect.Value, error) {
+    if v == nil {
+        return reflect.Zero(t), nil
+    }
+    mismatch := func() (reflect.Value, error) {
+        return reflect.Value{}, fmt.Errorf("%s expected, got %s", t, luaTypeName(v))
+    }
+    switch t.Kind() {
+    case reflect.Interface:
+        if reflect.TypeOf(v).AssignableTo(t) {
+            return reflect.ValueOf(v), nil
+        }
+        return mismatch()
+    case reflect.Bool:
+        if b, ok := v.(bool); ok {
+            return reflect.ValueOf(b).Convert(t), nil
+        }
+        return mismatch()
+    case reflect.String:
+        if s, ok := v.(string); ok {
+            return reflect.ValueOf(s).Convert(t), nil
+        }
+        return mismatch()
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        var i int64
+        switch n := v.(type) {
+        case int64:
+            i = n
+        case float64:
+            if n != math.Trunc(n) {
+                return reflect.Value{}, fmt.Errorf("number has no integer representation")
+            }
+            i = int64(n)
+        default:
+            return mismatch()
+        }
+        rv := reflect.New(t).Elem()
+        if rv.Kind() >= reflect.Uint && rv.Kind() <= reflect.Uintptr {
+            if i < 0 || rv.OverflowUint(uint64(i)) {
+                return reflect.Value{}, fmt.Errorf("%d overflows %s", i, t)
+            }
+            rv.SetUint(uint64(i))
+        } else {
+            if rv.OverflowInt(i) {
+                return reflect.Value{}, fmt.Errorf("%d overflows %s", i, t)
+            }
+            rv.SetInt(i)
+        }
+        return rv, nil
+    case reflect.Float32, reflect.Float64:
+        switch n := v.(type) {
+        case int64:
+            return reflect.ValueOf(float64(n)).Convert(t), nil
+        case float64:
+            return reflect.ValueOf(n).Convert(t), nil
+        }
+        return mismatch()
+    case reflect.Slice:
+        if s, ok := v.(string); ok && t.Elem().Kind() == reflect.Uint8 {
+            return reflect.ValueOf([]byte(s)).Convert(t), nil
+        }
+        items, ok := sequence(v)
+        if !ok {
+            return mismatch()
+        }
+        rv := reflect.MakeSlice(t, len(items), len(items))
+        for i, item := range items {
+            e, err := convertValue(item, t.Elem())
+            if err != nil {
+                return reflect.Value{}, fmt.Errorf("[%d]: %v", i+1, err)
+            }
+            rv.Index(i).Set(e)
+        }
+        return rv, nil
+    case reflect.Array:
+        items, ok := sequence(v)
+        if !ok || len(items) > t.Len() {
+            return mismatch()
+        }
+        rv := reflect.New(t).Elem()
+        for i, item := range items {
+            e, err := convertValue(item, t.Elem())
+            if err != nil {
+                return reflect.Value{}, fmt.Errorf("[%d]: %v", i+1, err)
+            }
+            rv.Index(i).Set(e)
+        }
+        return rv, nil
+    case reflect.Map:
+        rv := reflect.MakeMap(t)
+        switch m := v.(type) {
+        case map[string]interface{}:
+            for k, item := range m {
+                key, err := convertKey(k, t.Key())
+                if err != nil {
+                    return reflect.Value{}, err
+                }
+                e, err := convertValue(item, t.Elem())
+                if err != nil {
+                    return reflect.Value{}, fmt.Errorf("[%s]: %v", k, err)
+                }
+                rv.SetMapIndex(key, e)
+            }
+        case []interface{}:
+            for i, item := range m {
+                key, err := convertValue(int64(i+1), t.Key())
+                if err != nil {
+                    return reflect.Value{}, err
+                }
+                e, err := convertValue(item, t.Elem())
+                if err != nil {
+                    return reflect.Value{}, fmt.Errorf("[%d]: %v", i+1, err)
+                }
+                rv.SetMapIndex(key, e)
+            }
+        default:
+            return mismatch()
+        }
+        return rv, nil
+    case reflect.Struct:
+        m, ok := v.(map[string]interface{})
+        if !ok {
+            return mismatch()
+        }
+        rv := reflect.New(t).Elem()
+        if err := setFields(rv, m); err != nil {
+            return reflect.Value{}, err
+        }
+        return rv, nil
+    case reflect.Ptr:
+        e, err := convertValue(v, t.Elem())
+        if err != nil {
+            return reflect.Value{}, err
+        }
+        p := reflect.New(t.Elem())
+        p.Elem().Set(e)
+        return p, nil
+    }
+    return reflect.Value{}, fmt.Errorf("unsupported type %s", t)
+}
+
+// sequence accepts arrays and the empty table
+func sequence(v interface{}) ([]interface{}, bool) {
+    switch s := v.(type) {
+    case []interface{}:
+        return s, true
+    case map[string]interface{}:
+        return nil, len(s) == 0
+    }
+    return nil, false
+}
+
+func convertKey(k string, t reflect.Type) (reflect.Value, error) {
+    switch t.Kind() {
+    case reflect.String:
+        return reflect.ValueOf(k).Convert(t), nil
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        i, err := strconv.ParseInt(k, 10, 64)
+        if err != nil {
+            return reflect.Value{}, fmt.Errorf("bad key %q for %s", k, t)
+        }
+        return convertValue(i, t)
+    }
+    return reflect.Value{}, fmt.Errorf("unsupported key type %s", t)
+}
+
+// setFields sets the fields of the struct rv named by the keys of m
+func setFields(rv reflect.Value, m interface{}) error {
+    fields, ok := m.(map[string]interface{})
+    if !ok {
+        if items, ok := sequence(m); ok && len(items) == 0 {
+            return nil
+        }
+        return fmt.Errorf("table with fields expected")
+    }
+    for k, item := range fields {
+        f, ok := structField(rv, k)
+        if !ok || !f.CanSet() {
+            return fmt.Errorf("%s has no field %s", rv.Type(), k)
+        }
+        e, err := convertValue(item, f.Type())
+        if err != nil {
+            return fmt.Errorf("%s: %v", k, err)
+        }
+        f.Set(e)
+    }
+    return nil
+}
+
+// structField finds the field of rv named name, by tag or by field name,
+// looking into embedded structs
+func structField(rv reflect.Value, name string) (reflect.Value, bool) {
+    t := rv.Type()
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        n, ok := fieldName(f)
+        if !ok {
+            continue
+        }
+        if f.Anonymous && n == "" {
+            fv := rv.Field(i)
+            if fv.Kind() == reflect.Ptr {
+                if fv.IsNil() {
+                    continue
+                }
+                fv = fv.Elem()
+            }
+            if fv.Kind() == reflect.Struct {
+                if v, ok := structField(fv, name); ok {
+                    return v, true
+                }
+            }
+            continue
+        }
+        if f.PkgPath == "" && n == name {
+            return rv.Field(i), true
+        }
+    }
+    return reflect.Value{}, false
+}
+
+func luaTypeName(v interface{}) string {
+    switch v.(type) {
+    case bool:
+        return "boolean"
+    case int64, float64:
+        return "number"
+    case string:
+        return "string"
+    case []interface{}, map[string]interface{}:
+        return "table"
+    }
+    return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,225 @@
+package golualib
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "testing"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+type bindPoint struct {
+    X, Y int
+}
+
+func (p *bindPoint) Sum() int {
+    return p.X + p.Y
+}
+
+// the types bound in a state do not leak into the others
+func TestRegisterTypePerState(t *testing.T) {
+    newState := func(name string) *lua.State {
+        L := lua.NewState()
+        L.OpenLibs()
+        t.Cleanup(L.Close)
+        if name != "" {
+            if err := RegisterType(L, name, &bindPoint{}); err != nil {
+                t.Fatal(err)
+            }
+        }
+        if err := RegisterFunc(L, "point", func(x, y int) *bindPoint {
+            return &bindPoint{x, y}
+        }); err != nil {
+            t.Fatal(err)
+        }
+        return L
+    }
+    check := func(L *lua.State, code, want string) {
+        t.Helper()
+        if err := L.DoString("_result = tostring(" + code + ")"); err != nil {
+            t.Fatal(err)
+        }
+        L.GetGlobal("_result")
+        got := L.ToString(-1)
+        L.Pop(1)
+        if got != want {
+            t.Fatalf("%s = %q, want %q", code, got, want)
+        }
+    }
+    a, b, plain := newState("Point"), newState("Vec"), newState("")
+    check(a, "getmetatable(point(1, 2)).__name", "Point")
+    check(a, "point(1, 2):Sum()", "3")
+    check(b, "getmetatable(point(3, 4)).__name", "Vec")
+    check(b, "point(3, 4):Sum()", "7")
+    check(plain, "getmetatable(point(5, 6))", "nil")
+}
+
+type bindShape struct {
+    Name   string            `lua:"name"`
+    Points []bindPoint       `lua:"points"`
+    Tags   map[string]int    `lua:"tags"`
+    Origin *bindPoint        `lua:"origin"`
+    Scale  float64
+    Hidden string            `lua:"-"`
+    Meta   map[int][]string
+}
+
+// bindState opens a state with the bindings of the tests
+func bindState(t *testing.T) *lua.State {
+    t.Helper()
+    L := lua.NewState()
+    L.OpenLibs()
+    t.Cleanup(L.Close)
+    if err := RegisterType(L, "Point", &bindPoint{X: 1}); err != nil {
+        t.Fatal(err)
+    }
+    funcs := map[string]interface{}{
+        "describe": func(s bindShape) string {
+            keys := make([]string, 0, len(s.Tags))
+            for k, v := range s.Tags {
+                keys = append(keys, fmt.Sprintf("%s=%d", k, v))
+            }
+            sort.Strings(keys)
+            origin := "nil"
+            if s.Origin != nil {
+                origin = fmt.Sprint(*s.Origin)
+            }
+            return fmt.Sprintf("%s %v %v %s %g %q %v", s.Name, s.Points, keys, origin, s.Scale, s.Hidden, s.Meta)
+        },
+        "sum": func(xs ...int) int {
+            n := 0
+            for _, x := range xs {
+                n += x
+            }
+            return n
+        },
+        "byte": func(b uint8, f float32, ok bool) string {
+            return fmt.Sprint(b, f, ok)
+        },
+        "bytes": func(b []byte) int {
+            return len(b)
+        },
+        "divide": func(a, b int) (int, error) {
+            if b == 0 {
+                return 0, errors.New("division by zero")
+            }
+            return a / b, nil
+        },
+        "check": func(s string) error {
+            if s == "" {
+                return errors.New("empty")
+            }
+            return nil
+        },
+        "shape": func() bindShape {
+            return bindShape{Name: "sq", Points: []bindPoint{{1, 2}}, Tags: map[string]int{"a": 1}}
+        },
+        "point": func(x, y int) *bindPoint {
+            return &bindPoint{x, y}
+        },
+        "norm": func(p *bindPoint) int {
+            return p.X*p.X + p.Y*p.Y
+        },
+        "mid": func(a, b bindPoint) bindPoint {
+            return bindPoint{(a.X + b.X) / 2, (a.Y + b.Y) / 2}
+        },
+    }
+    for name, fn := range funcs {
+        if err := RegisterFunc(L, name, fn); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return L
+}
+
+// evalAll returns the results of the Lua expression list exprs, printed
+// with tostring and joined by spaces
+func evalAll(t *testing.T, L *lua.State, exprs string) string {
+    t.Helper()
+    code := `local rs = table.pack(` + exprs + `)
+for i = 1, rs.n do rs[i] = tostring(rs[i]) end
+_result = table.concat(rs, ' ', 1, rs.n)`
+    if err := L.DoString(code); err != nil {
+        t.Fatalf("%s: %v", exprs, err)
+    }
+    L.GetGlobal("_result")
+    defer L.Pop(1)
+    return L.ToString(-1)
+}
+
+func TestBindConversions(t *testing.T) {
+    L := bindState(t)
+    tests := []struct {
+        exprs, want string
+    }{
+        // tables to structs, slices and maps
+        {`describe({name = 'tri', points = {{X = 1, Y = 2}, {X = 3}}, tags = {b = 2, a = 1},
+            origin = {X = 9}, Scale = 1.5, Meta = {[2] = {'u', 'v'}}})`,
+            `tri [{1 2} {3 0}] [a=1 b=2] {9 0} 1.5 "" map[2:[u v]]`},
+        {`describe({})`, ` [] [] nil 0 "" map[]`},
+        {`describe({points = {}})`, ` [] [] nil 0 "" map[]`},
+        {`sum()`, `0`},
+        {`sum(1, 2, 3)`, `6`},
+        {`byte(255, 0.5, true)`, `255 0.5 true`},
+        {`bytes('abc')`, `3`},
+        {`bytes({1, 2})`, `2`},
+        // structs to tables
+        {`shape().name, shape().points[1].X, shape().tags.a`, `sq 1 1`},
+        // a trailing error becomes nil, err
+        {`divide(7, 2)`, `3`},
+        {`divide(1, 0)`, `nil division by zero`},
+        {`select('#', check('x'))`, `0`},
+        {`check('')`, `nil empty`},
+        // bad arguments raise in the caller
+        {`pcall(sum, 1, 'x')`, `false bad argument #2 (int expected, got string)`},
+        {`pcall(byte, 256, 0, true)`, `false bad argument #1 (256 overflows uint8)`},
+        {`pcall(byte, 1.5, 0, true)`, `false bad argument #1 (number has no integer representation)`},
+        {`pcall(byte, 1, 'x', true)`, `false bad argument #2 (float32 expected, got string)`},
+        {`pcall(describe, {points = 1})`, `false bad argument #1 (points: []golualib.bindPoint expected, got number)`},
+        {`pcall(describe, {nope = 1})`, `false bad argument #1 (golualib.bindShape has no field nope)`},
+        {`pcall(describe, {Hidden = 'x'})`, `false bad argument #1 (golualib.bindShape has no field Hidden)`},
+        {`pcall(describe, {tags = {a = 'x'}})`, `false bad argument #1 (tags: [a]: int expected, got string)`},
+        {`pcall(describe, {points = {{X = 'x'}}})`, `false bad argument #1 (points: [1]: X: int expected, got string)`},
+    }
+    for _, test := range tests {
+        if got := evalAll(t, L, test.exprs); got != test.want {
+            t.Errorf("%s = %q, want %q", test.exprs, got, test.want)
+        }
+    }
+}
+
+func TestBindObjects(t *testing.T) {
+    L := bindState(t)
+    tests := []struct {
+        exprs, want string
+    }{
+        // objects are handles with the fields and methods of the type
+        {`type(Point.new()), Point.new().X, Point.new({Y = 2}):Sum()`, `userdata 1 3`},
+        {`point(3, 4):Sum(), norm(point(3, 4)), norm(Point.new({Y = 1}))`, `7 25 2`},
+        {`mid(point(0, 0), point(4, 2)):Sum()`, `3`},
+        {`mid({X = 2}, {X = 4}).X`, `3`},
+        {`(function() local p = point(1, 1); p.X = 5; return p.X, p:Sum(), norm(p) end)()`, `5 6 26`},
+        {`(function() local p = point(1, 1); return p == point(1, 1), rawequal(p, p) end)()`, `false true`},
+        {`getmetatable(point(1, 2)).__name, tostring(point(1, 2)):match('^Point: ') ~= nil`, `Point true`},
+        // scripts cannot reach the Go value
+        {`pcall(rawset, point(1, 2), '__go', 1)`, `false bad argument #1 to 'rawset' (table expected, got Point)`},
+        {`pcall(function() point(1, 2).Z = 1 end)`, `false cannot set field 'Z' of Point`},
+        {`point(1, 2).Z`, `nil`},
+        {`pcall(function() local p = point(1, 2); p.X = 'x' end)`, `false bad value for Point.X (int expected, got string)`},
+        {`pcall(point(1, 2).Sum, {})`, `false calling 'Sum' on bad self (Point expected, got table)`},
+        {`pcall(norm, {X = 3, Y = 4})`, `true 25`},
+        {`pcall(norm, io.stdout)`, `false bad argument #1 (*golualib.bindPoint expected, got userdata)`},
+    }
+    for _, test := range tests {
+        got := evalAll(t, L, test.exprs)
+        // the position of errors raised from Lua varies
+        if i := strings.Index(got, `]:1: `); i >= 0 {
+            got = got[:strings.Index(got, " ")+1] + got[i+len(`]:1: `):]
+        }
+        if got != test.want {
+            t.Errorf("%s = %q, want %q", test.exprs, got, test.want)
+        }
+    }
+}
@@ -0,0 +1,291 @@
+package golualib
+
+import (
+    "container/heap"
+    "context"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Clock is the time source of a context. lua_time reads the time from it,
+// lua_looper and the network modules run their timers and timeouts on it.
+type Clock interface {
+    Now() time.Time
+    // AfterFunc calls f once d elapsed, like time.AfterFunc
+    AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+// ClockTimer is a timer of a Clock, Stop and Reset work like on time.Timer
+type ClockTimer interface {
+    Stop() bool
+    Reset(d time.Duration) bool
+}
+
+// RealClock is the system clock, used by contexts without WithClock
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+    return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+    return time.AfterFunc(d, f)
+}
+
+// WithClock sets the clock of the context, RealClock by default
+func WithClock(c Clock) Option {
+    return func(ctx *luaContext) {
+        ctx.clock = c
+        if vc, ok := c.(*VirtualClock); ok {
+            vc.attach(ctx)
+        }
+    }
+}
+
+// ClockOf returns the clock of ctx
+func ClockOf(ctx LuaContext) Clock {
+    if lc, ok := ctx.(*luaContext); ok && lc.clock != nil {
+        return lc.clock
+    }
+    return RealClock
+}
+
+// AbortAfter arms a timer of c which sets a deadline in the past through
+// setDeadline once d elapsed, aborting the pending I/O of a net.Conn. stop
+// disarms it and clears the deadline if it fired. d <= 0 arms nothing.
+func AbortAfter(c Clock, d time.Duration, setDeadline func(time.Time) error) (stop func()) {
+    if d <= 0 {
+        return func() {}
+    }
+    var (
+        mutex   sync.Mutex
+        fired   bool
+        stopped bool
+    )
+    t := c.AfterFunc(d, func() {
+        mutex.Lock()
+        defer mutex.Unlock()
+        if !stopped {
+            fired = true
+            _ = setDeadline(time.Unix(1, 0))
+        }
+    })
+    return func() {
+        mutex.Lock()
+        defer mutex.Unlock()
+        stopped = true
+        t.Stop()
+        if fired {
+            _ = setDeadline(time.Time{})
+        }
+    }
+}
+
+// ClockTimeout returns a copy of parent canceled once d elapsed on c, its
+// Err is then context.DeadlineExceeded. d <= 0 sets no timeout.
+func ClockTimeout(parent context.Context, c Clock, d time.Duration) (context.Context, context.CancelFunc) {
+    cc, cancel := context.WithCancel(parent)
+    if d <= 0 {
+        return cc, cancel
+    }
+    tc := &clockContext{Context: cc}
+    t := c.AfterFunc(d, func() {
+        atomic.StoreInt32(&tc.expired, 1)
+        cancel()
+    })
+    return tc, func() {
+        t.Stop()
+        cancel()
+    }
+}
+
+type clockContext struct {
+    context.Context
+    expired int32
+}
+
+func (c *clockContext) Err() error {
+    err := c.Context.Err()
+    if err != nil && atomic.LoadInt32(&c.expired) == 1 {
+        return context.DeadlineExceeded
+    }
+    return err
+}
+
+// VirtualClock is a Clock that only moves on Advance, for tests of timer
+// driven scripts. Advance fires the timers due on the calling goroutine in
+// the order of their time, the clock reading the time of each timer while
+// it runs. After each timer it waits for the contexts using the clock to
+// run what the timer queued, so scripts see every timer and loop tick in
+// order before Advance returns. Contexts not started yet are not waited for,
+// their callbacks run once they start. Advance must not be called on the
+// goroutine of such a context.
+type VirtualClock struct {
+    mutex    sync.Mutex
+    now      time.Time
+    seq      uint64
+    timers   virtualTimers
+    contexts []*luaContext
+    // advancing serializes Advance
+    advancing sync.Mutex
+}
+
+type virtualTimer struct {
+    c    *VirtualClock
+    when time.Time
+    // seq orders the timers due at the same time by creation
+    seq uint64
+    // index is the position in the heap, -1 when not pending
+    index int
+    f     func()
+}
+
+type virtualTimers []*virtualTimer
+
+// NewVirtualClock creates a clock reading start until it is advanced
+func NewVirtualClock(start time.Time) *VirtualClock {
+    return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    return c.now
+}
+
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+    t := &virtualTimer{c: c, index: -1, f: f}
+    t.Reset(d)
+    return t
+}
+
+// Len returns the number of pending timers
+func (c *VirtualClock) Len() int {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    return len(c.timers)
+}
+
+// Advance moves the clock forward by d and fires the timers due by then,
+// including those they start. Advance(0) fires the timers due now.
+func (c *VirtualClock) Advance(d time.Duration) {
+    c.advancing.Lock()
+    defer c.advancing.Unlock()
+    c.mutex.Lock()
+    target := c.now.Add(d)
+    for len(c.timers) > 0 && !c.timers[0].when.After(target) {
+        t := heap.Pop(&c.timers).(*virtualTimer)
+        if t.when.After(c.now) {
+            c.now = t.when
+        }
+        c.mutex.Unlock()
+        t.f()
+        c.settle()
+        c.mutex.Lock()
+    }
+    if target.After(c.now) {
+        c.now = target
+    }
+    c.mutex.Unlock()
+}
+
+func (c *VirtualClock) attach(ctx *luaContext) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.contexts = append(c.contexts, ctx)
+}
+
+// settle waits for the contexts to run the callbacks queued so far, the
+// low lane only runs once the others are empty. Closed contexts are dropped
+// and those not started skipped, nothing would drain their queue.
+func (c *VirtualClock) settle() {
+    c.mutex.Lock()
+    contexts := append([]*luaContext(nil), c.contexts...)
+    c.mutex.Unlock()
+    for _, ctx := range contexts {
+        if atomic.LoadInt32(&ctx.started) == 0 {
+            continue
+        }
+        done := make(chan struct{})
+        if err := ctx.RunPriority(PriorityLow, func() { close(done) }); err != nil {
+            if err == ErrContextClosed {
+                c.detach(ctx)
+            }
+            continue
+        }
+        select {
+        case <-done:
+        case <-ctx.Done():
+        }
+    }
+}
+
+func (c *VirtualClock) detach(ctx *luaContext) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    for i, v := range c.contexts {
+        if v == ctx {
+            c.contexts = append(c.contexts[:i], c.contexts[i+1:]...)
+            return
+        }
+    }
+}
+
+func (t *virtualTimer) Stop() bool {
+    t.c.mutex.Lock()
+    defer t.c.mutex.Unlock()
+    if t.index < 0 {
+        return false
+    }
+    heap.Remove(&t.c.timers, t.index)
+    return true
+}
+
+func (t *virtualTimer) Reset(d time.Duration) bool {
+    c := t.c
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    pending := t.index >= 0
+    if pending {
+        heap.Remove(&c.timers, t.index)
+    }
+    c.seq++
+    t.when, t.seq = c.now.Add(d), c.seq
+    heap.Push(&c.timers, t)
+    return pending
+}
+
+func (ts virtualTimers) Len() int {
+    return len(ts)
+}
+
+func (ts virtualTimers) Less(i, j int) bool {
+    if !ts[i].when.Equal(ts[j].when) {
+        return ts[i].when.Before(ts[j].when)
+    }
+    return ts[i].seq < ts[j].seq
+}
+
+func (ts virtualTimers) Swap(i, j int) {
+    ts[i], ts[j] = ts[j], ts[i]
+    ts[i].index = i
+    ts[j].index = j
+}
+
+func (ts *virtualTimers) Push(x interface{}) {
+    t := x.(*virtualTimer)
+    t.index = len(*ts)
+    *ts = append(*ts, t)
+}
+
+func (ts *virtualTimers) Pop() interface{} {
+    old := *ts
+    t := old[len(old)-1]
+    old[len(old)-1] = nil
+    t.index = -1
+    *ts = old[:len(old)-1]
+    return t
+}
@@ -0,0 +1,68 @@
+package golualib
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestVirtualClockOrder(t *testing.T) {
+    vc := NewVirtualClock(time.Unix(0, 0))
+    var got []int
+    vc.AfterFunc(3*time.Second, func() { got = append(got, 3) })
+    vc.AfterFunc(time.Second, func() {
+        got = append(got, 1)
+        // started while advancing, due before the target
+        vc.AfterFunc(time.Second, func() { got = append(got, 2) })
+    })
+    stopped := vc.AfterFunc(2*time.Second, func() { got = append(got, -1) })
+    if !stopped.Stop() {
+        t.Fatal("Stop of a pending timer returned false")
+    }
+    vc.AfterFunc(10*time.Second, func() { got = append(got, 10) })
+
+    vc.Advance(5 * time.Second)
+    if want := []int{1, 2, 3}; !equalInts(got, want) {
+        t.Fatalf("fired %v, want %v", got, want)
+    }
+    if now := vc.Now(); !now.Equal(time.Unix(5, 0)) {
+        t.Fatalf("Now() = %v after Advance, want %v", now, time.Unix(5, 0))
+    }
+    if n := vc.Len(); n != 1 {
+        t.Fatalf("Len() = %d, want 1", n)
+    }
+}
+
+func TestVirtualClockSkipsContextsNotStarted(t *testing.T) {
+    vc := NewVirtualClock(time.Unix(0, 0))
+    ctx := NewDefaultContext(nil, WithClock(vc))
+    defer ctx.Close(context.Background())
+    ran := make(chan struct{})
+    vc.AfterFunc(time.Second, func() {
+        ctx.Run(func() { close(ran) })
+    })
+    advanced := make(chan struct{})
+    go func() {
+        vc.Advance(time.Second)
+        close(advanced)
+    }()
+    select {
+    case <-advanced:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Advance blocked on a context not started")
+    }
+    ctx.Start()
+    <-ran
+}
+
+func equalInts(a, b []int) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
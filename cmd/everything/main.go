@@ -1,11 +1,18 @@
 package main
 
 import (
+    "archive/zip"
+    "flag"
+    "io/fs"
     "log"
+    "path/filepath"
+    "strings"
+    "time"
 
     "github.com/DGHeroin/golualib/lua_jsonrpc"
     "github.com/DGHeroin/golualib/lua_kcp"
     "github.com/DGHeroin/golualib/lua_looper"
+    "github.com/DGHeroin/golualib/lua_pb"
     "github.com/DGHeroin/golualib/lua_time"
     "github.com/DGHeroin/golualib/lua_websocket"
 
@@ -15,24 +22,120 @@ import (
     "github.com/DGHeroin/golualib/lua_http"
 )
 
+var (
+    watch   = flag.Duration("watch", 0, "reload scripts when they change, polling at this interval")
+    onError = flag.String("on-error", "log", "what to do when a callback fails: log, restart or exit")
+    mainLua = flag.String("main", "main.lua", "script to run when the input is a directory or a zip archive")
+    paths   = flag.String("path", "", "require search paths inside a directory or zip archive, separated by ;")
+    admin   = flag.String("admin", "", "serve /metrics and /debug/lua/ on this address, e.g. 127.0.0.1:9100")
+    console = flag.String("console", "", "debug console address, host:port on loopback or unix:/path; GOLUALIB_CONSOLE_TOKEN sets its token")
+    gc      = flag.Duration("gc", 0, "force a garbage collection and return memory to the OS at this interval")
+    pbSets  = flag.String("pb", "", "protobuf descriptor sets for require('golualib.pb'), from protoc --include_imports --descriptor_set_out, separated by ;")
+)
+
 func main() {
     log.SetFlags(log.LstdFlags | log.Lshortfile)
-    ctx := NewDefaultContext(nil)
-    L := ctx.LuaState()
-    lua_http.Register(L)
-    lua_looper.Register(L)
-    lua_time.Register(L)
-    lua_websocket.Register(L)
-    lua_kcp.Register(L)
-    lua_jsonrpc.Register(L)
-    if len(os.Args) == 2 {
-        if fi, err := os.Stat(os.Args[1]); err == nil && !fi.IsDir() {
-            if err := L.DoFile(os.Args[1]); err != nil {
+    flag.Parse()
+    if *pbSets != "" {
+        for _, name := range strings.Split(*pbSets, ";") {
+            data, err := os.ReadFile(name)
+            if err == nil {
+                err = lua_pb.Preload(data)
+            }
+            if err != nil {
                 log.Println(err)
+                return
             }
-            ctx.WaitQuit()
+        }
+    }
+    if flag.NArg() == 1 {
+        input := flag.Arg(0)
+        fi, err := os.Stat(input)
+        if err != nil {
+            log.Println(err)
             return
         }
+        var (
+            opts        = []Option{WithGCPolicy(GCPolicy{Interval: *gc, FreeOSMemory: true})}
+            searchPaths []string
+            file        = input
+            reload      = true
+        )
+        if *paths != "" {
+            searchPaths = strings.Split(*paths, ";")
+        }
+        switch {
+        case fi.IsDir():
+            opts = append(opts, WithFS(os.DirFS(input), searchPaths...))
+            file = *mainLua
+        case filepath.Ext(input) == ".zip":
+            r, err := zip.OpenReader(input)
+            if err != nil {
+                log.Println(err)
+                return
+            }
+            defer r.Close()
+            opts = append(opts, WithFS(fs.FS(r), searchPaths...))
+            file = *mainLua
+            reload = false
+        }
+        ctx := NewDefaultContext(nil, opts...)
+        if *admin != "" {
+            a := NewAdmin(ctx.Metrics())
+            a.Handle("/debug/lua/profile", ProfileHandler(ctx))
+            a.Handle("/debug/lua/callbacks", CallbackProfileHandler(ctx))
+            if err := a.Listen(*admin); err != nil {
+                log.Println(err)
+                return
+            }
+            defer a.Close()
+        }
+        if *console != "" {
+            options := ConsoleOptions{Addr: *console, Token: os.Getenv("GOLUALIB_CONSOLE_TOKEN")}
+            if strings.HasPrefix(*console, "unix:") {
+                options.Network, options.Addr = "unix", strings.TrimPrefix(*console, "unix:")
+            }
+            c := NewConsole(ctx, options)
+            if err := c.Listen(); err != nil {
+                log.Println(err)
+                return
+            }
+            defer c.Close()
+        }
+        switch *onError {
+        case "restart":
+            ctx.SetErrorPolicy(ErrorPolicyRestart)
+        case "exit":
+            ctx.SetErrorPolicy(ErrorPolicyExit)
+        }
+        setup := func(ctx LuaContext) error {
+            L := ctx.LuaState()
+            lua_http.Register(L)
+            lua_looper.Register(L)
+            lua_time.Register(L)
+            lua_websocket.Register(L)
+            lua_kcp.Register(L)
+            lua_jsonrpc.Register(L)
+            return DoFile(ctx, file)
+        }
+        ctx.SetInitializer(setup)
+        if err := setup(ctx); err != nil {
+            log.Println(err)
+        }
+        if reload {
+            var reloader *Reloader
+            if fi.IsDir() {
+                reloader = NewFSReloader(input, file, ctx)
+            } else {
+                reloader = NewReloader(file, ctx)
+            }
+            reloader.WatchSignal()
+            if *watch > time.Duration(0) {
+                reloader.Watch(*watch)
+            }
+        }
+        ctx.WaitQuit()
+        return
     }
     log.Println("no input file")
 }
@@ -0,0 +1,404 @@
+package golualib
+
+import (
+    "bufio"
+    "crypto/subtle"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+// Inspector lists the live resources of one kind for the debug console,
+// one line each
+type Inspector func() []string
+
+type inspector struct {
+    kind string
+    fn   Inspector
+}
+
+// AddInspector registers fn under kind, e.g. "timers" or "conns", until the
+// returned closer is closed
+func AddInspector(ctx LuaContext, kind string, fn Inspector) io.Closer {
+    lc, ok := ctx.(*luaContext)
+    if !ok {
+        return closerFunc(func() error { return nil })
+    }
+    i := &inspector{kind: kind, fn: fn}
+    lc.mutex.Lock()
+    lc.inspectors = append(lc.inspectors, i)
+    lc.mutex.Unlock()
+    return closerFunc(func() error {
+        lc.mutex.Lock()
+        defer lc.mutex.Unlock()
+        for n, v := range lc.inspectors {
+            if v == i {
+                lc.inspectors = append(lc.inspectors[:n], lc.inspectors[n+1:]...)
+                break
+            }
+        }
+        return nil
+    })
+}
+
+// Inspect returns the lines of every inspector of kind registered on ctx
+func Inspect(ctx LuaContext, kind string) []string {
+    lc, ok := ctx.(*luaContext)
+    if !ok {
+        return nil
+    }
+    lc.mutex.Lock()
+    var fns []Inspector
+    for _, i := range lc.inspectors {
+        if i.kind == kind {
+            fns = append(fns, i.fn)
+        }
+    }
+    lc.mutex.Unlock()
+    var rs []string
+    for _, fn := range fns {
+        rs = append(rs, fn()...)
+    }
+    return rs
+}
+
+func inspectorKinds(ctx LuaContext) []string {
+    lc, ok := ctx.(*luaContext)
+    if !ok {
+        return nil
+    }
+    lc.mutex.Lock()
+    defer lc.mutex.Unlock()
+    seen := make(map[string]bool)
+    var rs []string
+    for _, i := range lc.inspectors {
+        if !seen[i.kind] {
+            seen[i.kind] = true
+            rs = append(rs, i.kind)
+        }
+    }
+    sort.Strings(rs)
+    return rs
+}
+
+func hasKind(ctx LuaContext, kind string) bool {
+    for _, k := range inspectorKinds(ctx) {
+        if k == kind {
+            return true
+        }
+    }
+    return false
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+    return f()
+}
+
+// ConsoleOptions configures a debug console
+type ConsoleOptions struct {
+    // Network is "unix" or "tcp", tcp only listens on loopback addresses
+    Network string
+    Addr    string
+    // Token is the first line operators must send, no check when empty
+    Token string
+    // Timeout bounds the evaluation of one line, which is then stopped,
+    // 10 seconds when zero
+    Timeout time.Duration
+}
+
+// Console is a line based debug console evaluating Lua on the live state of
+// a context. Lines are run through ctx.Run, so they never race the scripts.
+type Console struct {
+    ctx     LuaContext
+    options ConsoleOptions
+    mutex   sync.Mutex
+    ln      net.Listener
+    conns   map[net.Conn]struct{}
+    closed  bool
+}
+
+func NewConsole(ctx LuaContext, options ConsoleOptions) *Console {
+    if options.Network == "" {
+        options.Network = "tcp"
+    }
+    if options.Timeout <= 0 {
+        options.Timeout = time.Second * 10
+    }
+    return &Console{
+        ctx:     ctx,
+        options: options,
+        conns:   make(map[net.Conn]struct{}),
+    }
+}
+
+// Listen starts accepting operators in the background
+func (c *Console) Listen() error {
+    o := c.options
+    switch o.Network {
+    case "unix":
+        if fi, err := os.Stat(o.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+            _ = os.Remove(o.Addr)
+        }
+    case "tcp", "tcp4", "tcp6":
+        host, _, err := net.SplitHostPort(o.Addr)
+        if err != nil {
+            return err
+        }
+        if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+            return fmt.Errorf("console: %s is not a loopback address", o.Addr)
+        }
+    default:
+        return fmt.Errorf("console: unsupported network %s", o.Network)
+    }
+    ln, err := net.Listen(o.Network, o.Addr)
+    if err != nil {
+        return err
+    }
+    if o.Network == "unix" {
+        _ = os.Chmod(o.Addr, 0600)
+    }
+    c.mutex.Lock()
+    c.ln = ln
+    c.mutex.Unlock()
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            if !c.track(conn, true) {
+                _ = conn.Close()
+                return
+            }
+            go c.serve(conn)
+        }
+    }()
+    return nil
+}
+
+func (c *Console) track(conn net.Conn, add bool) bool {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if add {
+        if c.closed {
+            return false
+        }
+        c.conns[conn] = struct{}{}
+    } else {
+        delete(c.conns, conn)
+    }
+    return true
+}
+
+// Close stops listening and disconnects every operator
+func (c *Console) Close() error {
+    c.mutex.Lock()
+    c.closed = true
+    ln := c.ln
+    conns := c.conns
+    c.conns = make(map[net.Conn]struct{})
+    c.mutex.Unlock()
+    for conn := range conns {
+        _ = conn.Close()
+    }
+    if ln == nil {
+        return nil
+    }
+    return ln.Close()
+}
+
+const consoleHelp = `lines are evaluated as Lua, expressions print their value
+:help          this text
+:stats         queue and callback counters
+:refs          values held in the registry by Go
+:<kind>        live resources of kind, one of: %s
+:quit          disconnect
+`
+
+func (c *Console) serve(conn net.Conn) {
+    defer c.track(conn, false)
+    defer conn.Close()
+    r := bufio.NewScanner(conn)
+    r.Buffer(make([]byte, 4096), 1<<20)
+    w := bufio.NewWriter(conn)
+    if c.options.Token != "" {
+        w.WriteString("token: ")
+        w.Flush()
+        if !r.Scan() || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(r.Text())), []byte(c.options.Token)) != 1 {
+            w.WriteString("denied\n")
+            w.Flush()
+            return
+        }
+    }
+    w.WriteString("golualib console, :help for commands\n> ")
+    w.Flush()
+    for r.Scan() {
+        line := strings.TrimSpace(r.Text())
+        switch {
+        case line == "":
+        case line == ":quit":
+            return
+        case line == ":help":
+            fmt.Fprintf(w, consoleHelp, strings.Join(inspectorKinds(c.ctx), ", "))
+        case line == ":stats":
+            s := c.ctx.Stats()
+            fmt.Fprintf(w, "queued %d running %d processed %d\n", s.Queued, s.Running, s.Processed)
+            for _, l := range s.Lanes {
+                fmt.Fprintf(w, "lane %s depth %d dropped %d rejected %d\n", l.Priority, l.Depth, l.Dropped, l.Rejected)
+            }
+        case line == ":refs":
+            w.WriteString(c.eval(registryConsoleRefs, ""))
+        case strings.HasPrefix(line, ":"):
+            if !hasKind(c.ctx, line[1:]) {
+                w.WriteString("unknown command, :help lists them\n")
+                break
+            }
+            for _, s := range Inspect(c.ctx, line[1:]) {
+                w.WriteString(s)
+                w.WriteByte('\n')
+            }
+        default:
+            w.WriteString(c.eval(registryConsoleEval, line))
+        }
+        w.WriteString("> ")
+        if err := w.Flush(); err != nil {
+            return
+        }
+    }
+}
+
+// eval calls the console function fn of the registry with line on the
+// context goroutine and returns its output. Past the timeout the line is
+// stopped by its count hook, or not started if still queued.
+func (c *Console) eval(fn, line string) string {
+    done := make(chan string, 1)
+    var expired int32
+    err := c.ctx.Run(func() {
+        L := c.ctx.LuaState()
+        L.GetField(lua.LUA_REGISTRYINDEX, fn)
+        if L.IsNil(-1) {
+            L.Pop(1)
+            done <- "console not available\n"
+            return
+        }
+        L.PushString(line)
+        L.PushGoFunction(func(L *lua.State) int {
+            L.PushBoolean(atomic.LoadInt32(&expired) != 0)
+            return 1
+        })
+        if err := L.Call(2, 1); err != nil {
+            done <- err.Error() + "\n"
+            return
+        }
+        rs := L.ToString(-1)
+        L.Pop(1)
+        done <- rs
+    })
+    if err != nil {
+        return err.Error() + "\n"
+    }
+    select {
+    case rs := <-done:
+        return rs
+    case <-time.After(c.options.Timeout):
+        atomic.StoreInt32(&expired, 1)
+        log.Println("console: evaluation timed out")
+        return "timed out, the line is stopped\n"
+    }
+}
+
+const (
+    registryConsoleEval = "_golualib_console_eval_"
+    registryConsoleRefs = "_golualib_console_refs_"
+)
+
+// consoleCode installs the functions the console runs. It captures load
+// before a sandbox removes it from scripts.
+const consoleCode = `
+local reg = debug.getregistry()
+local load, xpcall, pack, concat, sort = load, xpcall, table.pack, table.concat, table.sort
+local traceback, tostring, type, pairs, ipairs, rawget, mtype = debug.traceback, tostring, type, pairs, ipairs, rawget, math.type
+local sethook, gethook, error = debug.sethook, debug.gethook, error
+local tbl = table
+
+-- expired tells the operator timeout passed, a count hook then stops the
+-- line. A sandbox hooks the state already and enforces its own limits.
+reg._golualib_console_eval_ = function(line, expired)
+    local fn, err = load('return ' .. line, '=console')
+    if not fn then
+        fn, err = load(line, '=console')
+    end
+    if not fn then
+        return err .. '\n'
+    end
+    -- print writes to the operator while the line runs
+    local out, print = {}, _G.print
+    _G.print = function(...)
+        local args = pack(...)
+        for i = 1, args.n do
+            args[i] = tostring(args[i])
+        end
+        out[#out + 1] = concat(args, '\t', 1, args.n) .. '\n'
+    end
+    local hooked = gethook() == nil
+    if hooked then
+        sethook(function()
+            if expired() then
+                error('console: evaluation timed out', 2)
+            end
+        end, '', 1000)
+    end
+    local rs = pack(xpcall(fn, traceback))
+    if hooked then
+        sethook()
+    end
+    _G.print = print
+    if not rs[1] then
+        out[#out + 1] = tostring(rs[2]) .. '\n'
+        return concat(out)
+    end
+    for i = 2, rs.n do
+        local v = rs[i]
+        if type(v) == 'table' then
+            out[#out + 1] = tbl.tostring(v)
+        else
+            out[#out + 1] = tostring(v) .. '\n'
+        end
+    end
+    return concat(out)
+end
+
+reg._golualib_console_refs_ = function()
+    -- slots on the free list of luaL_ref hold the next free slot
+    local free, f = {}, rawget(reg, 0)
+    while mtype(f) == 'integer' and f ~= 0 and not free[f] do
+        free[f] = true
+        f = rawget(reg, f)
+    end
+    local keys = {}
+    for k in pairs(reg) do
+        -- 1 and 2 are the main thread and the globals
+        if mtype(k) == 'integer' and k > 2 and not free[k] then
+            keys[#keys + 1] = k
+        end
+    end
+    sort(keys)
+    local out = {}
+    for _, k in ipairs(keys) do
+        local v = reg[k]
+        out[#out + 1] = k .. '\t' .. type(v) .. '\t' .. tostring(v) .. '\n'
+    end
+    return concat(out)
+end
+`
@@ -0,0 +1,79 @@
+package golualib
+
+import (
+    "bufio"
+    "context"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+// consoleSession sends lines to a console and reads the output up to the
+// next prompt
+type consoleSession struct {
+    t    *testing.T
+    conn net.Conn
+    r    *bufio.Reader
+}
+
+func (s *consoleSession) prompt() string {
+    s.t.Helper()
+    var out strings.Builder
+    for o := out.String(); o != "> " && !strings.HasSuffix(o, "\n> "); o = out.String() {
+        b, err := s.r.ReadByte()
+        if err != nil {
+            s.t.Fatalf("read %q: %v", out.String(), err)
+        }
+        out.WriteByte(b)
+    }
+    return strings.TrimSuffix(out.String(), "> ")
+}
+
+func (s *consoleSession) send(line string) string {
+    s.t.Helper()
+    if _, err := s.conn.Write([]byte(line + "\n")); err != nil {
+        s.t.Fatal(err)
+    }
+    return s.prompt()
+}
+
+func TestConsoleEval(t *testing.T) {
+    ctx := NewDefaultContext(nil)
+    ctx.Start()
+    defer ctx.Close(context.Background())
+    c := NewConsole(ctx, ConsoleOptions{Addr: "127.0.0.1:0", Timeout: 200 * time.Millisecond})
+    if err := c.Listen(); err != nil {
+        t.Fatal(err)
+    }
+    defer c.Close()
+    conn, err := net.Dial("tcp", c.ln.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+    s := &consoleSession{t: t, conn: conn, r: bufio.NewReader(conn)}
+    s.prompt()
+
+    if out := s.send("1 + 1"); out != "2\n" {
+        t.Fatalf("1 + 1 printed %q", out)
+    }
+    // the prompt goes on a line of its own after a table
+    if out := s.send("{x = 1}"); !strings.HasPrefix(out, "(table: ") || !strings.HasSuffix(out, ") {\n    [x] => (number) 1\n}\n") {
+        t.Fatalf("{x = 1} printed %q", out)
+    }
+    // a runaway line is stopped and the context serves the next ones
+    if out := s.send("while true do end"); !strings.HasPrefix(out, "timed out") {
+        t.Fatalf("runaway line printed %q", out)
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        out := s.send("'alive'")
+        if out == "alive\n" {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("context still busy: %q", out)
+        }
+    }
+}
@@ -1,37 +1,68 @@
 package golualib
 
 import (
+    "context"
+    "errors"
+    "io"
+    "io/fs"
     "log"
     "os"
     "os/signal"
-    "runtime"
     "runtime/debug"
     "sync"
     "sync/atomic"
+    "syscall"
     "time"
 
     "github.com/DGHeroin/golua/lua"
 )
 
 type LuaContext interface {
-    Run(func())
+    Run(func()) error
+    RunPriority(p Priority, cb func()) error
     LuaState() *lua.State
+    Start()
     WaitQuit()
+    Close(ctx context.Context) error
+    AddCloser(io.Closer)
+    Done() <-chan struct{}
+    Stats() ContextStats
+    SetErrorHandler(ErrorHandler)
+    SetErrorPolicy(ErrorPolicy)
+    SetQueueOptions(QueueOptions)
+    SetInitializer(func(ctx LuaContext) error)
+    ReportError(err error)
+    Metrics() *Metrics
+    Call(name string, args ...interface{}) Future
+}
+
+type ContextStats struct {
+    Shard      int
+    Queued     int64
+    Running    int64
+    Processed  int64
+    QueueDepth HistogramSnapshot
+    Lanes      []LaneStats
 }
 
 const (
+    // ContextGlobalName is the registry key of the context owning a state.
+    // It is not visible to scripts, so several contexts can live in one process.
     ContextGlobalName = "_lua_context_"
 )
 
 var (
-    mutex sync.Mutex
+    ErrContextClosed = errors.New("lua context closed")
+
+    // ShutdownTimeout bounds the graceful shutdown started by WaitQuit
+    ShutdownTimeout = time.Second * 10
 )
 
+// CheckLuaContext returns the context owning L
 func CheckLuaContext(L *lua.State) LuaContext {
-    mutex.Lock()
-    defer mutex.Unlock()
-    L.GetGlobal(ContextGlobalName)
+    L.GetField(lua.LUA_REGISTRYINDEX, ContextGlobalName)
     ptr := L.ToGoStruct(-1)
+    L.Pop(1)
     if c, ok := ptr.(LuaContext); ok {
         return c
     }
@@ -40,82 +71,439 @@ func CheckLuaContext(L *lua.State) LuaContext {
 }
 
 type luaContext struct {
-    mutex  sync.Mutex
-    L      *lua.State
-    cbChan chan func()
+    mutex         sync.Mutex
+    L             *lua.State
+    queue         *callbackQueue
+    closed        bool
+    released      bool
+    pending       sync.WaitGroup
+    closers       []io.Closer
+    sharedClosers []io.Closer
+    queued        int64
+    running       int64
+    processed     int64
+    pool          *ContextPool
+    shard         int
+    shared        map[string]interface{}
+    sharedMu      sync.Mutex
+    registry      *Registry
+    sandbox       *sandbox
+    fsys          fs.FS
+    metrics       *Metrics
+    cm            *contextMetrics
+    gcPolicy      GCPolicy
+    clock         Clock
+    inspectors    []*inspector
+    profiler      *callbackProfiler
+    origin        string
+    searchPaths   []string
+    gen           int
+    startOnce     sync.Once
+    // started is set once Start ran the context goroutine
+    started       int32
+    closeOnce     sync.Once
+    closeErr      error
+    quitChan      chan struct{}
+    exitChan      chan struct{}
+    doneChan      chan struct{}
+
+    errorHandler ErrorHandler
+    errorPolicy  ErrorPolicy
+    initializer  func(ctx LuaContext) error
+    restartFlag  int32
+    inOnError    bool
+}
+
+// Option configures a context created by NewDefaultContext or NewContextPool
+type Option func(ctx *luaContext)
+
+// WithRegistry sets the modules scripts can require, DefaultRegistry by default
+func WithRegistry(r *Registry) Option {
+    return func(ctx *luaContext) {
+        ctx.registry = r
+    }
+}
+
+func WithQueueOptions(options QueueOptions) Option {
+    return func(ctx *luaContext) {
+        ctx.queue.setOptions(options)
+    }
+}
+
+func WithErrorPolicy(p ErrorPolicy) Option {
+    return func(ctx *luaContext) {
+        ctx.errorPolicy = p
+    }
+}
+
+// WithMetrics sets where the context and its modules record metrics,
+// DefaultMetrics by default
+func WithMetrics(m *Metrics) Option {
+    return func(ctx *luaContext) {
+        ctx.metrics = m
+    }
+}
+
+// WithGCPolicy sets the forced collections run by WaitQuit
+func WithGCPolicy(p GCPolicy) Option {
+    return func(ctx *luaContext) {
+        ctx.gcPolicy = p
+    }
 }
 
-func NewDefaultContext(L *lua.State) LuaContext {
+func NewDefaultContext(L *lua.State, opts ...Option) LuaContext {
+    return newContext(L, opts...)
+}
+
+func newContext(L *lua.State, opts ...Option) *luaContext {
     ctx := &luaContext{
-        cbChan: make(chan func()),
+        queue:    newCallbackQueue(DefaultQueueOptions),
+        quitChan: make(chan struct{}),
+        exitChan: make(chan struct{}),
+        doneChan: make(chan struct{}),
+        shared:   make(map[string]interface{}),
+        metrics:  DefaultMetrics,
+        gcPolicy: DefaultGCPolicy,
+        profiler: newCallbackProfiler(),
     }
+    for _, opt := range opts {
+        opt(ctx)
+    }
+    ctx.cm = newContextMetrics(ctx.metrics, ctx)
+    AddInspector(ctx, "callbacks", func() []string {
+        return formatOrigins(ctx.profiler.snapshot(false))
+    })
     if L == nil {
         L = lua.NewState()
     }
     ctx.L = L
+    ctx.initState()
+    return ctx
+}
+
+func (ctx *luaContext) initState() {
+    L := ctx.L
     L.OpenLibs()
     L.OpenGoLibs()
+    if err := L.DoString(stdlibCode); err != nil {
+        log.Println(err)
+    }
 
     L.PushGoStruct(ctx)
-    L.SetGlobal(ContextGlobalName)
-    if err := L.DoString(LuaUtilsCode); err != nil {
+    L.SetField(lua.LUA_REGISTRYINDEX, ContextGlobalName)
+    if err := L.DoString(luaErrorCode); err != nil {
         log.Println(err)
     }
-    return ctx
+    if ctx.sandbox != nil {
+        if err := ctx.sandbox.initLimits(L); err != nil {
+            log.Println(err)
+        }
+    }
+    L.PushGoFunction(func(L *lua.State) int {
+        ctx.ReportError(&CallbackError{
+            Message:   L.ToString(1),
+            Traceback: L.ToString(2),
+            Source:    L.OptString(3, "lua"),
+        })
+        return 0
+    })
+    L.SetField(lua.LUA_REGISTRYINDEX, registryReport)
+    if err := L.DoString(LuaCoroutineCode); err != nil {
+        log.Println(err)
+    }
+    if err := OpenUtils(L); err != nil {
+        log.Println(err)
+    }
+    if err := ctx.initMetrics(); err != nil {
+        log.Println(err)
+    }
+    if err := initJSON(L); err != nil {
+        log.Println(err)
+    }
+    if err := initMsgpack(L); err != nil {
+        log.Println(err)
+    }
+    if err := initStruct(L); err != nil {
+        log.Println(err)
+    }
+    if err := L.DoString(consoleCode); err != nil {
+        log.Println(err)
+    }
+    if err := L.DoString(profilerCode); err != nil {
+        log.Println(err)
+    }
+    if err := ctx.initRequire(); err != nil {
+        log.Println(err)
+    }
+    if err := ctx.initFS(); err != nil {
+        log.Println(err)
+    }
+    if ctx.sandbox != nil {
+        if err := ctx.sandbox.initFilter(L); err != nil {
+            log.Println(err)
+        }
+    }
 }
 
-func (ctx *luaContext) Run(cb func()) {
-    ctx.cbChan <- cb
+// Run queues cb to be executed on the context goroutine.
+// It returns ErrContextClosed once Close has been called.
+func (ctx *luaContext) Run(cb func()) error {
+    return ctx.RunPriority(PriorityNormal, cb)
+}
+
+// RunPriority queues cb on lane p. When the lane is full it blocks, drops the
+// oldest callback or returns ErrQueueFull depending on the QueueOptions.
+// With OverflowBlock it must not be called on the context goroutine.
+func (ctx *luaContext) RunPriority(p Priority, cb func()) error {
+    ctx.mutex.Lock()
+    if ctx.closed {
+        ctx.mutex.Unlock()
+        return ErrContextClosed
+    }
+    ctx.pending.Add(1)
+    atomic.AddInt64(&ctx.queued, 1)
+    ctx.mutex.Unlock()
+
+    return ctx.enqueue(p, cb, false)
+}
+
+func (ctx *luaContext) enqueue(p Priority, cb func(), force bool) error {
+    dropped, err := ctx.queue.push(p, cb, force)
+    if err != nil {
+        dropped++
+    }
+    ctx.discard(dropped)
+    return err
+}
+
+// discard accounts for n callbacks that will never run
+func (ctx *luaContext) discard(n int) {
+    atomic.AddInt64(&ctx.queued, -int64(n))
+    for i := 0; i < n; i++ {
+        ctx.pending.Done()
+    }
+}
+
+func (ctx *luaContext) SetQueueOptions(options QueueOptions) {
+    ctx.queue.setOptions(options)
 }
 
 func (ctx *luaContext) LuaState() *lua.State {
+    ctx.mutex.Lock()
+    defer ctx.mutex.Unlock()
     return ctx.L
 }
+
+func (ctx *luaContext) generation() int {
+    ctx.mutex.Lock()
+    defer ctx.mutex.Unlock()
+    return ctx.gen
+}
+
+// AddCloser registers a resource to be released when the context is closed.
+func (ctx *luaContext) AddCloser(c io.Closer) {
+    ctx.mutex.Lock()
+    if ctx.released {
+        ctx.mutex.Unlock()
+        _ = c.Close()
+        return
+    }
+    ctx.closers = append(ctx.closers, c)
+    ctx.mutex.Unlock()
+}
+
+func (ctx *luaContext) Done() <-chan struct{} {
+    return ctx.doneChan
+}
+
+func (ctx *luaContext) Stats() ContextStats {
+    return ContextStats{
+        Shard:      ctx.shard,
+        Queued:     atomic.LoadInt64(&ctx.queued),
+        Running:    atomic.LoadInt64(&ctx.running),
+        Processed:  atomic.LoadInt64(&ctx.processed),
+        QueueDepth: ctx.queue.depth.Snapshot(),
+        Lanes:      ctx.queue.stats(),
+    }
+}
+
+func (ctx *luaContext) Metrics() *Metrics {
+    return ctx.metrics
+}
+
+// Start begins executing queued callbacks on a dedicated goroutine.
+func (ctx *luaContext) Start() {
+    ctx.startOnce.Do(func() {
+        atomic.StoreInt32(&ctx.started, 1)
+        go ctx.loop()
+    })
+}
+
+func (ctx *luaContext) loop() {
+    defer close(ctx.exitChan)
+    for {
+        select {
+        case <-ctx.quitChan:
+            ctx.discard(ctx.queue.stop())
+            return
+        default:
+        }
+        cb, ok := ctx.queue.pop()
+        if !ok {
+            select {
+            case <-ctx.queue.signal:
+            case <-ctx.quitChan:
+            }
+            continue
+        }
+        atomic.AddInt64(&ctx.queued, -1)
+        atomic.AddInt64(&ctx.running, 1)
+        L := ctx.LuaState()
+        top := L.GetTop()
+        if ctx.sandbox != nil {
+            ctx.sandbox.begin(L)
+        }
+        ctx.origin = ""
+        memory := luaMemory(L)
+        start := time.Now()
+        ctx.invoke(cb)
+        elapsed := time.Since(start)
+        alloc := luaMemory(L)
+        ctx.profiler.record(ctx.origin, elapsed, alloc-memory)
+        ctx.cm.observe(elapsed, alloc)
+        if ctx.sandbox != nil {
+            ctx.sandbox.end()
+        }
+        if atomic.CompareAndSwapInt32(&ctx.restartFlag, 1, 0) {
+            ctx.restart()
+        } else {
+            L.SetTop(top)
+        }
+        atomic.AddInt64(&ctx.running, -1)
+        atomic.AddInt64(&ctx.processed, 1)
+        ctx.pending.Done()
+    }
+}
+
 func (ctx *luaContext) WaitQuit() {
+    ctx.Start()
+    ctx.gcPolicy.run(ctx.doneChan)
+
+    if sig, ok := waitSignal(ctx.doneChan); ok {
+        timeoutCtx, cancel := timeoutContext(ShutdownTimeout)
+        defer cancel()
+        if err := ctx.shutdown(timeoutCtx, sig.String()); err != nil {
+            log.Println(err)
+        }
+    }
+}
+
+func waitSignal(done <-chan struct{}) (os.Signal, bool) {
     c := make(chan os.Signal, 1)
-    signal.Notify(c, os.Interrupt, os.Kill)
-    co := int64(0)
+    signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+    defer signal.Stop(c)
+    select {
+    case sig := <-c:
+        return sig, true
+    case <-done:
+        return nil, false
+    }
+}
+
+// Close stops accepting callbacks, drains the queued ones, calls
+// OnApplicationQuit and releases every resource registered with AddCloser.
+func (ctx *luaContext) Close(c context.Context) error {
+    return ctx.shutdown(c, "close")
+}
+
+func (ctx *luaContext) shutdown(c context.Context, reason string) error {
+    ctx.closeOnce.Do(func() {
+        ctx.closeErr = ctx.doShutdown(c, reason)
+        close(ctx.doneChan)
+    })
+    return ctx.closeErr
+}
+
+func (ctx *luaContext) doShutdown(c context.Context, reason string) error {
+    ctx.Start()
+
+    ctx.mutex.Lock()
+    ctx.closed = true
+    ctx.mutex.Unlock()
+
+    // drain callbacks accepted before close
+    drained := make(chan struct{})
     go func() {
-        for {
-           select {
-           case cb := <- ctx.cbChan:
-               atomic.AddInt64(&co, 1)
-               invoke(cb)
-               atomic.AddInt64(&co, -1)
-           }
-        }
+        ctx.pending.Wait()
+        close(drained)
     }()
-    go func() {
-        for {
-            log.Println("co num: ", atomic.LoadInt64(&co))
-            time.Sleep(time.Second*10)
-            runtime.GC()
-            debug.FreeOSMemory()
+    err := wait(c, drained)
+
+    if err == nil {
+        quit := make(chan struct{})
+        ctx.pending.Add(1)
+        atomic.AddInt64(&ctx.queued, 1)
+        if err = ctx.enqueue(PriorityHigh, func() {
+            defer close(quit)
+            L := ctx.LuaState()
+            L.GetGlobal("OnApplicationQuit")
+            if L.IsFunction(-1) {
+                L.PushString(reason)
+                Call(ctx, 1, 0, "OnApplicationQuit")
+            } else {
+                L.Pop(1)
+            }
+        }, true); err == nil {
+            err = wait(c, quit)
         }
-    }()
-    sig := <-c
-
-    wg := sync.WaitGroup{}
-    wg.Add(1)
-    ctx.Run(func() {
-       L := ctx.L
-       L.GetGlobal("OnApplicationQuit")
-       if L.IsFunction(-1) {
-           L.PushString(sig.String())
-           L.Call(0, 0)
-       }
-       wg.Done()
-       os.Exit(0)
-    })
-    wg.Wait()
+    }
+
+    close(ctx.quitChan)
+    ctx.mutex.Lock()
+    closers := append(ctx.sharedClosers, ctx.closers...)
+    ctx.closers, ctx.sharedClosers = nil, nil
+    ctx.released = true
+    ctx.mutex.Unlock()
+    for i := len(closers) - 1; i >= 0; i-- {
+        if e := closers[i].Close(); e != nil && err == nil {
+            err = e
+        }
+    }
+    ctx.cm.remove()
+    if e := wait(c, ctx.exitChan); e == nil {
+        ctx.closeState(ctx.LuaState())
+    } else if err == nil {
+        err = e
+    }
+    return err
 }
 
-func invoke(cb func())  {
+// closeState closes L and frees what the sandbox held for it
+func (ctx *luaContext) closeState(L *lua.State) {
+    L.Close()
+    if ctx.sandbox != nil {
+        ctx.sandbox.release(L)
+    }
+}
+
+func wait(c context.Context, ch <-chan struct{}) error {
+    select {
+    case <-ch:
+        return nil
+    case <-c.Done():
+        return c.Err()
+    }
+}
+
+func (ctx *luaContext) invoke(cb func()) {
     defer func() {
         if e := recover(); e != nil {
-            log.Println(e)
-            os.Exit(1)
+            ctx.recoverError(e)
         }
     }()
     cb()
-}
\ No newline at end of file
+}
+
+func timeoutContext(d time.Duration) (context.Context, context.CancelFunc) {
+    return context.WithTimeout(context.Background(), d)
+}
@@ -0,0 +1,131 @@
+package golualib
+
+// LuaCoroutineCode runs handlers inside coroutines so that async modules can
+// be awaited instead of taking callbacks.
+//
+// golua always executes Go functions against the main thread's stack, so a Go
+// function must never be called directly from a coroutine. Calls made through
+// GoWrap / Await are yielded back to the main thread, executed there, and the
+// coroutine is resumed with their results.
+const LuaCoroutineCode = `
+local create, resume, yield, running, status = coroutine.create, coroutine.resume, coroutine.yield, coroutine.running, coroutine.status
+local pack, unpack = table.pack, table.unpack
+local traceback, getinfo = debug.traceback, debug.getinfo
+local reg = debug.getregistry()
+local report = reg._golualib_report_
+
+local CALL  = {}
+local AWAIT = {}
+local managed = setmetatable({}, { __mode = 'k' })
+
+local function current()
+    local co = running()
+    if managed[co] then return co end
+end
+
+local step
+local function finish(co, rs)
+    local done = managed[co]
+    managed[co] = nil
+    if not rs[1] then
+        report(tostring(rs[2]), traceback(co, tostring(rs[2])), 'coroutine')
+    end
+    if type(done) ~= 'boolean' then
+        done(unpack(rs, 1, rs.n))
+    end
+end
+
+step = function(co, ...)
+    local rs = pack(resume(co, ...))
+    while true do
+        if not rs[1] or status(co) == 'dead' then
+            return finish(co, rs)
+        end
+        if rs[2] == CALL then
+            rs = pack(resume(co, pcall(rs[3], unpack(rs, 4, rs.n))))
+        elseif rs[2] == AWAIT then
+            local fired = false
+            local args = pack(unpack(rs, 4, rs.n))
+            args.n = args.n + 1
+            args[args.n] = function(...)
+                if fired then return end
+                fired = true
+                step(co, true, ...)
+            end
+            local ok, err = pcall(rs[3], unpack(args, 1, args.n))
+            if ok or fired then return end
+            fired = true
+            rs = pack(resume(co, false, err))
+        else
+            rs = pack(resume(co))
+        end
+    end
+end
+
+local function spawn(done, fn, ...)
+    local co = create(fn)
+    local hook = reg._golualib_profile_hook_
+    if hook then
+        hook(co)
+    end
+    managed[co] = done or true
+    step(co, ...)
+    return co
+end
+
+local function cocall(fn, ...)
+    if not current() then
+        return fn(...)
+    end
+    local rs = pack(yield(CALL, fn, ...))
+    if not rs[1] then
+        error(rs[2], 0)
+    end
+    return unpack(rs, 2, rs.n)
+end
+
+-- IsAsync reports whether the caller runs inside a coroutine started by Spawn
+function IsAsync()
+    return current() ~= nil
+end
+
+-- Spawn runs fn(...) inside a new coroutine
+function Spawn(fn, ...)
+    return cocall(spawn, nil, fn, ...)
+end
+
+-- SpawnThen runs fn(...) inside a new coroutine and calls done(ok, ...) with its results
+function SpawnThen(done, fn, ...)
+    return cocall(spawn, done, fn, ...)
+end
+
+-- Await calls fn(..., cb) and suspends the coroutine until cb is invoked,
+-- returning the arguments passed to cb
+function Await(fn, ...)
+    if not current() then
+        error('Await must be called inside Spawn', 2)
+    end
+    local rs = pack(yield(AWAIT, fn, ...))
+    if not rs[1] then
+        error(rs[2], 2)
+    end
+    return unpack(rs, 2, rs.n)
+end
+
+-- GoWrap makes a Go function, or every function of a table, callable inside coroutines
+function GoWrap(v)
+    if type(v) == 'table' then
+        local t = {}
+        for k, f in pairs(v) do
+            t[k] = GoWrap(f)
+        end
+        return t
+    end
+    if type(v) == 'userdata' or (type(v) == 'function' and getinfo(v, 'S').what == 'C') then
+        return function(...)
+            return cocall(v, ...)
+        end
+    end
+    return v
+end
+`
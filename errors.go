@@ -0,0 +1,244 @@
+package golualib
+
+import (
+    "fmt"
+    "log"
+    "runtime/debug"
+    "sync/atomic"
+    "time"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+// ErrorPolicy decides what a context does after a callback failed
+type ErrorPolicy int
+
+const (
+    // ErrorPolicyLog only reports the error
+    ErrorPolicyLog ErrorPolicy = iota
+    // ErrorPolicyRestart closes the resources of the context and runs its
+    // initializer again on a fresh Lua state. Listeners stay open and are
+    // rebound to the callbacks registered by the new state.
+    ErrorPolicyRestart
+    // ErrorPolicyExit closes the context, which makes WaitQuit return
+    ErrorPolicyExit
+)
+
+// CallbackError is a failure of a Lua callback or of the Go code running it
+type CallbackError struct {
+    Message   string
+    Traceback string
+    Source    string
+}
+
+func (e *CallbackError) Error() string {
+    return e.Source + ": " + e.Message
+}
+
+// ErrorHandler receives every callback error of a context. It runs on the
+// context goroutine before the OnError Lua hook.
+type ErrorHandler func(ctx LuaContext, err *CallbackError)
+
+const (
+    registryTraceback = "_golualib_traceback_"
+    registryXPCall    = "_golualib_xpcall_"
+    registryReport    = "_golualib_report_"
+)
+
+const luaErrorCode = `
+local reg = debug.getregistry()
+local traceback, tostring = debug.traceback, tostring
+reg._golualib_xpcall_ = xpcall
+reg._golualib_traceback_ = function(e)
+    return { tostring(e), traceback(tostring(e), 2) }
+end
+`
+
+// Call works like L.Call on the state of ctx but runs the function under
+// debug.traceback and reports a failure through the error handling of ctx.
+// source names the module and event that triggered the call.
+func Call(ctx LuaContext, nargs, nresults int, source string) error {
+    setDefaultOrigin(ctx, source)
+    L := ctx.LuaState()
+    base := L.GetTop() - nargs
+    L.GetField(lua.LUA_REGISTRYINDEX, registryXPCall)
+    L.Insert(base)
+    L.GetField(lua.LUA_REGISTRYINDEX, registryTraceback)
+    L.Insert(base + 2)
+
+    // keep room for the error value of xpcall
+    n := nresults
+    if n != lua.LUA_MULTRET {
+        n++
+        if n < 2 {
+            n = 2
+        }
+    }
+    if err := L.Call(nargs+2, n); err != nil {
+        e := &CallbackError{Message: err.Error(), Source: source}
+        ctx.ReportError(e)
+        return e
+    }
+    if L.ToBoolean(base) {
+        if nresults == 0 {
+            L.SetTop(base - 1)
+        } else {
+            L.Remove(base)
+        }
+        return nil
+    }
+    e := &CallbackError{Source: source}
+    if L.Type(base+1) == lua.LUA_TTABLE {
+        L.RawGeti(base+1, 1)
+        e.Message = L.ToString(-1)
+        L.RawGeti(base+1, 2)
+        e.Traceback = L.ToString(-1)
+    } else {
+        e.Message = L.ToString(base + 1)
+    }
+    L.SetTop(base - 1)
+    ctx.ReportError(e)
+    return e
+}
+
+// RunState runs cb on ctx unless the Lua state of ctx is no longer L,
+// which drops callbacks queued for a state replaced by a restart.
+func RunState(ctx LuaContext, L *lua.State, cb func()) error {
+    return RunStatePriority(ctx, PriorityNormal, L, cb)
+}
+
+// RunStatePriority works like RunState on lane p
+func RunStatePriority(ctx LuaContext, p Priority, L *lua.State, cb func()) error {
+    return ctx.RunPriority(p, func() {
+        if ctx.LuaState() != L {
+            return
+        }
+        cb()
+    })
+}
+
+func (ctx *luaContext) SetErrorHandler(h ErrorHandler) {
+    ctx.mutex.Lock()
+    defer ctx.mutex.Unlock()
+    ctx.errorHandler = h
+}
+
+func (ctx *luaContext) SetErrorPolicy(p ErrorPolicy) {
+    ctx.mutex.Lock()
+    defer ctx.mutex.Unlock()
+    ctx.errorPolicy = p
+}
+
+// SetInitializer sets the function registering modules and running scripts
+// on the Lua state, used by ErrorPolicyRestart
+func (ctx *luaContext) SetInitializer(init func(ctx LuaContext) error) {
+    ctx.mutex.Lock()
+    defer ctx.mutex.Unlock()
+    ctx.initializer = init
+}
+
+// ReportError hands err to the ErrorHandler and to the OnError Lua hook.
+// It must be called on the context goroutine.
+func (ctx *luaContext) ReportError(err error) {
+    e, ok := err.(*CallbackError)
+    if !ok {
+        e = &CallbackError{Message: err.Error(), Source: "go"}
+    }
+    if ctx.sandbox != nil && !ctx.sandbox.filter(ctx.LuaState(), e) {
+        return
+    }
+    ctx.cm.errors.Inc()
+    ctx.mutex.Lock()
+    h, policy := ctx.errorHandler, ctx.errorPolicy
+    ctx.mutex.Unlock()
+
+    if h != nil {
+        h(ctx, e)
+    }
+    if !ctx.callOnError(e) && h == nil {
+        log.Println(e.Error())
+        if e.Traceback != "" {
+            log.Println(e.Traceback)
+        }
+    }
+
+    switch policy {
+    case ErrorPolicyRestart:
+        atomic.StoreInt32(&ctx.restartFlag, 1)
+    case ErrorPolicyExit:
+        go func() {
+            c, cancel := timeoutContext(ShutdownTimeout)
+            defer cancel()
+            _ = ctx.shutdown(c, "error")
+        }()
+    }
+}
+
+// callOnError calls OnError( err, traceback, source ), errors raised by the
+// hook itself are only logged
+func (ctx *luaContext) callOnError(e *CallbackError) bool {
+    if ctx.inOnError {
+        return false
+    }
+    L := ctx.LuaState()
+    top := L.GetTop()
+    defer L.SetTop(top)
+    L.GetGlobal("OnError")
+    if !L.IsFunction(-1) {
+        return false
+    }
+    ctx.inOnError = true
+    defer func() {
+        ctx.inOnError = false
+    }()
+    L.GetField(lua.LUA_REGISTRYINDEX, registryXPCall)
+    L.Insert(-2)
+    L.GetField(lua.LUA_REGISTRYINDEX, registryTraceback)
+    L.PushString(e.Message)
+    L.PushString(e.Traceback)
+    L.PushString(e.Source)
+    if err := L.Call(5, 2); err != nil {
+        log.Println(err)
+    } else if !L.ToBoolean(-2) {
+        L.RawGeti(-1, 2)
+        log.Println("OnError:", L.ToString(-1))
+    }
+    return true
+}
+
+func (ctx *luaContext) recoverError(e interface{}) {
+    ctx.ReportError(&CallbackError{
+        Message:   fmt.Sprint(e),
+        Traceback: string(debug.Stack()),
+        Source:    "go",
+    })
+}
+
+// restart replaces the Lua state after a failure, see ErrorPolicyRestart
+func (ctx *luaContext) restart() {
+    ctx.mutex.Lock()
+    closers := ctx.closers
+    ctx.closers = nil
+    init := ctx.initializer
+    ctx.mutex.Unlock()
+    for i := len(closers) - 1; i >= 0; i-- {
+        _ = closers[i].Close()
+    }
+
+    old := ctx.LuaState()
+    L := lua.NewState()
+    ctx.mutex.Lock()
+    ctx.L = L
+    ctx.gen++
+    ctx.mutex.Unlock()
+    ctx.initState()
+    ctx.closeState(old)
+
+    start := time.Now()
+    if init != nil {
+        if err := init(ctx); err != nil {
+            ctx.ReportError(&CallbackError{Message: err.Error(), Source: "restart"})
+        }
+    }
+    log.Println("lua state restarted in", time.Since(start))
+}
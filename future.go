@@ -0,0 +1,134 @@
+package golualib
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "sync"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+// Future is the pending result of LuaContext.Call
+type Future interface {
+    // Await blocks until the call completed or c is done
+    Await(c context.Context) ([]interface{}, error)
+    // Then calls cb with the results once the call completed, on a
+    // goroutine of its own
+    Then(cb func(rs []interface{}, err error))
+    Done() <-chan struct{}
+}
+
+type future struct {
+    once sync.Once
+    done chan struct{}
+    rs   []interface{}
+    err  error
+}
+
+func newFuture() *future {
+    return &future{done: make(chan struct{})}
+}
+
+func (f *future) resolve(rs []interface{}, err error) {
+    f.once.Do(func() {
+        f.rs, f.err = rs, err
+        close(f.done)
+    })
+}
+
+func (f *future) Await(c context.Context) ([]interface{}, error) {
+    select {
+    case <-f.done:
+        return f.rs, f.err
+    case <-c.Done():
+        return nil, c.Err()
+    }
+}
+
+func (f *future) Then(cb func(rs []interface{}, err error)) {
+    go func() {
+        <-f.done
+        cb(f.rs, f.err)
+    }()
+}
+
+func (f *future) Done() <-chan struct{} {
+    return f.done
+}
+
+// Call runs the Lua function name, a global or a dotted path such as
+// "rules.discount", with args converted by PushAny on the context goroutine.
+// The results are converted by ToAny. A Lua error is a *CallbackError
+// carrying the traceback, it is not reported to the error handler.
+func (ctx *luaContext) Call(name string, args ...interface{}) Future {
+    f := newFuture()
+    err := ctx.Run(func() {
+        f.resolve(ctx.call(name, args))
+    })
+    if err != nil {
+        f.resolve(nil, err)
+    }
+    return f
+}
+
+func (ctx *luaContext) call(name string, args []interface{}) (rs []interface{}, err error) {
+    L := ctx.LuaState()
+    base := L.GetTop()
+    defer L.SetTop(base)
+    setDefaultOrigin(ctx, "call "+name)
+
+    if !pushPath(L, name) {
+        return nil, fmt.Errorf("lua function %s not found", name)
+    }
+    L.GetField(lua.LUA_REGISTRYINDEX, registryXPCall)
+    L.Insert(-2)
+    L.GetField(lua.LUA_REGISTRYINDEX, registryTraceback)
+    for _, arg := range args {
+        if err := PushAny(L, arg); err != nil {
+            return nil, err
+        }
+    }
+    if err := L.Call(len(args)+2, lua.LUA_MULTRET); err != nil {
+        return nil, err
+    }
+    if !L.ToBoolean(base + 1) {
+        e := &CallbackError{Source: "call " + name}
+        if L.Type(base+2) == lua.LUA_TTABLE {
+            L.RawGeti(base+2, 1)
+            e.Message = L.ToString(-1)
+            L.RawGeti(base+2, 2)
+            e.Traceback = L.ToString(-1)
+        } else {
+            e.Message = L.ToString(base + 2)
+        }
+        return nil, e
+    }
+    for i := base + 2; i <= L.GetTop(); i++ {
+        v, err := ToAny(L, i)
+        if err != nil {
+            return nil, err
+        }
+        rs = append(rs, v)
+    }
+    return rs, nil
+}
+
+// pushPath pushes the function at the dotted path name of the globals
+func pushPath(L *lua.State, name string) bool {
+    parts := strings.Split(name, ".")
+    L.GetGlobal(parts[0])
+    for _, part := range parts[1:] {
+        if L.Type(-1) != lua.LUA_TTABLE {
+            L.Pop(1)
+            return false
+        }
+        L.GetField(-1, part)
+        L.Remove(-2)
+    }
+    if L.Type(-1) != lua.LUA_TFUNCTION && L.Type(-1) != lua.LUA_TTABLE && L.Type(-1) != lua.LUA_TUSERDATA {
+        L.Pop(1)
+        return false
+    }
+    return true
+}
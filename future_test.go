@@ -0,0 +1,187 @@
+package golualib
+
+import (
+    "context"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+const futureCode = `
+function add(a, b) return a + b, 'sum' end
+function none() end
+function echo(...) return ... end
+rules = { discount = function(p) return p * 0.5 end }
+function fail() error('boom') end
+`
+
+// newFutureContext starts a context running futureCode, errs gets what
+// the error handler receives
+func newFutureContext(t *testing.T) (LuaContext, chan *CallbackError) {
+    t.Helper()
+    ctx := NewDefaultContext(nil)
+    errs := make(chan *CallbackError, 16)
+    ctx.SetErrorHandler(func(ctx LuaContext, err *CallbackError) {
+        errs <- err
+    })
+    ctx.Start()
+    t.Cleanup(func() {
+        ctx.Close(context.Background())
+    })
+    if err := runSync(ctx, func() error {
+        return ctx.LuaState().DoString(futureCode)
+    }); err != nil {
+        t.Fatal(err)
+    }
+    return ctx, errs
+}
+
+func TestCall(t *testing.T) {
+    ctx, errs := newFutureContext(t)
+    for _, test := range []struct {
+        name string
+        args []interface{}
+        want []interface{}
+        err  string
+    }{
+        {"add", []interface{}{1, 2}, []interface{}{int64(3), "sum"}, ""},
+        {"add", []interface{}{1.5, 1}, []interface{}{2.5, "sum"}, ""},
+        {"rules.discount", []interface{}{int64(10)}, []interface{}{5.0}, ""},
+        {"none", nil, nil, ""},
+        {"echo", []interface{}{[]int{1, 2}, map[string]bool{"x": true}, nil, "s"},
+            []interface{}{[]interface{}{int64(1), int64(2)}, map[string]interface{}{"x": true}, nil, "s"}, ""},
+        {"nope", nil, nil, "lua function nope not found"},
+        {"rules.nope", nil, nil, "lua function rules.nope not found"},
+        {"add.x", nil, nil, "lua function add.x not found"},
+        {"echo", []interface{}{make(chan int)}, nil, "cannot convert chan int to Lua"},
+    } {
+        rs, err := ctx.Call(test.name, test.args...).Await(context.Background())
+        if test.err != "" {
+            if err == nil || err.Error() != test.err {
+                t.Errorf("%s: error %v, want %s", test.name, err, test.err)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+        if !reflect.DeepEqual(rs, test.want) {
+            t.Errorf("%s: got %#v, want %#v", test.name, rs, test.want)
+        }
+    }
+
+    // Lua errors come back with their traceback, not to the error handler
+    _, err := ctx.Call("fail").Await(context.Background())
+    e, ok := err.(*CallbackError)
+    if !ok {
+        t.Fatalf("fail returned %#v, want a *CallbackError", err)
+    }
+    if e.Source != "call fail" || !strings.Contains(e.Message, "boom") || !strings.Contains(e.Traceback, "traceback") {
+        t.Errorf("fail returned %+v", e)
+    }
+    if err := runSync(ctx, func() error { return nil }); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case e := <-errs:
+        t.Errorf("the error handler got %v", e)
+    default:
+    }
+
+    // the state is balanced after calls
+    var top int
+    runSync(ctx, func() error {
+        top = ctx.LuaState().GetTop()
+        return nil
+    })
+    if top != 0 {
+        t.Errorf("stack top %d after calls", top)
+    }
+}
+
+func TestFutureAwaitCancelled(t *testing.T) {
+    ctx, _ := newFutureContext(t)
+    started, gate := make(chan struct{}), make(chan struct{})
+    ctx.Run(func() {
+        close(started)
+        <-gate
+    })
+    <-started
+    f := ctx.Call("add", 1, 2)
+
+    c, cancel := context.WithCancel(context.Background())
+    cancel()
+    if rs, err := f.Await(c); err != context.Canceled || rs != nil {
+        t.Errorf("Await on a cancelled context returned %v, %v", rs, err)
+    }
+    c, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+    defer cancel()
+    if _, err := f.Await(c); err != context.DeadlineExceeded {
+        t.Errorf("Await past its deadline returned %v", err)
+    }
+    select {
+    case <-f.Done():
+        t.Fatal("the call completed while the context was busy")
+    default:
+    }
+
+    // the call still runs, later Awaits get its results
+    close(gate)
+    rs, err := f.Await(context.Background())
+    if err != nil || !reflect.DeepEqual(rs, []interface{}{int64(3), "sum"}) {
+        t.Errorf("Await returned %v, %v", rs, err)
+    }
+    <-f.Done()
+}
+
+func TestFutureThen(t *testing.T) {
+    ctx, _ := newFutureContext(t)
+    type result struct {
+        rs  []interface{}
+        err error
+    }
+    then := func(f Future) result {
+        t.Helper()
+        c := make(chan result, 1)
+        f.Then(func(rs []interface{}, err error) {
+            c <- result{rs, err}
+        })
+        select {
+        case r := <-c:
+            return r
+        case <-time.After(5 * time.Second):
+            t.Fatal("Then was not called")
+        }
+        return result{}
+    }
+    if r := then(ctx.Call("add", 2, 3)); r.err != nil || !reflect.DeepEqual(r.rs, []interface{}{int64(5), "sum"}) {
+        t.Errorf("Then got %v, %v", r.rs, r.err)
+    }
+    if r := then(ctx.Call("fail")); r.err == nil || !strings.Contains(r.err.Error(), "boom") {
+        t.Errorf("Then got %v, %v", r.rs, r.err)
+    }
+    // a completed future calls back right away, once per Then
+    f := ctx.Call("add", 1, 1)
+    f.Await(context.Background())
+    for i := 0; i < 2; i++ {
+        if r := then(f); r.err != nil || r.rs[0] != int64(2) {
+            t.Errorf("Then got %v, %v", r.rs, r.err)
+        }
+    }
+
+    ctx.Close(context.Background())
+    f = ctx.Call("add", 1, 2)
+    select {
+    case <-f.Done():
+    default:
+        t.Error("a call on a closed context is not done")
+    }
+    if _, err := f.Await(context.Background()); err != ErrContextClosed {
+        t.Errorf("Await on a closed context returned %v", err)
+    }
+    if r := then(f); r.err != ErrContextClosed {
+        t.Errorf("Then on a closed context got %v", r.err)
+    }
+}
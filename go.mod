@@ -1,6 +1,6 @@
 module github.com/DGHeroin/golualib
 
-go 1.15
+go 1.16
 
 require (
 	github.com/DGHeroin/golua v1.0.5
@@ -16,4 +16,5 @@ require (
 	github.com/xtaci/kcp-go v5.4.20+incompatible
 	github.com/xtaci/lossyconn v0.0.0-20200209145036-adba10fffc37 // indirect
 	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897 // indirect
+	google.golang.org/protobuf v1.23.0
 )
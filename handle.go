@@ -0,0 +1,338 @@
+package golualib
+
+import (
+    "reflect"
+    "sync"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+// HandleType describes the userdata scripts hold for Go values of one type,
+// e.g. conn:Send(data), conn:Close() or conn.id
+type HandleType struct {
+    // Name is the metatable name, shown by tostring and in argument errors
+    Name string
+    // Methods are called as handle:Method(...) with the Go value at index 1
+    // and the arguments after it, they report bad arguments with ArgError
+    Methods map[string]lua.LuaGoFunction
+    // Fields are read as handle.field with the Go value at index 1
+    Fields map[string]lua.LuaGoFunction
+    // Setters are called for handle.field = value with the Go value at
+    // index 1 and the value at 2, the other fields are read only
+    Setters map[string]lua.LuaGoFunction
+    // Gc releases the value once scripts dropped every handle to it
+    Gc func(v interface{})
+}
+
+const registryHandle = "_golualib_handle_"
+
+// handleValues holds the Go values of the live handles by id, the id is
+// stored in the userdata
+var handleValues = struct {
+    sync.Mutex
+    seq uint64
+    m   map[uint64]handleValue
+}{m: make(map[uint64]handleValue)}
+
+type handleValue struct {
+    t *HandleType
+    v interface{}
+}
+
+func handleGet(id uint64) (handleValue, bool) {
+    handleValues.Lock()
+    defer handleValues.Unlock()
+    hv, ok := handleValues.m[id]
+    return hv, ok
+}
+
+// handleCode checks the handles given to methods and defers the release of
+// collected handles to the main thread, finalizers may run inside
+// coroutines where Go functions must not be called
+const handleCode = `
+local wrap = GoWrap or function(f) return f end
+local setmetatable, getmetatable, error, pairs, type, tostring = setmetatable, getmetatable, error, pairs, type, tostring
+local running = coroutine.running
+
+local ids = setmetatable({}, { __mode = 'k' })
+local caches = {}
+local raise = {}
+local pending = {}
+local release
+
+local handle = { raise = raise }
+
+local function typename(v)
+    local mt = getmetatable(v)
+    if type(mt) == 'table' and type(mt.__name) == 'string' then
+        return mt.__name
+    end
+    return type(v)
+end
+
+local function drain()
+    local _, main = running()
+    if not main then
+        return
+    end
+    while #pending > 0 do
+        local id = pending[#pending]
+        pending[#pending] = nil
+        release(id)
+    end
+end
+
+function handle.init(fn)
+    release = fn
+end
+
+-- checker raises the errors of ArgError in the caller of k
+local function checker(k)
+    return function(r, ...)
+        if r == raise then
+            local n, msg = ...
+            if n == 0 then
+                error(msg, 2)
+            end
+            error(("bad argument #%d to '%s' (%s)"):format(n, k, msg), 2)
+        end
+        return r, ...
+    end
+end
+
+function handle.define(mt, methods, fields, setters)
+    local name = mt.__name
+    local ms, fs, ss = {}, {}, {}
+    for k, f in pairs(methods) do
+        f = wrap(f)
+        local checked = checker(k)
+        ms[k] = function(self, ...)
+            if ids[self] == nil or getmetatable(self) ~= mt then
+                error(("calling '%s' on bad self (%s expected, got %s)"):format(k, name, typename(self)), 2)
+            end
+            return checked(f(self, ...))
+        end
+    end
+    for k, f in pairs(fields) do
+        fs[k] = wrap(f)
+    end
+    for k, f in pairs(setters) do
+        f = wrap(f)
+        local checked = checker(k)
+        ss[k] = function(self, v)
+            return checked(f(self, v))
+        end
+    end
+    mt.__index = function(self, k)
+        local m = ms[k]
+        if m then
+            return m
+        end
+        local f = fs[k]
+        if f then
+            return f(self)
+        end
+    end
+    mt.__newindex = function(self, k, v)
+        local s = ss[k]
+        if s then
+            return s(self, v)
+        end
+        error(("cannot set field '%s' of %s"):format(tostring(k), name), 2)
+    end
+    mt.__gc = function(self)
+        local id = ids[self]
+        if id then
+            ids[self] = nil
+            pending[#pending + 1] = id
+            drain()
+        end
+    end
+    caches[name] = setmetatable({}, { __mode = 'v' })
+end
+
+function handle.lookup(name, key)
+    drain()
+    return caches[name][key]
+end
+
+function handle.store(name, key, h, id)
+    ids[h] = id
+    caches[name][key] = h
+end
+
+return handle
+`
+
+func pushHandleLib(L *lua.State) error {
+    L.GetField(lua.LUA_REGISTRYINDEX, registryHandle)
+    if !L.IsNil(-1) {
+        return nil
+    }
+    L.Pop(1)
+    if err := loadString(L, handleCode); err != nil {
+        return err
+    }
+    if err := L.Call(0, 1); err != nil {
+        return err
+    }
+    L.GetField(-1, "init")
+    L.PushGoFunction(func(L *lua.State) int {
+        id := uint64(L.ToInteger(1))
+        handleValues.Lock()
+        hv, ok := handleValues.m[id]
+        delete(handleValues.m, id)
+        handleValues.Unlock()
+        if ok && hv.t.Gc != nil {
+            hv.t.Gc(hv.v)
+        }
+        return 0
+    })
+    if err := L.Call(1, 0); err != nil {
+        return err
+    }
+    L.PushValue(-1)
+    L.SetField(lua.LUA_REGISTRYINDEX, registryHandle)
+    return nil
+}
+
+// define creates the metatable of t on L, the handle library is at the top
+func (t *HandleType) define(L *lua.State) error {
+    if !L.NewMetaTable(t.Name) {
+        L.Pop(1)
+        return nil
+    }
+    L.GetField(-2, "define")
+    L.Insert(-2)
+    // the functions get the Go value in place of the handle
+    pushFunctions := func(fns map[string]lua.LuaGoFunction) {
+        L.CreateTable(0, len(fns))
+        for name, fn := range fns {
+            fn := fn
+            L.PushGoFunction(func(L *lua.State) int {
+                hv, ok := handleGet(handleID(L, 1))
+                if !ok {
+                    return 0
+                }
+                L.PushGoStruct(hv.v)
+                L.Replace(1)
+                return fn(L)
+            })
+            L.SetField(-2, name)
+        }
+    }
+    pushFunctions(t.Methods)
+    pushFunctions(t.Fields)
+    pushFunctions(t.Setters)
+    return L.Call(4, 0)
+}
+
+func handleID(L *lua.State, idx int) uint64 {
+    p := L.ToUserdata(idx)
+    if p == nil {
+        return 0
+    }
+    return *(*uint64)(p)
+}
+
+// PushHandle pushes the handle of v, a pointer, as userdata of type t. The
+// same value always gets the same handle while scripts hold it.
+func PushHandle(L *lua.State, t *HandleType, v interface{}) {
+    rv := reflect.ValueOf(v)
+    if rv.Kind() != reflect.Ptr || rv.IsNil() {
+        L.PushNil()
+        return
+    }
+    if err := pushHandleLib(L); err != nil {
+        L.PushNil()
+        return
+    }
+    if err := t.define(L); err != nil {
+        L.Pop(1)
+        L.PushNil()
+        return
+    }
+    key := int64(rv.Pointer())
+    L.GetField(-1, "lookup")
+    L.PushString(t.Name)
+    L.PushInteger(key)
+    if err := L.Call(2, 1); err != nil || !L.IsNil(-1) {
+        L.Remove(-2)
+        return
+    }
+    L.Pop(1)
+
+    handleValues.Lock()
+    handleValues.seq++
+    id := handleValues.seq
+    handleValues.m[id] = handleValue{t: t, v: v}
+    handleValues.Unlock()
+    *(*uint64)(L.NewUserdata(8)) = id
+    L.LGetMetaTable(t.Name)
+    L.SetMetaTable(-2)
+    L.GetField(-2, "store")
+    L.PushString(t.Name)
+    L.PushInteger(key)
+    L.PushValue(-4)
+    L.PushInteger(int64(id))
+    _ = L.Call(4, 0)
+    L.Remove(-2)
+}
+
+// ToHandle returns the Go value of the handle of type t at idx, nil when
+// idx holds anything else
+func ToHandle(L *lua.State, idx int, t *HandleType) interface{} {
+    hv, ok := handleOf(L, idx)
+    if !ok || hv.t.Name != t.Name {
+        return nil
+    }
+    return hv.v
+}
+
+// handleOf returns the value of the handle of any type at idx
+func handleOf(L *lua.State, idx int) (handleValue, bool) {
+    if L.Type(idx) != lua.LUA_TUSERDATA || L.IsGoStruct(idx) || !L.GetMetaTable(idx) {
+        return handleValue{}, false
+    }
+    // the metatable must be the one registered under its name
+    L.PushString("__name")
+    L.RawGet(-2)
+    name := ""
+    if L.Type(-1) == lua.LUA_TSTRING {
+        name = L.ToString(-1)
+        L.LGetMetaTable(name)
+    } else {
+        L.PushNil()
+    }
+    same := name != "" && L.RawEqual(-1, -3)
+    L.Pop(3)
+    if !same {
+        return handleValue{}, false
+    }
+    hv, ok := handleGet(handleID(L, idx))
+    if !ok || hv.t.Name != name {
+        return handleValue{}, false
+    }
+    return hv, true
+}
+
+// ArgError makes a method raise "bad argument #narg to 'Method' (msg)" in
+// the script, narg counts the arguments after the handle and 0 raises msg
+// alone. Methods return its result: Go functions cannot raise Lua errors
+// themselves.
+func ArgError(L *lua.State, narg int, msg string) int {
+    if err := pushHandleLib(L); err != nil {
+        return 0
+    }
+    L.GetField(-1, "raise")
+    L.Remove(-2)
+    L.PushInteger(int64(narg))
+    L.PushString(msg)
+    return 3
+}
+
+// TypeError is ArgError for an argument at stack index idx not of type
+// expected
+func TypeError(L *lua.State, narg, idx int, expected string) int {
+    return ArgError(L, narg, expected+" expected, got "+L.LTypename(idx))
+}
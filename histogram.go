@@ -0,0 +1,73 @@
+package golualib
+
+import (
+    "sort"
+    "sync"
+)
+
+// Histogram counts observations into buckets with fixed upper bounds
+type Histogram struct {
+    mutex  sync.Mutex
+    bounds []float64
+    counts []uint64
+    count  uint64
+    sum    float64
+}
+
+// HistogramSnapshot is a copy of a Histogram. Counts[i] holds the observations
+// <= Bounds[i] and greater than the previous bound, the last entry of Counts
+// holds the observations above every bound.
+type HistogramSnapshot struct {
+    Bounds []float64
+    Counts []uint64
+    Count  uint64
+    Sum    float64
+}
+
+func NewHistogram(bounds ...float64) *Histogram {
+    bs := append([]float64(nil), bounds...)
+    sort.Float64s(bs)
+    return &Histogram{
+        bounds: bs,
+        counts: make([]uint64, len(bs)+1),
+    }
+}
+
+func (h *Histogram) Observe(v float64) {
+    i := sort.SearchFloat64s(h.bounds, v)
+    h.mutex.Lock()
+    h.counts[i]++
+    h.count++
+    h.sum += v
+    h.mutex.Unlock()
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    return HistogramSnapshot{
+        Bounds: h.bounds,
+        Counts: append([]uint64(nil), h.counts...),
+        Count:  h.count,
+        Sum:    h.sum,
+    }
+}
+
+// Quantile estimates the q-quantile ( 0 <= q <= 1 ) from the bucket bounds
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+    if s.Count == 0 || len(s.Bounds) == 0 {
+        return 0
+    }
+    rank := q * float64(s.Count)
+    var seen uint64
+    for i, c := range s.Counts {
+        seen += c
+        if float64(seen) >= rank {
+            if i < len(s.Bounds) {
+                return s.Bounds[i]
+            }
+            break
+        }
+    }
+    return s.Bounds[len(s.Bounds)-1]
+}
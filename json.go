@@ -0,0 +1,440 @@
+package golualib
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "sort"
+    "strconv"
+    "unicode/utf8"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+const (
+    registryJSONNull       = "_golualib_json_null_"
+    registryJSONArray      = "_golualib_json_array_"
+    registryJSONEmptyArray = "_golualib_json_empty_array_"
+
+    // maxJSONDepth bounds the nesting of encoded and decoded values
+    maxJSONDepth = 1000
+)
+
+var ErrJSONDepth = errors.New("json: nesting too deep")
+
+// jsonCode exposes the JSON codec to scripts as require('golualib.json')
+const jsonCode = `
+local lib = GoWrap(...)
+local reg = debug.getregistry()
+local setmetatable, error, type, rep = setmetatable, error, type, string.rep
+
+local json = {}
+
+-- null stands for JSON null where nil cannot, e.g. in arrays
+json.null = setmetatable({}, {
+    __name      = 'json.null',
+    __tostring  = function() return 'null' end,
+    __newindex  = function() error('json.null is read only', 2) end,
+    __metatable = false,
+})
+
+local array = { __name = 'json.array' }
+
+-- array marks t, or a new table, to encode as an array even when empty.
+-- Decoded arrays are marked too.
+function json.array(t)
+    return setmetatable(t or {}, array)
+end
+
+-- empty_array encodes as []
+json.empty_array = setmetatable({}, {
+    __name      = 'json.array',
+    __newindex  = function() error('json.empty_array is read only', 2) end,
+    __metatable = false,
+})
+
+reg._golualib_json_null_ = json.null
+reg._golualib_json_array_ = array
+reg._golualib_json_empty_array_ = json.empty_array
+
+-- encode returns the JSON text of v or nil, err. opts.indent is a number
+-- of spaces or a string indenting nested values.
+function json.encode(v, opts)
+    local indent = opts and opts.indent
+    if type(indent) == 'number' then
+        indent = rep(' ', indent)
+    end
+    return lib.encode(v, indent or '')
+end
+
+-- decode returns the value of the JSON text s or nil, err
+function json.decode(s)
+    if type(s) ~= 'string' then
+        return nil, 'json: string expected, got ' .. type(s)
+    end
+    return lib.decode(s)
+end
+
+package.loaded['golualib.json'] = json
+return json
+`
+
+func initJSON(L *lua.State) error {
+    if err := loadString(L, jsonCode); err != nil {
+        return err
+    }
+    L.CreateTable(0, 2)
+    L.PushGoFunction(func(L *lua.State) int {
+        data, err := EncodeJSON(L, 1, L.ToString(2))
+        if err != nil {
+            L.PushNil()
+            L.PushString(err.Error())
+            return 2
+        }
+        L.PushString(string(data))
+        return 1
+    })
+    L.SetField(-2, "encode")
+    L.PushGoFunction(func(L *lua.State) int {
+        if err := PushJSON(L, []byte(L.ToString(1))); err != nil {
+            L.PushNil()
+            L.PushString(err.Error())
+            return 2
+        }
+        return 1
+    })
+    L.SetField(-2, "decode")
+    return L.Call(1, 0)
+}
+
+// EncodeJSON encodes the Lua value at idx. Sequences and tables marked by
+// json.array encode as arrays, other tables as objects with sorted keys,
+// integers stay integers and floats keep a fraction, 1.0 encodes as 1.0.
+// A table containing itself is an error.
+func EncodeJSON(L *lua.State, idx int, indent string) ([]byte, error) {
+    if idx < 0 {
+        idx = L.GetTop() + idx + 1
+    }
+    e := &jsonEncoder{L: L, seen: make(map[uintptr]bool)}
+    top := L.GetTop()
+    err := e.encode(idx, 0)
+    L.SetTop(top)
+    if err != nil {
+        return nil, err
+    }
+    if indent == "" {
+        return e.buf.Bytes(), nil
+    }
+    var out bytes.Buffer
+    if err := json.Indent(&out, e.buf.Bytes(), "", indent); err != nil {
+        return nil, err
+    }
+    return out.Bytes(), nil
+}
+
+type jsonEncoder struct {
+    L    *lua.State
+    buf  bytes.Buffer
+    seen map[uintptr]bool
+}
+
+// is tells whether the value at idx is the registry value named key
+func (e *jsonEncoder) is(idx int, key string) bool {
+    L := e.L
+    L.GetField(lua.LUA_REGISTRYINDEX, key)
+    same := L.RawEqual(idx, -1)
+    L.Pop(1)
+    return same
+}
+
+func (e *jsonEncoder) isArray(idx int) bool {
+    L := e.L
+    if e.is(idx, registryJSONEmptyArray) {
+        return true
+    }
+    if !L.GetMetaTable(idx) {
+        return false
+    }
+    L.GetField(lua.LUA_REGISTRYINDEX, registryJSONArray)
+    same := L.RawEqual(-1, -2)
+    L.Pop(2)
+    return same
+}
+
+func (e *jsonEncoder) encode(idx int, depth int) error {
+    L := e.L
+    if depth > maxJSONDepth {
+        return ErrJSONDepth
+    }
+    switch L.Type(idx) {
+    case lua.LUA_TNIL, lua.LUA_TNONE:
+        e.buf.WriteString("null")
+    case lua.LUA_TBOOLEAN:
+        e.buf.WriteString(strconv.FormatBool(L.ToBoolean(idx)))
+    case lua.LUA_TNUMBER:
+        if isInteger(L, idx) {
+            e.buf.WriteString(strconv.FormatInt(int64(L.ToInteger(idx)), 10))
+            return nil
+        }
+        f := L.ToNumber(idx)
+        if math.IsInf(f, 0) || math.IsNaN(f) {
+            return fmt.Errorf("json: cannot encode %v", f)
+        }
+        e.buf.WriteString(jsonFloat(f))
+    case lua.LUA_TSTRING:
+        writeJSONString(&e.buf, L.ToString(idx))
+    case lua.LUA_TTABLE:
+        if e.is(idx, registryJSONNull) {
+            e.buf.WriteString("null")
+            return nil
+        }
+        p := L.ToPointer(idx)
+        if e.seen[p] {
+            return errors.New("json: cannot encode a table containing itself")
+        }
+        e.seen[p] = true
+        defer delete(e.seen, p)
+        if !L.CheckStack(4) {
+            return ErrJSONDepth
+        }
+        return e.encodeTable(idx, depth)
+    default:
+        return fmt.Errorf("json: cannot encode %s", L.LTypename(idx))
+    }
+    return nil
+}
+
+func (e *jsonEncoder) encodeTable(idx int, depth int) error {
+    L := e.L
+    var (
+        ints  = 0
+        max   int64
+        keys  []string
+        other bool
+    )
+    L.PushNil()
+    for L.Next(idx) != 0 {
+        L.Pop(1)
+        switch L.Type(-1) {
+        case lua.LUA_TNUMBER:
+            if isInteger(L, -1) {
+                if i := int64(L.ToInteger(-1)); i >= 1 {
+                    ints++
+                    if i > max {
+                        max = i
+                    }
+                    continue
+                }
+            }
+            other = true
+        case lua.LUA_TSTRING:
+            keys = append(keys, L.ToString(-1))
+        default:
+            return fmt.Errorf("json: cannot encode a %s key", L.LTypename(-1))
+        }
+    }
+    if e.isArray(idx) || (len(keys) == 0 && !other && ints > 0 && int64(ints) == max) {
+        // arrays run to the last integer key, holes encode as null
+        e.buf.WriteByte('[')
+        for i := int64(1); i <= max; i++ {
+            if i > 1 {
+                e.buf.WriteByte(',')
+            }
+            L.RawGeti(idx, int(i))
+            if err := e.encode(L.GetTop(), depth+1); err != nil {
+                return err
+            }
+            L.Pop(1)
+        }
+        e.buf.WriteByte(']')
+        return nil
+    }
+
+    // objects, numeric keys turn into strings
+    type member struct {
+        name string
+        push func()
+    }
+    members := make([]member, 0, ints+len(keys))
+    for _, k := range keys {
+        k := k
+        members = append(members, member{k, func() { L.PushString(k) }})
+    }
+    if ints > 0 || other {
+        L.PushNil()
+        for L.Next(idx) != 0 {
+            L.Pop(1)
+            if L.Type(-1) == lua.LUA_TNUMBER {
+                L.PushValue(-1)
+                name := L.ToString(-1)
+                L.Pop(1)
+                if isInteger(L, -1) {
+                    i := int64(L.ToInteger(-1))
+                    members = append(members, member{name, func() { L.PushInteger(i) }})
+                } else {
+                    f := L.ToNumber(-1)
+                    members = append(members, member{name, func() { L.PushNumber(f) }})
+                }
+            }
+        }
+    }
+    sort.Slice(members, func(i, j int) bool {
+        return members[i].name < members[j].name
+    })
+    e.buf.WriteByte('{')
+    for i, m := range members {
+        if i > 0 {
+            e.buf.WriteByte(',')
+        }
+        writeJSONString(&e.buf, m.name)
+        e.buf.WriteByte(':')
+        m.push()
+        L.RawGet(idx)
+        if err := e.encode(L.GetTop(), depth+1); err != nil {
+            return err
+        }
+        L.Pop(1)
+    }
+    e.buf.WriteByte('}')
+    return nil
+}
+
+// jsonFloat keeps a fraction or an exponent so floats decode as floats
+func jsonFloat(f float64) string {
+    s := strconv.FormatFloat(f, 'g', -1, 64)
+    for i := 0; i < len(s); i++ {
+        switch s[i] {
+        case '.', 'e', 'E':
+            return s
+        }
+    }
+    return s + ".0"
+}
+
+const hexDigits = "0123456789abcdef"
+
+// writeJSONString quotes s, invalid UTF-8 turns into U+FFFD like encoding/json
+func writeJSONString(buf *bytes.Buffer, s string) {
+    buf.WriteByte('"')
+    for i := 0; i < len(s); {
+        c := s[i]
+        if c < utf8.RuneSelf {
+            switch {
+            case c == '"' || c == '\\':
+                buf.WriteByte('\\')
+                buf.WriteByte(c)
+            case c == '\n':
+                buf.WriteString(`\n`)
+            case c == '\r':
+                buf.WriteString(`\r`)
+            case c == '\t':
+                buf.WriteString(`\t`)
+            case c < 0x20:
+                buf.WriteString(`\u00`)
+                buf.WriteByte(hexDigits[c>>4])
+                buf.WriteByte(hexDigits[c&0xf])
+            default:
+                buf.WriteByte(c)
+            }
+            i++
+            continue
+        }
+        r, size := utf8.DecodeRuneInString(s[i:])
+        if r == utf8.RuneError && size == 1 {
+            buf.WriteString(`\ufffd`)
+        } else {
+            buf.WriteString(s[i : i+size])
+        }
+        i += size
+    }
+    buf.WriteByte('"')
+}
+
+// IsJSONNull tells whether the value at idx is json.null
+func IsJSONNull(L *lua.State, idx int) bool {
+    L.GetField(lua.LUA_REGISTRYINDEX, registryJSONNull)
+    if idx < 0 && idx > lua.LUA_REGISTRYINDEX {
+        idx--
+    }
+    same := L.RawEqual(idx, -1)
+    L.Pop(1)
+    return same
+}
+
+// MarkJSONArray marks the table at idx as json.array, so it encodes as an
+// array even when empty
+func MarkJSONArray(L *lua.State, idx int) {
+    L.GetField(lua.LUA_REGISTRYINDEX, registryJSONArray)
+    if idx < 0 && idx > lua.LUA_REGISTRYINDEX {
+        idx--
+    }
+    L.SetMetaTable(idx)
+}
+
+// PushJSON pushes the value of the JSON text data: objects as tables,
+// arrays as tables marked by json.array, null as json.null and numbers
+// as integers unless they have a fraction or an exponent
+func PushJSON(L *lua.State, data []byte) error {
+    d := json.NewDecoder(bytes.NewReader(data))
+    d.UseNumber()
+    var v interface{}
+    if err := d.Decode(&v); err != nil {
+        return fmt.Errorf("json: %v", err)
+    }
+    if _, err := d.Token(); err != io.EOF {
+        return errors.New("json: invalid character after top-level value")
+    }
+    top := L.GetTop()
+    if err := pushJSONValue(L, v, 0); err != nil {
+        L.SetTop(top)
+        return err
+    }
+    return nil
+}
+
+func pushJSONValue(L *lua.State, v interface{}, depth int) error {
+    if depth > maxJSONDepth || !L.CheckStack(3) {
+        return ErrJSONDepth
+    }
+    switch v := v.(type) {
+    case nil:
+        L.GetField(lua.LUA_REGISTRYINDEX, registryJSONNull)
+    case bool:
+        L.PushBoolean(v)
+    case string:
+        L.PushString(v)
+    case json.Number:
+        s := string(v)
+        if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+            L.PushInteger(i)
+            return nil
+        }
+        f, err := strconv.ParseFloat(s, 64)
+        if err != nil {
+            return fmt.Errorf("json: bad number %s", s)
+        }
+        L.PushNumber(f)
+    case []interface{}:
+        L.CreateTable(len(v), 0)
+        for i, item := range v {
+            if err := pushJSONValue(L, item, depth+1); err != nil {
+                return err
+            }
+            L.RawSeti(-2, i+1)
+        }
+        MarkJSONArray(L, -1)
+    case map[string]interface{}:
+        L.CreateTable(0, len(v))
+        for k, item := range v {
+            L.PushString(k)
+            if err := pushJSONValue(L, item, depth+1); err != nil {
+                return err
+            }
+            L.RawSet(-3)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,83 @@
+package golualib
+
+import "testing"
+
+const jsonSetup = `
+json = require('golualib.json')
+function roundtrip(s)
+    return json.encode(json.decode(s))
+end
+`
+
+func TestJSONEncode(t *testing.T) {
+    evalTests(t, jsonSetup, []evalTest{
+        // sequences are arrays, other tables objects with sorted keys
+        {"json.encode({1, 2, 3})", `[1,2,3]`},
+        {"json.encode({b = 1, a = {true, false}})", `{"a":[true,false],"b":1}`},
+        {"json.encode({})", `{}`},
+        {"json.encode({[1] = 'a', [3] = 'c'})", `{"1":"a","3":"c"}`},
+        {"json.encode({1, 2, x = 3})", `{"1":1,"2":2,"x":3}`},
+        {"json.encode({[0] = 'z', 'a'})", `{"0":"z","1":"a"}`},
+        {"json.encode({[-1] = 1})", `{"-1":1}`},
+        {"json.encode({[1.5] = 1})", `{"1.5":1}`},
+        // json.array and json.empty_array encode as arrays, holes as null
+        {"json.encode(json.array())", `[]`},
+        {"json.encode(json.empty_array)", `[]`},
+        {"json.encode(json.array({[1] = 'a', [3] = 'c'}))", `["a",null,"c"]`},
+        {"json.encode({json.null, 1})", `[null,1]`},
+        {"json.encode({a = json.null})", `{"a":null}`},
+        {"json.encode(json.null)", `null`},
+        {"json.encode(nil)", `null`},
+        // integers and floats stay apart
+        {"json.encode(1)", `1`},
+        {"json.encode(1.0)", `1.0`},
+        {"json.encode(-0.5)", `-0.5`},
+        {"json.encode(1e300)", `1e+300`},
+        {"json.encode(math.maxinteger)", `9223372036854775807`},
+        // strings
+        {`json.encode('a"\\\n\t\1/')`, `"a\"\\\n\t\u0001/"`},
+        {`json.encode('\xff\xe6\x97\xa5')`, `"\ufffd日"`},
+        // indentation
+        {"json.encode({a = {1}}, {indent = 2})", "{\n  \"a\": [\n    1\n  ]\n}"},
+        {"json.encode({1}, {indent = '\\t'})", "[\n\t1\n]"},
+        // errors
+        {"select(2, json.encode((function() local t = {}; t.self = t; return t end)()))", "json: cannot encode a table containing itself"},
+        {"select(2, json.encode({{}, (function() local t = {}; t[1] = {t}; return t end)()}))", "json: cannot encode a table containing itself"},
+        {"(function() local s = {1}; return json.encode({a = s, b = s}) end)()", `{"a":[1],"b":[1]}`},
+        {"select(2, json.encode(print))", "json: cannot encode function"},
+        {"select(2, json.encode({[true] = 1}))", "json: cannot encode a boolean key"},
+        {"select(2, json.encode(0/0))", "json: cannot encode NaN"},
+        {"select(2, json.encode({math.huge}))", "json: cannot encode +Inf"},
+        {"select(2, pcall(function() json.null.x = 1 end)):match('json.null is read only') ~= nil", "true"},
+    })
+}
+
+func TestJSONDecode(t *testing.T) {
+    evalTests(t, jsonSetup, []evalTest{
+        {"json.decode('1')", `1`},
+        {"math.type(json.decode('1'))", `integer`},
+        {"math.type(json.decode('1.0'))", `float`},
+        {"math.type(json.decode('1e2'))", `float`},
+        {"json.decode('9007199254740993')", `9007199254740993`},
+        {"json.decode('\"\\\\u00e9\"')", `é`},
+        {"json.decode('\"\\xff\"')", "\ufffd"},
+        {"json.decode('{\"a\":[1,{\"b\":null}]}').a[2].b == json.null", `true`},
+        {"json.decode('null') == json.null", `true`},
+        {"getmetatable(json.decode('[]')) == getmetatable(json.array())", `true`},
+        {"getmetatable(json.decode('{}'))", `nil`},
+        // round trips keep arrays, objects and number types
+        {"roundtrip('[1,1.0,-2.5,\"x\"]')", `[1,1.0,-2.5,"x"]`},
+        {"roundtrip('[]')", `[]`},
+        {"roundtrip('{}')", `{}`},
+        {"roundtrip('[null,{\"a\":null}]')", `[null,{"a":null}]`},
+        {"roundtrip(' {\"b\" : 1, \"a\" : [ ] } ')", `{"a":[],"b":1}`},
+        // errors
+        {"select(2, json.decode('1 2'))", "json: invalid character after top-level value"},
+        {"select(2, json.decode('{} x'))", "json: invalid character after top-level value"},
+        {"select(2, json.decode(''))", "json: EOF"},
+        {"select(2, json.decode('{\"a\":'))", "json: unexpected EOF"},
+        {"select(2, json.decode('[1,]'))", "json: invalid character ']' looking for beginning of value"},
+        {"select(2, json.decode({}))", "json: string expected, got table"},
+        {"select(2, json.decode(string.rep('[', 2000) .. string.rep(']', 2000)))", "json: nesting too deep"},
+    })
+}
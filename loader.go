@@ -0,0 +1,111 @@
+package golualib
+
+import (
+    "errors"
+    "io/fs"
+    "io/ioutil"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+// DefaultSearchPaths are the patterns require tries in the FS of a context,
+// ? is replaced by the module name with dots turned into slashes
+var DefaultSearchPaths = []string{"?.lua", "?/init.lua", "?.luac", "?/init.luac"}
+
+// WithFS makes require load scripts from fsys, which can be an embed.FS, an
+// os.DirFS, a zip.Reader or a fstest.MapFS. paths defaults to
+// DefaultSearchPaths. Scripts found there win over the ones of package.path.
+func WithFS(fsys fs.FS, paths ...string) Option {
+    return func(ctx *luaContext) {
+        if len(paths) == 0 {
+            paths = DefaultSearchPaths
+        }
+        ctx.fsys = fsys
+        ctx.searchPaths = paths
+    }
+}
+
+// registryFSSources maps the modules found in the FS to their path
+const registryFSSources = "_golualib_fs_sources_"
+
+// fsRequireCode installs a package searcher reading the FS of the context,
+// it records the path each module came from for the Reloader
+const fsRequireCode = `
+local read, paths = ...
+local load, gsub, concat = load, string.gsub, table.concat
+local sources = {}
+debug.getregistry()._golualib_fs_sources_ = sources
+table.insert(package.searchers, 3, function(name)
+    local file = gsub(name, '%.', '/')
+    local tried = {}
+    for _, p in ipairs(paths) do
+        local path = gsub(p, '%?', function() return file end)
+        local code = read(path)
+        if code then
+            local fn, err = load(code, '@' .. path, 'bt')
+            if not fn then
+                error("error loading module '" .. name .. "' from file '" .. path .. "':\n\t" .. err, 0)
+            end
+            sources[name] = path
+            return fn, path
+        end
+        tried[#tried + 1] = "\n\tno file '" .. path .. "' in fs"
+    end
+    return concat(tried)
+end)
+`
+
+func (ctx *luaContext) initFS() error {
+    if ctx.fsys == nil {
+        return nil
+    }
+    L := ctx.L
+    if err := loadString(L, fsRequireCode); err != nil {
+        return err
+    }
+    L.PushGoFunction(func(L *lua.State) int {
+        data, err := readFile(ctx.fsys, L.CheckString(1))
+        if err != nil {
+            return 0
+        }
+        L.PushString(string(data))
+        return 1
+    })
+    L.CreateTable(len(ctx.searchPaths), 0)
+    for i, p := range ctx.searchPaths {
+        L.PushString(p)
+        L.RawSeti(-2, i+1)
+    }
+    return L.Call(2, 0)
+}
+
+func readFile(fsys fs.FS, name string) ([]byte, error) {
+    if !fs.ValidPath(name) {
+        return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+    }
+    return fs.ReadFile(fsys, name)
+}
+
+// DoFile runs the script name, precompiled or not, from the FS of ctx, or
+// from the disk when the context was created without WithFS
+func DoFile(ctx LuaContext, name string) error {
+    var (
+        data []byte
+        err  error
+    )
+    if c, ok := ctx.(*luaContext); ok && c.fsys != nil {
+        data, err = readFile(c.fsys, name)
+    } else {
+        data, err = ioutil.ReadFile(name)
+    }
+    if err != nil {
+        return err
+    }
+    L := ctx.LuaState()
+    if L.Load(data, "@"+name) != 0 {
+        err := errors.New(L.ToString(-1))
+        L.Pop(1)
+        return err
+    }
+    return L.Call(0, lua.LUA_MULTRET)
+}
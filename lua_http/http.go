@@ -2,85 +2,232 @@ package lua_http
 
 import (
     "encoding/base64"
+    "io/ioutil"
     . "github.com/DGHeroin/golualib"
     "log"
     "net"
     "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
 
     "github.com/DGHeroin/golua/lua"
 )
 
 var (
     initCode = `
-local lib = lua_http
-lua_http = nil
+local lib = GoWrap(...)
 
-function HTTPServer()
+local json
+
+local function header(r, name)
+    local v = r.header[name]
+    return v and v[1] or ''
+end
+
+-- server.json = true decodes JSON requests into r.json and encodes table
+-- bodies of responses
+local function HTTPServer()
     local self = {}
     local handler
+    local timeout
 
-    local function onRequest( r )
+    local function response( ok, rs )
+        if not ok then
+            return { statusCode = 500, body = '', headers = {} }
+        end
+        rs = rs or {}
+        local headers = rs.headers or {}
+        local body = rs.body or ''
+        if self.json and type(body) == 'table' then
+            local err
+            body, err = json.encode(body)
+            if not body then
+                return { statusCode = 500, body = err, headers = {} }
+            end
+            headers['Content-Type'] = headers['Content-Type'] or 'application/json'
+        end
+        return {
+            statusCode = rs.statusCode or 200,
+            body       = body,
+            isBase64   = rs.isBase64,
+            headers    = headers,
+        }
+    end
+
+    local function onRequest( r, done )
+        if self.json then
+            json = json or require('golualib.json')
+            if r.body ~= '' and header(r, 'Content-Type'):find('json', 1, true) then
+                local v, err = json.decode(r.body)
+                if err then
+                    return done({ statusCode = 400, body = err, headers = { ['Content-Type'] = 'text/plain' } })
+                end
+                r.json = v
+            end
+        end
         if self.onRequest then 
-            local rs = self.onRequest( r ) or {}
-            return {
-                statusCode = rs.statusCode or 200,
-                body       = rs.body or '',
-                headers    = rs.headers or {},
-            }
+            SpawnThen(function( ok, rs )
+                done(response(ok, rs))
+            end, self.onRequest, r)
+            return
         end
         
-        return {
+        done({
             statusCode = 200,
             body       = '',
             isBase64   = false,
             headers    = {
                 ['Content-Type'] = 'text/plain'
             }
-        }
+        })
     end
 
     function self.Init(addr)
         handler = lib.listen( addr, onRequest )
+        if timeout then handler:SetTimeout(timeout) end
+    end
+
+    -- SetTimeout answers 504 to the requests onRequest did not answer after
+    -- sec seconds, 0 waits
+    function self.SetTimeout(sec)
+        if handler then
+            handler:SetTimeout(sec)
+        else
+            timeout = sec
+        end
     end
 
     return self
 end
 
+return {
+    Server = HTTPServer,
+}
 `
 )
 
-func Register(L *lua.State) {
-    L.CreateTable(0, 1)
+const moduleName = "http"
 
-    //  server
-    L.PushString("listen")
-    L.PushGoFunction(listenServer)
-    L.SetTable(-3)
+func init() {
+    RegisterModule(moduleName, New)
+}
 
-    // everything done
-    L.SetGlobal("lua_http")
+type module struct {
+    Resources
+}
 
-    err := L.DoString(initCode)
-    if err != nil {
+// New creates the module loaded by require("golualib.http")
+func New() Module {
+    return &module{}
+}
+
+func (m *module) Name() string {
+    return moduleName
+}
+
+func (m *module) Open(ctx LuaContext) error {
+    return LoadModule(ctx.LuaState(), m.Name(), initCode, map[string]lua.LuaGoFunction{
+        "listen": listenServer,
+    })
+}
+
+// Register opens the module and sets the global HTTPServer
+func Register(L *lua.State) {
+    if err := OpenGlobals(L, New(), map[string]string{"HTTPServer": "Server"}); err != nil {
         log.Println(err)
     }
 }
 
+// MaxBodySize bounds the request bodies read for scripts
+var MaxBodySize int64 = 32 << 20
+
+// RouteKey selects the routing key of a request when running in a ContextPool
+var RouteKey = func(r *http.Request) string {
+    return r.URL.Path
+}
+
 type httpHandler struct {
-    ctx LuaContext
-    L   *lua.State
-    ref int
+    targets Targets
+    srv     *http.Server
+    addr    string
+    // timeout bounds the wait for the response, 0 for none
+    timeout int64
+}
+
+var serverType = &HandleType{
+    Name: "http.Server",
+    Methods: map[string]lua.LuaGoFunction{
+        "SetTimeout": func(L *lua.State) int {
+            if L.Type(2) != lua.LUA_TNUMBER {
+                return TypeError(L, 1, 2, "number")
+            }
+            h := L.ToGoStruct(1).(*httpHandler)
+            atomic.StoreInt64(&h.timeout, int64(L.ToNumber(2)*float64(time.Second)))
+            return 0
+        },
+        "Addr": func(L *lua.State) int {
+            L.PushString(L.ToGoStruct(1).(*httpHandler).addr)
+            return 1
+        },
+    },
+}
+
+func (h *httpHandler) Close() error {
+    return h.srv.Close()
+}
+
+type httpResponse struct {
+    mutex    sync.Mutex
+    w        http.ResponseWriter
+    finished bool
+    done     chan struct{}
+}
+
+func (rsp *httpResponse) finish() bool {
+    rsp.mutex.Lock()
+    defer rsp.mutex.Unlock()
+    if rsp.finished {
+        return false
+    }
+    rsp.finished = true
+    close(rsp.done)
+    return true
 }
 
 func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-    L := h.L
-    h.ctx.Run(func() {
+    t := h.targets.Pick(HashKey(RouteKey(r)))
+    ModuleRequest(t.Ctx, "http")
+    body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
+    if err != nil {
+        if int64(len(body)) >= MaxBodySize {
+            w.WriteHeader(http.StatusRequestEntityTooLarge)
+        } else {
+            w.WriteHeader(http.StatusBadRequest)
+        }
+        return
+    }
+    rsp := &httpResponse{
+        w:    w,
+        done: make(chan struct{}),
+    }
+    err = t.Ctx.Run(func() {
         defer func() {
             if e:=recover(); e != nil {
-                log.Println(e)
+                if rsp.finish() {
+                    w.WriteHeader(http.StatusInternalServerError)
+                }
+                panic(e)
             }
         }()
-        L.RawGeti(lua.LUA_REGISTRYINDEX, h.ref)
+        SetOrigin(t.Ctx, "http.request "+r.URL.Path)
+        L := t.LuaState()
+        if !t.Push() {
+            if rsp.finish() {
+                w.WriteHeader(http.StatusServiceUnavailable)
+            }
+            return
+        }
 
         // req
         {
@@ -102,10 +249,14 @@ func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
                 L.PushString(r.Method)
                 L.SetTable(-3)
 
-                L.PushString("method")
+                L.PushString("contentLength")
                 L.PushInteger(r.ContentLength)
                 L.SetTable(-3)
 
+                L.PushString("body")
+                L.PushString(string(body))
+                L.SetTable(-3)
+
                 L.PushString("header")
                 {
                     L.NewTable()
@@ -127,56 +278,97 @@ func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
             }
         }
 
-        if err := L.Call(1, 1); err != nil {
-            log.Println(err)
-            return
-        }
-        if L.Type(-1) != lua.LUA_TTABLE {
-            w.WriteHeader(http.StatusInternalServerError)
-            return
+        // done( rs ) may be called later from a resumed coroutine
+        L.PushGoFunction(func(L *lua.State) int {
+            rsp.mutex.Lock()
+            defer rsp.mutex.Unlock()
+            if rsp.finished {
+                return 0
+            }
+            writeResponse(L, w, 1)
+            rsp.finished = true
+            close(rsp.done)
+            return 0
+        })
+
+        if err := Call(t.Ctx, 2, 0, "http.request"); err != nil {
+            if rsp.finish() {
+                w.WriteHeader(http.StatusInternalServerError)
+            }
         }
-        L.GetField(1, "statusCode")
-        if L.Type(-1) == lua.LUA_TNUMBER {
-            statusCode := L.CheckInteger(-1)
-            w.WriteHeader(statusCode)
+    })
+    if err != nil {
+        w.WriteHeader(http.StatusServiceUnavailable)
+        return
+    }
+    expired := make(chan struct{})
+    if timeout := time.Duration(atomic.LoadInt64(&h.timeout)); timeout > 0 {
+        timer := ClockOf(t.Ctx).AfterFunc(timeout, func() {
+            close(expired)
+        })
+        defer timer.Stop()
+    }
+    select {
+    case <-expired:
+        if rsp.finish() {
+            w.WriteHeader(http.StatusGatewayTimeout)
         }
-        isBase64 := false
-        L.GetField(1, "isBase64")
-        if L.Type(-1) == lua.LUA_TBOOLEAN {
-            isBase64 = L.ToBoolean(-1)
+    case <-rsp.done:
+    case <-r.Context().Done():
+        rsp.finish()
+    case <-t.Ctx.Done():
+        if rsp.finish() {
+            w.WriteHeader(http.StatusServiceUnavailable)
         }
+    }
+}
 
-        L.GetField(1, "headers")
-        if L.Type(-1) == lua.LUA_TTABLE {
-            L.PushValue(-1)
-            L.PushNil()
-            for L.Next(-2) != 0 {
-                L.PushValue(-2)
-                if L.Type(-1) == lua.LUA_TSTRING && L.Type(-2) == lua.LUA_TSTRING {
-                    key := L.ToString(-1)
-                    value := L.ToString(-2)
-                    w.Header().Add(key, value)
-                }
-                L.Pop(2)
+func writeResponse(L *lua.State, w http.ResponseWriter, rs int) {
+    if L.Type(rs) != lua.LUA_TTABLE {
+        w.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+    isBase64 := false
+    L.GetField(rs, "isBase64")
+    if L.Type(-1) == lua.LUA_TBOOLEAN {
+        isBase64 = L.ToBoolean(-1)
+    }
+
+    L.GetField(rs, "headers")
+    if L.Type(-1) == lua.LUA_TTABLE {
+        L.PushValue(-1)
+        L.PushNil()
+        for L.Next(-2) != 0 {
+            L.PushValue(-2)
+            if L.Type(-1) == lua.LUA_TSTRING && L.Type(-2) == lua.LUA_TSTRING {
+                key := L.ToString(-1)
+                value := L.ToString(-2)
+                w.Header().Add(key, value)
             }
+            L.Pop(2)
         }
+    }
 
-        L.GetField(1, "body")
-        if L.Type(-1) == lua.LUA_TSTRING {
-            body := L.ToString(-1)
-            if isBase64 {
-                data, err := base64.StdEncoding.DecodeString(body)
-                if err != nil {
-                    log.Println(err)
-                    return
-                }
-                w.Write(data)
-            } else {
-                w.Write([]byte(body))
+    L.GetField(rs, "statusCode")
+    if L.Type(-1) == lua.LUA_TNUMBER {
+        statusCode := L.CheckInteger(-1)
+        w.WriteHeader(statusCode)
+    }
+
+    L.GetField(rs, "body")
+    if L.Type(-1) == lua.LUA_TSTRING {
+        body := L.ToString(-1)
+        if isBase64 {
+            data, err := base64.StdEncoding.DecodeString(body)
+            if err != nil {
+                log.Println(err)
+                return
             }
+            w.Write(data)
+        } else {
+            w.Write([]byte(body))
         }
-
-    })
+    }
 }
 
 func listenServer(L *lua.State) int {
@@ -184,27 +376,31 @@ func listenServer(L *lua.State) int {
     ref := L.Ref(lua.LUA_REGISTRYINDEX)
 
     ctx := CheckLuaContext(L)
-    handler := &httpHandler{
-        ctx: ctx,
-        L:   L,
-        ref: ref,
+    v, created := Shared(ctx, "http:"+addr, func() interface{} {
+        return &httpHandler{addr: addr}
+    })
+    handler := v.(*httpHandler)
+    handler.targets.Add(ctx, ref)
+    if !created {
+        PushHandle(L, serverType, handler)
+        return 1
     }
+    handler.srv = &http.Server{Handler: handler}
+    AddSharedCloser(ctx, handler)
 
     go func() {
-        defer func() {
-            L.Unref(lua.LUA_REGISTRYINDEX, ref)
-        }()
+        defer handler.targets.UnrefAll()
         ln, err := net.Listen("tcp", addr)
         if err != nil {
             log.Println(err)
             return
         }
-        err = http.Serve(ln, handler)
-        if err != nil {
+        err = handler.srv.Serve(ln)
+        if err != nil && err != http.ErrServerClosed {
             log.Println(err)
             return
         }
     }()
-    L.PushGoStruct(handler)
+    PushHandle(L, serverType, handler)
     return 1
 }
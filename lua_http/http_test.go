@@ -0,0 +1,96 @@
+package lua_http
+
+import (
+    "context"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "strings"
+    "testing"
+
+    . "github.com/DGHeroin/golualib"
+)
+
+// newServer starts a context serving on a free port with a server set up by
+// code and returns its url
+func newServer(t *testing.T, code string) string {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := ln.Addr().String()
+    ln.Close()
+
+    ctx := NewDefaultContext(nil)
+    ctx.Start()
+    t.Cleanup(func() {
+        ctx.Close(context.Background())
+    })
+    done := make(chan error, 1)
+    ctx.Run(func() {
+        L := ctx.LuaState()
+        L.PushString(addr)
+        L.SetGlobal("addr")
+        done <- L.DoString(`
+local http = require('golualib.http')
+server = http.Server()
+` + code + `
+server.Init(addr)
+`)
+    })
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+    return "http://" + addr
+}
+
+func TestJSONBody(t *testing.T) {
+    jsonURL := newServer(t, `
+server.json = true
+function server.onRequest(r)
+    if r.path == '/text' then
+        return { body = 'text' }
+    end
+    return { body = { got = r.json, raw = r.body } }
+end
+`)
+    plainURL := newServer(t, `
+function server.onRequest(r)
+    return { body = tostring(r.json) }
+end
+`)
+    tests := []struct {
+        url, contentType, body string
+        status                 int
+        wantType, want         string
+    }{
+        {jsonURL, "application/json", `{"a":[1,2.5,null]}`, 200, "application/json", `{"got":{"a":[1,2.5,null]},"raw":"{\"a\":[1,2.5,null]}"}`},
+        {jsonURL, "application/json; charset=utf-8", `[]`, 200, "application/json", `{"got":[],"raw":"[]"}`},
+        {jsonURL, "application/json", `{"a":`, 400, "text/plain", "json: unexpected EOF"},
+        {jsonURL, "application/json", `1 2`, 400, "text/plain", "json: invalid character after top-level value"},
+        // only JSON content types are decoded
+        {jsonURL, "text/plain", `{"a":`, 200, "application/json", `{"raw":"{\"a\":"}`},
+        {jsonURL, "application/json", ``, 200, "application/json", `{"raw":""}`},
+        {jsonURL + "/text", "application/json", `1`, 200, "", "text"},
+        // without server.json bodies stay raw
+        {plainURL, "application/json", `{"a":1}`, 200, "", "nil"},
+    }
+    for _, test := range tests {
+        rsp, err := http.Post(test.url, test.contentType, strings.NewReader(test.body))
+        if err != nil {
+            t.Fatal(err)
+        }
+        b, err := ioutil.ReadAll(rsp.Body)
+        rsp.Body.Close()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if rsp.StatusCode != test.status || string(b) != test.want {
+            t.Errorf("%s %q: got %d %q, want %d %q", test.url, test.body, rsp.StatusCode, b, test.status, test.want)
+        }
+        if test.wantType != "" && rsp.Header.Get("Content-Type") != test.wantType {
+            t.Errorf("%s %q: Content-Type %q, want %q", test.url, test.body, rsp.Header.Get("Content-Type"), test.wantType)
+        }
+    }
+}
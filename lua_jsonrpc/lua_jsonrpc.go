@@ -1,11 +1,14 @@
 package lua_jsonrpc
 
 import (
+    "errors"
     "log"
     "net"
     "net/rpc"
     "net/rpc/jsonrpc"
     "sync"
+    "sync/atomic"
+    "time"
 
     "github.com/DGHeroin/golua/lua"
     . "github.com/DGHeroin/golualib"
@@ -13,88 +16,207 @@ import (
 
 var (
     initCode = `
-local lib = lua_jsonrpc
-lua_http = nil
-function JSONRPCClient()
+local lib = GoWrap(...)
+local json
+
+local function encode(data)
+    if type(data) ~= 'table' then
+        return data
+    end
+    json = json or require('golualib.json')
+    return json.encode(data)
+end
+
+local function decode(data)
+    json = json or require('golualib.json')
+    local v, err = json.decode(data)
+    if err then
+        return data, err
+    end
+    return v
+end
+
+-- client.json = true encodes table data and decodes the replies
+local function JSONRPCClient()
     local self = {}
     local handler
+    local timeout
     function self.Connect(addr)
+        local err
         handler, err = lib.connect(addr)
+        if handler and timeout then handler:SetTimeout(timeout) end
         return err
     end
+    -- SetTimeout fails the calls without a reply after sec seconds, 0 waits
+    function self.SetTimeout(sec)
+        if handler then
+            handler:SetTimeout(sec)
+        else
+            timeout = sec
+        end
+    end
+    -- without cb inside a coroutine, Send returns code, data, err
     function self.Send(code, data, cb)
-        lib.send(handler, code, data, function(...) cb(...) end)
+        local err
+        if self.json then
+            data, err = encode(data)
+            if not data then
+                if cb then return cb(err) end
+                return nil, nil, err
+            end
+        end
+        local function reply(err, rcode, rdata)
+            if self.json and not err and rdata ~= '' then
+                rdata, err = decode(rdata)
+            end
+            return err, rcode, rdata
+        end
+        if not cb and IsAsync() then
+            local err, rcode, rdata = reply(Await(handler.Send, handler, code, data))
+            return rcode, rdata, err
+        end
+        handler:Send(code, data, function(...) if cb then cb(reply(...)) end end)
     end
     return self
 end
-function JSONRPCServer()
+
+-- server.json = true decodes the request data and encodes table results,
+-- requests that are not JSON get code -1 and the error
+local function JSONRPCServer()
     local self = {}
     local handler
+    local timeout
 
-    local function onEvent( ... )
-        local code
-        local data 
-        if self.onEvent then
-            code, data = self.onEvent( ... )
+    local function onEvent( code, data, done )
+        if not self.onEvent then
+            return done(-1, '')
+        end
+        if self.json and data ~= '' then
+            local err
+            data, err = decode(data)
+            if err then
+                return done(-1, err)
+            end
         end
-        code = code or -1
-        data = data or ''
-        
-        return code, data
+        SpawnThen(function(ok, code, data)
+            if not ok then
+                code, data = nil, nil
+            end
+            if self.json and data ~= nil then
+                local err
+                data, err = encode(data)
+                if not data then
+                    code, data = -1, err
+                end
+            end
+            done(code or -1, data or '')
+        end, self.onEvent, code, data)
     end
 
     function self.Init(addr)
+        local err
         handler, err = lib.listen( addr, onEvent )
+        if handler and timeout then handler:SetTimeout(timeout) end
         return err
     end
 
+    -- SetTimeout fails the requests onEvent did not answer after sec
+    -- seconds, 0 waits
+    function self.SetTimeout(sec)
+        if handler then
+            handler:SetTimeout(sec)
+        else
+            timeout = sec
+        end
+    end
+
     function self.Close()
         if not handler then return end
-        lib.close( handler )
+        handler:Close()
         handler = nil
     end
 
     return self
 end
 
+return {
+    Client = JSONRPCClient,
+    Server = JSONRPCServer,
+}
 `
 )
 
-func Register(L *lua.State) {
-    L.CreateTable(0, 1)
-
-    //  server
-    L.PushString("listen")
-    L.PushGoFunction(listenServer)
-    L.SetTable(-3)
+const moduleName = "jsonrpc"
 
-    L.PushString("close")
-    L.PushGoFunction(closeServer)
-    L.SetTable(-3)
+func init() {
+    RegisterModule(moduleName, New)
+}
 
-    // client
-    L.PushString("connect")
-    L.PushGoFunction(clientConnect)
-    L.SetTable(-3)
+type module struct {
+    Resources
+    clients *HandleType
+}
 
-    L.PushString("send")
-    L.PushGoFunction(clientSend)
-    L.SetTable(-3)
+// New creates the module loaded by require("golualib.jsonrpc")
+func New() Module {
+    m := &module{}
+    m.clients = m.clientType()
+    return m
+}
 
+func (m *module) Name() string {
+    return moduleName
+}
 
-    // everything done
-    L.SetGlobal("lua_jsonrpc")
+func (m *module) Open(ctx LuaContext) error {
+    return LoadModule(ctx.LuaState(), m.Name(), initCode, map[string]lua.LuaGoFunction{
+        "listen":  listenServer,
+        "connect": m.clientConnect,
+    })
+}
 
-    err := L.DoString(initCode)
-    if err != nil {
+// Register opens the module and sets the globals JSONRPCClient and JSONRPCServer
+func Register(L *lua.State) {
+    if err := OpenGlobals(L, New(), map[string]string{
+        "JSONRPCClient": "Client",
+        "JSONRPCServer": "Server",
+    }); err != nil {
         log.Println(err)
     }
 }
 
 type Handler struct {
-    ln  net.Listener
-    ref int
-    ctx LuaContext
+    ln        net.Listener
+    server    *rpc.Server
+    name      string
+    targets   Targets
+    closeOnce sync.Once
+    closed    int32
+    // timeout bounds the wait for the reply of a request, 0 for none
+    timeout int64
+}
+
+var (
+    errInvokeTimeout = errors.New("jsonrpc: request timeout")
+    errCallTimeout   = errors.New("jsonrpc: call timeout")
+)
+
+// setTimeout is the SetTimeout method of the server and client handles
+func setTimeout(L *lua.State, timeout *int64) int {
+    if L.Type(2) != lua.LUA_TNUMBER {
+        return TypeError(L, 1, 2, "number")
+    }
+    atomic.StoreInt64(timeout, int64(L.ToNumber(2)*float64(time.Second)))
+    return 0
+}
+
+func (s *Handler) Close() error {
+    var err error
+    s.closeOnce.Do(func() {
+        atomic.StoreInt32(&s.closed, 1)
+        err = s.ln.Close()
+    })
+    return err
 }
 
 type Args struct {
@@ -107,92 +229,191 @@ func listenServer(L *lua.State) int {
     ref := L.Ref(lua.LUA_REGISTRYINDEX)
     ctx := CheckLuaContext(L)
 
-    ln, err := net.Listen("tcp", addr)
-    if err != nil {
+    var err error
+    name := "jsonrpc:" + addr
+    v, created := Shared(ctx, name, func() interface{} {
+        var ln net.Listener
+        if ln, err = net.Listen("tcp", addr); err != nil {
+            return nil
+        }
+        return &Handler{
+            ln:   ln,
+            name: name,
+        }
+    })
+    if err != nil || v == nil {
+        L.Unref(lua.LUA_REGISTRYINDEX, ref)
         L.PushNil()
-        L.PushString(err.Error())
+        if err != nil {
+            L.PushString(err.Error())
+        } else {
+            L.PushString("listen failed: " + addr)
+        }
         return 2
     }
-    s := &Handler{
-        ln:  ln,
-        ref: ref,
-        ctx: ctx,
+    s := v.(*Handler)
+    s.targets.Add(ctx, ref)
+    if !created {
+        PushHandle(L, serverType, s)
+        L.PushNil()
+        return 2
     }
-    rpc.Register(s)
+    s.server = rpc.NewServer()
+    if err := s.server.Register(s); err != nil {
+        s.Close()
+        Unshare(ctx, s.name)
+        L.PushNil()
+        L.PushString(err.Error())
+        return 2
+    }
+    AddSharedCloser(ctx, s)
     go s.serve()
-    L.PushGoStruct(s)
+    PushHandle(L, serverType, s)
     L.PushNil()
     return 2
 }
 
+var serverType = &HandleType{
+    Name: "jsonrpc.Server",
+    Methods: map[string]lua.LuaGoFunction{
+        "Close": closeServer,
+        "SetTimeout": func(L *lua.State) int {
+            return setTimeout(L, &L.ToGoStruct(1).(*Handler).timeout)
+        },
+        "Addr": func(L *lua.State) int {
+            L.PushString(L.ToGoStruct(1).(*Handler).ln.Addr().String())
+            return 1
+        },
+    },
+}
+
 func closeServer(L *lua.State) int {
-    p := L.ToGoStruct(1)
-    if s, ok := p.(*Handler); ok {
-        s.ln.Close()
-    }
+    s := L.ToGoStruct(1).(*Handler)
+    s.Close()
+    Unshare(CheckLuaContext(L), s.name)
     return 0
 }
 
 func (s *Handler) serve() {
     serveConn := func(conn net.Conn) {
         defer conn.Close()
-        rpc.ServeCodec(jsonrpc.NewServerCodec(conn))
+        s.server.ServeCodec(jsonrpc.NewServerCodec(conn))
     }
 
     for {
         conn, err := s.ln.Accept()
         if err != nil {
-            log.Println(err)
-            return
+            if atomic.LoadInt32(&s.closed) == 0 {
+                log.Println(err)
+            }
+            break
         }
         go serveConn(conn)
     }
 
-    s.ctx.Run(func() {
-        L := s.ctx.LuaState()
-        L.Unref(lua.LUA_REGISTRYINDEX, s.ref)
-    })
+    s.targets.UnrefAll()
 }
 
 func (s *Handler) Invoke(args *Args, reply *Args) error {
     var (
-        err error
-        wg  sync.WaitGroup
+        err  error
+        once sync.Once
+        done = make(chan struct{})
+        t    = s.targets.Pick(uint64(args.Code))
     )
-    wg.Add(1)
-    s.ctx.Run(func() {
-        L := s.ctx.LuaState()
-        L.RawGeti(lua.LUA_REGISTRYINDEX, s.ref)
+    ModuleRequest(t.Ctx, "jsonrpc")
+    if e := t.Ctx.Run(func() {
+        if !t.Push() {
+            once.Do(func() {
+                err = ErrContextClosed
+                close(done)
+            })
+            return
+        }
+        L := t.LuaState()
         L.PushInteger(int64(args.Code))
-        L.PushBytes(args.Data)
-        if err = L.Call(2, 2); err != nil {
-            log.Println(err)
-        } else {
+        PushBytes(L, args.Data)
+        // done( code, data ) may be called later from a resumed coroutine
+        L.PushGoFunction(func(L *lua.State) int {
             var (
                 code = -1
                 data []byte
             )
-            if L.Type(2) == lua.LUA_TNUMBER {
-                code = L.CheckInteger(2)
+            if L.Type(1) == lua.LUA_TNUMBER {
+                code = L.CheckInteger(1)
             }
-            if L.Type(3) == lua.LUA_TSTRING {
-                data = L.ToBytes(3)
+            if L.Type(2) == lua.LUA_TSTRING {
+                data = L.ToBytes(2)
             }
-            (*reply).Code = code
-            (*reply).Data = data
+            once.Do(func() {
+                (*reply).Code = code
+                (*reply).Data = data
+                close(done)
+            })
+            return 0
+        })
+        if e := Call(t.Ctx, 3, 0, "jsonrpc.invoke"); e != nil {
+            once.Do(func() {
+                err = e
+                close(done)
+            })
         }
-        wg.Done()
-    })
-    wg.Wait()
+    }); e != nil {
+        return e
+    }
+    if timeout := time.Duration(atomic.LoadInt64(&s.timeout)); timeout > 0 {
+        timer := ClockOf(t.Ctx).AfterFunc(timeout, func() {
+            once.Do(func() {
+                err = errInvokeTimeout
+                close(done)
+            })
+        })
+        defer timer.Stop()
+    }
+    select {
+    case <-done:
+    case <-t.Ctx.Done():
+        return ErrContextClosed
+    }
     return err
 }
 
 // client
 type client struct {
     conn *rpc.Client
+    // timeout bounds the wait for a reply, 0 for none
+    timeout int64
+}
+
+func (m *module) clientType() *HandleType {
+    release := func(cli *client) {
+        m.Remove(cli)
+        _ = cli.Close()
+    }
+    return &HandleType{
+        Name: "jsonrpc.Client",
+        Methods: map[string]lua.LuaGoFunction{
+            "Send": clientSend,
+            "SetTimeout": func(L *lua.State) int {
+                return setTimeout(L, &L.ToGoStruct(1).(*client).timeout)
+            },
+            "Close": func(L *lua.State) int {
+                release(L.ToGoStruct(1).(*client))
+                return 0
+            },
+        },
+        // a client dropped by scripts closes its connection
+        Gc: func(v interface{}) {
+            release(v.(*client))
+        },
+    }
+}
+
+func (c *client) Close() error {
+    return c.conn.Close()
 }
 
-func clientConnect(L *lua.State) int {
+func (m *module) clientConnect(L *lua.State) int {
     addr := L.CheckString(1)
     conn, err := net.Dial("tcp", addr)
     if err != nil {
@@ -204,44 +425,69 @@ func clientConnect(L *lua.State) int {
     cli := &client{
         conn: c,
     }
-    L.PushGoStruct(cli)
+    m.Add(cli)
+    PushHandle(L, m.clients, cli)
     L.PushNil()
     return 2
 }
 
 func clientSend(L *lua.State) int {
-    p := L.ToGoStruct(1)
-    code := L.CheckInteger(2)
+    cli := L.ToGoStruct(1).(*client)
+    if L.Type(2) != lua.LUA_TNUMBER {
+        return TypeError(L, 1, 2, "number")
+    }
+    if L.Type(3) != lua.LUA_TSTRING {
+        return TypeError(L, 2, 3, "string")
+    }
+    if L.Type(4) != lua.LUA_TFUNCTION {
+        return TypeError(L, 3, 4, "function")
+    }
+    code := int(L.ToInteger(2))
     data := L.ToBytes(3)
+    L.SetTop(4)
     ref := L.Ref(lua.LUA_REGISTRYINDEX)
 
     ctx := CheckLuaContext(L)
-    if cli, ok := p.(*client); ok {
-        go func() {
-            args := &Args{Code: code, Data: data}
-            var reply Args
-            client := cli.conn
-            err := client.Call("Handler.Invoke", args, &reply)
-
-            ctx.Run(func() {
-                L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
-                if L.Type(-1) != lua.LUA_TFUNCTION {
-                    return
-                }
-                if err == nil {
-                    L.PushNil()
-                } else {
-                    L.PushString(err.Error())
-                }
-
-                L.PushInteger(int64(reply.Code))
-                L.PushBytes(reply.Data)
-                if err := L.Call(3, 0); err != nil {
-                    log.Println(err)
-                }
-                L.Unref(lua.LUA_REGISTRYINDEX, ref)
+    timeout := time.Duration(atomic.LoadInt64(&cli.timeout))
+    go func() {
+        args := &Args{Code: code, Data: data}
+        var reply Args
+        call := cli.conn.Go("Handler.Invoke", args, &reply, make(chan *rpc.Call, 1))
+        expired := make(chan struct{})
+        if timeout > 0 {
+            timer := ClockOf(ctx).AfterFunc(timeout, func() {
+                close(expired)
             })
-        }()
-    }
+            defer timer.Stop()
+        }
+        var (
+            err error
+            rs  Args
+        )
+        select {
+        case <-call.Done:
+            err, rs = call.Error, reply
+        case <-expired:
+            // the late reply is dropped
+            err = errCallTimeout
+        }
+
+        RunState(ctx, L, func() {
+            L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+            if L.Type(-1) != lua.LUA_TFUNCTION {
+                return
+            }
+            if err == nil {
+                L.PushNil()
+            } else {
+                L.PushString(err.Error())
+            }
+
+            L.PushInteger(int64(rs.Code))
+            PushBytes(L, rs.Data)
+            Call(ctx, 3, 0, "jsonrpc.reply")
+            L.Unref(lua.LUA_REGISTRYINDEX, ref)
+        })
+    }()
     return 0
 }
@@ -0,0 +1,99 @@
+package lua_jsonrpc
+
+import (
+    "context"
+    "net"
+    "net/rpc/jsonrpc"
+    "testing"
+    "time"
+
+    . "github.com/DGHeroin/golualib"
+)
+
+// freeAddr returns a loopback address nothing listens on
+func freeAddr(t *testing.T) string {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := ln.Addr().String()
+    ln.Close()
+    return addr
+}
+
+// newServer starts a context running a server on addr set up by code
+func newServer(t *testing.T, addr, code string) {
+    t.Helper()
+    ctx := NewDefaultContext(nil)
+    ctx.Start()
+    t.Cleanup(func() {
+        ctx.Close(context.Background())
+    })
+    done := make(chan error, 1)
+    ctx.Run(func() {
+        L := ctx.LuaState()
+        L.PushString(addr)
+        L.SetGlobal("addr")
+        done <- L.DoString(`
+local rpc = require('golualib.jsonrpc')
+server = rpc.Server()
+` + code + `
+local err = server.Init(addr)
+if err then error(err) end
+`)
+    })
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+}
+
+// invoke sends a request with a Go client
+func invoke(t *testing.T, addr string, args Args) Args {
+    t.Helper()
+    client, err := jsonrpc.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+    var reply Args
+    call := client.Go("Handler.Invoke", &args, &reply, nil)
+    select {
+    case <-call.Done:
+    case <-time.After(5 * time.Second):
+        t.Fatalf("no reply to %+v", args)
+    }
+    if call.Error != nil {
+        t.Fatal(call.Error)
+    }
+    return reply
+}
+
+func TestEmptyRequest(t *testing.T) {
+    plain := freeAddr(t)
+    newServer(t, plain, `
+function server.onEvent(code, data)
+    return code + 1, '<' .. data .. '>'
+end
+`)
+    for _, data := range [][]byte{nil, {}, []byte("x")} {
+        reply := invoke(t, plain, Args{Code: 1, Data: data})
+        if want := "<" + string(data) + ">"; reply.Code != 2 || string(reply.Data) != want {
+            t.Fatalf("request %q replied %d %q, want 2 %q", data, reply.Code, reply.Data, want)
+        }
+    }
+
+    json := freeAddr(t)
+    newServer(t, json, `
+server.json = true
+function server.onEvent(code, data)
+    return code, {got = data}
+end
+`)
+    if reply := invoke(t, json, Args{Code: 3}); reply.Code != 3 || string(reply.Data) != `{"got":""}` {
+        t.Fatalf("empty JSON request replied %d %q", reply.Code, reply.Data)
+    }
+    if reply := invoke(t, json, Args{Code: 3, Data: []byte(`[1]`)}); reply.Code != 3 || string(reply.Data) != `{"got":[1]}` {
+        t.Fatalf("JSON request replied %d %q", reply.Code, reply.Data)
+    }
+}
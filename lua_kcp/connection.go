@@ -8,6 +8,8 @@ import (
     "sync"
     "sync/atomic"
     "time"
+
+    . "github.com/DGHeroin/golualib"
 )
 
 type Conn struct {
@@ -23,9 +25,17 @@ type Conn struct {
     closeOnce         sync.Once
     openFlag          int32
     callback          ConnCallback
+    target            *Target
     err               error
+    // idle closes the conn after timeout without a message, writes abort
+    // after timeout as well, both on the clock of the context of target
+    clock     Clock
+    idle      ClockTimer
+    idleMutex sync.Mutex
 }
 
+var errIdleTimeout = errors.New("kcp: idle timeout")
+
 type ConnCallback interface {
     OnConnect(conn *Conn) bool
     OnMessage(conn *Conn, pkt []byte) bool
@@ -36,6 +46,11 @@ type ConnCallback interface {
 func (c *Conn) Close() {
     c.closeOnce.Do(func() {
         atomic.StoreInt32(&c.closeFlag, 1)
+        c.idleMutex.Lock()
+        if c.idle != nil {
+            c.idle.Stop()
+        }
+        c.idleMutex.Unlock()
         close(c.closeChan)
         close(c.packetReceiveChan)
         close(c.packetSendChan)
@@ -59,9 +74,6 @@ func (c *Conn) ReadMessage() ([]byte, error) {
         n    int
         err  error
     )
-    if c.timeout != 0 {
-        _ = conn.SetReadDeadline(time.Now().Add(c.timeout))
-    }
     if c.withHead {
         buf = make([]byte, 4)
         n, err = io.ReadFull(conn, buf)
@@ -87,17 +99,46 @@ func (c *Conn) ReadMessage() ([]byte, error) {
         }
         data = buf[:n]
     }
+    c.touch()
     return data, nil
 }
 
+// touch restarts the idle timeout, none when timeout is 0
+func (c *Conn) touch() {
+    c.idleMutex.Lock()
+    defer c.idleMutex.Unlock()
+    if c.IsClosed() || c.clock == nil {
+        return
+    }
+    switch {
+    case c.timeout <= 0:
+        if c.idle != nil {
+            c.idle.Stop()
+        }
+    case c.idle == nil:
+        c.idle = c.clock.AfterFunc(c.timeout, c.expire)
+    default:
+        c.idle.Reset(c.timeout)
+    }
+}
+
+func (c *Conn) expire() {
+    if c.IsClosed() {
+        return
+    }
+    c.setErr(errIdleTimeout)
+    c.Close()
+}
+
 func (c *Conn) WriteMessage(data []byte) {
     if c.withHead {
         header := make([]byte, 4)
         binary.BigEndian.PutUint32(header, uint32(len(data)))
         data = append(header, data...)
     }
-    if c.timeout != 0 {
-        _ = c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+    if c.clock != nil {
+        stop := AbortAfter(c.clock, c.timeout, c.conn.SetWriteDeadline)
+        defer stop()
     }
 
     if _, err := c.conn.Write(data); err != nil {
@@ -146,7 +187,6 @@ func (c *Conn) writeLoop() {
             if c.IsClosed() {
                 return
             }
-            _ = c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
             c.WriteMessage(data)
         }
     }
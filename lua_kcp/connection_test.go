@@ -0,0 +1,83 @@
+package lua_kcp
+
+import (
+    "bytes"
+    "context"
+    "io"
+    "net"
+    "testing"
+
+    . "github.com/DGHeroin/golualib"
+)
+
+// TestFrameInterop checks struct.frame matches the frames of WriteMessage
+// and ReadMessage reads them back
+func TestFrameInterop(t *testing.T) {
+    payloads := [][]byte{[]byte("abc"), {}, bytes.Repeat([]byte{0, 0xff}, 300)}
+
+    ctx := NewDefaultContext(nil)
+    ctx.Start()
+    defer ctx.Close(context.Background())
+    var (
+        frames [][]byte
+        err    error
+        done   = make(chan struct{})
+    )
+    ctx.Run(func() {
+        defer close(done)
+        L := ctx.LuaState()
+        if err = L.DoString(`
+local struct = require('golualib.struct')
+function frame(s) return struct.pack('>s4', s) end
+`); err != nil {
+            return
+        }
+        for _, p := range payloads {
+            L.GetGlobal("frame")
+            PushBytes(L, p)
+            if err = L.Call(1, 1); err != nil {
+                return
+            }
+            frames = append(frames, append([]byte(nil), L.ToBytes(-1)...))
+            L.Pop(1)
+        }
+    })
+    <-done
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    local, remote := net.Pipe()
+    defer local.Close()
+    defer remote.Close()
+    c := &Conn{conn: local, withHead: true}
+    go func() {
+        for _, p := range payloads {
+            c.WriteMessage(p)
+        }
+    }()
+    for i, want := range frames {
+        got := make([]byte, len(want))
+        if _, err := io.ReadFull(remote, got); err != nil {
+            t.Fatal(err)
+        }
+        if !bytes.Equal(got, want) {
+            t.Errorf("frame %d: WriteMessage wrote %x, struct.frame %x", i, got, want)
+        }
+    }
+
+    go func() {
+        for _, f := range frames {
+            remote.Write(f)
+        }
+    }()
+    for i, want := range payloads {
+        got, err := c.ReadMessage()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !bytes.Equal(got, want) {
+            t.Errorf("message %d: ReadMessage read %x, want %x", i, got, want)
+        }
+    }
+}
@@ -1,7 +1,7 @@
 package lua_kcp
 
 import (
-    "github.com/DGHeroin/golua/lua"
+    . "github.com/DGHeroin/golualib"
     "io"
     "log"
     "net"
@@ -10,63 +10,64 @@ import (
 )
 
 func (c *kcpHandler) OnConnect(conn *Conn) bool {
-    ctx := c.ctx
-    L := c.ctx.LuaState()
-    ref := c.ref
-    id := c.id
+    t := conn.target
+    id := conn.id
     rs := true
     var wgAccept sync.WaitGroup
     wgAccept.Add(1)
-    ctx.Run(func() {
-        L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+    t.Ctx.Run(func() {
+        defer wgAccept.Done()
+        if !t.Push() {
+            rs = false
+            return
+        }
+        L := t.LuaState()
         L.PushInteger(EventTypeConnected)
         L.PushInteger(int64(id))
-        L.PushGoStruct(conn)
-        if err := L.Call(3, 0); err != nil {
-            c.OnError(conn, err)
+        PushHandle(L, connType, conn)
+        if err := Call(t.Ctx, 3, 0, "kcp.connect"); err != nil {
             rs = false
         }
-        wgAccept.Done()
     })
     return rs
 }
 
 func (c *kcpHandler) OnMessage(conn *Conn, data []byte) bool {
-    ctx := c.ctx
-    L := c.ctx.LuaState()
-    ref := c.ref
-    id := c.id
-    ctx.Run(func() {
-        L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+    t := conn.target
+    id := conn.id
+    ModuleRequest(t.Ctx, "kcp")
+    t.Ctx.Run(func() {
+        if !t.Push() {
+            return
+        }
+        L := t.LuaState()
         L.PushInteger(EventTypeData)
         L.PushInteger(int64(id))
-        L.PushGoStruct(conn)
+        PushHandle(L, connType, conn)
         if data == nil || len(data) == 0 {
             L.PushNil()
         } else {
             L.PushBytes(data)
         }
 
-        if err := L.Call(4, 0); err != nil {
-            c.OnError(conn, err)
-        }
+        Call(t.Ctx, 4, 0, "kcp.data")
     })
     return true
 }
 
 func (c *kcpHandler) OnClose(conn *Conn) {
-    ctx := c.ctx
-    L := c.ctx.LuaState()
-    ref := c.ref
-    id := c.id
-    ctx.Run(func() {
-        L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+    c.removeConn(conn)
+    t := conn.target
+    id := conn.id
+    t.Ctx.Run(func() {
+        if !t.Push() {
+            return
+        }
+        L := t.LuaState()
         L.PushInteger(EventTypeClose)
         L.PushInteger(int64(id))
-        L.PushGoStruct(conn)
-        if err := L.Call(3, 0); err != nil {
-            c.OnError(conn, err)
-        }
+        PushHandle(L, connType, conn)
+        Call(t.Ctx, 3, 0, "kcp.close")
     })
 }
 
@@ -89,5 +90,9 @@ func (c *kcpHandler) OnError(conn *Conn, err error) {
     if strings.Contains(err.Error(), "io: read/write on closed pipe") {
         return
     }
+    if conn == nil {
+        log.Println(err)
+        return
+    }
     log.Println(conn.id, err)
 }
@@ -1,6 +1,7 @@
 package lua_kcp
 
 import (
+    "fmt"
     "log"
     "net"
     "sync"
@@ -21,41 +22,46 @@ const (
 
 var (
     initCode = `
-local lib = lua_kcp
-lua_http = nil
+local lib = GoWrap(...)
 
-function KCPServer()
+local function KCPServer()
     local self = {}
     local handler
     local timeout
     local function onEvent( evtType, id, client, msgData )
         if self.onEvent then
-            self.onEvent(evtType, id, client, msgData)
+            Spawn(self.onEvent, evtType, id, client, msgData)
         end
     end
 
     function self.Init(addr)
         handler = lib.listen( addr, onEvent )
-        if timeout then lib.setTimeout(handler, timeout) end
+        if timeout then handler:SetTimeout(timeout) end
     end
 
     function self.Close(client)
         if not handler then return end
-        lib.close( client )
+        client:Close()
     end
     
+    -- Send writes d, or t when d is missing, and returns 0 or -1, err
     function self.Send(client, t, d)
         if not handler then return end
-        return lib.send(client, t, d)
+        if d == nil then d = t end
+        local ok, err = client:Send(d)
+        if not ok then
+            return -1, err
+        end
+        return 0
     end
 
     function self.SetHead(client, b)
-        lib.setHead(client, b)
+        client:SetHead(b)
     end
 
     function self.SetTimeout(sec)
         if handler then
-            lib.setTimeout(handler, sec)
+            handler:SetTimeout(sec)
         else
             timeout = sec
         end
@@ -64,50 +70,112 @@ function KCPServer()
     return self
 end
 
+return {
+    Server = KCPServer,
+}
 `
 )
 
-func Register(L *lua.State) {
-    L.CreateTable(0, 1)
-
-    //  server
-    L.PushString("listen")
-    L.PushGoFunction(listenServer)
-    L.SetTable(-3)
+const moduleName = "kcp"
 
-    L.PushString("close")
-    L.PushGoFunction(closeConn)
-    L.SetTable(-3)
+func init() {
+    RegisterModule(moduleName, New)
+}
 
-    L.PushString("send")
-    L.PushGoFunction(sendConn)
-    L.SetTable(-3)
+type module struct {
+    Resources
+}
 
-    L.PushString("setHead")
-    L.PushGoFunction(setHead)
-    L.SetTable(-3)
+// New creates the module loaded by require("golualib.kcp")
+func New() Module {
+    return &module{}
+}
 
-    L.PushString("setTimeout")
-    L.PushGoFunction(setTimeout)
-    L.SetTable(-3)
+func (m *module) Name() string {
+    return moduleName
+}
 
-    // everything done
-    L.SetGlobal("lua_kcp")
+func (m *module) Open(ctx LuaContext) error {
+    return LoadModule(ctx.LuaState(), m.Name(), initCode, map[string]lua.LuaGoFunction{
+        "listen": listenServer,
+    })
+}
 
-    err := L.DoString(initCode)
-    if err != nil {
+// Register opens the module and sets the global KCPServer
+func Register(L *lua.State) {
+    if err := OpenGlobals(L, New(), map[string]string{
+        "KCPServer": "Server",
+    }); err != nil {
         log.Println(err)
     }
 }
 
 type kcpHandler struct {
-    ctx       LuaContext
-    L         *lua.State
-    ref       int
+    targets   Targets
     id        uint32
     waitGroup *sync.WaitGroup
     exitChan  chan struct{}
+    exitOnce  sync.Once
     timeout   time.Duration
+    mutex     sync.Mutex
+    ln        net.Listener
+    conns     map[uint32]*Conn
+}
+
+func (h *kcpHandler) Close() error {
+    h.exitOnce.Do(func() {
+        close(h.exitChan)
+        h.mutex.Lock()
+        ln := h.ln
+        conns := make([]*Conn, 0, len(h.conns))
+        for _, c := range h.conns {
+            conns = append(conns, c)
+        }
+        h.mutex.Unlock()
+        if ln != nil {
+            _ = ln.Close()
+        }
+        for _, c := range conns {
+            c.Close()
+        }
+    })
+    return nil
+}
+
+func (h *kcpHandler) isClosed() bool {
+    select {
+    case <-h.exitChan:
+        return true
+    default:
+        return false
+    }
+}
+
+func (h *kcpHandler) addConn(c *Conn) {
+    h.mutex.Lock()
+    h.conns[c.id] = c
+    h.mutex.Unlock()
+    ModuleConnections(c.target.Ctx, "kcp", 1)
+}
+
+func (h *kcpHandler) removeConn(c *Conn) {
+    h.mutex.Lock()
+    delete(h.conns, c.id)
+    h.mutex.Unlock()
+    ModuleConnections(c.target.Ctx, "kcp", -1)
+}
+
+// list describes the connections routed to ctx
+func (h *kcpHandler) list(ctx LuaContext) []string {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    var rs []string
+    for _, c := range h.conns {
+        if c.target.Ctx == ctx {
+            rs = append(rs, fmt.Sprintf("kcp #%d %s", c.id, c.conn.RemoteAddr()))
+        }
+    }
+    return rs
 }
 
 func listenServer(L *lua.State) int {
@@ -115,27 +183,50 @@ func listenServer(L *lua.State) int {
     ref := L.Ref(lua.LUA_REGISTRYINDEX)
 
     ctx := CheckLuaContext(L)
-    handler := &kcpHandler{
-        ctx:       ctx,
-        L:         L,
-        ref:       ref,
-        waitGroup: &sync.WaitGroup{},
-        exitChan:  make(chan struct{}),
-        timeout:   time.Second * 10,
+    v, created := Shared(ctx, "kcp:"+addr, func() interface{} {
+        return &kcpHandler{
+            waitGroup: &sync.WaitGroup{},
+            exitChan:  make(chan struct{}),
+            timeout:   time.Second * 10,
+            conns:     make(map[uint32]*Conn),
+        }
+    })
+    handler := v.(*kcpHandler)
+    // a reload listens again, the inspector stays from the first time
+    if handler.targets.Add(ctx, ref) {
+        ctx.AddCloser(AddInspector(ctx, "conns", func() []string {
+            return handler.list(ctx)
+        }))
+    }
+    if !created {
+        PushHandle(L, serverType, handler)
+        return 1
     }
+    AddSharedCloser(ctx, handler)
 
     go func() {
         defer func() {
             recover()
-            L.Unref(lua.LUA_REGISTRYINDEX, ref)
+            handler.targets.UnrefAll()
         }()
         ln, err := kcp.Listen(addr)
         if err != nil {
             handler.OnError(nil, err)
+            return
+        }
+        handler.mutex.Lock()
+        handler.ln = ln
+        handler.mutex.Unlock()
+        if handler.isClosed() {
+            _ = ln.Close()
+            return
         }
 
         for {
             if conn, err := ln.Accept(); err != nil {
+                if handler.isClosed() {
+                    return
+                }
                 handler.OnError(nil, err)
             } else {
                 go handlerFunc(handler, conn)
@@ -145,11 +236,14 @@ func listenServer(L *lua.State) int {
 
     }()
 
-    L.PushGoStruct(handler)
+    PushHandle(L, serverType, handler)
     return 1
 }
 
 func handlerFunc(h *kcpHandler, conn net.Conn) {
+    h.mutex.Lock()
+    timeout := h.timeout
+    h.mutex.Unlock()
     c := &Conn{
         conn:              conn,
         id:                atomic.AddUint32(&h.id, 1),
@@ -158,9 +252,17 @@ func handlerFunc(h *kcpHandler, conn net.Conn) {
         packetReceiveChan: make(chan []byte, 10),
         packetSendChan:    make(chan []byte, 10),
         withHead:          true,
-        timeout:           h.timeout,
+        timeout:           timeout,
     }
+    c.target = h.targets.Pick(uint64(c.id))
+    c.clock = ClockOf(c.target.Ctx)
     c.SetCallback(h)
+    h.addConn(c)
+    if h.isClosed() {
+        c.Close()
+        return
+    }
+    c.touch()
 
     go func() { // read message
         for !c.IsClosed() {
@@ -180,58 +282,96 @@ func handlerFunc(h *kcpHandler, conn net.Conn) {
 
 }
 
+var serverType = &HandleType{
+    Name: "kcp.Server",
+    Methods: map[string]lua.LuaGoFunction{
+        "SetTimeout": func(L *lua.State) int {
+            h := L.ToGoStruct(1).(*kcpHandler)
+            if L.Type(2) != lua.LUA_TNUMBER {
+                return TypeError(L, 1, 2, "number")
+            }
+            h.mutex.Lock()
+            h.timeout = time.Duration(L.ToNumber(2) * float64(time.Second))
+            h.mutex.Unlock()
+            return 0
+        },
+        "Addr": func(L *lua.State) int {
+            h := L.ToGoStruct(1).(*kcpHandler)
+            h.mutex.Lock()
+            ln := h.ln
+            h.mutex.Unlock()
+            if ln == nil {
+                L.PushNil()
+            } else {
+                L.PushString(ln.Addr().String())
+            }
+            return 1
+        },
+    },
+}
+
+var connType = &HandleType{
+    Name: "kcp.Conn",
+    Methods: map[string]lua.LuaGoFunction{
+        "Send":       sendConn,
+        "Close":      closeConn,
+        "SetHead":    setHead,
+        "SetTimeout": setTimeout,
+        "IsClosed": func(L *lua.State) int {
+            L.PushBoolean(L.ToGoStruct(1).(*Conn).IsClosed())
+            return 1
+        },
+        "RemoteAddr": func(L *lua.State) int {
+            L.PushString(L.ToGoStruct(1).(*Conn).conn.RemoteAddr().String())
+            return 1
+        },
+        "LocalAddr": func(L *lua.State) int {
+            L.PushString(L.ToGoStruct(1).(*Conn).conn.LocalAddr().String())
+            return 1
+        },
+    },
+    Fields: map[string]lua.LuaGoFunction{
+        "id": func(L *lua.State) int {
+            L.PushInteger(int64(L.ToGoStruct(1).(*Conn).id))
+            return 1
+        },
+    },
+}
+
 func closeConn(L *lua.State) int {
-    p := L.ToGoStruct(1)
-    if client, ok := p.(*Conn); ok {
-        go client.Close()
-    }
+    go L.ToGoStruct(1).(*Conn).Close()
     return 0
 }
 
+// sendConn returns true, or nil and the error
 func sendConn(L *lua.State) int {
-    var (
-        payload []byte
-    )
-    p := L.ToGoStruct(1)
-    if L.Type(2) == lua.LUA_TSTRING {
-        payload = L.ToBytes(2)
+    client := L.ToGoStruct(1).(*Conn)
+    if L.Type(2) != lua.LUA_TSTRING {
+        return TypeError(L, 1, 2, "string")
     }
-    if client, ok := p.(*Conn); ok {
-        st, err := client.Send(payload)
-        L.PushInteger(int64(st))
-        if err != nil {
-            L.PushString(err.Error())
-        } else {
-            L.PushNil()
-        }
-        return 2
-    } else {
-        L.PushInteger(-1)
-        L.PushString("convert error")
+    if _, err := client.Send(L.ToBytes(2)); err != nil {
+        L.PushNil()
+        L.PushString(err.Error())
         return 2
     }
+    L.PushBoolean(true)
+    return 1
 }
 
 func setHead(L *lua.State) int {
-    p := L.ToGoStruct(1)
-    b := L.ToBoolean(2)
-    if client, ok := p.(*Conn); ok {
-        client.withHead = b
-    } else {
-        L.PushString("convert error")
-        return 1
+    if L.Type(2) != lua.LUA_TBOOLEAN {
+        return TypeError(L, 1, 2, "boolean")
     }
+    L.ToGoStruct(1).(*Conn).withHead = L.ToBoolean(2)
     return 0
 }
 
 func setTimeout(L *lua.State) int {
-    p := L.ToGoStruct(1)
-    sec := L.ToNumber(2)
-    if h, ok := p.(*kcpHandler); ok {
-        h.timeout = time.Duration(sec * float64(time.Second))
-    } else {
-        L.PushString("convert error")
-        return 1
+    if L.Type(2) != lua.LUA_TNUMBER {
+        return TypeError(L, 1, 2, "number")
     }
+    c := L.ToGoStruct(1).(*Conn)
+    c.timeout = time.Duration(L.ToNumber(2) * float64(time.Second))
+    c.touch()
     return 0
 }
@@ -0,0 +1,468 @@
+package lua_looper
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/DGHeroin/golua/lua"
+    . "github.com/DGHeroin/golualib"
+    "github.com/DGHeroin/golualib/lua_time"
+)
+
+var (
+    cronCode = `
+local lib = GoWrap(...)
+local cron = {}
+
+-- add runs fn(name, at) on the spec in a new coroutine, at is the scheduled
+-- time in Unix ns. opts are name, tz, missed ("once", "skip" or "all") and
+-- grace in seconds. It returns the job name
+function cron.add(spec, fn, opts)
+    if type(fn) ~= 'function' then
+        error("bad argument #2 to 'add' (function expected, got " .. type(fn) .. ")", 2)
+    end
+    return lib.add(spec, function(name, at) Spawn(fn, name, at) end, opts)
+end
+
+cron.remove = lib.remove
+cron.pause  = lib.pause
+cron.resume = lib.resume
+cron.next   = lib.next
+cron.list   = lib.list
+
+return cron
+`
+)
+
+const (
+    // cronRecheck bounds the wait of a job so a jump of the wall clock, such
+    // as a resume from suspend, is noticed
+    cronRecheck = time.Minute
+    // cronMaxCatchUp bounds the missed runs the "all" policy replays
+    cronMaxCatchUp = 1000
+)
+
+// missed policies, for the runs found late by more than the grace period
+// after a process pause
+const (
+    // missedOnce runs once for all of them
+    missedOnce = "once"
+    // missedSkip drops them
+    missedSkip = "skip"
+    // missedAll replays each of them
+    missedAll = "all"
+)
+
+const cronModuleName = "cron"
+
+func init() {
+    RegisterModule(cronModuleName, NewCron)
+}
+
+type cronModule struct {
+    Resources
+    mutex sync.Mutex
+    clock Clock
+    seq   int
+    jobs  map[string]*cronJob
+}
+
+type cronJob struct {
+    m      *cronModule
+    ctx    LuaContext
+    L      *lua.State
+    ref    int
+    name   string
+    spec   string
+    zone   string
+    missed string
+    grace  time.Duration
+    sched  schedule
+    // next is the zero time when the spec has no more runs
+    next    time.Time
+    last    time.Time
+    runs    int
+    paused  bool
+    removed bool
+    timer   ClockTimer
+    // gen tells the timer of the current arm from stale ones
+    gen int
+}
+
+// NewCron creates the module loaded by require("golualib.cron")
+func NewCron() Module {
+    return &cronModule{}
+}
+
+func (m *cronModule) Name() string {
+    return cronModuleName
+}
+
+func (m *cronModule) Open(ctx LuaContext) error {
+    m.jobs = make(map[string]*cronJob)
+    m.clock = ClockOf(ctx)
+    m.Add(AddInspector(ctx, "cron", m.inspect))
+    return LoadModule(ctx.LuaState(), m.Name(), cronCode, map[string]lua.LuaGoFunction{
+        "add":    m.add,
+        "remove": m.remove,
+        "pause":  m.pause,
+        "resume": m.resume,
+        "next":   m.next,
+        "list":   m.list,
+    })
+}
+
+// inspect lists the jobs and their next runs
+func (m *cronModule) inspect() []string {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    now := m.clock.Now()
+    var rs []string
+    for _, j := range m.jobs {
+        state := "done"
+        switch {
+        case j.paused:
+            state = "paused"
+        case !j.next.IsZero():
+            state = fmt.Sprintf("next in %v", j.next.Sub(now).Round(time.Second))
+        }
+        rs = append(rs, fmt.Sprintf("cron %s %q %s, %d runs", j.name, j.spec, state, j.runs))
+    }
+    sort.Strings(rs)
+    return rs
+}
+
+func pushError(L *lua.State, err error) int {
+    L.PushNil()
+    L.PushString(err.Error())
+    return 2
+}
+
+func (m *cronModule) add(L *lua.State) int {
+    if !L.IsString(1) {
+        return pushError(L, fmt.Errorf("cron: bad argument #1 (string expected, got %s)", L.LTypename(1)))
+    }
+    spec := L.ToString(1)
+    j := &cronJob{
+        m:      m,
+        ctx:    CheckLuaContext(L),
+        L:      L,
+        spec:   spec,
+        missed: missedOnce,
+        grace:  time.Second,
+    }
+    switch L.Type(3) {
+    case lua.LUA_TNIL, lua.LUA_TNONE:
+    case lua.LUA_TTABLE:
+        if err := j.options(L, 3); err != nil {
+            return pushError(L, err)
+        }
+    default:
+        return pushError(L, fmt.Errorf("cron: bad argument #3 (table expected, got %s)", L.LTypename(3)))
+    }
+    loc, err := lua_time.LoadZone(j.zone)
+    if err != nil {
+        return pushError(L, fmt.Errorf("cron: unknown zone %q", j.zone))
+    }
+    now := m.clock.Now()
+    if j.sched, err = parseSchedule(spec, loc, now); err != nil {
+        return pushError(L, err)
+    }
+    if j.next = j.sched.Next(now); j.next.IsZero() {
+        return pushError(L, errNoRun)
+    }
+
+    m.mutex.Lock()
+    if j.name == "" {
+        for {
+            m.seq++
+            j.name = fmt.Sprintf("job#%d", m.seq)
+            if _, ok := m.jobs[j.name]; !ok {
+                break
+            }
+        }
+    } else if _, ok := m.jobs[j.name]; ok {
+        m.mutex.Unlock()
+        return pushError(L, fmt.Errorf("cron: job %q exists", j.name))
+    }
+    L.PushValue(2)
+    j.ref = L.Ref(lua.LUA_REGISTRYINDEX)
+    m.jobs[j.name] = j
+    j.arm(now)
+    m.mutex.Unlock()
+    m.Add(j)
+
+    L.PushString(j.name)
+    return 1
+}
+
+// options reads the option table at idx
+func (j *cronJob) options(L *lua.State, idx int) error {
+    for _, key := range []string{"name", "tz", "missed"} {
+        L.GetField(idx, key)
+        if !L.IsNil(-1) && L.Type(-1) != lua.LUA_TSTRING {
+            err := fmt.Errorf("cron: option %s must be a string, got %s", key, L.LTypename(-1))
+            L.Pop(1)
+            return err
+        }
+        s := L.ToString(-1)
+        L.Pop(1)
+        switch key {
+        case "name":
+            j.name = s
+        case "tz":
+            j.zone = s
+        case "missed":
+            switch s {
+            case "":
+            case missedOnce, missedSkip, missedAll:
+                j.missed = s
+            default:
+                return fmt.Errorf("cron: unknown missed policy %q", s)
+            }
+        }
+    }
+    L.GetField(idx, "grace")
+    defer L.Pop(1)
+    switch L.Type(-1) {
+    case lua.LUA_TNIL:
+    case lua.LUA_TNUMBER:
+        sec := L.ToNumber(-1)
+        if sec < 0 {
+            return fmt.Errorf("cron: negative grace %v", sec)
+        }
+        j.grace = time.Duration(sec * float64(time.Second))
+    default:
+        return fmt.Errorf("cron: option grace must be a number, got %s", L.LTypename(-1))
+    }
+    return nil
+}
+
+// job returns the job named by argument 1
+func (m *cronModule) job(L *lua.State) (*cronJob, error) {
+    if !L.IsString(1) {
+        return nil, fmt.Errorf("cron: bad argument #1 (string expected, got %s)", L.LTypename(1))
+    }
+    name := L.ToString(1)
+    j, ok := m.jobs[name]
+    if !ok {
+        return nil, fmt.Errorf("cron: no job %q", name)
+    }
+    return j, nil
+}
+
+func (m *cronModule) remove(L *lua.State) int {
+    m.mutex.Lock()
+    j, err := m.job(L)
+    if err != nil {
+        m.mutex.Unlock()
+        L.PushBoolean(false)
+        return 1
+    }
+    delete(m.jobs, j.name)
+    j.removed = true
+    j.stop()
+    m.mutex.Unlock()
+    m.Remove(j)
+    L.Unref(lua.LUA_REGISTRYINDEX, j.ref)
+    L.PushBoolean(true)
+    return 1
+}
+
+// pause stops the runs of a job until resume, the runs in between are
+// skipped whatever the missed policy
+func (m *cronModule) pause(L *lua.State) int {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    j, err := m.job(L)
+    if err != nil {
+        L.PushBoolean(false)
+        return 1
+    }
+    j.paused = true
+    j.stop()
+    L.PushBoolean(true)
+    return 1
+}
+
+func (m *cronModule) resume(L *lua.State) int {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    j, err := m.job(L)
+    if err != nil {
+        L.PushBoolean(false)
+        return 1
+    }
+    if j.paused {
+        j.paused = false
+        now := m.clock.Now()
+        if j.next = j.sched.Next(now); !j.next.IsZero() {
+            j.arm(now)
+        }
+    }
+    L.PushBoolean(true)
+    return 1
+}
+
+// next returns the time of the next run in Unix ns
+func (m *cronModule) next(L *lua.State) int {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    j, err := m.job(L)
+    switch {
+    case err != nil:
+        return pushError(L, err)
+    case j.paused:
+        return pushError(L, fmt.Errorf("cron: job %q is paused", j.name))
+    case j.next.IsZero():
+        return pushError(L, fmt.Errorf("cron: job %q has no next run", j.name))
+    }
+    L.PushInteger(j.next.UnixNano())
+    return 1
+}
+
+// list returns the jobs sorted by name
+func (m *cronModule) list(L *lua.State) int {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    names := make([]string, 0, len(m.jobs))
+    for name := range m.jobs {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    L.CreateTable(len(names), 0)
+    for i, name := range names {
+        j := m.jobs[name]
+        L.CreateTable(0, 8)
+        L.PushString(j.name)
+        L.SetField(-2, "name")
+        L.PushString(j.spec)
+        L.SetField(-2, "spec")
+        L.PushString(j.zone)
+        L.SetField(-2, "tz")
+        L.PushString(j.missed)
+        L.SetField(-2, "missed")
+        L.PushBoolean(j.paused)
+        L.SetField(-2, "paused")
+        L.PushInteger(int64(j.runs))
+        L.SetField(-2, "runs")
+        if !j.paused && !j.next.IsZero() {
+            L.PushInteger(j.next.UnixNano())
+            L.SetField(-2, "next")
+        }
+        if !j.last.IsZero() {
+            L.PushInteger(j.last.UnixNano())
+            L.SetField(-2, "last")
+        }
+        L.RawSeti(-2, i+1)
+    }
+    return 1
+}
+
+// arm waits for the next run, m.mutex is held
+func (j *cronJob) arm(now time.Time) {
+    j.stop()
+    gen := j.gen
+    d := j.next.Sub(now)
+    if d > cronRecheck {
+        d = cronRecheck
+    }
+    j.timer = j.m.clock.AfterFunc(d, func() {
+        j.fire(gen)
+    })
+}
+
+// stop cancels the pending timer, m.mutex is held
+func (j *cronJob) stop() {
+    j.gen++
+    if j.timer != nil {
+        j.timer.Stop()
+        j.timer = nil
+    }
+}
+
+func (j *cronJob) fire(gen int) {
+    m := j.m
+    m.mutex.Lock()
+    if gen != j.gen || j.paused || j.removed {
+        m.mutex.Unlock()
+        return
+    }
+    now := m.clock.Now()
+    if now.Before(j.next) {
+        // woken to recheck the wall clock
+        j.arm(now)
+        m.mutex.Unlock()
+        return
+    }
+    runs := j.due(now)
+    if j.next = j.sched.Next(now); !j.next.IsZero() {
+        j.arm(now)
+    }
+    m.mutex.Unlock()
+    for _, at := range runs {
+        j.run(at)
+    }
+}
+
+// due returns the runs to make at now. The runs late by more than the grace
+// period are missed, they are handled by the missed policy: "once" runs the
+// first of them when nothing else runs, "skip" drops them and "all" keeps
+// up to cronMaxCatchUp of them
+func (j *cronJob) due(now time.Time) []time.Time {
+    var (
+        runs   []time.Time
+        missed time.Time
+        edge   = now.Add(-j.grace)
+        at     = j.next
+    )
+    if at.Before(edge) {
+        missed = at
+        if j.missed == missedAll {
+            for ; !at.IsZero() && at.Before(edge) && len(runs) < cronMaxCatchUp; at = j.sched.Next(at) {
+                runs = append(runs, at)
+            }
+        }
+        if !at.IsZero() && at.Before(edge) {
+            at = j.sched.Next(edge.Add(-time.Nanosecond))
+        }
+    }
+    for ; !at.IsZero() && !at.After(now); at = j.sched.Next(at) {
+        runs = append(runs, at)
+    }
+    if len(runs) == 0 && !missed.IsZero() && j.missed == missedOnce {
+        runs = append(runs, missed)
+    }
+    return runs
+}
+
+// run calls the job on the Lua state, unless it was paused or removed since
+func (j *cronJob) run(at time.Time) {
+    m, L := j.m, j.L
+    RunStatePriority(j.ctx, PriorityHigh, L, func() {
+        m.mutex.Lock()
+        ok := !j.paused && !j.removed
+        if ok {
+            j.runs++
+            j.last = at
+        }
+        m.mutex.Unlock()
+        if !ok {
+            return
+        }
+        L.RawGeti(lua.LUA_REGISTRYINDEX, j.ref)
+        L.PushString(j.name)
+        L.PushInteger(at.UnixNano())
+        Call(j.ctx, 2, 0, "cron."+j.name)
+    })
+}
+
+func (j *cronJob) Close() error {
+    j.m.mutex.Lock()
+    j.removed = true
+    j.stop()
+    j.m.mutex.Unlock()
+    return nil
+}
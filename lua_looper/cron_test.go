@@ -0,0 +1,41 @@
+package lua_looper
+
+import (
+    "strconv"
+    "testing"
+    "time"
+)
+
+func TestCronOnVirtualClock(t *testing.T) {
+    start := time.Date(2024, 3, 1, 11, 58, 30, 0, time.UTC)
+    ctx, vc := newClockContext(t, start)
+    run(t, ctx, logCode+`
+cron = require('golualib.cron')
+T = require('golualib.time')
+minutes, noon = {}, {}
+local function at(list)
+    return function(name, ns) list[#list + 1] = T.Format(ns, '15:04:05') end
+end
+assert(cron.add('* * * * *', at(minutes), { name = 'minutes' }))
+assert(cron.add('0 12 * * *', at(noon), { name = 'noon' }))
+`)
+    noon := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+    expect(t, ctx, "cron.next('noon')", strconv.FormatInt(noon.UnixNano(), 10))
+    expect(t, ctx, "T.Now()", strconv.FormatInt(start.UnixNano(), 10))
+
+    vc.Advance(2 * time.Minute)
+    expect(t, ctx, "table.concat(minutes, ' ')", "11:59:00 12:00:00")
+    expect(t, ctx, "table.concat(noon, ' ')", "12:00:00")
+
+    expect(t, ctx, "cron.pause('minutes')", "true")
+    vc.Advance(3 * time.Minute)
+    expect(t, ctx, "#minutes", "2")
+    expect(t, ctx, "cron.resume('minutes')", "true")
+    vc.Advance(time.Minute)
+    expect(t, ctx, "minutes[3]", "12:04:00")
+
+    expect(t, ctx, "cron.remove('minutes')", "true")
+    vc.Advance(10 * time.Minute)
+    expect(t, ctx, "#minutes", "3")
+    expect(t, ctx, "cron.list()[1].name", "noon")
+}
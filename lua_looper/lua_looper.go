@@ -1,94 +1,289 @@
 package lua_looper
 
 import (
+    "fmt"
     . "github.com/DGHeroin/golualib"
     "log"
+    "sort"
+    "sync"
+    "sync/atomic"
     "time"
 
     "github.com/DGHeroin/golua/lua"
-
 )
 
-func Register(L *lua.State) {
-    L.CreateTable(0, 1)
-
-    //  server
-    L.PushString("New")
-    L.PushGoFunction(newLooper)
-    L.SetTable(-3)
-
-    L.PushString("Stop")
-    L.PushGoFunction(stopLooper)
-    L.SetTable(-3)
-
-    L.PushString("AfterFunc")
-    L.PushGoFunction(afterFunc)
-    L.SetTable(-3)
-
-    // everything done
-    L.SetGlobal("loop")
-
-    err := L.DoString(`
-local l = loop
+var (
+    initCode = `
+local l = GoWrap(...)
 local timeCounter = 0
-function LoopTimeCount_ns()
-    return l.LoopTimeCount_ns()
+local function LoopTimeCount_ns()
+    return timeCounter
 end
 
 local function LoopTimeCounter( ns )
     timeCounter = timeCounter + ns
 end
 
-function LuaLoop()
+local function checkTimer(name, sec, cb)
+    if type(sec) ~= 'number' then
+        error(("bad argument #1 to '%s' (number expected, got %s)"):format(name, type(sec)), 3)
+    end
+    if type(cb) ~= 'function' then
+        error(("bad argument #2 to '%s' (function expected, got %s)"):format(name, type(cb)), 3)
+    end
+end
+
+local function LuaLoop()
     local self = {}
     local loop
-    local updateList = {}
-    local function onUpdate()
-        for _, cb in pairs(updateList) do
-            cb()
+    -- updates is sorted by priority then insertion, it is replaced rather
+    -- than modified so a frame iterates a stable list
+    local updates = {}
+    local function onUpdate(dt, frame)
+        local list = updates
+        for i = 1, #list do
+            local u = list[i]
+            if not u.removed then
+                u.cb(dt, frame)
+            end
         end
     end
-    function self.Start(ms)
-        loop = l.New(ms, onUpdate, LoopTimeCounter)
+    -- Start calls the updates every ms milliseconds with the seconds elapsed
+    -- since the previous frame and the frame number. With opts.fixed each
+    -- frame covers exactly ms, frames late are caught up, at most
+    -- opts.maxSteps (5) per tick, the time beyond is skipped. opts may be an
+    -- update function.
+    function self.Start(ms, opts)
+        if type(opts) == 'function' then
+            self.AddUpdate(opts)
+            opts = nil
+        end
+        opts = opts or {}
+        if loop then
+            loop:Stop()
+        end
+        loop = l.New(ms, onUpdate, LoopTimeCounter, opts.fixed, opts.maxSteps or 5)
     end
     function self.Stop()
         if loop then
-            l.Stop(loop)
+            loop:Stop()
         end
         loop = nil
     end
-    function self.AfterFunc(sec, cb)
-        l.AfterFunc(sec, cb)
+    -- Stats returns the frame number, frames, overruns (frames longer than
+    -- ms), skipped (frames dropped by maxSteps), avg and max frame time in
+    -- ns. reset starts the next stats over
+    function self.Stats(reset)
+        if loop then
+            return loop:Stats(reset)
+        end
+    end
+    -- After calls cb once after sec seconds in a new coroutine, it returns
+    -- the timer: t:Cancel(), t:Reset(sec) and t.pending
+    function self.After(sec, cb)
+        checkTimer('After', sec, cb)
+        return l.After(sec, function() Spawn(cb) end)
     end
-    function self.AddUpdate(cb)
-        updateList[cb] = cb
+    -- Every calls cb every sec seconds, each call in a new coroutine
+    function self.Every(sec, cb)
+        checkTimer('Every', sec, cb)
+        return l.Every(sec, function() Spawn(cb) end)
+    end
+    self.AfterFunc = self.After
+    -- AddUpdate adds cb to the updates, the lower priorities (0) run first
+    -- and equal ones in the order they were added
+    function self.AddUpdate(cb, priority)
+        priority = priority or 0
+        self.RemoveUpdate(cb)
+        local list = {}
+        local u = { cb = cb, priority = priority }
+        for _, v in ipairs(updates) do
+            if u and v.priority > priority then
+                list[#list + 1] = u
+                u = nil
+            end
+            list[#list + 1] = v
+        end
+        list[#list + 1] = u
+        updates = list
     end
     function self.RemoveUpdate(cb)
-        updateList[cb] = nil
+        local list = {}
+        for _, v in ipairs(updates) do
+            if v.cb == cb then
+                v.removed = true
+            else
+                list[#list + 1] = v
+            end
+        end
+        updates = list
     end
     return self
 end
 
--- default looper
-Looper = LuaLoop()
-loop = nil
-`)
-    if err != nil {
+-- Sleep suspends the calling coroutine for sec seconds
+local function Sleep(sec)
+    Await(l.After, sec)
+end
+
+return {
+    Loop             = LuaLoop,
+    -- default looper
+    Default          = LuaLoop(),
+    Sleep            = Sleep,
+    LoopTimeCount_ns = LoopTimeCount_ns,
+}
+`
+)
+
+const moduleName = "looper"
+
+func init() {
+    RegisterModule(moduleName, New)
+}
+
+type module struct {
+    Resources
+    mutex sync.Mutex
+    loops map[*loop]struct{}
+    clock Clock
+    // wheel runs the timers of After and Every
+    wheel *wheel
+    // loopType is the handle New returns
+    loopType *HandleType
+    // timerType is the handle After and Every return
+    timerType *HandleType
+}
+
+// New creates the module loaded by require("golualib.looper")
+func New() Module {
+    m := &module{}
+    m.loopType = &HandleType{
+        Name: "looper.Loop",
+        Methods: map[string]lua.LuaGoFunction{
+            "Stop":  m.stopLooper,
+            "Stats": m.loopStatsOf,
+        },
+        Fields: map[string]lua.LuaGoFunction{
+            "rate": func(L *lua.State) int {
+                L.PushInteger(int64(L.ToGoStruct(1).(*loop).rate))
+                return 1
+            },
+        },
+    }
+    m.timerType = &HandleType{
+        Name: "looper.Timer",
+        Methods: map[string]lua.LuaGoFunction{
+            "Cancel": m.cancelTimer,
+            "Reset":  m.resetTimer,
+        },
+        Fields: map[string]lua.LuaGoFunction{
+            "pending": func(L *lua.State) int {
+                L.PushBoolean(m.wheel.Pending(&L.ToGoStruct(1).(*luaTimer).timer))
+                return 1
+            },
+        },
+        Gc: func(v interface{}) {
+            t := v.(*luaTimer)
+            t.collected = true
+            t.release()
+        },
+    }
+    return m
+}
+
+func (m *module) Name() string {
+    return moduleName
+}
+
+func (m *module) Open(ctx LuaContext) error {
+    m.loops = make(map[*loop]struct{})
+    m.clock = ClockOf(ctx)
+    m.wheel = newWheel(m.clock)
+    m.Add(m.wheel)
+    m.Add(AddInspector(ctx, "timers", m.timers))
+    return LoadModule(ctx.LuaState(), m.Name(), initCode, map[string]lua.LuaGoFunction{
+        "New": m.newLooper,
+        "After": func(L *lua.State) int {
+            return m.newTimer(L, false)
+        },
+        "Every": func(L *lua.State) int {
+            return m.newTimer(L, true)
+        },
+    })
+}
+
+// timers lists the running loops and counts the pending timers
+func (m *module) timers() []string {
+    m.mutex.Lock()
+    var rs []string
+    for l := range m.loops {
+        rs = append(rs, fmt.Sprintf("loop every %dms", l.rate))
+    }
+    m.mutex.Unlock()
+    sort.Strings(rs)
+    return append(rs, fmt.Sprintf("%d timers pending", m.wheel.Len()))
+}
 
+// Register opens the module and sets the globals LuaLoop, Looper, Sleep
+// and LoopTimeCount_ns
+func Register(L *lua.State) {
+    if err := OpenGlobals(L, New(), map[string]string{
+        "LuaLoop":          "Loop",
+        "Looper":           "Default",
+        "Sleep":            "Sleep",
+        "LoopTimeCount_ns": "LoopTimeCount_ns",
+    }); err != nil {
+        log.Println(err)
     }
 }
+
 type loop struct {
     callbackRef    int
     counterRef int
     rate           int
-    ticker         *time.Ticker
     L              *lua.State
     ctx            LuaContext
+    done           chan struct{}
+    once           sync.Once
+    // timer fires at next on the clock, mutex guards both
+    mutex sync.Mutex
+    clock Clock
+    timer ClockTimer
+    next  time.Time
+    // fixed makes every frame last step, maxSteps bounds the frames a tick
+    // catches up
+    fixed    bool
+    step     time.Duration
+    maxSteps int
+    // queued is set while a tick waits on the context, the ticks meanwhile
+    // are folded into it
+    queued int32
+    // the fields below belong to the context goroutine
+    last  time.Time
+    acc   time.Duration
+    frame int64
+    stats loopStats
 }
 
-func newLooper(L *lua.State) int {
+type loopStats struct {
+    frames   int64
+    overruns int64
+    skipped  int64
+    total    time.Duration
+    max      time.Duration
+}
+
+func (m *module) newLooper(L *lua.State) int {
     l := &loop{}
     l.rate = L.CheckInteger(1)
+    l.step = time.Millisecond * time.Duration(l.rate)
+    l.fixed = L.ToBoolean(4)
+    l.maxSteps = L.ToInteger(5)
+    if l.maxSteps < 1 {
+        l.maxSteps = 1
+    }
+    L.SetTop(3)
 
     l.counterRef = L.Ref(lua.LUA_REGISTRYINDEX)
     L.SetTop(2)
@@ -96,76 +291,242 @@ func newLooper(L *lua.State) int {
 
     l.L = L
     l.ctx = CheckLuaContext(L)
+    l.clock = m.clock
+    m.Add(l)
+    m.mutex.Lock()
+    m.loops[l] = struct{}{}
+    m.mutex.Unlock()
 
     l.Start()
 
-    L.PushGoStruct(l)
+    PushHandle(L, m.loopType, l)
     return 1
 }
 
-func stopLooper(L *lua.State) int {
-    looper := checkLooper(L, 1)
+func (m *module) stopLooper(L *lua.State) int {
+    looper := L.ToGoStruct(1).(*loop)
     looper.Stop()
+    m.Remove(looper)
+    m.mutex.Lock()
+    delete(m.loops, looper)
+    m.mutex.Unlock()
     return 0
 }
 
-func checkLooper(L *lua.State, i int) *loop {
-    ptr := L.ToGoStruct(i)
-    if l, ok := ptr.(*loop); ok {
-        return l
+// loopStatsOf returns the stats of the loop, reset clears them
+func (m *module) loopStatsOf(L *lua.State) int {
+    l := L.ToGoStruct(1).(*loop)
+    st := l.stats
+    L.CreateTable(0, 6)
+    L.PushInteger(l.frame)
+    L.SetField(-2, "frame")
+    L.PushInteger(st.frames)
+    L.SetField(-2, "frames")
+    L.PushInteger(st.overruns)
+    L.SetField(-2, "overruns")
+    L.PushInteger(st.skipped)
+    L.SetField(-2, "skipped")
+    var avg time.Duration
+    if st.frames > 0 {
+        avg = st.total / time.Duration(st.frames)
     }
-    return nil
+    L.PushInteger(int64(avg))
+    L.SetField(-2, "avg")
+    L.PushInteger(int64(st.max))
+    L.SetField(-2, "max")
+    if L.ToBoolean(2) {
+        l.stats = loopStats{}
+    }
+    return 1
 }
 
 func (l *loop) Start() {
-    go func() {
-        l.ticker = time.NewTicker(time.Millisecond * time.Duration(l.rate))
-        L := l.L
-        for {
-            <-l.ticker.C
-            l.ctx.Run(func() {
-                startTime := time.Now()
-                // tick
-                L.RawGeti(lua.LUA_REGISTRYINDEX, l.callbackRef)
-                if err := L.Call(0, 0); err != nil {
-                    log.Println(err)
-                }
-                // calc
-                elapsedNs := time.Now().Sub(startTime).Nanoseconds()
-                L.RawGeti(lua.LUA_REGISTRYINDEX, l.counterRef)
-                L.PushInteger(elapsedNs)
-                if err := L.Call(1, 0); err != nil {
-                    log.Println(err)
-                }
-            })
-        }
-    }()
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    l.done = make(chan struct{})
+    l.last = l.clock.Now()
+    l.next = l.last.Add(l.step)
+    l.timer = l.clock.AfterFunc(l.step, l.fire)
 }
+
+// fire runs on the clock, it rearms the timer for the next step, skipping
+// the steps already past, and queues a tick unless one is waiting
+func (l *loop) fire() {
+    l.mutex.Lock()
+    if l.stopped() {
+        l.mutex.Unlock()
+        return
+    }
+    now := l.clock.Now()
+    if !l.next.After(now) {
+        l.next = l.next.Add((now.Sub(l.next)/l.step + 1) * l.step)
+    }
+    l.timer.Reset(l.next.Sub(now))
+    l.mutex.Unlock()
+    if !atomic.CompareAndSwapInt32(&l.queued, 0, 1) {
+        return
+    }
+    if RunStatePriority(l.ctx, PriorityHigh, l.L, l.tick) != nil {
+        atomic.StoreInt32(&l.queued, 0)
+    }
+}
+
+// tick runs the frames due since the previous tick
+func (l *loop) tick() {
+    atomic.StoreInt32(&l.queued, 0)
+    if l.stopped() {
+        return
+    }
+    now := l.clock.Now()
+    elapsed := now.Sub(l.last)
+    l.last = now
+    if !l.fixed {
+        l.update(elapsed)
+        return
+    }
+    l.acc += elapsed
+    steps := int64(l.acc / l.step)
+    if max := int64(l.maxSteps); steps > max {
+        l.stats.skipped += steps - max
+        l.acc -= time.Duration(steps-max) * l.step
+        steps = max
+    }
+    for i := int64(0); i < steps && !l.stopped(); i++ {
+        l.acc -= l.step
+        l.update(l.step)
+    }
+}
+
+// update runs one frame of dt
+func (l *loop) update(dt time.Duration) {
+    L := l.L
+    l.frame++
+    startTime := time.Now()
+    L.RawGeti(lua.LUA_REGISTRYINDEX, l.callbackRef)
+    L.PushNumber(dt.Seconds())
+    L.PushInteger(l.frame)
+    Call(l.ctx, 2, 0, "looper.tick")
+    elapsed := time.Now().Sub(startTime)
+
+    l.stats.frames++
+    l.stats.total += elapsed
+    if elapsed > l.stats.max {
+        l.stats.max = elapsed
+    }
+    if elapsed > l.step {
+        l.stats.overruns++
+    }
+    L.RawGeti(lua.LUA_REGISTRYINDEX, l.counterRef)
+    L.PushInteger(elapsed.Nanoseconds())
+    Call(l.ctx, 1, 0, "looper.tick")
+}
+
+func (l *loop) stopped() bool {
+    select {
+    case <-l.done:
+        return true
+    default:
+        return false
+    }
+}
+
+// Stop stops the timer of l
 func (l *loop) Stop() {
-    l.ticker.Stop()
-}
-
-func afterFunc(L *lua.State) int {
-    sec := L.CheckNumber(1)
-    ref := L.Ref(lua.LUA_REGISTRYINDEX)
-    ctx := CheckLuaContext(L)
-    L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
-    if L.Type(-1) != lua.LUA_TFUNCTION {
-        log.Println("AfterFunc not function")
-        return 0
-    }
-
-    dur := time.Duration(sec * float64(time.Second))
-    time.AfterFunc(dur, func() {
-        ctx.Run(func() {
-            L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
-            if L.Type(-1) == lua.LUA_TFUNCTION {
-                if err := L.Call(0, 0); err != nil {
-                    log.Println(err)
-                }
-                L.Unref(lua.LUA_REGISTRYINDEX, ref)
-            }
-        })
+    l.once.Do(func() {
+        l.mutex.Lock()
+        defer l.mutex.Unlock()
+        l.timer.Stop()
+        close(l.done)
     })
-    return 0
-}
\ No newline at end of file
+}
+
+func (l *loop) Close() error {
+    l.Stop()
+    return nil
+}
+
+// luaTimer is a timer of After and Every calling a Lua function
+type luaTimer struct {
+    timer
+    m      *module
+    ctx    LuaContext
+    L      *lua.State
+    ref    int
+    repeat bool
+    // collected tells scripts dropped the handle, the function is released
+    // once the timer is no longer pending
+    collected bool
+}
+
+func (m *module) newTimer(L *lua.State, repeat bool) int {
+    d := seconds(L.ToNumber(1))
+    if L.Type(2) != lua.LUA_TFUNCTION {
+        L.PushNil()
+        return 1
+    }
+    L.PushValue(2)
+    t := &luaTimer{
+        m:      m,
+        ctx:    CheckLuaContext(L),
+        L:      L,
+        ref:    L.Ref(lua.LUA_REGISTRYINDEX),
+        repeat: repeat,
+    }
+    t.f = t.fire
+    t.start(d)
+    PushHandle(L, m.timerType, t)
+    return 1
+}
+
+func seconds(sec float64) time.Duration {
+    return time.Duration(sec * float64(time.Second))
+}
+
+// start arms t to fire after d, and then every d if it repeats
+func (t *luaTimer) start(d time.Duration) bool {
+    var interval time.Duration
+    if t.repeat {
+        interval = d
+        if interval < wheelTick {
+            interval = wheelTick
+        }
+    }
+    return t.m.wheel.Start(&t.timer, d, interval)
+}
+
+// fire runs on the clock, the call is dropped if the timer was
+// cancelled or reset since
+func (t *luaTimer) fire(seq uint64) {
+    L := t.L
+    RunStatePriority(t.ctx, PriorityHigh, L, func() {
+        if t.m.wheel.Take(&t.timer, seq) {
+            L.RawGeti(lua.LUA_REGISTRYINDEX, t.ref)
+            Call(t.ctx, 0, 0, "looper.after")
+        }
+        t.release()
+    })
+}
+
+func (t *luaTimer) release() {
+    if t.collected && t.ref != lua.LUA_NOREF && t.m.wheel.Idle(&t.timer) {
+        t.L.Unref(lua.LUA_REGISTRYINDEX, t.ref)
+        t.ref = lua.LUA_NOREF
+    }
+}
+
+// cancelTimer stops the timer, it returns whether the timer was pending
+func (m *module) cancelTimer(L *lua.State) int {
+    L.PushBoolean(m.wheel.Stop(&L.ToGoStruct(1).(*luaTimer).timer))
+    return 1
+}
+
+// resetTimer arms the timer again to fire after sec seconds, a repeating
+// timer then fires every sec. It returns whether the timer was pending.
+func (m *module) resetTimer(L *lua.State) int {
+    if L.Type(2) != lua.LUA_TNUMBER {
+        return TypeError(L, 1, 2, "number")
+    }
+    t := L.ToGoStruct(1).(*luaTimer)
+    L.PushBoolean(t.start(seconds(L.ToNumber(2))))
+    return 1
+}
@@ -0,0 +1,159 @@
+package lua_looper
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    "github.com/DGHeroin/golua/lua"
+    . "github.com/DGHeroin/golualib"
+)
+
+// newClockContext starts a context on a virtual clock reading start
+func newClockContext(t *testing.T, start time.Time) (LuaContext, *VirtualClock) {
+    t.Helper()
+    vc := NewVirtualClock(start)
+    ctx := NewDefaultContext(nil, WithClock(vc))
+    ctx.Start()
+    t.Cleanup(func() {
+        ctx.Close(context.Background())
+    })
+    return ctx, vc
+}
+
+// run runs code on the context and waits for it
+func run(t *testing.T, ctx LuaContext, code string) {
+    t.Helper()
+    done := make(chan error, 1)
+    ctx.Run(func() {
+        done <- ctx.LuaState().DoString(code)
+    })
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+}
+
+// eval returns the string value of the Lua expression expr
+func eval(t *testing.T, ctx LuaContext, expr string) string {
+    t.Helper()
+    done := make(chan string, 1)
+    ctx.Run(func() {
+        L := ctx.LuaState()
+        if err := L.DoString("_result = tostring(" + expr + ")"); err != nil {
+            done <- err.Error()
+            return
+        }
+        L.GetGlobal("_result")
+        done <- L.ToString(-1)
+        L.Pop(1)
+    })
+    return <-done
+}
+
+func expect(t *testing.T, ctx LuaContext, expr, want string) {
+    t.Helper()
+    if got := eval(t, ctx, expr); got != want {
+        t.Fatalf("%s = %q, want %q", expr, got, want)
+    }
+}
+
+const logCode = `
+looper = require('golualib.looper')
+log = {}
+function add(s) log[#log + 1] = s end
+function flush()
+    local s = table.concat(log, ' ')
+    log = {}
+    return s
+end
+`
+
+func TestTimersOnVirtualClock(t *testing.T) {
+    ctx, vc := newClockContext(t, time.Unix(1000, 0))
+    run(t, ctx, logCode+`
+looper.Default.After(1, function() add('after1') end)
+cancelled = looper.Default.After(2, function() add('cancelled') end)
+looper.Default.After(0.5, function() add('after0.5') end)
+local n = 0
+every = looper.Default.Every(1, function() n = n + 1; add('every' .. n) end)
+Spawn(function() looper.Sleep(1.5); add('slept') end)
+`)
+    expect(t, ctx, "cancelled:Cancel()", "true")
+    expect(t, ctx, "cancelled.pending", "false")
+    expect(t, ctx, "every.pending", "true")
+
+    vc.Advance(999 * time.Millisecond)
+    expect(t, ctx, "flush()", "after0.5")
+    vc.Advance(time.Millisecond)
+    expect(t, ctx, "flush()", "after1 every1")
+    vc.Advance(2 * time.Second)
+    expect(t, ctx, "flush()", "slept every2 every3")
+
+    expect(t, ctx, "every:Cancel()", "true")
+    vc.Advance(10 * time.Second)
+    expect(t, ctx, "flush()", "")
+}
+
+func TestTimerResetOnVirtualClock(t *testing.T) {
+    ctx, vc := newClockContext(t, time.Unix(1000, 0))
+    run(t, ctx, logCode+`
+timer = looper.Default.After(1, function() add('fired') end)
+`)
+    vc.Advance(900 * time.Millisecond)
+    expect(t, ctx, "timer:Reset(1)", "true")
+    vc.Advance(900 * time.Millisecond)
+    expect(t, ctx, "flush()", "")
+    vc.Advance(100 * time.Millisecond)
+    expect(t, ctx, "flush()", "fired")
+    expect(t, ctx, "timer:Cancel()", "false")
+}
+
+func TestFixedLoopOnVirtualClock(t *testing.T) {
+    ctx, vc := newClockContext(t, time.Unix(1000, 0))
+    run(t, ctx, logCode+`
+loop = looper.Loop()
+loop.AddUpdate(function(dt, frame) add(frame .. ':' .. dt) end, 1)
+loop.AddUpdate(function(dt, frame) add('first') end, 0)
+loop.Start(100, { fixed = true, maxSteps = 5 })
+`)
+    vc.Advance(350 * time.Millisecond)
+    expect(t, ctx, "flush()", "first 1:0.1 first 2:0.1 first 3:0.1")
+    expect(t, ctx, "loop.Stats().frames", "3")
+
+    run(t, ctx, "loop.Stop()")
+    vc.Advance(time.Second)
+    expect(t, ctx, "flush()", "")
+}
+
+func TestVariableLoopOnVirtualClock(t *testing.T) {
+    ctx, vc := newClockContext(t, time.Unix(1000, 0))
+    run(t, ctx, logCode+`
+loop = looper.Loop()
+loop.Start(250, function(dt, frame) add(frame .. ':' .. dt) end)
+`)
+    vc.Advance(time.Second)
+    expect(t, ctx, "flush()", "1:0.25 2:0.25 3:0.25 4:0.25")
+    run(t, ctx, "loop.Stop()")
+}
+
+// the looper keeps working on the real clock
+func TestTimersOnRealClock(t *testing.T) {
+    ctx := NewDefaultContext(nil)
+    ctx.Start()
+    defer ctx.Close(context.Background())
+    fired := make(chan struct{})
+    ctx.Run(func() {
+        L := ctx.LuaState()
+        L.PushGoFunction(func(L *lua.State) int {
+            close(fired)
+            return 0
+        })
+        L.SetGlobal("fired")
+    })
+    run(t, ctx, logCode+"looper.Default.After(0.01, function() fired() end)")
+    select {
+    case <-fired:
+    case <-time.After(5 * time.Second):
+        t.Fatal("timer did not fire")
+    }
+}
@@ -0,0 +1,240 @@
+package lua_looper
+
+import (
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// schedule yields the run times of a cron job
+type schedule interface {
+    // Next returns the first run after t, the zero time if there is none
+    Next(t time.Time) time.Time
+}
+
+// cronSpec is a parsed cron expression, each field is a bit set
+type cronSpec struct {
+    second, minute, hour, dom, month, dow uint64
+    // domStar and dowStar tell the day fields are unrestricted, when both
+    // are restricted a day matching either of them runs
+    domStar, dowStar bool
+    loc              *time.Location
+}
+
+// everySchedule runs at start + k * every
+type everySchedule struct {
+    start time.Time
+    every time.Duration
+}
+
+type cronField struct {
+    name   string
+    lo, hi int
+    names  map[string]int
+}
+
+var (
+    cronFields = []cronField{
+        {"second", 0, 59, nil},
+        {"minute", 0, 59, nil},
+        {"hour", 0, 23, nil},
+        {"day of month", 1, 31, nil},
+        {"month", 1, 12, map[string]int{
+            "jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+            "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+        }},
+        // 7 is Sunday as well
+        {"day of week", 0, 7, map[string]int{
+            "sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+        }},
+    }
+    cronMacros = map[string]string{
+        "@yearly":   "0 0 0 1 1 *",
+        "@annually": "0 0 0 1 1 *",
+        "@monthly":  "0 0 0 1 * *",
+        "@weekly":   "0 0 0 * * 0",
+        "@daily":    "0 0 0 * * *",
+        "@midnight": "0 0 0 * * *",
+        "@hourly":   "0 0 * * * *",
+    }
+)
+
+// parseSchedule parses a cron spec. It takes 5 fields (minute hour
+// day-of-month month day-of-week), 6 fields with seconds first, the macros
+// @yearly @monthly @weekly @daily @hourly, or "@every <duration>" which
+// counts from now. Fields are lists of values, ranges and steps such as
+// "*/15", "1-5" or "mon,wed,fri".
+func parseSchedule(spec string, loc *time.Location, now time.Time) (schedule, error) {
+    spec = strings.TrimSpace(spec)
+    if strings.HasPrefix(spec, "@every ") {
+        d, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+        if err != nil {
+            return nil, fmt.Errorf("cron: bad spec %q: %v", spec, err)
+        }
+        if d < time.Second {
+            return nil, fmt.Errorf("cron: bad spec %q: interval under 1s", spec)
+        }
+        return &everySchedule{start: now.Round(0), every: d}, nil
+    }
+    if s, ok := cronMacros[spec]; ok {
+        spec = s
+    }
+    fields := strings.Fields(spec)
+    switch len(fields) {
+    case 5:
+        fields = append([]string{"0"}, fields...)
+    case 6:
+    default:
+        return nil, fmt.Errorf("cron: bad spec %q: expected 5 or 6 fields, got %d", spec, len(fields))
+    }
+    s := &cronSpec{loc: loc}
+    bits := []*uint64{&s.second, &s.minute, &s.hour, &s.dom, &s.month, &s.dow}
+    for i, f := range fields {
+        v, err := cronFields[i].parse(f)
+        if err != nil {
+            return nil, fmt.Errorf("cron: bad spec %q: %v", spec, err)
+        }
+        *bits[i] = v
+    }
+    if s.dow&(1<<7) != 0 {
+        s.dow |= 1
+    }
+    s.domStar = fields[3][0] == '*' || fields[3][0] == '?'
+    s.dowStar = fields[5][0] == '*' || fields[5][0] == '?'
+    return s, nil
+}
+
+func (f *cronField) parse(s string) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(s, ",") {
+        expr, step := part, 1
+        hasStep := false
+        if i := strings.IndexByte(part, '/'); i >= 0 {
+            n, err := strconv.Atoi(part[i+1:])
+            if err != nil || n <= 0 {
+                return 0, fmt.Errorf("bad step in %s field %q", f.name, part)
+            }
+            expr, step, hasStep = part[:i], n, true
+        }
+        var lo, hi int
+        switch {
+        case expr == "*" || expr == "?":
+            lo, hi = f.lo, f.hi
+        case strings.IndexByte(expr, '-') > 0:
+            i := strings.IndexByte(expr, '-')
+            var err error
+            if lo, err = f.value(expr[:i]); err != nil {
+                return 0, err
+            }
+            if hi, err = f.value(expr[i+1:]); err != nil {
+                return 0, err
+            }
+            if lo > hi {
+                return 0, fmt.Errorf("bad range in %s field %q", f.name, part)
+            }
+        default:
+            var err error
+            if lo, err = f.value(expr); err != nil {
+                return 0, err
+            }
+            hi = lo
+            if hasStep {
+                hi = f.hi
+            }
+        }
+        for i := lo; i <= hi; i += step {
+            bits |= 1 << uint(i)
+        }
+    }
+    return bits, nil
+}
+
+func (f *cronField) value(s string) (int, error) {
+    if v, ok := f.names[strings.ToLower(s)]; ok {
+        return v, nil
+    }
+    v, err := strconv.Atoi(s)
+    if err != nil {
+        return 0, fmt.Errorf("bad value in %s field %q", f.name, s)
+    }
+    if v < f.lo || v > f.hi {
+        return 0, fmt.Errorf("%s %d out of range [%d, %d]", f.name, v, f.lo, f.hi)
+    }
+    return v, nil
+}
+
+var errNoRun = errors.New("cron: spec never runs")
+
+// Next walks the fields from month down to second, a field that does not
+// match resets the smaller ones. Hours step in absolute time, so the times
+// in a DST gap are skipped and those of a repeated hour run twice.
+func (s *cronSpec) Next(t time.Time) time.Time {
+    t = t.In(s.loc).Truncate(time.Second).Add(time.Second)
+    limit := t.Year() + 5
+WRAP:
+    for t.Year() <= limit {
+        for s.month&(1<<uint(t.Month())) == 0 {
+            t = dayStart(t.Year(), t.Month()+1, 1, s.loc)
+            if t.Month() == time.January {
+                continue WRAP
+            }
+        }
+        for !s.dayMatches(t) {
+            t = dayStart(t.Year(), t.Month(), t.Day()+1, s.loc)
+            if t.Day() == 1 {
+                continue WRAP
+            }
+        }
+        for s.hour&(1<<uint(t.Hour())) == 0 {
+            day := t.Day()
+            t = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second)
+            if t.Day() != day {
+                continue WRAP
+            }
+        }
+        for s.minute&(1<<uint(t.Minute())) == 0 {
+            t = t.Add(time.Minute - time.Duration(t.Second())*time.Second)
+            if t.Minute() == 0 {
+                continue WRAP
+            }
+        }
+        for s.second&(1<<uint(t.Second())) == 0 {
+            t = t.Add(time.Second)
+            if t.Second() == 0 {
+                continue WRAP
+            }
+        }
+        return t
+    }
+    return time.Time{}
+}
+
+// dayStart returns the first instant of a day, which is past midnight when
+// midnight falls in a DST gap
+func dayStart(year int, month time.Month, day int, loc *time.Location) time.Time {
+    noon := time.Date(year, month, day, 12, 0, 0, 0, loc)
+    t := time.Date(year, month, day, 0, 0, 0, 0, loc)
+    for t.Day() != noon.Day() {
+        t = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute)
+    }
+    return t
+}
+
+func (s *cronSpec) dayMatches(t time.Time) bool {
+    dom := s.dom&(1<<uint(t.Day())) != 0
+    dow := s.dow&(1<<uint(t.Weekday())) != 0
+    if s.domStar || s.dowStar {
+        return dom && dow
+    }
+    return dom || dow
+}
+
+func (s *everySchedule) Next(t time.Time) time.Time {
+    if t.Before(s.start) {
+        return s.start.Add(s.every)
+    }
+    n := t.Sub(s.start)/s.every + 1
+    return s.start.Add(n * s.every)
+}
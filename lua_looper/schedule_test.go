@@ -0,0 +1,117 @@
+package lua_looper
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseSchedule(t *testing.T) {
+    // a Monday
+    from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    tests := []struct {
+        spec string
+        next []string
+    }{
+        // lists, ranges and steps
+        {"*/15 * * * *", []string{"2024-01-01 00:15:00", "2024-01-01 00:30:00", "2024-01-01 00:45:00", "2024-01-01 01:00:00"}},
+        {"5/20 * * * *", []string{"2024-01-01 00:05:00", "2024-01-01 00:25:00", "2024-01-01 00:45:00", "2024-01-01 01:05:00"}},
+        {"0 9-17/4 * * *", []string{"2024-01-01 09:00:00", "2024-01-01 13:00:00", "2024-01-01 17:00:00", "2024-01-02 09:00:00"}},
+        {"30 1,5,23 * * *", []string{"2024-01-01 01:30:00", "2024-01-01 05:30:00", "2024-01-01 23:30:00"}},
+        {"0 0 1 1-3/2 *", []string{"2024-03-01 00:00:00", "2025-01-01 00:00:00"}},
+        {"15 30 10 * * *", []string{"2024-01-01 10:30:15", "2024-01-02 10:30:15"}},
+        // names
+        {"0 0 * FEB *", []string{"2024-02-01 00:00:00", "2024-02-02 00:00:00"}},
+        {"0 0 1 jan,jul *", []string{"2024-07-01 00:00:00", "2025-01-01 00:00:00"}},
+        {"0 12 * * mon-wed", []string{"2024-01-01 12:00:00", "2024-01-02 12:00:00", "2024-01-03 12:00:00", "2024-01-08 12:00:00"}},
+        {"0 0 * * sun", []string{"2024-01-07 00:00:00", "2024-01-14 00:00:00"}},
+        {"0 0 * * 7", []string{"2024-01-07 00:00:00", "2024-01-14 00:00:00"}},
+        {"0 0 * * 5-7", []string{"2024-01-05 00:00:00", "2024-01-06 00:00:00", "2024-01-07 00:00:00", "2024-01-12 00:00:00"}},
+        // a restricted day of month or of week alone must match
+        {"0 0 13 * *", []string{"2024-01-13 00:00:00", "2024-02-13 00:00:00"}},
+        {"0 0 13 * ?", []string{"2024-01-13 00:00:00", "2024-02-13 00:00:00"}},
+        {"0 0 * * fri", []string{"2024-01-05 00:00:00", "2024-01-12 00:00:00"}},
+        // both restricted, either of them matches
+        {"0 0 13 * fri", []string{"2024-01-05 00:00:00", "2024-01-12 00:00:00", "2024-01-13 00:00:00", "2024-01-19 00:00:00"}},
+        // macros
+        {"@hourly", []string{"2024-01-01 01:00:00", "2024-01-01 02:00:00"}},
+        {"@daily", []string{"2024-01-02 00:00:00"}},
+        {"@midnight", []string{"2024-01-02 00:00:00"}},
+        {"@weekly", []string{"2024-01-07 00:00:00"}},
+        {"@monthly", []string{"2024-02-01 00:00:00"}},
+        {"@yearly", []string{"2025-01-01 00:00:00"}},
+        {"@annually", []string{"2025-01-01 00:00:00"}},
+        {"@every 90s", []string{"2024-01-01 00:01:30", "2024-01-01 00:03:00"}},
+        // leap day and a day that never comes
+        {"0 0 29 2 *", []string{"2024-02-29 00:00:00", "2028-02-29 00:00:00"}},
+        {"0 0 30 2 *", []string{""}},
+    }
+    for _, test := range tests {
+        s, err := parseSchedule(test.spec, time.UTC, from)
+        if err != nil {
+            t.Errorf("parseSchedule(%q): %v", test.spec, err)
+            continue
+        }
+        at := from
+        for i, want := range test.next {
+            at = s.Next(at)
+            got := ""
+            if !at.IsZero() {
+                got = at.Format("2006-01-02 15:04:05")
+            }
+            if got != want {
+                t.Errorf("%q run %d = %q, want %q", test.spec, i, got, want)
+                break
+            }
+        }
+    }
+}
+
+func TestParseScheduleRejects(t *testing.T) {
+    specs := []string{
+        "",
+        "* * * *",
+        "* * * * * * *",
+        "@sometimes",
+        "60 * * * *",
+        "* 24 * * *",
+        "* * 0 * *",
+        "* * 32 * *",
+        "* * * 0 *",
+        "* * * 13 *",
+        "* * * * 8",
+        "60 * * * * *",
+        "-1 * * * *",
+        "*/0 * * * *",
+        "*/-5 * * * *",
+        "*/x * * * *",
+        "5-1 * * * *",
+        "1-2-3 * * * *",
+        "1- * * * *",
+        "* * * foo *",
+        "* * * * funday",
+        "* * * jan-foo *",
+        "1,,2 * * * *",
+        "@every 500ms",
+        "@every soon",
+        "@every -1m",
+    }
+    from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    for _, spec := range specs {
+        if _, err := parseSchedule(spec, time.UTC, from); err == nil {
+            t.Errorf("parseSchedule(%q) accepted", spec)
+        }
+    }
+}
+
+func TestScheduleInZone(t *testing.T) {
+    loc := time.FixedZone("UTC+8", 8*3600)
+    s, err := parseSchedule("0 9 * * *", loc, time.Time{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    want := time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)
+    if got := s.Next(from); !got.Equal(want) {
+        t.Fatalf("Next(%v) = %v, want %v", from, got, want)
+    }
+}
@@ -0,0 +1,322 @@
+package lua_looper
+
+import (
+    "sync"
+    "time"
+
+    . "github.com/DGHeroin/golualib"
+)
+
+const (
+    // wheelTick is the resolution of the timers
+    wheelTick = time.Millisecond
+    // the first level has 256 slots of one tick, the next ones 64 slots of
+    // a full turn of the level below, which covers 2^32 ticks (49 days)
+    wheelBits0   = 8
+    wheelBits    = 6
+    wheelLevels  = 5
+    wheelMaxSpan = 1<<(wheelBits0+wheelBits*(wheelLevels-1)) - 1
+)
+
+// wheel is a hierarchical timer wheel driven by a clock. A single clock
+// timer advances it and calls the expired timers, it is armed for the next
+// non empty slot of the first level or the next cascade of the upper ones.
+type wheel struct {
+    mutex  sync.Mutex
+    clock  Clock
+    start  time.Time
+    // now is the next tick to process
+    now    uint64
+    slots0 [1 << wheelBits0]timerList
+    slots  [wheelLevels - 1][1 << wheelBits]timerList
+    count  int
+    // wakeAt is the tick the clock timer is armed for
+    wakeAt uint64
+    sleep  ClockTimer
+    closed bool
+    // running serializes the ticks so the expiries are called in order
+    running sync.Mutex
+}
+
+// timer is a timer of a wheel, its fields are guarded by the wheel mutex
+type timer struct {
+    expire uint64
+    // interval is the period of a repeating timer in ticks, 0 for one shot
+    interval uint64
+    // seq changes on every Stop and Reset, f gets the seq of the expiry so
+    // it can drop a call made stale in between
+    seq uint64
+    // queued counts the expiries handed to f and not yet taken
+    queued     int
+    list       *timerList
+    prev, next *timer
+    f          func(seq uint64)
+}
+
+type timerList struct {
+    head, tail *timer
+}
+
+type expiry struct {
+    t   *timer
+    seq uint64
+}
+
+func (l *timerList) push(t *timer) {
+    t.list = l
+    t.prev = l.tail
+    t.next = nil
+    if l.tail != nil {
+        l.tail.next = t
+    } else {
+        l.head = t
+    }
+    l.tail = t
+}
+
+func (l *timerList) remove(t *timer) {
+    if t.prev != nil {
+        t.prev.next = t.next
+    } else {
+        l.head = t.next
+    }
+    if t.next != nil {
+        t.next.prev = t.prev
+    } else {
+        l.tail = t.prev
+    }
+    t.list, t.prev, t.next = nil, nil, nil
+}
+
+// take empties l and returns its first timer, the others follow by next
+func (l *timerList) take() *timer {
+    t := l.head
+    l.head, l.tail = nil, nil
+    return t
+}
+
+func newWheel(clock Clock) *wheel {
+    return &wheel{
+        clock:  clock,
+        start:  clock.Now(),
+        wakeAt: ^uint64(0),
+    }
+}
+
+// Close stops the clock timer, the pending timers never fire
+func (w *wheel) Close() error {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    w.closed = true
+    if w.sleep != nil {
+        w.sleep.Stop()
+    }
+    return nil
+}
+
+// Len returns the number of pending timers
+func (w *wheel) Len() int {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    return w.count
+}
+
+// Start schedules t to fire after d and then every interval if it is not
+// zero, a pending t is rescheduled. It returns whether t was pending.
+func (w *wheel) Start(t *timer, d, interval time.Duration) bool {
+    w.mutex.Lock()
+    pending := w.stop(t)
+    t.interval = 0
+    if interval > 0 {
+        t.interval = w.ticks(interval)
+    }
+    t.expire = w.ticks(w.clock.Now().Sub(w.start) + d)
+    if t.expire < w.now {
+        t.expire = w.now
+    }
+    w.add(t)
+    if t.expire < w.wakeAt {
+        w.arm(t.expire)
+    }
+    w.mutex.Unlock()
+    return pending
+}
+
+// Stop cancels t, it returns whether t was pending
+func (w *wheel) Stop(t *timer) bool {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    return w.stop(t)
+}
+
+// Pending tells whether t waits to fire
+func (w *wheel) Pending(t *timer) bool {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    return t.list != nil
+}
+
+// Take accounts for an expiry given to f, which must take each of them
+// once. It returns whether t was not stopped or reset since.
+func (w *wheel) Take(t *timer, seq uint64) bool {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    t.queued--
+    return t.seq == seq
+}
+
+// Idle tells whether t is not pending and has no expiry to take
+func (w *wheel) Idle(t *timer) bool {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    return t.list == nil && t.queued == 0
+}
+
+func (w *wheel) stop(t *timer) bool {
+    t.seq++
+    if t.list == nil {
+        return false
+    }
+    t.list.remove(t)
+    w.count--
+    return true
+}
+
+// ticks rounds d up to ticks so a timer never fires early
+func (w *wheel) ticks(d time.Duration) uint64 {
+    if d <= 0 {
+        return 0
+    }
+    return uint64((d + wheelTick - 1) / wheelTick)
+}
+
+func (w *wheel) add(t *timer) {
+    expire := t.expire
+    delta := expire - w.now
+    if delta > wheelMaxSpan {
+        // beyond the last level, it goes back down at the cascade
+        delta = wheelMaxSpan
+        expire = w.now + delta
+    }
+    var l *timerList
+    switch shift := uint(wheelBits0); {
+    case delta < 1<<shift:
+        l = &w.slots0[expire&(1<<wheelBits0-1)]
+    default:
+        for level := 0; ; level++ {
+            if delta < 1<<(shift+wheelBits) || level == wheelLevels-2 {
+                l = &w.slots[level][(expire>>shift)&(1<<wheelBits-1)]
+                break
+            }
+            shift += wheelBits
+        }
+    }
+    l.push(t)
+    w.count++
+}
+
+// cascade moves the timers of the slots reached by w.now one level down
+func (w *wheel) cascade() {
+    shift := uint(wheelBits0)
+    for level := 0; level < wheelLevels-1; level++ {
+        index := (w.now >> shift) & (1<<wheelBits - 1)
+        for t := w.slots[level][index].take(); t != nil; {
+            next := t.next
+            t.list, t.prev, t.next = nil, nil, nil
+            w.count--
+            w.add(t)
+            t = next
+        }
+        if index != 0 {
+            return
+        }
+        shift += wheelBits
+    }
+}
+
+// advance processes the ticks up to target and returns the expiries in
+// order. A repeating timer that fell behind skips the periods it missed.
+func (w *wheel) advance(target uint64) []expiry {
+    var fired []expiry
+    for w.now <= target {
+        if w.count == 0 {
+            w.now = target + 1
+            break
+        }
+        index := w.now & (1<<wheelBits0 - 1)
+        if index == 0 {
+            w.cascade()
+        }
+        for t := w.slots0[index].take(); t != nil; {
+            next := t.next
+            t.list, t.prev, t.next = nil, nil, nil
+            w.count--
+            t.queued++
+            fired = append(fired, expiry{t, t.seq})
+            if t.interval > 0 {
+                t.expire += t.interval
+                if t.expire <= target {
+                    t.expire += ((target-t.expire)/t.interval + 1) * t.interval
+                }
+                w.add(t)
+            }
+            t = next
+        }
+        w.now++
+    }
+    return fired
+}
+
+// next returns the tick to wake up at, the next non empty slot of the first
+// level or the next cascade, w.now included as it is not processed yet
+func (w *wheel) next() uint64 {
+    if w.count == 0 {
+        return ^uint64(0)
+    }
+    for tick := w.now; ; tick++ {
+        if tick&(1<<wheelBits0-1) == 0 {
+            return tick
+        }
+        if w.slots0[tick&(1<<wheelBits0-1)].head != nil {
+            return tick
+        }
+    }
+}
+
+// arm sets the clock timer to fire at tick
+func (w *wheel) arm(tick uint64) {
+    w.wakeAt = tick
+    if w.closed {
+        return
+    }
+    if tick == ^uint64(0) {
+        if w.sleep != nil {
+            w.sleep.Stop()
+        }
+        return
+    }
+    d := time.Duration(tick)*wheelTick - w.clock.Now().Sub(w.start)
+    if w.sleep == nil {
+        w.sleep = w.clock.AfterFunc(d, w.tick)
+    } else {
+        w.sleep.Reset(d)
+    }
+}
+
+// tick advances to the clock time and calls the expired timers
+func (w *wheel) tick() {
+    w.running.Lock()
+    defer w.running.Unlock()
+    w.mutex.Lock()
+    if w.closed {
+        w.mutex.Unlock()
+        return
+    }
+    fired := w.advance(uint64(w.clock.Now().Sub(w.start) / wheelTick))
+    w.arm(w.next())
+    w.mutex.Unlock()
+
+    for _, e := range fired {
+        e.t.f(e.seq)
+    }
+}
@@ -0,0 +1,181 @@
+package lua_looper
+
+import (
+    "testing"
+    "time"
+
+    . "github.com/DGHeroin/golualib"
+)
+
+// firing records the clock time of each expiry of a timer
+type firing struct {
+    w     *wheel
+    vc    *VirtualClock
+    start time.Time
+    fired []time.Duration
+}
+
+func newFiring() *firing {
+    vc := NewVirtualClock(time.Unix(1000, 0))
+    return &firing{w: newWheel(vc), vc: vc, start: vc.Now()}
+}
+
+// timer returns a timer recording its expiries, then calls then if set
+func (f *firing) timer(then func(t *timer)) *timer {
+    t := &timer{}
+    t.f = func(seq uint64) {
+        if f.w.Take(t, seq) {
+            f.fired = append(f.fired, f.vc.Now().Sub(f.start))
+            if then != nil {
+                then(t)
+            }
+        }
+    }
+    return t
+}
+
+func TestWheelCascade(t *testing.T) {
+    f := newFiring()
+    defer f.w.Close()
+    // one past the span of each level, and the edges around them
+    delays := []time.Duration{
+        time.Millisecond,
+        255 * time.Millisecond,
+        256 * time.Millisecond,
+        257 * time.Millisecond,
+        1<<14*time.Millisecond - time.Millisecond,
+        1 << 14 * time.Millisecond,
+        1<<14*time.Millisecond + 3*time.Millisecond,
+        1<<20*time.Millisecond - time.Millisecond,
+        1<<20*time.Millisecond + 5*time.Millisecond,
+        1<<22*time.Millisecond + 7*time.Millisecond,
+    }
+    // started in reverse so the order comes from the wheel
+    for i := len(delays) - 1; i >= 0; i-- {
+        f.w.Start(f.timer(nil), delays[i], 0)
+    }
+    if n := f.w.Len(); n != len(delays) {
+        t.Fatalf("Len() = %d, want %d", n, len(delays))
+    }
+    f.vc.Advance(delays[len(delays)-1])
+    if len(f.fired) != len(delays) {
+        t.Fatalf("fired %d timers, want %d: %v", len(f.fired), len(delays), f.fired)
+    }
+    for i, d := range delays {
+        if f.fired[i] != d {
+            t.Fatalf("timer %d fired at %v, want %v", i, f.fired[i], d)
+        }
+    }
+    if n := f.w.Len(); n != 0 {
+        t.Fatalf("Len() = %d after firing, want 0", n)
+    }
+}
+
+func TestWheelStop(t *testing.T) {
+    f := newFiring()
+    defer f.w.Close()
+
+    // before it fires
+    cancelled := f.timer(nil)
+    f.w.Start(cancelled, time.Second, 0)
+    f.vc.Advance(500 * time.Millisecond)
+    if !f.w.Stop(cancelled) {
+        t.Fatal("Stop of a pending timer returned false")
+    }
+    if f.w.Pending(cancelled) || !f.w.Idle(cancelled) {
+        t.Fatal("stopped timer still pending")
+    }
+    f.vc.Advance(time.Second)
+    if len(f.fired) != 0 {
+        t.Fatalf("stopped timer fired at %v", f.fired)
+    }
+
+    // after it fired
+    once := f.timer(nil)
+    f.w.Start(once, time.Second, 0)
+    f.vc.Advance(time.Second)
+    if len(f.fired) != 1 {
+        t.Fatalf("fired %v, want one expiry", f.fired)
+    }
+    if f.w.Stop(once) {
+        t.Fatal("Stop of a fired timer returned true")
+    }
+
+    // a repeating timer stays pending until stopped
+    f.fired = nil
+    f.start = f.vc.Now()
+    every := f.timer(nil)
+    f.w.Start(every, 100*time.Millisecond, 100*time.Millisecond)
+    f.vc.Advance(300 * time.Millisecond)
+    if !f.w.Stop(every) {
+        t.Fatal("Stop of a repeating timer returned false")
+    }
+    f.vc.Advance(time.Second)
+    if want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}; !equalDurations(f.fired, want) {
+        t.Fatalf("fired at %v, want %v", f.fired, want)
+    }
+}
+
+// an expiry handed out before a Stop or Start is stale
+func TestWheelStaleExpiry(t *testing.T) {
+    vc := NewVirtualClock(time.Unix(1000, 0))
+    w := newWheel(vc)
+    defer w.Close()
+    tm := &timer{}
+    var seqs []uint64
+    tm.f = func(seq uint64) {
+        seqs = append(seqs, seq)
+    }
+    w.Start(tm, time.Millisecond, 0)
+    vc.Advance(time.Millisecond)
+    if len(seqs) != 1 {
+        t.Fatalf("got %d expiries, want 1", len(seqs))
+    }
+    w.Start(tm, time.Second, 0)
+    if w.Take(tm, seqs[0]) {
+        t.Fatal("Take of an expiry from before Start returned true")
+    }
+    if w.Idle(tm) {
+        t.Fatal("Idle of a pending timer")
+    }
+}
+
+func TestWheelStartDuringTick(t *testing.T) {
+    f := newFiring()
+    defer f.w.Close()
+    var (
+        now, later, again *timer
+    )
+    now = f.timer(nil)
+    later = f.timer(nil)
+    again = f.timer(nil)
+    first := f.timer(func(*timer) {
+        f.w.Start(now, 0, 0)
+        f.w.Start(later, 5*time.Millisecond, 0)
+        f.w.Start(again, time.Second, 0)
+    })
+    f.w.Start(first, 10*time.Millisecond, 0)
+    f.vc.Advance(2 * time.Second)
+    want := []time.Duration{
+        10 * time.Millisecond,
+        // due at once, it runs on the next tick
+        11 * time.Millisecond,
+        15 * time.Millisecond,
+        1010 * time.Millisecond,
+    }
+    if !equalDurations(f.fired, want) {
+        t.Fatalf("fired at %v, want %v", f.fired, want)
+    }
+}
+
+func equalDurations(a, b []time.Duration) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
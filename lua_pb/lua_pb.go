@@ -0,0 +1,606 @@
+package lua_pb
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "strings"
+    "sync"
+
+    "github.com/DGHeroin/golua/lua"
+    . "github.com/DGHeroin/golualib"
+    "google.golang.org/protobuf/proto"
+    "google.golang.org/protobuf/reflect/protodesc"
+    "google.golang.org/protobuf/reflect/protoreflect"
+    "google.golang.org/protobuf/reflect/protoregistry"
+    "google.golang.org/protobuf/types/descriptorpb"
+    "google.golang.org/protobuf/types/dynamicpb"
+)
+
+var (
+    initCode = `
+local lib = GoWrap(...)
+local type = type
+
+local pb = {}
+
+local function check(name, what, v)
+    if type(v) ~= what then
+        return ('pb: bad %s (%s expected, got %s)'):format(name, what, type(v))
+    end
+end
+
+-- load adds the messages of a serialized FileDescriptorSet, as written by
+-- protoc --include_imports --descriptor_set_out, it returns true or nil, err
+function pb.load(data)
+    local err = check('descriptor set', 'string', data)
+    if err then
+        return nil, err
+    end
+    return lib.load(data)
+end
+
+-- encode returns the bytes of the message name holding the fields of t, or
+-- nil, err. Enums take names or numbers and a oneof takes one of its fields.
+function pb.encode(name, t)
+    local err = check('message name', 'string', name) or check('message', 'table', t)
+    if err then
+        return nil, err
+    end
+    return lib.encode(name, t)
+end
+
+-- decode returns the table of the message name read from data, or nil, err.
+-- Enums decode as names, repeated fields as json.array and a set oneof
+-- names its field, e.g. t.payload == 'login'. opts.defaults fills unset
+-- scalars with their defaults.
+function pb.decode(name, data, opts)
+    local err = check('message name', 'string', name) or check('data', 'string', data)
+    if err then
+        return nil, err
+    end
+    return lib.decode(name, data, opts and opts.defaults or false)
+end
+
+-- messages lists the full names of the loaded and preloaded messages, not
+-- those compiled into the program, which encode and decode know as well
+function pb.messages()
+    return lib.messages()
+end
+
+return pb
+`
+)
+
+const moduleName = "pb"
+
+func init() {
+    RegisterModule(moduleName, New)
+}
+
+type module struct {
+    Resources
+    files *protoregistry.Files
+}
+
+// New creates the module loaded by require("golualib.pb")
+func New() Module {
+    return &module{files: new(protoregistry.Files)}
+}
+
+func (m *module) Name() string {
+    return moduleName
+}
+
+func (m *module) Open(ctx LuaContext) error {
+    preloaded.Lock()
+    sets := preloaded.sets
+    preloaded.Unlock()
+    for _, set := range sets {
+        if err := m.load(set); err != nil {
+            return err
+        }
+    }
+    return LoadModule(ctx.LuaState(), m.Name(), initCode, map[string]lua.LuaGoFunction{
+        "load":     m.loadSet,
+        "encode":   m.encode,
+        "decode":   m.decode,
+        "messages": m.messages,
+    })
+}
+
+var preloaded struct {
+    sync.Mutex
+    sets []*descriptorpb.FileDescriptorSet
+}
+
+// Preload adds a serialized FileDescriptorSet to every context opening the
+// module afterwards. Messages compiled into the program are always known to
+// encode and decode, messages() lists only the loaded and preloaded ones.
+func Preload(data []byte) error {
+    set, err := unmarshalSet(data)
+    if err != nil {
+        return err
+    }
+    // check it on its own before contexts see it
+    if err := (&module{files: new(protoregistry.Files)}).load(set); err != nil {
+        return err
+    }
+    preloaded.Lock()
+    preloaded.sets = append(preloaded.sets, set)
+    preloaded.Unlock()
+    return nil
+}
+
+func unmarshalSet(data []byte) (*descriptorpb.FileDescriptorSet, error) {
+    set := &descriptorpb.FileDescriptorSet{}
+    if err := proto.Unmarshal(data, set); err != nil {
+        return nil, protoError(err)
+    }
+    return set, nil
+}
+
+// resolver looks up the loaded files, then the ones compiled in
+type resolver struct {
+    files *protoregistry.Files
+}
+
+func (r resolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+    if fd, err := r.files.FindFileByPath(path); err == nil {
+        return fd, nil
+    }
+    return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (r resolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+    if d, err := r.files.FindDescriptorByName(name); err == nil {
+        return d, nil
+    }
+    return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
+
+// load registers the files of set, in whatever order their dependencies
+// allow. Files loaded before are skipped.
+func (m *module) load(set *descriptorpb.FileDescriptorSet) error {
+    pending := set.GetFile()
+    for len(pending) > 0 {
+        var (
+            rest    []*descriptorpb.FileDescriptorProto
+            lastErr error
+        )
+        for _, fdp := range pending {
+            if _, err := m.files.FindFileByPath(fdp.GetName()); err == nil {
+                continue
+            }
+            fd, err := protodesc.NewFile(fdp, resolver{m.files})
+            if err != nil {
+                rest = append(rest, fdp)
+                lastErr = err
+                continue
+            }
+            if err := m.files.RegisterFile(fd); err != nil {
+                return fmt.Errorf("pb: %v", err)
+            }
+        }
+        if len(rest) == len(pending) {
+            return fmt.Errorf("pb: %v", lastErr)
+        }
+        pending = rest
+    }
+    return nil
+}
+
+func (m *module) message(name string) (protoreflect.MessageDescriptor, error) {
+    d, err := resolver{m.files}.FindDescriptorByName(protoreflect.FullName(strings.TrimPrefix(name, ".")))
+    if err != nil {
+        return nil, fmt.Errorf("pb: unknown message %s", name)
+    }
+    md, ok := d.(protoreflect.MessageDescriptor)
+    if !ok {
+        return nil, fmt.Errorf("pb: %s is not a message", name)
+    }
+    return md, nil
+}
+
+func pushError(L *lua.State, err error) int {
+    L.PushNil()
+    L.PushString(err.Error())
+    return 2
+}
+
+// protoError swaps the prefix of protobuf errors, which may be followed by
+// a non-breaking space
+func protoError(err error) error {
+    msg := strings.TrimLeft(strings.TrimPrefix(err.Error(), "proto:"), " \u00a0")
+    return fmt.Errorf("pb: %s", msg)
+}
+
+func (m *module) loadSet(L *lua.State) int {
+    set, err := unmarshalSet(L.ToBytes(1))
+    if err == nil {
+        err = m.load(set)
+    }
+    if err != nil {
+        return pushError(L, err)
+    }
+    L.PushBoolean(true)
+    return 1
+}
+
+func (m *module) encode(L *lua.State) int {
+    md, err := m.message(L.ToString(1))
+    if err != nil {
+        return pushError(L, err)
+    }
+    msg := dynamicpb.NewMessage(md)
+    if err := toMessage(L, 2, msg, 0); err != nil {
+        return pushError(L, err)
+    }
+    data, err := proto.Marshal(msg)
+    if err != nil {
+        return pushError(L, protoError(err))
+    }
+    L.PushString(string(data))
+    return 1
+}
+
+func (m *module) decode(L *lua.State) int {
+    md, err := m.message(L.ToString(1))
+    if err != nil {
+        return pushError(L, err)
+    }
+    msg := dynamicpb.NewMessage(md)
+    if err := proto.Unmarshal(L.ToBytes(2), msg); err != nil {
+        return pushError(L, protoError(err))
+    }
+    top := L.GetTop()
+    if err := pushMessage(L, msg, L.ToBoolean(3)); err != nil {
+        L.SetTop(top)
+        return pushError(L, err)
+    }
+    return 1
+}
+
+func (m *module) messages(L *lua.State) int {
+    var names []string
+    var walk func(ms protoreflect.MessageDescriptors)
+    walk = func(ms protoreflect.MessageDescriptors) {
+        for i := 0; i < ms.Len(); i++ {
+            md := ms.Get(i)
+            if md.IsMapEntry() {
+                continue
+            }
+            names = append(names, string(md.FullName()))
+            walk(md.Messages())
+        }
+    }
+    m.files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+        walk(fd.Messages())
+        return true
+    })
+    sort.Strings(names)
+    L.CreateTable(len(names), 0)
+    for i, name := range names {
+        L.PushString(name)
+        L.RawSeti(-2, i+1)
+    }
+    MarkJSONArray(L, -1)
+    return 1
+}
+
+// maxDepth bounds the nesting of messages converted from tables
+const maxDepth = 100
+
+func toMessage(L *lua.State, idx int, msg protoreflect.Message, depth int) error {
+    md := msg.Descriptor()
+    if L.Type(idx) != lua.LUA_TTABLE {
+        return fmt.Errorf("pb: table expected for %s, got %s", md.FullName(), L.LTypename(idx))
+    }
+    if depth > maxDepth || !L.CheckStack(4) {
+        return fmt.Errorf("pb: %s nested too deep", md.FullName())
+    }
+    fields := md.Fields()
+    oneofs := make(map[protoreflect.OneofDescriptor]protoreflect.FieldDescriptor)
+    L.PushNil()
+    for L.Next(idx) != 0 {
+        if L.Type(-2) != lua.LUA_TSTRING {
+            return fmt.Errorf("pb: bad key %s in %s", L.LTypename(-2), md.FullName())
+        }
+        name := L.ToString(-2)
+        fd := fields.ByName(protoreflect.Name(name))
+        if fd == nil {
+            fd = fields.ByJSONName(name)
+        }
+        if fd == nil {
+            // decoded tables name the field set in a oneof
+            if od := md.Oneofs().ByName(protoreflect.Name(name)); od != nil && L.Type(-1) == lua.LUA_TSTRING {
+                L.Pop(1)
+                continue
+            }
+            return fmt.Errorf("pb: unknown field %s in %s", name, md.FullName())
+        }
+        if IsJSONNull(L, -1) {
+            L.Pop(1)
+            continue
+        }
+        if od := fd.ContainingOneof(); od != nil && !od.IsSynthetic() {
+            if other, ok := oneofs[od]; ok {
+                return fmt.Errorf("pb: oneof %s of %s has both %s and %s", od.Name(), md.FullName(), other.Name(), fd.Name())
+            }
+            oneofs[od] = fd
+        }
+        if err := setField(L, L.GetTop(), msg, fd, depth); err != nil {
+            return err
+        }
+        L.Pop(1)
+    }
+    return nil
+}
+
+func setField(L *lua.State, idx int, msg protoreflect.Message, fd protoreflect.FieldDescriptor, depth int) error {
+    switch {
+    case fd.IsMap():
+        if L.Type(idx) != lua.LUA_TTABLE {
+            return fieldError(L, idx, fd, "table")
+        }
+        mp := msg.Mutable(fd).Map()
+        L.PushNil()
+        for L.Next(idx) != 0 {
+            k, err := toScalar(L, -2, fd.MapKey())
+            if err != nil {
+                return err
+            }
+            if err := toValue(L, L.GetTop(), fd.MapValue(), mp.NewValue, depth, func(v protoreflect.Value) {
+                mp.Set(k.MapKey(), v)
+            }); err != nil {
+                return err
+            }
+            L.Pop(1)
+        }
+    case fd.IsList():
+        if L.Type(idx) != lua.LUA_TTABLE {
+            return fieldError(L, idx, fd, "table")
+        }
+        list := msg.Mutable(fd).List()
+        for i := 1; ; i++ {
+            L.RawGeti(idx, i)
+            if L.IsNil(-1) {
+                L.Pop(1)
+                break
+            }
+            if err := toValue(L, L.GetTop(), fd, list.NewElement, depth, list.Append); err != nil {
+                return err
+            }
+            L.Pop(1)
+        }
+    default:
+        return toValue(L, idx, fd, func() protoreflect.Value {
+            return msg.NewField(fd)
+        }, depth, func(v protoreflect.Value) {
+            msg.Set(fd, v)
+        })
+    }
+    return nil
+}
+
+// toValue converts one value of fd, messages are filled into a value from
+// alloc, and hands it to set
+func toValue(L *lua.State, idx int, fd protoreflect.FieldDescriptor, alloc func() protoreflect.Value, depth int, set func(protoreflect.Value)) error {
+    switch fd.Kind() {
+    case protoreflect.MessageKind, protoreflect.GroupKind:
+        v := alloc()
+        if err := toMessage(L, idx, v.Message(), depth+1); err != nil {
+            return err
+        }
+        set(v)
+        return nil
+    }
+    v, err := toScalar(L, idx, fd)
+    if err != nil {
+        return err
+    }
+    set(v)
+    return nil
+}
+
+func fieldError(L *lua.State, idx int, fd protoreflect.FieldDescriptor, expected string) error {
+    return fmt.Errorf("pb: bad field %s (%s expected, got %s)", fd.FullName(), expected, L.LTypename(idx))
+}
+
+func toScalar(L *lua.State, idx int, fd protoreflect.FieldDescriptor) (protoreflect.Value, error) {
+    integer := func(min, max float64) (int64, uint64, error) {
+        if L.Type(idx) != lua.LUA_TNUMBER {
+            return 0, 0, fieldError(L, idx, fd, "number")
+        }
+        v, _ := ToAny(L, idx)
+        switch v := v.(type) {
+        case int64:
+            if float64(v) < min || float64(v) > max {
+                return 0, 0, fmt.Errorf("pb: field %s out of range (%d)", fd.FullName(), v)
+            }
+            return v, uint64(v), nil
+        case float64:
+            // uint64 fields past the integers decode as floats
+            if v != math.Trunc(v) {
+                return 0, 0, fmt.Errorf("pb: field %s needs an integer (%v)", fd.FullName(), v)
+            }
+            if v < min || v > max {
+                return 0, 0, fmt.Errorf("pb: field %s out of range (%v)", fd.FullName(), v)
+            }
+            if v >= math.MaxInt64 {
+                return 0, uint64(v), nil
+            }
+            return int64(v), uint64(v), nil
+        }
+        return 0, 0, fieldError(L, idx, fd, "number")
+    }
+    switch fd.Kind() {
+    case protoreflect.BoolKind:
+        if L.Type(idx) != lua.LUA_TBOOLEAN {
+            return protoreflect.Value{}, fieldError(L, idx, fd, "boolean")
+        }
+        return protoreflect.ValueOfBool(L.ToBoolean(idx)), nil
+    case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+        i, _, err := integer(math.MinInt32, math.MaxInt32)
+        return protoreflect.ValueOfInt32(int32(i)), err
+    case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+        i, _, err := integer(math.MinInt64, math.MaxInt64)
+        return protoreflect.ValueOfInt64(i), err
+    case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+        _, u, err := integer(0, math.MaxUint32)
+        return protoreflect.ValueOfUint32(uint32(u)), err
+    case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+        _, u, err := integer(0, math.MaxUint64)
+        return protoreflect.ValueOfUint64(u), err
+    case protoreflect.FloatKind, protoreflect.DoubleKind:
+        if L.Type(idx) != lua.LUA_TNUMBER {
+            return protoreflect.Value{}, fieldError(L, idx, fd, "number")
+        }
+        if fd.Kind() == protoreflect.FloatKind {
+            return protoreflect.ValueOfFloat32(float32(L.ToNumber(idx))), nil
+        }
+        return protoreflect.ValueOfFloat64(L.ToNumber(idx)), nil
+    case protoreflect.StringKind:
+        if L.Type(idx) != lua.LUA_TSTRING {
+            return protoreflect.Value{}, fieldError(L, idx, fd, "string")
+        }
+        return protoreflect.ValueOfString(L.ToString(idx)), nil
+    case protoreflect.BytesKind:
+        if L.Type(idx) != lua.LUA_TSTRING {
+            return protoreflect.Value{}, fieldError(L, idx, fd, "string")
+        }
+        return protoreflect.ValueOfBytes(L.ToBytes(idx)), nil
+    case protoreflect.EnumKind:
+        switch L.Type(idx) {
+        case lua.LUA_TSTRING:
+            name := L.ToString(idx)
+            ev := fd.Enum().Values().ByName(protoreflect.Name(name))
+            if ev == nil {
+                return protoreflect.Value{}, fmt.Errorf("pb: unknown value %s of enum %s", name, fd.Enum().FullName())
+            }
+            return protoreflect.ValueOfEnum(ev.Number()), nil
+        case lua.LUA_TNUMBER:
+            i, _, err := integer(math.MinInt32, math.MaxInt32)
+            return protoreflect.ValueOfEnum(protoreflect.EnumNumber(i)), err
+        }
+        return protoreflect.Value{}, fieldError(L, idx, fd, "string or number")
+    }
+    return protoreflect.Value{}, fmt.Errorf("pb: field %s of unsupported kind %s", fd.FullName(), fd.Kind())
+}
+
+func pushMessage(L *lua.State, msg protoreflect.Message, defaults bool) error {
+    if !L.CheckStack(4) {
+        return fmt.Errorf("pb: %s nested too deep", msg.Descriptor().FullName())
+    }
+    md := msg.Descriptor()
+    L.CreateTable(0, md.Fields().Len())
+    var err error
+    msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+        if fd.IsExtension() {
+            return true
+        }
+        L.PushString(string(fd.Name()))
+        if err = pushField(L, fd, v, defaults); err != nil {
+            return false
+        }
+        L.RawSet(-3)
+        return true
+    })
+    if err != nil {
+        return err
+    }
+    oneofs := md.Oneofs()
+    for i := 0; i < oneofs.Len(); i++ {
+        od := oneofs.Get(i)
+        if od.IsSynthetic() {
+            continue
+        }
+        if fd := msg.WhichOneof(od); fd != nil {
+            L.PushString(string(fd.Name()))
+            L.SetField(-2, string(od.Name()))
+        }
+    }
+    if !defaults {
+        return nil
+    }
+    fields := md.Fields()
+    for i := 0; i < fields.Len(); i++ {
+        fd := fields.Get(i)
+        if msg.Has(fd) || fd.IsList() || fd.IsMap() || fd.Message() != nil || fd.ContainingOneof() != nil {
+            continue
+        }
+        pushScalar(L, fd, msg.Get(fd))
+        L.SetField(-2, string(fd.Name()))
+    }
+    return nil
+}
+
+func pushField(L *lua.State, fd protoreflect.FieldDescriptor, v protoreflect.Value, defaults bool) error {
+    switch {
+    case fd.IsMap():
+        mp := v.Map()
+        L.CreateTable(0, mp.Len())
+        var err error
+        mp.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+            pushScalar(L, fd.MapKey(), k.Value())
+            if err = pushValue(L, fd.MapValue(), v, defaults); err != nil {
+                return false
+            }
+            L.RawSet(-3)
+            return true
+        })
+        return err
+    case fd.IsList():
+        list := v.List()
+        L.CreateTable(list.Len(), 0)
+        for i := 0; i < list.Len(); i++ {
+            if err := pushValue(L, fd, list.Get(i), defaults); err != nil {
+                return err
+            }
+            L.RawSeti(-2, i+1)
+        }
+        MarkJSONArray(L, -1)
+        return nil
+    }
+    return pushValue(L, fd, v, defaults)
+}
+
+func pushValue(L *lua.State, fd protoreflect.FieldDescriptor, v protoreflect.Value, defaults bool) error {
+    if fd.Message() != nil {
+        return pushMessage(L, v.Message(), defaults)
+    }
+    pushScalar(L, fd, v)
+    return nil
+}
+
+func pushScalar(L *lua.State, fd protoreflect.FieldDescriptor, v protoreflect.Value) {
+    switch fd.Kind() {
+    case protoreflect.BoolKind:
+        L.PushBoolean(v.Bool())
+    case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+        protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+        L.PushInteger(v.Int())
+    case protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+        protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+        if u := v.Uint(); u > math.MaxInt64 {
+            // beyond Lua integers, keep the magnitude
+            L.PushNumber(float64(u))
+        } else {
+            L.PushInteger(int64(u))
+        }
+    case protoreflect.FloatKind, protoreflect.DoubleKind:
+        L.PushNumber(v.Float())
+    case protoreflect.StringKind:
+        L.PushString(v.String())
+    case protoreflect.BytesKind:
+        L.PushString(string(v.Bytes()))
+    case protoreflect.EnumKind:
+        if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+            L.PushString(string(ev.Name()))
+        } else {
+            L.PushInteger(int64(v.Enum()))
+        }
+    default:
+        L.PushNil()
+    }
+}
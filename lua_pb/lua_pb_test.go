@@ -0,0 +1,270 @@
+package lua_pb
+
+import (
+    "context"
+    "testing"
+
+    . "github.com/DGHeroin/golualib"
+    "google.golang.org/protobuf/proto"
+    "google.golang.org/protobuf/types/descriptorpb"
+)
+
+// testSet is the FileDescriptorSet of
+//
+//  syntax = "proto3";
+//  package test;
+//  enum Kind { KIND_UNKNOWN = 0; KIND_A = 1; KIND_B = 2; }
+//  message Login { string user = 1; }
+//  message Item {
+//      int32 id = 1;
+//      Kind kind = 2;
+//      repeated string tags = 3;
+//      map<string, int32> counts = 4;
+//      map<int32, Login> logins = 5;
+//      oneof payload { Login login = 6; string text = 7; int64 code = 8; }
+//      repeated Kind kinds = 9;
+//      uint64 big = 10;
+//      bool ok = 11;
+//      double ratio = 12;
+//      bytes raw = 13;
+//      Login nested = 14;
+//  }
+func testSet(t *testing.T) []byte {
+    t.Helper()
+    type (
+        typ   = descriptorpb.FieldDescriptorProto_Type
+        label = descriptorpb.FieldDescriptorProto_Label
+    )
+    field := func(name string, number int32, l label, tp typ, typeName string, oneof *int32) *descriptorpb.FieldDescriptorProto {
+        f := &descriptorpb.FieldDescriptorProto{
+            Name:       proto.String(name),
+            Number:     proto.Int32(number),
+            Label:      l.Enum(),
+            Type:       tp.Enum(),
+            OneofIndex: oneof,
+        }
+        if typeName != "" {
+            f.TypeName = proto.String(typeName)
+        }
+        return f
+    }
+    const (
+        optional = descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+        repeated = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+    )
+    entry := func(name string, key, value typ, valueName string) *descriptorpb.DescriptorProto {
+        return &descriptorpb.DescriptorProto{
+            Name: proto.String(name),
+            Field: []*descriptorpb.FieldDescriptorProto{
+                field("key", 1, optional, key, "", nil),
+                field("value", 2, optional, value, valueName, nil),
+            },
+            Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+        }
+    }
+    payload := proto.Int32(0)
+    file := &descriptorpb.FileDescriptorProto{
+        Name:    proto.String("test.proto"),
+        Package: proto.String("test"),
+        Syntax:  proto.String("proto3"),
+        EnumType: []*descriptorpb.EnumDescriptorProto{{
+            Name: proto.String("Kind"),
+            Value: []*descriptorpb.EnumValueDescriptorProto{
+                {Name: proto.String("KIND_UNKNOWN"), Number: proto.Int32(0)},
+                {Name: proto.String("KIND_A"), Number: proto.Int32(1)},
+                {Name: proto.String("KIND_B"), Number: proto.Int32(2)},
+            },
+        }},
+        MessageType: []*descriptorpb.DescriptorProto{{
+            Name: proto.String("Login"),
+            Field: []*descriptorpb.FieldDescriptorProto{
+                field("user", 1, optional, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", nil),
+            },
+        }, {
+            Name: proto.String("Item"),
+            Field: []*descriptorpb.FieldDescriptorProto{
+                field("id", 1, optional, descriptorpb.FieldDescriptorProto_TYPE_INT32, "", nil),
+                field("kind", 2, optional, descriptorpb.FieldDescriptorProto_TYPE_ENUM, ".test.Kind", nil),
+                field("tags", 3, repeated, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", nil),
+                field("counts", 4, repeated, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Item.CountsEntry", nil),
+                field("logins", 5, repeated, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Item.LoginsEntry", nil),
+                field("login", 6, optional, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Login", payload),
+                field("text", 7, optional, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", payload),
+                field("code", 8, optional, descriptorpb.FieldDescriptorProto_TYPE_INT64, "", payload),
+                field("kinds", 9, repeated, descriptorpb.FieldDescriptorProto_TYPE_ENUM, ".test.Kind", nil),
+                field("big", 10, optional, descriptorpb.FieldDescriptorProto_TYPE_UINT64, "", nil),
+                field("ok", 11, optional, descriptorpb.FieldDescriptorProto_TYPE_BOOL, "", nil),
+                field("ratio", 12, optional, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, "", nil),
+                field("raw", 13, optional, descriptorpb.FieldDescriptorProto_TYPE_BYTES, "", nil),
+                field("nested", 14, optional, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Login", nil),
+            },
+            NestedType: []*descriptorpb.DescriptorProto{
+                entry("CountsEntry", descriptorpb.FieldDescriptorProto_TYPE_STRING, descriptorpb.FieldDescriptorProto_TYPE_INT32, ""),
+                entry("LoginsEntry", descriptorpb.FieldDescriptorProto_TYPE_INT32, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Login"),
+            },
+            OneofDecl: []*descriptorpb.OneofDescriptorProto{{Name: proto.String("payload")}},
+        }},
+    }
+    data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return data
+}
+
+type evalTest struct {
+    code, want string
+}
+
+// evalTests runs setup in a new context, with the test set in the global
+// descriptors, then compares tostring of each expression to its want
+func evalTests(t *testing.T, setup string, tests []evalTest) {
+    t.Helper()
+    ctx := NewDefaultContext(nil)
+    ctx.Start()
+    defer ctx.Close(context.Background())
+    data := testSet(t)
+    eval := func(code string) (string, error) {
+        var (
+            got  string
+            err  error
+            done = make(chan struct{})
+        )
+        ctx.Run(func() {
+            defer close(done)
+            L := ctx.LuaState()
+            if err = L.DoString(code); err != nil {
+                return
+            }
+            L.GetGlobal("_result")
+            got = L.ToString(-1)
+            L.Pop(1)
+        })
+        <-done
+        return got, err
+    }
+    if _, err := eval(`
+pb = require('golualib.pb')
+json = require('golualib.json')
+`); err != nil {
+        t.Fatal(err)
+    }
+    ctx.Run(func() {
+        L := ctx.LuaState()
+        PushBytes(L, data)
+        L.SetGlobal("descriptors")
+    })
+    if _, err := eval(setup); err != nil {
+        t.Fatal(err)
+    }
+    for _, test := range tests {
+        got, err := eval("_result = tostring(" + test.code + ")")
+        if err != nil {
+            t.Fatalf("%s: %v", test.code, err)
+        }
+        if got != test.want {
+            t.Errorf("%s = %q, want %q", test.code, got, test.want)
+        }
+    }
+}
+
+const roundtrip = `
+function rt(t, opts)
+    local data, err = pb.encode('test.Item', t)
+    if not data then
+        return err
+    end
+    return json.encode(pb.decode('test.Item', data, opts))
+end
+`
+
+func TestLoad(t *testing.T) {
+    evalTests(t, "", []evalTest{
+        {"pb.load(descriptors)", "true"},
+        // loading again skips the files known already
+        {"pb.load(descriptors)", "true"},
+        {"table.concat(pb.messages(), ',')", "test.Item,test.Login"},
+        // compiled in messages are known without being listed
+        {"pb.decode('google.protobuf.FileDescriptorProto', pb.encode('google.protobuf.FileDescriptorProto', {name = 'x.proto'})).name", "x.proto"},
+        {"select(2, pb.load('\\xff'))", "pb: unexpected EOF"},
+        {"select(2, pb.load(1))", "pb: bad descriptor set (string expected, got number)"},
+        {"select(2, pb.encode('test.Nope', {}))", "pb: unknown message test.Nope"},
+        {"select(2, pb.encode('test.Kind', {}))", "pb: test.Kind is not a message"},
+        {"select(2, pb.encode('test.Item', 1))", "pb: bad message (table expected, got number)"},
+        {"select(2, pb.decode('test.Item', '\\xff'))", "pb: unexpected EOF"},
+    })
+}
+
+func TestEncodeDecode(t *testing.T) {
+    evalTests(t, "pb.load(descriptors)"+roundtrip, []evalTest{
+        {"rt({})", "{}"},
+        {"rt({id = 1, ok = true, ratio = 0.5, raw = '\\0\\1', big = math.maxinteger})", `{"big":9223372036854775807,"id":1,"ok":true,"ratio":0.5,"raw":"\u0000\u0001"}`},
+        {"rt({nested = {user = 'u'}})", `{"nested":{"user":"u"}}`},
+        {"rt({id = json.null})", "{}"},
+        // enums by name and by number, decoded as names
+        {"rt({kind = 'KIND_B'})", `{"kind":"KIND_B"}`},
+        {"rt({kind = 2})", `{"kind":"KIND_B"}`},
+        {"rt({kind = 7})", `{"kind":7}`},
+        {"rt({kinds = {'KIND_A', 2, 'KIND_UNKNOWN'}})", `{"kinds":["KIND_A","KIND_B","KIND_UNKNOWN"]}`},
+        // repeated fields and maps
+        {"rt({tags = {'a', 'b'}})", `{"tags":["a","b"]}`},
+        {"rt({tags = {}})", "{}"},
+        {"getmetatable(pb.decode('test.Item', pb.encode('test.Item', {tags = {'a'}})).tags) == getmetatable(json.array())", "true"},
+        {"rt({counts = {x = 1, y = 2}})", `{"counts":{"x":1,"y":2}}`},
+        {"rt({logins = {[7] = {user = 'u'}, [-1] = {}}})", `{"logins":{"-1":{},"7":{"user":"u"}}}`},
+        // errors
+        {"rt({id = 'x'})", "pb: bad field test.Item.id (number expected, got string)"},
+        {"rt({id = 2^31})", "pb: field test.Item.id out of range (2.147483648e+09)"},
+        {"rt({id = 2147483648})", "pb: field test.Item.id out of range (2147483648)"},
+        {"rt({id = 1.5})", "pb: field test.Item.id needs an integer (1.5)"},
+        {"rt({big = -1})", "pb: field test.Item.big out of range (-1)"},
+        {"rt({kind = 'NOPE'})", "pb: unknown value NOPE of enum test.Kind"},
+        {"rt({kind = true})", "pb: bad field test.Item.kind (string or number expected, got boolean)"},
+        {"rt({tags = 'a'})", "pb: bad field test.Item.tags (table expected, got string)"},
+        {"rt({counts = {x = 'y'}})", "pb: bad field test.Item.CountsEntry.value (number expected, got string)"},
+        {"rt({nested = 1})", "pb: table expected for test.Login, got number"},
+        {"rt({nope = 1})", "pb: unknown field nope in test.Item"},
+        {"rt({1})", "pb: bad key number in test.Item"},
+    })
+}
+
+func TestOneof(t *testing.T) {
+    evalTests(t, "pb.load(descriptors)"+roundtrip, []evalTest{
+        // decode names the field set in the oneof
+        {"rt({login = {user = 'u'}})", `{"login":{"user":"u"},"payload":"login"}`},
+        {"rt({text = 'hi'})", `{"payload":"text","text":"hi"}`},
+        {"rt({code = 0})", `{"code":0,"payload":"code"}`},
+        {"pb.decode('test.Item', pb.encode('test.Item', {text = 'hi'})).payload", "text"},
+        // encode skips that name, so decoded tables encode again
+        {"rt(pb.decode('test.Item', pb.encode('test.Item', {text = 'hi'})))", `{"payload":"text","text":"hi"}`},
+        {"rt({payload = 'text'})", "{}"},
+        {"rt({payload = 1})", "pb: unknown field payload in test.Item"},
+        {"rt({text = 'hi', code = 1}):match('^pb: oneof payload of test.Item has both %a+ and %a+$') ~= nil", "true"},
+    })
+}
+
+func TestDefaults(t *testing.T) {
+    evalTests(t, "pb.load(descriptors)"+roundtrip, []evalTest{
+        {"rt({}, {defaults = true})", `{"big":0,"id":0,"kind":"KIND_UNKNOWN","ok":false,"ratio":0.0,"raw":""}`},
+        {"rt({}, {defaults = false})", "{}"},
+        {"rt({id = 3}, {defaults = true})", `{"big":0,"id":3,"kind":"KIND_UNKNOWN","ok":false,"ratio":0.0,"raw":""}`},
+        // nested messages fill their defaults, unset oneofs stay unset
+        {"rt({nested = {}}, {defaults = true})", `{"big":0,"id":0,"kind":"KIND_UNKNOWN","nested":{"user":""},"ok":false,"ratio":0.0,"raw":""}`},
+        {"rt({login = {}}, {defaults = true}):match('\"login\":{\"user\":\"\"},.*\"payload\":\"login\"') ~= nil", "true"},
+        {"rt({nested = {}})", `{"nested":{}}`},
+    })
+}
+
+func TestPreload(t *testing.T) {
+    if err := Preload([]byte("\xff")); err == nil {
+        t.Error("Preload accepted bad data")
+    }
+    if err := Preload(testSet(t)); err != nil {
+        t.Fatal(err)
+    }
+    evalTests(t, roundtrip, []evalTest{
+        {"table.concat(pb.messages(), ',')", "test.Item,test.Login"},
+        {"rt({kind = 1})", `{"kind":"KIND_A"}`},
+        {"pb.load(descriptors)", "true"},
+    })
+}
@@ -7,75 +7,149 @@ import (
     . "github.com/DGHeroin/golualib"
     "github.com/go-redis/redis/v8"
     "log"
+    "sync/atomic"
+    "time"
 )
 
 var (
     initCode = `
-local lib = lua_redis
-lua_http = nil
+local lib = GoWrap(...)
 
-function RedisClient()
+local function RedisClient()
     local self = {}
     local handler
+    local timeout
+
+    -- calls before Connect succeeded fail like the client does
+    local notConnected = {}
+    function notConnected:Get(key, cb) cb('redis client not connected') end
+    function notConnected:Set(key, val, cb) cb('redis client not connected') end
+    function notConnected:SetTimeout(sec) timeout = sec end
+    function notConnected:Close() end
+    handler = notConnected
 
     function self.Connect(addr, username, password, db)
         username = username or ''
         password = password or ''
         db       = db       or 0
-        handler, err = lib.connect( addr, username, password, db )
+        local h, err = lib.connect( addr, username, password, db )
+        handler = h or notConnected
+        if h and timeout then h:SetTimeout(timeout) end
         return err
     end
 
+    -- SetTimeout fails the commands without a reply after sec seconds,
+    -- 0 waits
+    function self.SetTimeout(sec)
+        handler:SetTimeout(sec)
+    end
+
+    -- without cb inside a coroutine, Get returns val, err
     function self.Get(key, cb)
-        lib.get(handler, key, function(err, val) 
+        if not cb and IsAsync() then
+            local err, val = Await(handler.Get, handler, key)
+            return val, err
+        end
+        handler:Get(key, function(err, val) 
             if cb then 
                 cb(err, val) 
             end 
         end)
     end
 
+    -- without cb inside a coroutine, Set returns val, err
     function self.Set(key, val, cb)
-        lib.set(handler, key, val, function(err, val) 
+        if not cb and IsAsync() then
+            local err, rs = Await(handler.Set, handler, key, val)
+            return rs, err
+        end
+        handler:Set(key, val, function(err, val) 
             if cb then 
                 cb(err, val) 
             end 
         end)
     end
 
+    function self.Close()
+        handler:Close()
+        handler = notConnected
+    end
+
     return self
 end
 
+return {
+    Client = RedisClient,
+}
 `
 )
 
-func Register(L *lua.State) {
-    L.CreateTable(0, 1)
+const moduleName = "redis"
+
+func init() {
+    RegisterModule(moduleName, New)
+}
+
+type module struct {
+    Resources
+    clients *HandleType
+}
 
-    //  connect
-    L.PushString("connect")
-    L.PushGoFunction(connect)
-    L.SetTable(-3)
+type client struct {
+    *redis.Client
+    // timeout bounds a command, 0 for none
+    timeout int64
+}
 
-    //  get
-    L.PushString("get")
-    L.PushGoFunction(get)
-    L.SetTable(-3)
+// New creates the module loaded by require("golualib.redis")
+func New() Module {
+    m := &module{}
+    m.clients = &HandleType{
+        Name: "redis.Client",
+        Methods: map[string]lua.LuaGoFunction{
+            "Get": get,
+            "Set": set,
+            "SetTimeout": func(L *lua.State) int {
+                if L.Type(2) != lua.LUA_TNUMBER {
+                    return TypeError(L, 1, 2, "number")
+                }
+                cli := L.ToGoStruct(1).(*client)
+                atomic.StoreInt64(&cli.timeout, int64(L.ToNumber(2)*float64(time.Second)))
+                return 0
+            },
+            "Close": func(L *lua.State) int {
+                m.release(L.ToGoStruct(1).(*client))
+                return 0
+            },
+        },
+        // a client dropped by scripts closes its connections
+        Gc: func(v interface{}) {
+            m.release(v.(*client))
+        },
+    }
+    return m
+}
 
-    //  get
-    L.PushString("set")
-    L.PushGoFunction(set)
-    L.SetTable(-3)
+func (m *module) Name() string {
+    return moduleName
+}
 
-    // everything done
-    L.SetGlobal("lua_redis")
+func (m *module) Open(ctx LuaContext) error {
+    return LoadModule(ctx.LuaState(), m.Name(), initCode, map[string]lua.LuaGoFunction{
+        "connect": m.connect,
+    })
+}
 
-    err := L.DoString(initCode)
-    if err != nil {
+// Register opens the module and sets the global RedisClient
+func Register(L *lua.State) {
+    if err := OpenGlobals(L, New(), map[string]string{
+        "RedisClient": "Client",
+    }); err != nil {
         log.Println(err)
     }
 }
 
-func connect(L *lua.State) int {
+func (m *module) connect(L *lua.State) int {
     var (
         addr     string
         username string
@@ -109,53 +183,69 @@ func connect(L *lua.State) int {
         }
     }
 
-    cli := redis.NewClient(opt)
+    cli := &client{Client: redis.NewClient(opt)}
     if cmd := cli.Ping(context.Background()); cmd.Err() != nil {
         _ = cli.Close()
         L.PushNil()
         L.PushString(cmd.Err().Error())
         return 2
     }
-    L.PushGoStruct(cli)
+    m.Add(cli)
+    PushHandle(L, m.clients, cli)
     L.PushNil()
     return 2
 }
 
-func get(L *lua.State) int {
-    L.CheckType(2, lua.LUA_TSTRING)
-    L.CheckType(3, lua.LUA_TFUNCTION)
+func (m *module) release(cli *client) {
+    m.Remove(cli)
+    _ = cli.Close()
+}
+
+// do runs cmd bounded by the timeout of cli on the clock of ctx, it returns
+// context.DeadlineExceeded once the timeout expired
+func (cli *client) do(ctx LuaContext, cmd func(c context.Context) error) error {
+    c, cancel := ClockTimeout(context.Background(), ClockOf(ctx), time.Duration(atomic.LoadInt64(&cli.timeout)))
+    defer cancel()
+    done := make(chan error, 1)
+    go func() {
+        done <- cmd(c)
+    }()
+    select {
+    case err := <-done:
+        return err
+    case <-c.Done():
+        return c.Err()
+    }
+}
 
-    ptr := L.ToGoStruct(1)
+func get(L *lua.State) int {
+    if L.Type(2) != lua.LUA_TSTRING {
+        return TypeError(L, 1, 2, "string")
+    }
+    if L.Type(3) != lua.LUA_TFUNCTION {
+        return TypeError(L, 2, 3, "function")
+    }
+    cli := L.ToGoStruct(1).(*client)
     key := L.ToString(2)
+    L.SetTop(3)
     ref := L.Ref(lua.LUA_REGISTRYINDEX)
     ctx := CheckLuaContext(L)
-    cli, ok := ptr.(*redis.Client)
-
-    if !ok {
-        L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
-
-        L.PushString("redis client pointer convert failed.")
-        if err := L.Call(1, 0); err != nil {
-            log.Println(err)
-        }
-        L.Unref(lua.LUA_REGISTRYINDEX, ref)
-        return 1
-    }
+    ModuleRequest(ctx, "redis")
     go func() {
-
-        cmd := cli.Get(context.Background(), key)
-        if cmd.Err() != nil { // 发生错误
-            ctx.Run(func() {
+        var cmd *redis.StringCmd
+        if err := cli.do(ctx, func(c context.Context) error {
+            cmd = cli.Get(c, key)
+            return cmd.Err()
+        }); err != nil { // 发生错误
+            RunState(ctx, L, func() {
                 L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
 
-                L.PushString(cmd.Err().Error())
-                if err := L.Call(1, 0); err != nil {
-                    log.Println(err)
-                }
+                L.PushString(err.Error())
+                Call(ctx, 1, 0, "redis.get")
                 L.Unref(lua.LUA_REGISTRYINDEX, ref)
             })
         } else {
-            ctx.Run(func() {
+            RunState(ctx, L, func() {
                 data, err := cmd.Bytes()
                 L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
 
@@ -171,9 +261,7 @@ func get(L *lua.State) int {
                     }
                 }
 
-                if err := L.Call(2, 0); err != nil {
-                    log.Println(err)
-                }
+                Call(ctx, 2, 0, "redis.get")
                 L.Unref(lua.LUA_REGISTRYINDEX, ref)
             })
         }
@@ -182,53 +270,48 @@ func get(L *lua.State) int {
 }
 
 func set(L *lua.State) int {
-    L.CheckType(2, lua.LUA_TSTRING)
-    L.CheckType(3, lua.LUA_TSTRING)
-    L.CheckType(4, lua.LUA_TFUNCTION)
-
-    ptr := L.ToGoStruct(1)
+    if L.Type(2) != lua.LUA_TSTRING {
+        return TypeError(L, 1, 2, "string")
+    }
+    if L.Type(3) != lua.LUA_TSTRING {
+        return TypeError(L, 2, 3, "string")
+    }
+    if L.Type(4) != lua.LUA_TFUNCTION {
+        return TypeError(L, 3, 4, "function")
+    }
+    cli := L.ToGoStruct(1).(*client)
     key := L.ToString(2)
     val := L.ToBytes(3)
+    L.SetTop(4)
     ref := L.Ref(lua.LUA_REGISTRYINDEX)
     ctx := CheckLuaContext(L)
-    cli, ok := ptr.(*redis.Client)
-    if !ok {
-        L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
-
-        L.PushString("redis client pointer convert failed.")
-        if err := L.Call(1, 0); err != nil {
-            log.Println(err)
-        }
-        L.Unref(lua.LUA_REGISTRYINDEX, ref)
-        return 1
-    }
 
     defer func() {
         if e := recover(); e != nil {
             log.Println(e)
         }
     }()
+    ModuleRequest(ctx, "redis")
     go func() {
-        cmd := cli.Set(context.Background(), key, val, 0)
-        if cmd.Err() != nil {
-            ctx.Run(func() {
+        var cmd *redis.StatusCmd
+        if err := cli.do(ctx, func(c context.Context) error {
+            cmd = cli.Set(c, key, val, 0)
+            return cmd.Err()
+        }); err != nil {
+            RunState(ctx, L, func() {
                 L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
-                L.PushString(cmd.Err().Error())
-                if err := L.Call(1, 0); err != nil {
-                    log.Println(err)
-                }
+                L.PushString(err.Error())
+                Call(ctx, 1, 0, "redis.set")
                 L.Unref(lua.LUA_REGISTRYINDEX, ref)
             })
             return
         }
 
-        ctx.Run(func() {
+        RunState(ctx, L, func() {
             L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
             L.PushNil()
             L.PushString(cmd.String())
-            if err := L.Call(2, 0); err != nil {
-                log.Println(err)
-            }
+            Call(ctx, 2, 0, "redis.set")
             L.Unref(lua.LUA_REGISTRYINDEX, ref)
         })
     }()
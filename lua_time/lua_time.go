@@ -1,36 +1,568 @@
 package lua_time
 
 import (
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "strconv"
+    "strings"
+    "sync"
     "time"
+    // zones resolve on hosts without a tz database
+    _ "time/tzdata"
 
     "github.com/DGHeroin/golua/lua"
+    . "github.com/DGHeroin/golualib"
 )
 
 var (
     startTime time.Time
 )
 
+const moduleName = "time"
+
 func init() {
     startTime = time.Now()
+    RegisterModule(moduleName, New)
 }
 
-func Register(L *lua.State) {
-    L.CreateTable(0, 1)
+var (
+    initCode = `
+local lib = GoWrap(...)
+
+-- Stopwatch measures on the monotonic clock, Elapsed and Reset return ns
+local function Stopwatch()
+    local self = {}
+    local start = lib.sinceStart()
+    function self.Elapsed()
+        return lib.sinceStart() - start
+    end
+    function self.Reset()
+        local now = lib.sinceStart()
+        local elapsed = now - start
+        start = now
+        return elapsed
+    end
+    return self
+end
+
+-- Times are Unix nanoseconds and durations nanoseconds or strings like
+-- '1h30m'. A zone is nil for the local one, 'UTC', an IANA name such as
+-- 'Asia/Shanghai' or an offset like '+08:00'. Functions taking a time use
+-- the current one for nil, failures return nil, err.
+return {
+    Now            = lib.now,
+    SinceStart     = lib.sinceStart,
+    Monotonic      = lib.sinceStart,
+    Stopwatch      = Stopwatch,
+    Unix           = lib.unix,
+    Format         = lib.format,
+    Parse          = lib.parse,
+    Date           = lib.date,
+    Time           = lib.time,
+    Add            = lib.add,
+    AddDate        = lib.addDate,
+    Sub            = lib.sub,
+    Truncate       = lib.truncate,
+    NextDaily      = lib.nextDaily,
+    Weekday        = lib.weekday,
+    ISOWeek        = lib.isoWeek,
+    Zone           = lib.zone,
+    ParseDuration  = lib.parseDuration,
+    FormatDuration = lib.formatDuration,
+}
+`
+)
+
+type module struct {
+    Resources
+    // start is the origin of sinceStart, the process start on the real clock
+    start time.Time
+}
+
+// New creates the module loaded by require("golualib.time")
+func New() Module {
+    return &module{}
+}
+
+func (m *module) Name() string {
+    return moduleName
+}
+
+func (m *module) Open(ctx LuaContext) error {
+    m.start = startTime
+    if clock := ClockOf(ctx); clock != RealClock {
+        m.start = clock.Now()
+    }
+    return LoadModule(ctx.LuaState(), m.Name(), initCode, map[string]lua.LuaGoFunction{
+        "now":            timeNow,
+        "sinceStart":     m.sinceStart,
+        "unix":           timeUnix,
+        "format":         timeFormat,
+        "parse":          timeParse,
+        "date":           timeDate,
+        "time":           timeTime,
+        "add":            timeAdd,
+        "addDate":        timeAddDate,
+        "sub":            timeSub,
+        "truncate":       timeTruncate,
+        "nextDaily":      timeNextDaily,
+        "weekday":        timeWeekday,
+        "isoWeek":        timeISOWeek,
+        "zone":           timeZone,
+        "parseDuration":  timeParseDuration,
+        "formatDuration": timeFormatDuration,
+    })
+}
 
-    L.PushGoFunction(timeNow)
-    L.SetGlobal("TimeNow")
+// Register opens the module and sets the globals TimeNow and TimeSinceStart
+func Register(L *lua.State) {
+    if err := OpenGlobals(L, New(), map[string]string{
+        "TimeNow":        "Now",
+        "TimeSinceStart": "SinceStart",
+    }); err != nil {
+        log.Println(err)
+    }
+}
 
-    L.PushGoFunction(timeSinceStart)
-    L.SetGlobal("TimeSinceStart")
+// now reads the clock of the context of L
+func now(L *lua.State) time.Time {
+    return ClockOf(CheckLuaContext(L)).Now()
 }
+
 func timeNow(L *lua.State) int {
-    now := time.Now()
-    L.PushInteger(now.UnixNano())
+    L.PushInteger(now(L).UnixNano())
     return 1
 }
 
-func timeSinceStart(L *lua.State) int {
-    dur := time.Now().Sub(startTime)
+func (m *module) sinceStart(L *lua.State) int {
+    dur := now(L).Sub(m.start)
     L.PushInteger(dur.Nanoseconds())
     return 1
 }
+
+func pushError(L *lua.State, err error) int {
+    L.PushNil()
+    L.PushString(err.Error())
+    return 2
+}
+
+func argError(L *lua.State, n int, expected string) error {
+    return fmt.Errorf("time: bad argument #%d (%s expected, got %s)", n, expected, L.LTypename(n))
+}
+
+// toTime reads a time in Unix nanoseconds, nil is now
+func toTime(L *lua.State, idx int) (time.Time, error) {
+    switch L.Type(idx) {
+    case lua.LUA_TNONE, lua.LUA_TNIL:
+        return now(L), nil
+    case lua.LUA_TNUMBER:
+        return time.Unix(0, int64(L.ToInteger(idx))), nil
+    }
+    return time.Time{}, argError(L, idx, "time")
+}
+
+// toDuration reads nanoseconds or a duration string
+func toDuration(L *lua.State, idx int) (time.Duration, error) {
+    switch L.Type(idx) {
+    case lua.LUA_TNUMBER:
+        return time.Duration(L.ToInteger(idx)), nil
+    case lua.LUA_TSTRING:
+        return time.ParseDuration(L.ToString(idx))
+    }
+    return 0, argError(L, idx, "duration")
+}
+
+var zones sync.Map
+
+// LoadZone resolves a zone name: "" or "Local", "UTC", a tz database name or
+// a fixed offset like "+08:00", "-0530" or "+8"
+func LoadZone(name string) (*time.Location, error) {
+    switch name {
+    case "", "Local":
+        return time.Local, nil
+    case "UTC", "Z":
+        return time.UTC, nil
+    }
+    if v, ok := zones.Load(name); ok {
+        return v.(*time.Location), nil
+    }
+    var (
+        loc *time.Location
+        err error
+    )
+    if name[0] == '+' || name[0] == '-' {
+        loc, err = fixedZone(name)
+    } else {
+        loc, err = time.LoadLocation(name)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("time: unknown zone %q", name)
+    }
+    zones.Store(name, loc)
+    return loc, nil
+}
+
+func fixedZone(name string) (*time.Location, error) {
+    s := strings.Replace(name[1:], ":", "", 1)
+    var h, m int
+    var err error
+    switch len(s) {
+    case 1, 2:
+        h, err = strconv.Atoi(s)
+    case 4:
+        if h, err = strconv.Atoi(s[:2]); err == nil {
+            m, err = strconv.Atoi(s[2:])
+        }
+    default:
+        err = errors.New("bad offset")
+    }
+    if err != nil || h > 14 || m > 59 {
+        return nil, errors.New("bad offset")
+    }
+    offset := h*3600 + m*60
+    if name[0] == '-' {
+        offset = -offset
+    }
+    return time.FixedZone(name, offset), nil
+}
+
+func toZone(L *lua.State, idx int) (*time.Location, error) {
+    switch L.Type(idx) {
+    case lua.LUA_TNONE, lua.LUA_TNIL:
+        return time.Local, nil
+    case lua.LUA_TSTRING:
+        return LoadZone(L.ToString(idx))
+    }
+    return nil, argError(L, idx, "zone")
+}
+
+// toTimeIn reads a time at idx and a zone at zone
+func toTimeIn(L *lua.State, idx, zone int) (time.Time, error) {
+    t, err := toTime(L, idx)
+    if err != nil {
+        return t, err
+    }
+    loc, err := toZone(L, zone)
+    if err != nil {
+        return t, err
+    }
+    return t.In(loc), nil
+}
+
+func timeUnix(L *lua.State) int {
+    if L.Type(1) != lua.LUA_TNUMBER {
+        return pushError(L, argError(L, 1, "number"))
+    }
+    nsec := int64(0)
+    if L.Type(2) == lua.LUA_TNUMBER {
+        nsec = int64(L.ToInteger(2))
+    }
+    // seconds may have a fraction
+    sec, _ := ToAny(L, 1)
+    switch sec := sec.(type) {
+    case int64:
+        L.PushInteger(time.Unix(sec, nsec).UnixNano())
+    case float64:
+        // apart so the nanoseconds keep their precision
+        whole, frac := math.Modf(sec)
+        L.PushInteger(time.Unix(int64(whole), int64(math.Round(frac*1e9))+nsec).UnixNano())
+    }
+    return 1
+}
+
+// timeFormat formats with a Go layout, or strftime when it holds a %
+func timeFormat(L *lua.State) int {
+    t, err := toTimeIn(L, 1, 3)
+    if err != nil {
+        return pushError(L, err)
+    }
+    layout := time.RFC3339
+    switch L.Type(2) {
+    case lua.LUA_TNONE, lua.LUA_TNIL:
+    case lua.LUA_TSTRING:
+        layout = L.ToString(2)
+    default:
+        return pushError(L, argError(L, 2, "string"))
+    }
+    if !strings.Contains(layout, "%") {
+        L.PushString(t.Format(layout))
+        return 1
+    }
+    s, err := strftime(t, layout)
+    if err != nil {
+        return pushError(L, err)
+    }
+    L.PushString(s)
+    return 1
+}
+
+func timeParse(L *lua.State) int {
+    if L.Type(1) != lua.LUA_TSTRING {
+        return pushError(L, argError(L, 1, "string"))
+    }
+    if L.Type(2) != lua.LUA_TSTRING {
+        return pushError(L, argError(L, 2, "string"))
+    }
+    loc, err := toZone(L, 3)
+    if err != nil {
+        return pushError(L, err)
+    }
+    layout := L.ToString(1)
+    if strings.Contains(layout, "%") {
+        if layout, err = strptimeLayout(layout); err != nil {
+            return pushError(L, err)
+        }
+    }
+    t, err := time.ParseInLocation(layout, L.ToString(2), loc)
+    if err != nil {
+        return pushError(L, fmt.Errorf("time: %v", err))
+    }
+    L.PushInteger(t.UnixNano())
+    return 1
+}
+
+// timeDate returns the fields of a time like os.date('*t'), wday counts from
+// Sunday = 1, plus nsec, isoyear, isoweek, zone and offset in seconds
+func timeDate(L *lua.State) int {
+    t, err := toTimeIn(L, 1, 2)
+    if err != nil {
+        return pushError(L, err)
+    }
+    isoYear, isoWeek := t.ISOWeek()
+    zone, offset := t.Zone()
+    L.CreateTable(0, 14)
+    for _, f := range []struct {
+        name  string
+        value int
+    }{
+        {"year", t.Year()}, {"month", int(t.Month())}, {"day", t.Day()},
+        {"hour", t.Hour()}, {"min", t.Minute()}, {"sec", t.Second()}, {"nsec", t.Nanosecond()},
+        {"wday", int(t.Weekday()) + 1}, {"yday", t.YearDay()},
+        {"isoyear", isoYear}, {"isoweek", isoWeek}, {"offset", offset},
+    } {
+        L.PushInteger(int64(f.value))
+        L.SetField(-2, f.name)
+    }
+    L.PushString(zone)
+    L.SetField(-2, "zone")
+    return 1
+}
+
+// timeTime is the inverse of timeDate, fields out of range normalize like
+// in os.time and missing ones default to the start of their period
+func timeTime(L *lua.State) int {
+    if L.Type(1) != lua.LUA_TTABLE {
+        return pushError(L, argError(L, 1, "table"))
+    }
+    loc, err := toZone(L, 2)
+    if err != nil {
+        return pushError(L, err)
+    }
+    field := func(name string, def int) (int, error) {
+        L.GetField(1, name)
+        defer L.Pop(1)
+        switch L.Type(-1) {
+        case lua.LUA_TNIL:
+            return def, nil
+        case lua.LUA_TNUMBER:
+            return L.ToInteger(-1), nil
+        }
+        return 0, fmt.Errorf("time: field '%s' is not a number", name)
+    }
+    var v [7]int
+    for i, f := range []struct {
+        name string
+        def  int
+    }{{"year", 1970}, {"month", 1}, {"day", 1}, {"hour", 0}, {"min", 0}, {"sec", 0}, {"nsec", 0}} {
+        if v[i], err = field(f.name, f.def); err != nil {
+            return pushError(L, err)
+        }
+    }
+    t := time.Date(v[0], time.Month(v[1]), v[2], v[3], v[4], v[5], v[6], loc)
+    L.PushInteger(t.UnixNano())
+    return 1
+}
+
+func timeAdd(L *lua.State) int {
+    t, err := toTime(L, 1)
+    if err != nil {
+        return pushError(L, err)
+    }
+    d, err := toDuration(L, 2)
+    if err != nil {
+        return pushError(L, err)
+    }
+    L.PushInteger(t.Add(d).UnixNano())
+    return 1
+}
+
+// timeAddDate adds years, months and days on the calendar of the zone
+func timeAddDate(L *lua.State) int {
+    t, err := toTimeIn(L, 1, 5)
+    if err != nil {
+        return pushError(L, err)
+    }
+    var n [3]int
+    for i := range n {
+        switch L.Type(i + 2) {
+        case lua.LUA_TNONE, lua.LUA_TNIL:
+        case lua.LUA_TNUMBER:
+            n[i] = L.ToInteger(i + 2)
+        default:
+            return pushError(L, argError(L, i+2, "number"))
+        }
+    }
+    L.PushInteger(t.AddDate(n[0], n[1], n[2]).UnixNano())
+    return 1
+}
+
+func timeSub(L *lua.State) int {
+    a, err := toTime(L, 1)
+    if err != nil {
+        return pushError(L, err)
+    }
+    b, err := toTime(L, 2)
+    if err != nil {
+        return pushError(L, err)
+    }
+    L.PushInteger(int64(a.Sub(b)))
+    return 1
+}
+
+// truncate returns the start of the unit holding t in its zone: year, month,
+// week (from Monday), day, hour or minute, or a multiple of a duration
+// counted on the wall clock of the zone
+func truncate(t time.Time, unit string) (time.Time, error) {
+    y, m, d := t.Date()
+    switch unit {
+    case "year":
+        return time.Date(y, 1, 1, 0, 0, 0, 0, t.Location()), nil
+    case "month":
+        return time.Date(y, m, 1, 0, 0, 0, 0, t.Location()), nil
+    case "week":
+        back := (int(t.Weekday()) + 6) % 7
+        return time.Date(y, m, d-back, 0, 0, 0, 0, t.Location()), nil
+    case "day":
+        return time.Date(y, m, d, 0, 0, 0, 0, t.Location()), nil
+    case "hour":
+        return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location()), nil
+    case "minute":
+        return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, t.Location()), nil
+    }
+    dur, err := time.ParseDuration(unit)
+    if err != nil {
+        return t, fmt.Errorf("time: bad unit %q", unit)
+    }
+    // Truncate counts in UTC, the wall clock is truncated as if it was UTC
+    wall := time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC).Truncate(dur)
+    return time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), t.Location()), nil
+}
+
+func timeTruncate(L *lua.State) int {
+    t, err := toTimeIn(L, 1, 3)
+    if err != nil {
+        return pushError(L, err)
+    }
+    var unit string
+    switch L.Type(2) {
+    case lua.LUA_TSTRING:
+        unit = L.ToString(2)
+    case lua.LUA_TNUMBER:
+        unit = time.Duration(L.ToInteger(2)).String()
+    default:
+        return pushError(L, argError(L, 2, "unit"))
+    }
+    t, err = truncate(t, unit)
+    if err != nil {
+        return pushError(L, err)
+    }
+    L.PushInteger(t.UnixNano())
+    return 1
+}
+
+// timeNextDaily returns the first time after t at the clock time "15:04" or
+// "15:04:05" in the zone, e.g. the next daily reset
+func timeNextDaily(L *lua.State) int {
+    t, err := toTimeIn(L, 1, 3)
+    if err != nil {
+        return pushError(L, err)
+    }
+    if L.Type(2) != lua.LUA_TSTRING {
+        return pushError(L, argError(L, 2, "string"))
+    }
+    clock := L.ToString(2)
+    at, err := time.Parse("15:04:05", clock)
+    if err != nil {
+        if at, err = time.Parse("15:04", clock); err != nil {
+            return pushError(L, fmt.Errorf("time: bad clock time %q", clock))
+        }
+    }
+    y, m, d := t.Date()
+    next := time.Date(y, m, d, at.Hour(), at.Minute(), at.Second(), 0, t.Location())
+    for !next.After(t) {
+        d++
+        next = time.Date(y, m, d, at.Hour(), at.Minute(), at.Second(), 0, t.Location())
+    }
+    L.PushInteger(next.UnixNano())
+    return 1
+}
+
+// timeWeekday returns the day of the week from Sunday = 0 and its name
+func timeWeekday(L *lua.State) int {
+    t, err := toTimeIn(L, 1, 2)
+    if err != nil {
+        return pushError(L, err)
+    }
+    L.PushInteger(int64(t.Weekday()))
+    L.PushString(t.Weekday().String())
+    return 2
+}
+
+func timeISOWeek(L *lua.State) int {
+    t, err := toTimeIn(L, 1, 2)
+    if err != nil {
+        return pushError(L, err)
+    }
+    year, week := t.ISOWeek()
+    L.PushInteger(int64(year))
+    L.PushInteger(int64(week))
+    return 2
+}
+
+// timeZone returns the abbreviation and offset in seconds of a zone at t
+func timeZone(L *lua.State) int {
+    loc, err := toZone(L, 1)
+    if err != nil {
+        return pushError(L, err)
+    }
+    t, err := toTime(L, 2)
+    if err != nil {
+        return pushError(L, err)
+    }
+    name, offset := t.In(loc).Zone()
+    L.PushString(name)
+    L.PushInteger(int64(offset))
+    return 2
+}
+
+func timeParseDuration(L *lua.State) int {
+    if L.Type(1) != lua.LUA_TSTRING {
+        return pushError(L, argError(L, 1, "string"))
+    }
+    d, err := toDuration(L, 1)
+    if err != nil {
+        return pushError(L, err)
+    }
+    L.PushInteger(int64(d))
+    return 1
+}
+
+func timeFormatDuration(L *lua.State) int {
+    if L.Type(1) != lua.LUA_TNUMBER {
+        return pushError(L, argError(L, 1, "number"))
+    }
+    L.PushString(time.Duration(L.ToInteger(1)).String())
+    return 1
+}
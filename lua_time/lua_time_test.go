@@ -0,0 +1,195 @@
+package lua_time
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    . "github.com/DGHeroin/golualib"
+)
+
+type evalTest struct {
+    code, want string
+}
+
+// evalTests runs setup on a context whose clock reads now, then compares
+// tostring of each expression to its want
+func evalTests(t *testing.T, now time.Time, setup string, tests []evalTest) {
+    t.Helper()
+    ctx := NewDefaultContext(nil, WithClock(NewVirtualClock(now)))
+    ctx.Start()
+    defer ctx.Close(context.Background())
+    eval := func(code string) (string, error) {
+        done := make(chan struct{})
+        var (
+            got string
+            err error
+        )
+        ctx.Run(func() {
+            defer close(done)
+            L := ctx.LuaState()
+            if err = L.DoString(code); err != nil {
+                return
+            }
+            L.GetGlobal("_result")
+            got = L.ToString(-1)
+            L.Pop(1)
+        })
+        <-done
+        return got, err
+    }
+    if _, err := eval(`
+T = require('golualib.time')
+function list(...)
+    local t = table.pack(...)
+    for i = 1, t.n do
+        t[i] = tostring(t[i])
+    end
+    return table.concat(t, ',')
+end
+-- 2024-03-10 13:45:30 UTC, a Sunday and the day New York moves to EDT
+base = T.Time({ year = 2024, month = 3, day = 10, hour = 13, min = 45, sec = 30 }, 'UTC')
+function at(v, zone)
+    return T.Format(v, nil, zone)
+end
+` + setup); err != nil {
+        t.Fatal(err)
+    }
+    for _, test := range tests {
+        got, err := eval("_result = tostring(" + test.code + ")")
+        if err != nil {
+            t.Fatalf("%s: %v", test.code, err)
+        }
+        if got != test.want {
+            t.Errorf("%s = %q, want %q", test.code, got, test.want)
+        }
+    }
+}
+
+var base = time.Date(2024, 3, 10, 13, 45, 30, 0, time.UTC)
+
+func TestZones(t *testing.T) {
+    evalTests(t, base, "", []evalTest{
+        {"base", "1710078330000000000"},
+        {"T.Now() == base", "true"},
+        {"at(base, 'UTC')", "2024-03-10T13:45:30Z"},
+        {"at(base, 'Z')", "2024-03-10T13:45:30Z"},
+        {"at(base, 'Asia/Shanghai')", "2024-03-10T21:45:30+08:00"},
+        // fixed offsets
+        {"at(base, '+05:30')", "2024-03-10T19:15:30+05:30"},
+        {"at(base, '-0530')", "2024-03-10T08:15:30-05:30"},
+        {"at(base, '+8')", "2024-03-10T21:45:30+08:00"},
+        {"at(base, '-03')", "2024-03-10T10:45:30-03:00"},
+        {"list(T.Zone('+08:00', base))", "+08:00,28800"},
+        {"list(T.Zone('UTC', base))", "UTC,0"},
+        // zones follow daylight saving
+        {"list(T.Zone('America/New_York', base))", "EDT,-14400"},
+        {"list(T.Zone('America/New_York', T.AddDate(base, 0, 0, -1)))", "EST,-18000"},
+        {"list(T.Zone('+15'))", `nil,time: unknown zone "+15"`},
+        {"list(T.Zone('+08:60'))", `nil,time: unknown zone "+08:60"`},
+        {"list(T.Zone('+123'))", `nil,time: unknown zone "+123"`},
+        {"list(T.Zone('Nowhere/City'))", `nil,time: unknown zone "Nowhere/City"`},
+        {"list(T.Zone(8))", "nil,time: bad argument #1 (zone expected, got number)"},
+        // Date and Time
+        {"T.Date(base, 'Asia/Tokyo').hour", "22"},
+        {"list(T.Date(base, 'Asia/Tokyo').zone, T.Date(base, 'Asia/Tokyo').offset)", "JST,32400"},
+        {"list(T.Date(base).wday, T.Date(base, 'UTC').yday, T.Date(base, 'UTC').isoweek, T.Date(base, 'UTC').isoyear)", "1,70,10,2024"},
+        {"T.Time({ year = 2024, month = 3, day = 10, hour = 21, min = 45, sec = 30 }, 'Asia/Shanghai') == base", "true"},
+        {"T.Time(T.Date(base, '-07:00'), '-07:00') == base", "true"},
+        {"at(T.Time({ year = 2024, month = 2, day = 30 }, 'UTC'), 'UTC')", "2024-03-01T00:00:00Z"},
+        {"list(T.Time({ year = 'x' }))", "nil,time: field 'year' is not a number"},
+    })
+}
+
+func TestStrftime(t *testing.T) {
+    evalTests(t, base, "", []evalTest{
+        {"T.Format(base, '%Y-%m-%d %H:%M:%S', 'UTC')", "2024-03-10 13:45:30"},
+        {"T.Format(base, '%a %A %b %B %h', 'UTC')", "Sun Sunday Mar March Mar"},
+        {"T.Format(base, '%C %y %e %j %D %F', 'UTC')", "20 24 10 070 03/10/24 2024-03-10"},
+        {"T.Format(base, '%I|%l|%p|%k|%R|%T', 'UTC')", "01| 1|PM|13|13:45|13:45:30"},
+        {"T.Format(base, '%k|%l|%p', '-13:00')", " 0|12|AM"},
+        {"T.Format(base, '%u %w %V %G %g', 'UTC')", "7 0 10 2024 24"},
+        {"T.Format(base, '%s', 'Asia/Shanghai')", "1710078330"},
+        {"T.Format(base, '%z %Z', 'Asia/Kolkata')", "+0530 IST"},
+        {"T.Format(base, '%c', 'UTC')", "Sun Mar 10 13:45:30 2024"},
+        {"T.Format(base, '%x %X', 'UTC')", "03/10/24 13:45:30"},
+        {"T.Format(base, '100%%%n%t', 'UTC')", "100%\n\t"},
+        // strftime when the layout holds a %, Go layouts otherwise
+        {"T.Format(base, 'Jan 2 15:04', 'UTC')", "Mar 10 13:45"},
+        {"list(T.Format(base, '%Q'))", "nil,time: unknown directive %Q"},
+        {"list(T.Format(base, '%Y%'))", "nil,time: format ends with %"},
+        {"list(T.Format(base, 1))", "nil,time: bad argument #2 (string expected, got number)"},
+    })
+}
+
+func TestStrptime(t *testing.T) {
+    evalTests(t, base, "", []evalTest{
+        {"T.Parse('%Y-%m-%d %H:%M:%S', '2024-03-10 21:45:30', 'Asia/Shanghai') == base", "true"},
+        {"T.Parse('%F %T', '2024-03-10 13:45:30', 'UTC') == base", "true"},
+        {"T.Parse('%d/%b/%Y:%H:%M:%S %z', '10/Mar/2024:21:45:30 +0800') == base", "true"},
+        {"T.Parse('%A, %e %B %y %I:%M:%S %p', 'Sunday, 10 March 24 01:45:30 PM', 'UTC') == base", "true"},
+        {"T.Parse('%Y%%', '2024%', 'UTC') == T.Time({ year = 2024 }, 'UTC')", "true"},
+        {"T.Parse('2006-01-02T15:04:05Z07:00', '2024-03-10T19:15:30+05:30') == base", "true"},
+        // a strftime round trip
+        {"T.Parse('%F %R %z', T.Format(base, '%F %R %z', '-05:30')) == base - 30 * 10^9", "true"},
+        {"list(T.Parse('%j', '070'))", "nil,time: directive %j is not supported by Parse"},
+        {"list(T.Parse('%Q', 'x'))", "nil,time: directive %Q is not supported by Parse"},
+        {"list(T.Parse('%Y at 1', '2024 at 1'))", `nil,time: literal " at 1" cannot be parsed with a strftime format, use a Go layout`},
+        {"T.Parse('%Y-', '2024-', 'UTC') == T.Time({ year = 2024 }, 'UTC')", "true"},
+        {"select(2, T.Parse('%Y', 'x')):match('^time: parsing time \"x\"') ~= nil", "true"},
+        {"list(T.Parse('%Y', '2024', 'Nowhere'))", `nil,time: unknown zone "Nowhere"`},
+    })
+}
+
+func TestTruncate(t *testing.T) {
+    evalTests(t, base, "", []evalTest{
+        // durations count on the wall clock of the zone, not in UTC
+        {"at(T.Truncate(base, '1h', '+05:30'), '+05:30')", "2024-03-10T19:00:00+05:30"},
+        {"at(T.Truncate(base, 3600 * 10^9 // 1, '+05:30'), '+05:30')", "2024-03-10T19:00:00+05:30"},
+        {"at(T.Truncate(base, '4h', 'Asia/Shanghai'), 'Asia/Shanghai')", "2024-03-10T20:00:00+08:00"},
+        {"at(T.Truncate(base, '24h', 'Asia/Shanghai'), 'Asia/Shanghai')", "2024-03-10T00:00:00+08:00"},
+        {"at(T.Truncate(base, '15m', '+05:45'), '+05:45')", "2024-03-10T19:30:00+05:45"},
+        {"at(T.Truncate(base, '1h', 'UTC'), 'UTC')", "2024-03-10T13:00:00Z"},
+        // calendar units
+        {"at(T.Truncate(base, 'minute', 'UTC'), 'UTC')", "2024-03-10T13:45:00Z"},
+        {"at(T.Truncate(base, 'hour', '+05:30'), '+05:30')", "2024-03-10T19:00:00+05:30"},
+        {"at(T.Truncate(base, 'day', 'Asia/Shanghai'), 'Asia/Shanghai')", "2024-03-10T00:00:00+08:00"},
+        {"at(T.Truncate(base, 'day', 'America/New_York'), 'America/New_York')", "2024-03-10T00:00:00-05:00"},
+        {"at(T.Truncate(base, 'week', 'UTC'), 'UTC')", "2024-03-04T00:00:00Z"},
+        {"at(T.Truncate(base, 'month', 'UTC'), 'UTC')", "2024-03-01T00:00:00Z"},
+        {"at(T.Truncate(base, 'year', '-10:00'), '-10:00')", "2024-01-01T00:00:00-10:00"},
+        {"list(T.Truncate(base, 'fortnight'))", `nil,time: bad unit "fortnight"`},
+        {"list(T.Truncate(base, true))", "nil,time: bad argument #2 (unit expected, got boolean)"},
+    })
+}
+
+func TestNextDaily(t *testing.T) {
+    evalTests(t, base, "", []evalTest{
+        {"at(T.NextDaily(base, '05:00', 'Asia/Shanghai'), 'Asia/Shanghai')", "2024-03-11T05:00:00+08:00"},
+        {"at(T.NextDaily(base, '22:00', 'Asia/Shanghai'), 'Asia/Shanghai')", "2024-03-10T22:00:00+08:00"},
+        // a time equal to t is the next day's
+        {"at(T.NextDaily(base, '21:45:30', 'Asia/Shanghai'), 'Asia/Shanghai')", "2024-03-11T21:45:30+08:00"},
+        {"at(T.NextDaily(base, '21:45:31', 'Asia/Shanghai'), 'Asia/Shanghai')", "2024-03-10T21:45:31+08:00"},
+        {"at(T.NextDaily(nil, '00:00', 'UTC'), 'UTC')", "2024-03-11T00:00:00Z"},
+        // the clock time follows daylight saving
+        {"at(T.NextDaily(base - 86400 * 10^9, '06:00', 'America/New_York'), 'America/New_York')", "2024-03-10T06:00:00-04:00"},
+        {"list(T.NextDaily(base, '25:00'))", `nil,time: bad clock time "25:00"`},
+        {"list(T.NextDaily(base, 5))", "nil,time: bad argument #2 (string expected, got number)"},
+    })
+}
+
+func TestUnix(t *testing.T) {
+    evalTests(t, base, "", []evalTest{
+        {"T.Unix(1710078330) == base", "true"},
+        {"T.Unix(1, 5)", "1000000005"},
+        {"T.Unix(1.5)", "1500000000"},
+        {"T.Unix(-1.5)", "-1500000000"},
+        {"T.Unix(0.1)", "100000000"},
+        {"T.Unix(1.5, 1)", "1500000001"},
+        {"math.type(T.Unix(1.5))", "integer"},
+        // fractions keep their nanoseconds past the precision of sec * 1e9
+        {"T.Unix(2^32 + 0.5)", "4294967296500000000"},
+        {"T.Unix(1710078330.25) - base", "250000000"},
+        {"list(T.Unix('1'))", "nil,time: bad argument #1 (number expected, got string)"},
+    })
+}
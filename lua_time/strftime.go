@@ -0,0 +1,177 @@
+package lua_time
+
+import (
+    "bytes"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// strftime formats t like C strftime, for the directives of POSIX
+func strftime(t time.Time, format string) (string, error) {
+    var buf bytes.Buffer
+    pad := func(v, width int) {
+        s := strconv.Itoa(v)
+        for i := len(s); i < width; i++ {
+            buf.WriteByte('0')
+        }
+        buf.WriteString(s)
+    }
+    space := func(v int) {
+        if v < 10 {
+            buf.WriteByte(' ')
+        }
+        buf.WriteString(strconv.Itoa(v))
+    }
+    hour12 := func() int {
+        h := t.Hour() % 12
+        if h == 0 {
+            h = 12
+        }
+        return h
+    }
+    for i := 0; i < len(format); i++ {
+        c := format[i]
+        if c != '%' {
+            buf.WriteByte(c)
+            continue
+        }
+        i++
+        if i == len(format) {
+            return "", fmt.Errorf("time: format ends with %%")
+        }
+        switch format[i] {
+        case 'a':
+            buf.WriteString(t.Weekday().String()[:3])
+        case 'A':
+            buf.WriteString(t.Weekday().String())
+        case 'b', 'h':
+            buf.WriteString(t.Month().String()[:3])
+        case 'B':
+            buf.WriteString(t.Month().String())
+        case 'c':
+            buf.WriteString(t.Format("Mon Jan _2 15:04:05 2006"))
+        case 'C':
+            pad(t.Year()/100, 2)
+        case 'd':
+            pad(t.Day(), 2)
+        case 'D':
+            buf.WriteString(t.Format("01/02/06"))
+        case 'e':
+            space(t.Day())
+        case 'F':
+            buf.WriteString(t.Format("2006-01-02"))
+        case 'G':
+            year, _ := t.ISOWeek()
+            pad(year, 4)
+        case 'g':
+            year, _ := t.ISOWeek()
+            pad(year%100, 2)
+        case 'H':
+            pad(t.Hour(), 2)
+        case 'I':
+            pad(hour12(), 2)
+        case 'j':
+            pad(t.YearDay(), 3)
+        case 'k':
+            space(t.Hour())
+        case 'l':
+            space(hour12())
+        case 'm':
+            pad(int(t.Month()), 2)
+        case 'M':
+            pad(t.Minute(), 2)
+        case 'n':
+            buf.WriteByte('\n')
+        case 'p':
+            buf.WriteString(t.Format("PM"))
+        case 'R':
+            buf.WriteString(t.Format("15:04"))
+        case 's':
+            buf.WriteString(strconv.FormatInt(t.Unix(), 10))
+        case 'S':
+            pad(t.Second(), 2)
+        case 't':
+            buf.WriteByte('\t')
+        case 'T':
+            buf.WriteString(t.Format("15:04:05"))
+        case 'u':
+            buf.WriteString(strconv.Itoa((int(t.Weekday())+6)%7 + 1))
+        case 'V':
+            _, week := t.ISOWeek()
+            pad(week, 2)
+        case 'w':
+            buf.WriteString(strconv.Itoa(int(t.Weekday())))
+        case 'x':
+            buf.WriteString(t.Format("01/02/06"))
+        case 'X':
+            buf.WriteString(t.Format("15:04:05"))
+        case 'y':
+            pad(t.Year()%100, 2)
+        case 'Y':
+            pad(t.Year(), 4)
+        case 'z':
+            buf.WriteString(t.Format("-0700"))
+        case 'Z':
+            buf.WriteString(t.Format("MST"))
+        case '%':
+            buf.WriteByte('%')
+        default:
+            return "", fmt.Errorf("time: unknown directive %%%c", format[i])
+        }
+    }
+    return buf.String(), nil
+}
+
+// strptimeLayouts are the Go layouts of the directives Parse accepts, %j
+// is missing as Go reads the day of the year from 1.20 on only
+var strptimeLayouts = map[byte]string{
+    'a': "Mon", 'A': "Monday", 'b': "Jan", 'h': "Jan", 'B': "January",
+    'd': "02", 'e': "_2", 'F': "2006-01-02", 'H': "15", 'I': "03",
+    'm': "01", 'M': "04", 'p': "PM", 'R': "15:04", 'S': "05",
+    'T': "15:04:05", 'y': "06", 'Y': "2006", 'z': "-0700", 'Z': "MST",
+}
+
+// goLayoutTokens start the elements of Go layouts, literal text holding
+// them would be read as such
+var goLayoutTokens = []string{"0", "1", "2", "3", "4", "5", "6", "7", "_", "Jan", "Mon", "MST", "PM", "pm", "-07", "Z07"}
+
+// strptimeLayout turns a strftime format into a Go layout for parsing
+func strptimeLayout(format string) (string, error) {
+    var buf strings.Builder
+    literal := func(s string) error {
+        for _, tok := range goLayoutTokens {
+            if strings.Contains(s, tok) {
+                return fmt.Errorf("time: literal %q cannot be parsed with a strftime format, use a Go layout", s)
+            }
+        }
+        buf.WriteString(s)
+        return nil
+    }
+    start := 0
+    for i := 0; i < len(format); i++ {
+        if format[i] != '%' {
+            continue
+        }
+        if err := literal(format[start:i]); err != nil {
+            return "", err
+        }
+        i++
+        if i == len(format) {
+            return "", fmt.Errorf("time: format ends with %%")
+        }
+        if format[i] == '%' {
+            buf.WriteByte('%')
+        } else if layout, ok := strptimeLayouts[format[i]]; ok {
+            buf.WriteString(layout)
+        } else {
+            return "", fmt.Errorf("time: directive %%%c is not supported by Parse", format[i])
+        }
+        start = i + 1
+    }
+    if err := literal(format[start:]); err != nil {
+        return "", err
+    }
+    return buf.String(), nil
+}
@@ -1,10 +1,12 @@
 package lua_websocket
 
 import (
+    "fmt"
     "log"
     "net/http"
     "sync"
     "sync/atomic"
+    "time"
 
     "github.com/DGHeroin/golua/lua"
     . "github.com/DGHeroin/golualib"
@@ -14,69 +16,144 @@ import (
 
 var (
     initCode = `
-local lib = lua_ws
-lua_http = nil
+local lib = GoWrap(...)
 
-function WSServer()
+local json
+
+-- server.json = true decodes the messages, onEvent gets the raw message and
+-- the error when it is not JSON, and Send encodes tables
+local function WSServer()
     local self = {}
     local handler
+    local timeout
 
     local function onEvent( evtType, id, client, msgType, msgData )
-        if self.onEvent then
-            self.onEvent(evtType, id, client, msgType, msgData)
+        if not self.onEvent then
+            return
+        end
+        local err
+        if self.json and msgData then
+            json = json or require('golualib.json')
+            local v
+            v, err = json.decode(msgData)
+            if not err then
+                msgData = v
+            end
         end
+        Spawn(self.onEvent, evtType, id, client, msgType, msgData, err)
     end
 
     function self.Init(addr)
         handler = lib.listen( addr, onEvent )
+        if timeout then handler:SetTimeout(timeout) end
+    end
+
+    -- SetTimeout closes the new clients idle for sec seconds and bounds
+    -- each write, 0 turns it off
+    function self.SetTimeout(sec)
+        if handler then
+            handler:SetTimeout(sec)
+        else
+            timeout = sec
+        end
     end
 
     function self.Close(client)
         if not handler then return end
-        lib.close( client )
+        client:Close()
     end
     
     function self.Send(client, t, d)
         if not handler then return end
-        lib.send(client, t, d)
+        if self.json and type(d) == 'table' then
+            json = json or require('golualib.json')
+            local err
+            d, err = json.encode(d)
+            if not d then
+                return nil, err
+            end
+        end
+        return client:Send(d or '', t)
     end
 
     return self
 end
 
+return {
+    Server = WSServer,
+}
 `
 )
 
-func Register(L *lua.State) {
-    L.CreateTable(0, 1)
+const moduleName = "websocket"
 
-    //  server
-    L.PushString("listen")
-    L.PushGoFunction(listenServer)
-    L.SetTable(-3)
+func init() {
+    RegisterModule(moduleName, New)
+}
+
+type module struct {
+    Resources
+}
 
-    L.PushString("close")
-    L.PushGoFunction(closeConn)
-    L.SetTable(-3)
+// New creates the module loaded by require("golualib.websocket")
+func New() Module {
+    return &module{}
+}
 
-    L.PushString("send")
-    L.PushGoFunction(sendConn)
-    L.SetTable(-3)
+func (m *module) Name() string {
+    return moduleName
+}
 
-    // everything done
-    L.SetGlobal("lua_ws")
+func (m *module) Open(ctx LuaContext) error {
+    return LoadModule(ctx.LuaState(), m.Name(), initCode, map[string]lua.LuaGoFunction{
+        "listen": listenServer,
+    })
+}
 
-    err := L.DoString(initCode)
-    if err != nil {
+// Register opens the module and sets the global WSServer
+func Register(L *lua.State) {
+    if err := OpenGlobals(L, New(), map[string]string{
+        "WSServer": "Server",
+    }); err != nil {
         log.Println(err)
     }
 }
 
 type wsHandler struct {
-    ctx LuaContext
-    L   *lua.State
-    ref int
-    id  uint32
+    targets Targets
+    id      uint32
+    srv     *http.Server
+    mutex   sync.Mutex
+    clients map[uint32]*wsClient
+    // timeout closes idle clients and aborts writes, 0 for none
+    timeout time.Duration
+}
+
+func (h *wsHandler) Close() error {
+    err := h.srv.Close()
+    h.mutex.Lock()
+    clients := make([]*wsClient, 0, len(h.clients))
+    for _, c := range h.clients {
+        clients = append(clients, c)
+    }
+    h.mutex.Unlock()
+    for _, c := range clients {
+        c.close()
+    }
+    return err
+}
+
+// list describes the clients routed to ctx
+func (h *wsHandler) list(ctx LuaContext) []string {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    var rs []string
+    for _, c := range h.clients {
+        if c.ctx == ctx {
+            rs = append(rs, fmt.Sprintf("websocket #%d %s", c.id, c.addr))
+        }
+    }
+    return rs
 }
 
 func listenServer(L *lua.State) int {
@@ -84,28 +161,41 @@ func listenServer(L *lua.State) int {
     ref := L.Ref(lua.LUA_REGISTRYINDEX)
 
     ctx := CheckLuaContext(L)
-    handler := &wsHandler{
-        ctx: ctx,
-        L:   L,
-        ref: ref,
+    v, created := Shared(ctx, "ws:"+addr, func() interface{} {
+        return &wsHandler{
+            clients: make(map[uint32]*wsClient),
+        }
+    })
+    handler := v.(*wsHandler)
+    // a reload listens again, the inspector stays from the first time
+    if handler.targets.Add(ctx, ref) {
+        ctx.AddCloser(AddInspector(ctx, "conns", func() []string {
+            return handler.list(ctx)
+        }))
+    }
+    if !created {
+        PushHandle(L, serverType, handler)
+        return 1
     }
+    gin.SetMode(gin.ReleaseMode)
+    r := gin.New()
+    r.GET("/ws", func(c *gin.Context) {
+        handlerFunc(handler, c)
+    })
+    r.GET("/pong", func(c *gin.Context) {
+        c.JSON(http.StatusOK, gin.H{"message": "pong"})
+    })
+    handler.srv = &http.Server{Addr: addr, Handler: r}
+    AddSharedCloser(ctx, handler)
 
     go func() {
-        defer func() {
-            L.Unref(lua.LUA_REGISTRYINDEX, ref)
-        }()
-        gin.SetMode(gin.ReleaseMode)
-        r := gin.New()
-        r.GET("/ws", func(c *gin.Context) {
-            handlerFunc(handler, c)
-        })
-        r.GET("/pong", func(c *gin.Context) {
-            c.JSON(http.StatusOK, gin.H{"message": "pong"})
-        })
-        r.Run(addr)
+        defer handler.targets.UnrefAll()
+        if err := handler.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+            log.Println(err)
+        }
     }()
 
-    L.PushGoStruct(handler)
+    PushHandle(L, serverType, handler)
     return 1
 }
 
@@ -113,17 +203,16 @@ type wsClient struct {
     close func()
     send  func(msgType int, payload []byte) error
     id    uint32
+    addr  string
+    ctx   LuaContext
 }
 
 func handlerFunc(h *wsHandler, c *gin.Context) {
     var (
-        L      = h.L
-        ref    = h.ref
         wg     sync.WaitGroup
         client = &wsClient{}
     )
 
-    ctx := CheckLuaContext(L)
     conn, err := (&websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
         return true
     }}).Upgrade(c.Writer, c.Request, nil)
@@ -132,39 +221,66 @@ func handlerFunc(h *wsHandler, c *gin.Context) {
         return
     }
     client.id = atomic.AddUint32(&h.id, 1)
+    t := h.targets.Pick(uint64(client.id))
+    ctx := t.Ctx
+    clock := ClockOf(ctx)
+    client.addr = c.Request.RemoteAddr
+    client.ctx = ctx
     client.close = func() {
         conn.Close()
     }
+    h.mutex.Lock()
+    h.clients[client.id] = client
+    timeout := h.timeout
+    h.mutex.Unlock()
     client.send = func(msgType int, payload []byte) error {
+        stop := AbortAfter(clock, timeout, conn.SetWriteDeadline)
+        defer stop()
         return conn.WriteMessage(msgType, payload)
     }
+    var idle ClockTimer
+    if timeout > 0 {
+        idle = clock.AfterFunc(timeout, func() {
+            conn.Close()
+        })
+        defer idle.Stop()
+    }
+    ModuleConnections(ctx, "websocket", 1)
 
     defer func() {
         conn.Close()
+        h.mutex.Lock()
+        delete(h.clients, client.id)
+        h.mutex.Unlock()
+        ModuleConnections(ctx, "websocket", -1)
         // 通知关闭
         ctx.Run(func() {
-            L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+            if !t.Push() {
+                return
+            }
+            L := t.LuaState()
             L.PushInteger(3)
             L.PushInteger(int64(client.id))
-            L.PushGoStruct(client)
-            if err := L.Call(3, 0); err != nil {
-                log.Println(err)
-            }
+            PushHandle(L, connType, client)
+            Call(ctx, 3, 0, "ws.close")
         })
     }()
     // 通知新连接
     var wgAccept sync.WaitGroup
     wgAccept.Add(1)
-    ctx.Run(func() {
-        L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+    if err := ctx.Run(func() {
+        defer wgAccept.Done()
+        if !t.Push() {
+            return
+        }
+        L := t.LuaState()
         L.PushInteger(1)
         L.PushInteger(int64(client.id))
-        L.PushGoStruct(client)
-        if err := L.Call(3, 0); err != nil {
-            log.Println(err)
-        }
-        wgAccept.Done()
-    })
+        PushHandle(L, connType, client)
+        Call(ctx, 3, 0, "ws.connect")
+    }); err != nil {
+        return
+    }
     wgAccept.Wait()
     // read
     wg.Add(1)
@@ -177,13 +293,21 @@ func handlerFunc(h *wsHandler, c *gin.Context) {
             if err != nil {
                 return
             }
+            if idle != nil {
+                idle.Reset(timeout)
+            }
+            ModuleRequest(ctx, "websocket")
             var wgLua sync.WaitGroup
             wgLua.Add(1)
             ctx.Run(func() {
-                L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+                defer wgLua.Done()
+                if !t.Push() {
+                    return
+                }
+                L := t.LuaState()
                 L.PushInteger(2)
                 L.PushInteger(int64(client.id))
-                L.PushGoStruct(client)
+                PushHandle(L, connType, client)
                 L.PushInteger(int64(msgType))
                 if data == nil || len(data) == 0 {
                     L.PushNil()
@@ -191,10 +315,7 @@ func handlerFunc(h *wsHandler, c *gin.Context) {
                     L.PushBytes(data)
                 }
 
-                if err := L.Call(5, 0); err != nil {
-                    log.Println(err)
-                }
-                wgLua.Done()
+                Call(ctx, 5, 0, "ws.data")
             })
 
         }
@@ -215,30 +336,69 @@ func handlerFunc(h *wsHandler, c *gin.Context) {
     wg.Wait()
 }
 
+var serverType = &HandleType{
+    Name: "websocket.Server",
+    Methods: map[string]lua.LuaGoFunction{
+        "SetTimeout": func(L *lua.State) int {
+            h := L.ToGoStruct(1).(*wsHandler)
+            if L.Type(2) != lua.LUA_TNUMBER {
+                return TypeError(L, 1, 2, "number")
+            }
+            h.mutex.Lock()
+            h.timeout = time.Duration(L.ToNumber(2) * float64(time.Second))
+            h.mutex.Unlock()
+            return 0
+        },
+        "Addr": func(L *lua.State) int {
+            L.PushString(L.ToGoStruct(1).(*wsHandler).srv.Addr)
+            return 1
+        },
+    },
+}
+
+var connType = &HandleType{
+    Name: "websocket.Conn",
+    Methods: map[string]lua.LuaGoFunction{
+        "Send":  sendConn,
+        "Close": closeConn,
+        "RemoteAddr": func(L *lua.State) int {
+            L.PushString(L.ToGoStruct(1).(*wsClient).addr)
+            return 1
+        },
+    },
+    Fields: map[string]lua.LuaGoFunction{
+        "id": func(L *lua.State) int {
+            L.PushInteger(int64(L.ToGoStruct(1).(*wsClient).id))
+            return 1
+        },
+    },
+}
+
 func closeConn(L *lua.State) int {
-    p := L.ToGoStruct(1)
-    if client, ok := p.(*wsClient); ok {
-        client.close()
-    } else {
-        log.Println("转换 client 对象失败")
-    }
+    L.ToGoStruct(1).(*wsClient).close()
     return 0
 }
 
+// sendConn writes data as a text message unless msgType says otherwise,
+// it returns true or nil and the error
 func sendConn(L *lua.State) int {
-    var (
-        msgType int
-        payload []byte
-    )
-    p := L.ToGoStruct(1)
-    msgType = L.CheckInteger(2)
-    if L.Type(3) == lua.LUA_TSTRING {
-        payload = L.ToBytes(3)
+    client := L.ToGoStruct(1).(*wsClient)
+    if L.Type(2) != lua.LUA_TSTRING {
+        return TypeError(L, 1, 2, "string")
     }
-    if client, ok := p.(*wsClient); ok {
-        client.send(msgType, payload)
-    } else {
-        log.Println("转换 client 对象失败")
+    msgType := websocket.TextMessage
+    switch L.Type(3) {
+    case lua.LUA_TNONE, lua.LUA_TNIL:
+    case lua.LUA_TNUMBER:
+        msgType = int(L.ToInteger(3))
+    default:
+        return TypeError(L, 2, 3, "number")
     }
-    return 0
+    if err := client.send(msgType, L.ToBytes(2)); err != nil {
+        L.PushNil()
+        L.PushString(err.Error())
+        return 2
+    }
+    L.PushBoolean(true)
+    return 1
 }
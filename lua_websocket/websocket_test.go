@@ -0,0 +1,105 @@
+package lua_websocket
+
+import (
+    "context"
+    "net"
+    "testing"
+    "time"
+
+    . "github.com/DGHeroin/golualib"
+    "github.com/gorilla/websocket"
+)
+
+// newServer starts a context serving on a free port with a server set up by
+// code and returns its address
+func newServer(t *testing.T, code string) string {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := ln.Addr().String()
+    ln.Close()
+
+    ctx := NewDefaultContext(nil)
+    ctx.Start()
+    t.Cleanup(func() {
+        ctx.Close(context.Background())
+    })
+    done := make(chan error, 1)
+    ctx.Run(func() {
+        L := ctx.LuaState()
+        L.PushString(addr)
+        L.SetGlobal("addr")
+        done <- L.DoString(`
+local websocket = require('golualib.websocket')
+server = websocket.Server()
+` + code + `
+server.Init(addr)
+`)
+    })
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+    return addr
+}
+
+// dial connects to the server, which listens in the background
+func dial(t *testing.T, addr string) *websocket.Conn {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+        if err == nil {
+            t.Cleanup(func() {
+                conn.Close()
+            })
+            return conn
+        }
+        if time.Now().After(deadline) {
+            t.Fatal(err)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestJSONMessages(t *testing.T) {
+    addr := newServer(t, `
+server.json = true
+function server.onEvent(evtType, id, client, msgType, msgData, err)
+    if evtType ~= 2 then
+        return
+    end
+    if err then
+        server.Send(client, 1, 'error: ' .. err .. ' in ' .. msgData)
+    elseif type(msgData) == 'table' then
+        server.Send(client, 1, { got = msgData })
+    else
+        server.Send(client, 1, { scalar = msgData })
+    end
+end
+`)
+    conn := dial(t, addr)
+    tests := []struct {
+        send, want string
+    }{
+        {`{"a":[1,2.5,null]}`, `{"got":{"a":[1,2.5,null]}}`},
+        {`[]`, `{"got":[]}`},
+        {`"x"`, `{"scalar":"x"}`},
+        {`{"a":`, `error: json: unexpected EOF in {"a":`},
+        {`1 2`, `error: json: invalid character after top-level value in 1 2`},
+    }
+    for _, test := range tests {
+        if err := conn.WriteMessage(websocket.TextMessage, []byte(test.send)); err != nil {
+            t.Fatal(err)
+        }
+        conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+        msgType, data, err := conn.ReadMessage()
+        if err != nil {
+            t.Fatalf("%s: %v", test.send, err)
+        }
+        if msgType != websocket.TextMessage || string(data) != test.want {
+            t.Errorf("%s: got %d %q, want %q", test.send, msgType, data, test.want)
+        }
+    }
+}
@@ -0,0 +1,295 @@
+package golualib
+
+import (
+    "errors"
+    "fmt"
+    "reflect"
+    "strings"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+var (
+    ErrCycle = errors.New("cannot convert a value referencing itself")
+
+    errorType = reflect.TypeOf((*error)(nil)).Elem()
+    bytesType = reflect.TypeOf([]byte(nil))
+)
+
+// PushAny pushes the Lua equivalent of a Go value: numbers, strings, []byte
+// and bools as such, slices and arrays as sequences, maps as tables and
+// structs as tables keyed by field name or `lua:"name"` tag. Functions of
+// type lua.LuaGoFunction are pushed as functions, errors as their message.
+func PushAny(L *lua.State, v interface{}) error {
+    top := L.GetTop()
+    if err := pushValue(L, reflect.ValueOf(v), make(map[uintptr]bool)); err != nil {
+        L.SetTop(top)
+        return err
+    }
+    return nil
+}
+
+func pushValue(L *lua.State, v reflect.Value, seen map[uintptr]bool) error {
+    if !v.IsValid() {
+        L.PushNil()
+        return nil
+    }
+    if v.Type() == bytesType {
+        L.PushString(string(v.Bytes()))
+        return nil
+    }
+    if v.Type().Implements(errorType) && v.Kind() != reflect.Struct {
+        if v.IsNil() {
+            L.PushNil()
+        } else {
+            L.PushString(v.Interface().(error).Error())
+        }
+        return nil
+    }
+    switch v.Kind() {
+    case reflect.Bool:
+        L.PushBoolean(v.Bool())
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        L.PushInteger(v.Int())
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        L.PushInteger(int64(v.Uint()))
+    case reflect.Float32, reflect.Float64:
+        L.PushNumber(v.Float())
+    case reflect.String:
+        L.PushString(v.String())
+    case reflect.Interface:
+        return pushValue(L, v.Elem(), seen)
+    case reflect.Ptr:
+        if v.IsNil() {
+            L.PushNil()
+            return nil
+        }
+        if seen[v.Pointer()] {
+            return ErrCycle
+        }
+        seen[v.Pointer()] = true
+        defer delete(seen, v.Pointer())
+        return pushValue(L, v.Elem(), seen)
+    case reflect.Slice, reflect.Array:
+        if v.Kind() == reflect.Slice {
+            if v.IsNil() {
+                L.PushNil()
+                return nil
+            }
+            if seen[v.Pointer()] && v.Len() > 0 {
+                return ErrCycle
+            }
+            seen[v.Pointer()] = true
+            defer delete(seen, v.Pointer())
+        }
+        L.CreateTable(v.Len(), 0)
+        for i := 0; i < v.Len(); i++ {
+            if err := pushValue(L, v.Index(i), seen); err != nil {
+                return err
+            }
+            L.RawSeti(-2, i+1)
+        }
+    case reflect.Map:
+        if v.IsNil() {
+            L.PushNil()
+            return nil
+        }
+        if seen[v.Pointer()] {
+            return ErrCycle
+        }
+        seen[v.Pointer()] = true
+        defer delete(seen, v.Pointer())
+        L.CreateTable(0, v.Len())
+        iter := v.MapRange()
+        for iter.Next() {
+            if err := pushValue(L, iter.Key(), seen); err != nil {
+                return err
+            }
+            if err := pushValue(L, iter.Value(), seen); err != nil {
+                return err
+            }
+            L.RawSet(-3)
+        }
+    case reflect.Struct:
+        L.CreateTable(0, v.NumField())
+        if err := pushFields(L, v, seen); err != nil {
+            return err
+        }
+    case reflect.Func:
+        if v.IsNil() {
+            L.PushNil()
+            return nil
+        }
+        if f, ok := v.Interface().(lua.LuaGoFunction); ok {
+            L.PushGoFunction(f)
+            return nil
+        }
+        if f, ok := v.Interface().(func(*lua.State) int); ok {
+            L.PushGoFunction(f)
+            return nil
+        }
+        return fmt.Errorf("cannot convert %s to Lua", v.Type())
+    default:
+        return fmt.Errorf("cannot convert %s to Lua", v.Type())
+    }
+    return nil
+}
+
+// pushFields sets the fields of struct v on the table at the top
+func pushFields(L *lua.State, v reflect.Value, seen map[uintptr]bool) error {
+    t := v.Type()
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        if f.PkgPath != "" && !f.Anonymous {
+            continue
+        }
+        name, ok := fieldName(f)
+        if !ok {
+            continue
+        }
+        fv := v.Field(i)
+        if f.Anonymous && name == "" {
+            if fv.Kind() == reflect.Ptr {
+                if fv.IsNil() {
+                    continue
+                }
+                fv = fv.Elem()
+            }
+            if fv.Kind() == reflect.Struct {
+                if err := pushFields(L, fv, seen); err != nil {
+                    return err
+                }
+            }
+            continue
+        }
+        if f.PkgPath != "" {
+            continue
+        }
+        if err := pushValue(L, fv, seen); err != nil {
+            return err
+        }
+        L.SetField(-2, name)
+    }
+    return nil
+}
+
+// fieldName reads the `lua:"name"` tag of f, an empty name for embedded
+// structs means their fields are inlined
+func fieldName(f reflect.StructField) (string, bool) {
+    tag := f.Tag.Get("lua")
+    if tag == "-" {
+        return "", false
+    }
+    if i := strings.IndexByte(tag, ','); i >= 0 {
+        tag = tag[:i]
+    }
+    if tag != "" {
+        return tag, true
+    }
+    if f.Anonymous {
+        return "", true
+    }
+    return f.Name, true
+}
+
+// ToAny converts the Lua value at idx into a Go value: nil, bool, int64
+// for integers, float64, string, []interface{} for sequences and
+// map[string]interface{} for other tables. Functions, threads and userdata
+// convert to nil.
+func ToAny(L *lua.State, idx int) (interface{}, error) {
+    if idx < 0 {
+        idx = L.GetTop() + idx + 1
+    }
+    return toValue(L, idx, make(map[uintptr]bool))
+}
+
+func toValue(L *lua.State, idx int, seen map[uintptr]bool) (interface{}, error) {
+    switch L.Type(idx) {
+    case lua.LUA_TBOOLEAN:
+        return L.ToBoolean(idx), nil
+    case lua.LUA_TNUMBER:
+        if isInteger(L, idx) {
+            return int64(L.ToInteger(idx)), nil
+        }
+        return L.ToNumber(idx), nil
+    case lua.LUA_TSTRING:
+        return L.ToString(idx), nil
+    case lua.LUA_TTABLE:
+        p := L.ToPointer(idx)
+        if seen[p] {
+            return nil, ErrCycle
+        }
+        seen[p] = true
+        defer delete(seen, p)
+        return toTable(L, idx, seen)
+    }
+    return nil, nil
+}
+
+func toTable(L *lua.State, idx int, seen map[uintptr]bool) (interface{}, error) {
+    var (
+        keys   []interface{}
+        values []interface{}
+        n      = 0
+        seq    = true
+    )
+    L.PushNil()
+    for L.Next(idx) != 0 {
+        var key interface{}
+        switch L.Type(-2) {
+        case lua.LUA_TNUMBER:
+            if isInteger(L, -2) {
+                key = int64(L.ToInteger(-2))
+            } else {
+                key = L.ToNumber(-2)
+                seq = false
+            }
+        case lua.LUA_TSTRING:
+            key = L.ToString(-2)
+            seq = false
+        case lua.LUA_TBOOLEAN:
+            key = L.ToBoolean(-2)
+            seq = false
+        default:
+            key = L.LTypename(-2)
+            seq = false
+        }
+        v, err := toValue(L, L.GetTop(), seen)
+        if err != nil {
+            L.Pop(2)
+            return nil, err
+        }
+        keys = append(keys, key)
+        values = append(values, v)
+        n++
+        L.Pop(1)
+    }
+    if seq && n > 0 {
+        rs := make([]interface{}, n)
+        for i, k := range keys {
+            j := k.(int64)
+            if j < 1 || j > int64(n) {
+                seq = false
+                break
+            }
+            rs[j-1] = values[i]
+        }
+        if seq {
+            return rs, nil
+        }
+    }
+    m := make(map[string]interface{}, n)
+    for i, k := range keys {
+        m[fmt.Sprint(k)] = values[i]
+    }
+    return m, nil
+}
+
+// isInteger tells integers from floats, which Lua 5.3 prints with a dot
+// or an exponent
+func isInteger(L *lua.State, idx int) bool {
+    L.PushValue(idx)
+    s := L.ToString(-1)
+    L.Pop(1)
+    return !strings.ContainsAny(s, ".eEnN")
+}
@@ -0,0 +1,217 @@
+package golualib
+
+import (
+    "errors"
+    "reflect"
+    "testing"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+type marshalInner struct {
+    Z int
+}
+
+type marshalBase struct {
+    ID   int
+    Kind string `lua:"kind"`
+}
+
+type marshalShape struct {
+    marshalBase
+    *marshalInner
+    Name    string `lua:"name,omitempty"`
+    Points  []marshalInner
+    Next    *marshalInner
+    Meta    marshalInner `lua:"meta"`
+    Data    []byte
+    Err     error
+    Skipped int `lua:"-"`
+    hidden  int
+}
+
+func TestPushAnyToAny(t *testing.T) {
+    L := lua.NewState()
+    L.OpenLibs()
+    defer L.Close()
+    type m = map[string]interface{}
+    type s = []interface{}
+    for _, test := range []struct {
+        in, want interface{}
+    }{
+        {nil, nil},
+        {true, true},
+        {int8(-3), int64(-3)},
+        {uint32(7), int64(7)},
+        {1.5, 1.5},
+        {float32(0.25), 0.25},
+        {1.0, 1.0},
+        {"str", "str"},
+        {[]byte("a\x00b"), "a\x00b"},
+        {[]byte{}, ""},
+        {errors.New("bad"), "bad"},
+        {[]int{1, 2, 3}, s{int64(1), int64(2), int64(3)}},
+        {[2]string{"a", "b"}, s{"a", "b"}},
+        {[]interface{}{1, "x", []byte("y"), nil}, s{int64(1), "x", "y"}},
+        {[]interface{}{1, nil, 3}, m{"1": int64(1), "3": int64(3)}},
+        {[]int{}, m{}},
+        {[]int(nil), nil},
+        {map[string]int{"a": 1, "b": 2}, m{"a": int64(1), "b": int64(2)}},
+        {map[int]string{1: "a", 2: "b"}, s{"a", "b"}},
+        {map[int]string{1: "a", 3: "c"}, m{"1": "a", "3": "c"}},
+        {map[bool]int{true: 1}, m{"true": int64(1)}},
+        {map[float64]int{1.5: 1}, m{"1.5": int64(1)}},
+        {map[string]interface{}{"nested": map[string][]int{"x": {1}}}, m{"nested": m{"x": s{int64(1)}}}},
+        {(map[string]int)(nil), nil},
+        {(*marshalInner)(nil), nil},
+        {&marshalInner{Z: 4}, m{"Z": int64(4)}},
+        {marshalShape{
+            marshalBase:  marshalBase{ID: 1, Kind: "k"},
+            marshalInner: &marshalInner{Z: 2},
+            Name:         "n",
+            Points:       []marshalInner{{Z: 3}},
+            Next:         &marshalInner{Z: 5},
+            Meta:         marshalInner{Z: 6},
+            Data:         []byte("d"),
+            Err:          errors.New("e"),
+            Skipped:      7,
+            hidden:       8,
+        }, m{
+            "ID": int64(1), "kind": "k", "Z": int64(2), "name": "n",
+            "Points": s{m{"Z": int64(3)}}, "Next": m{"Z": int64(5)},
+            "meta": m{"Z": int64(6)}, "Data": "d", "Err": "e",
+        }},
+        // a nil embedded pointer and nil fields are left out, bytes are
+        // strings even when nil
+        {marshalShape{}, m{
+            "ID": int64(0), "kind": "", "name": "", "meta": m{"Z": int64(0)}, "Data": "",
+        }},
+    } {
+        if err := PushAny(L, test.in); err != nil {
+            t.Errorf("PushAny(%#v): %v", test.in, err)
+            continue
+        }
+        got, err := ToAny(L, -1)
+        L.Pop(1)
+        if err != nil {
+            t.Errorf("ToAny(%#v): %v", test.in, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, test.want) {
+            t.Errorf("%#v: got %#v, want %#v", test.in, got, test.want)
+        }
+    }
+    if top := L.GetTop(); top != 0 {
+        t.Errorf("stack top %d", top)
+    }
+}
+
+func TestPushAnyFunctions(t *testing.T) {
+    L := lua.NewState()
+    L.OpenLibs()
+    defer L.Close()
+    double := func(L *lua.State) int {
+        L.PushInteger(int64(L.ToInteger(1) * 2))
+        return 1
+    }
+    for _, f := range []interface{}{double, lua.LuaGoFunction(double)} {
+        if err := PushAny(L, map[string]interface{}{"f": f}); err != nil {
+            t.Fatal(err)
+        }
+        L.SetGlobal("t")
+        if got := evalAll(t, L, "t.f(21)"); got != "42" {
+            t.Errorf("t.f(21) = %s", got)
+        }
+    }
+}
+
+func TestPushAnyErrors(t *testing.T) {
+    L := lua.NewState()
+    L.OpenLibs()
+    defer L.Close()
+    cyclic := map[string]interface{}{}
+    cyclic["self"] = cyclic
+    list := []interface{}{nil}
+    list[0] = list
+    type node struct{ Next *node }
+    loop := &node{}
+    loop.Next = loop
+    shared := []int{1}
+    for _, test := range []struct {
+        in   interface{}
+        want string
+    }{
+        {cyclic, ErrCycle.Error()},
+        {list, ErrCycle.Error()},
+        {loop, ErrCycle.Error()},
+        {make(chan int), "cannot convert chan int to Lua"},
+        {[]interface{}{1, func() {}}, "cannot convert func() to Lua"},
+        {map[string]interface{}{"c": complex(1, 2)}, "cannot convert complex128 to Lua"},
+    } {
+        err := PushAny(L, test.in)
+        if err == nil || err.Error() != test.want {
+            t.Errorf("PushAny(%T): %v, want %s", test.in, err, test.want)
+        }
+        if top := L.GetTop(); top != 0 {
+            t.Errorf("PushAny(%T) left %d values", test.in, top)
+            L.SetTop(0)
+        }
+    }
+    // values shared without a cycle are fine
+    if err := PushAny(L, [][]int{shared, shared}); err != nil {
+        t.Error(err)
+    }
+    L.SetTop(0)
+
+    if err := L.DoString(`cyclic = {}; cyclic.self = cyclic`); err != nil {
+        t.Fatal(err)
+    }
+    L.GetGlobal("cyclic")
+    if _, err := ToAny(L, -1); err != ErrCycle {
+        t.Errorf("ToAny of a cyclic table: %v", err)
+    }
+    L.Pop(1)
+}
+
+func TestToAny(t *testing.T) {
+    L := lua.NewState()
+    L.OpenLibs()
+    defer L.Close()
+    type m = map[string]interface{}
+    type s = []interface{}
+    for _, test := range []struct {
+        code string
+        want interface{}
+    }{
+        {"1", int64(1)},
+        {"1.0", 1.0},
+        {"2^53", 9007199254740992.0},
+        {"math.mininteger", int64(-1 << 63)},
+        {"'x'", "x"},
+        {"false", false},
+        {"print", nil},
+        {"coroutine.create(print)", nil},
+        {"{}", m{}},
+        {"{1, 2.5, 'x'}", s{int64(1), 2.5, "x"}},
+        {"{[1] = 'a', [3] = 'c'}", m{"1": "a", "3": "c"}},
+        {"{[0] = 'z', 'a'}", m{"0": "z", "1": "a"}},
+        {"{1, x = 2}", m{"1": int64(1), "x": int64(2)}},
+        {"{[1.5] = 1, [true] = 2}", m{"1.5": int64(1), "true": int64(2)}},
+        {"{a = {b = {1}}, f = print}", m{"a": m{"b": s{int64(1)}}, "f": nil}},
+        {"(function() local t = {1}; return {t, t} end)()", s{s{int64(1)}, s{int64(1)}}},
+    } {
+        if err := L.DoString("_result = " + test.code); err != nil {
+            t.Fatal(err)
+        }
+        L.GetGlobal("_result")
+        got, err := ToAny(L, -1)
+        L.Pop(1)
+        if err != nil {
+            t.Errorf("%s: %v", test.code, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, test.want) {
+            t.Errorf("%s: got %#v, want %#v", test.code, got, test.want)
+        }
+    }
+}
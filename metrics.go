@@ -0,0 +1,684 @@
+package golualib
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "net"
+    "net/http"
+    "runtime"
+    "runtime/debug"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+// Metrics holds counters, gauges and histograms and writes them in the
+// Prometheus text format. Metrics are identified by name and label pairs.
+type Metrics struct {
+    mutex    sync.RWMutex
+    families map[string]*family
+}
+
+type metricKind int
+
+const (
+    kindCounter metricKind = iota
+    kindGauge
+    kindHistogram
+)
+
+func (k metricKind) String() string {
+    switch k {
+    case kindGauge:
+        return "gauge"
+    case kindHistogram:
+        return "histogram"
+    }
+    return "counter"
+}
+
+type family struct {
+    name   string
+    help   string
+    kind   metricKind
+    bounds []float64
+    series map[string]*series
+}
+
+type series struct {
+    labels  string
+    counter *Counter
+    gauge   *Gauge
+    hist    *Histogram
+    fn      func() float64
+}
+
+var (
+    // DefaultMetrics is used by contexts created without WithMetrics
+    DefaultMetrics = NewMetrics()
+
+    // DefaultBuckets are the bounds of histograms created without any
+    DefaultBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10}
+)
+
+func NewMetrics() *Metrics {
+    return &Metrics{families: make(map[string]*family)}
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+    bits uint64
+}
+
+func (c *Counter) Inc() {
+    c.Add(1)
+}
+
+// Add increases the counter, negative values are ignored
+func (c *Counter) Add(v float64) {
+    if v < 0 {
+        return
+    }
+    addFloat(&c.bits, v)
+}
+
+func (c *Counter) Value() float64 {
+    return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+    bits uint64
+}
+
+func (g *Gauge) Set(v float64) {
+    atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+func (g *Gauge) Inc() {
+    g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+    g.Add(-1)
+}
+
+func (g *Gauge) Add(v float64) {
+    addFloat(&g.bits, v)
+}
+
+func (g *Gauge) Value() float64 {
+    return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func addFloat(bits *uint64, v float64) {
+    for {
+        old := atomic.LoadUint64(bits)
+        n := math.Float64bits(math.Float64frombits(old) + v)
+        if atomic.CompareAndSwapUint64(bits, old, n) {
+            return
+        }
+    }
+}
+
+// SetHelp sets the HELP line of the metric name
+func (m *Metrics) SetHelp(name, help string) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    if f, ok := m.families[name]; ok {
+        f.help = help
+        return
+    }
+    m.families[name] = &family{name: name, help: help, kind: -1, series: make(map[string]*series)}
+}
+
+// Counter returns the counter name with the given label pairs,
+// e.g. m.Counter("requests_total", "module", "http")
+func (m *Metrics) Counter(name string, labels ...string) *Counter {
+    s, err := m.lookup(name, kindCounter, nil, labels)
+    if err != nil {
+        log.Println(err)
+        return &Counter{}
+    }
+    return s.counter
+}
+
+// Gauge returns the gauge name with the given label pairs
+func (m *Metrics) Gauge(name string, labels ...string) *Gauge {
+    s, err := m.lookup(name, kindGauge, nil, labels)
+    if err != nil {
+        log.Println(err)
+        return &Gauge{}
+    }
+    return s.gauge
+}
+
+// GaugeFunc exports the value of fn, read each time the metrics are written
+func (m *Metrics) GaugeFunc(name string, fn func() float64, labels ...string) {
+    s, err := m.lookup(name, kindGauge, nil, labels)
+    if err != nil {
+        log.Println(err)
+        return
+    }
+    m.mutex.Lock()
+    s.fn = fn
+    m.mutex.Unlock()
+}
+
+// Histogram returns the histogram name with the given label pairs. The
+// bounds of the first call win, DefaultBuckets when empty.
+func (m *Metrics) Histogram(name string, bounds []float64, labels ...string) *Histogram {
+    if len(bounds) == 0 {
+        bounds = DefaultBuckets
+    }
+    s, err := m.lookup(name, kindHistogram, bounds, labels)
+    if err != nil {
+        log.Println(err)
+        return NewHistogram(bounds...)
+    }
+    return s.hist
+}
+
+// Remove forgets the metric name with the given label pairs
+func (m *Metrics) Remove(name string, labels ...string) {
+    key, err := formatLabels(labels)
+    if err != nil {
+        return
+    }
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    if f, ok := m.families[name]; ok {
+        delete(f.series, key)
+    }
+}
+
+func (m *Metrics) lookup(name string, kind metricKind, bounds []float64, labels []string) (*series, error) {
+    if !validMetricName(name) {
+        return nil, fmt.Errorf("metrics: invalid name %q", name)
+    }
+    key, err := formatLabels(labels)
+    if err != nil {
+        return nil, err
+    }
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    f, ok := m.families[name]
+    if !ok {
+        f = &family{name: name, kind: -1, series: make(map[string]*series)}
+        m.families[name] = f
+    }
+    if f.kind == -1 {
+        f.kind = kind
+        f.bounds = bounds
+    }
+    if f.kind != kind {
+        return nil, fmt.Errorf("metrics: %s is a %s, not a %s", name, f.kind, kind)
+    }
+    s, ok := f.series[key]
+    if !ok {
+        s = &series{labels: key}
+        switch kind {
+        case kindCounter:
+            s.counter = &Counter{}
+        case kindGauge:
+            s.gauge = &Gauge{}
+        case kindHistogram:
+            s.hist = NewHistogram(f.bounds...)
+        }
+        f.series[key] = s
+    }
+    return s, nil
+}
+
+func validMetricName(name string) bool {
+    if name == "" {
+        return false
+    }
+    for i, c := range name {
+        if c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9' {
+            continue
+        }
+        return false
+    }
+    return true
+}
+
+// formatLabels renders label pairs sorted by name: a="1",b="2"
+func formatLabels(labels []string) (string, error) {
+    if len(labels)%2 != 0 {
+        return "", fmt.Errorf("metrics: odd number of label strings %q", labels)
+    }
+    n := len(labels) / 2
+    idx := make([]int, n)
+    for i := range idx {
+        idx[i] = i * 2
+        if !validMetricName(labels[i*2]) || strings.Contains(labels[i*2], ":") {
+            return "", fmt.Errorf("metrics: invalid label %q", labels[i*2])
+        }
+    }
+    sort.Slice(idx, func(i, j int) bool {
+        return labels[idx[i]] < labels[idx[j]]
+    })
+    var b strings.Builder
+    for i, k := range idx {
+        if i > 0 {
+            b.WriteByte(',')
+        }
+        b.WriteString(labels[k])
+        b.WriteString(`="`)
+        b.WriteString(escapeLabel(labels[k+1]))
+        b.WriteByte('"')
+    }
+    return b.String(), nil
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+    return labelEscaper.Replace(s)
+}
+
+// WritePrometheus writes every metric in the Prometheus text format
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+    m.mutex.RLock()
+    names := make([]string, 0, len(m.families))
+    for name := range m.families {
+        names = append(names, name)
+    }
+    m.mutex.RUnlock()
+    sort.Strings(names)
+
+    bw := bufio.NewWriter(w)
+    for _, name := range names {
+        m.mutex.RLock()
+        f := m.families[name]
+        help, kind := f.help, f.kind
+        ss := make([]*series, 0, len(f.series))
+        for _, s := range f.series {
+            ss = append(ss, s)
+        }
+        m.mutex.RUnlock()
+        if kind == -1 || len(ss) == 0 {
+            continue
+        }
+        sort.Slice(ss, func(i, j int) bool {
+            return ss[i].labels < ss[j].labels
+        })
+        if help != "" {
+            fmt.Fprintf(bw, "# HELP %s %s\n", name, strings.ReplaceAll(help, "\n", `\n`))
+        }
+        fmt.Fprintf(bw, "# TYPE %s %s\n", name, kind)
+        for _, s := range ss {
+            switch kind {
+            case kindCounter:
+                writeSample(bw, name, s.labels, "", s.counter.Value())
+            case kindGauge:
+                m.mutex.RLock()
+                fn := s.fn
+                m.mutex.RUnlock()
+                v := s.gauge.Value()
+                if fn != nil {
+                    v = fn()
+                }
+                writeSample(bw, name, s.labels, "", v)
+            case kindHistogram:
+                snap := s.hist.Snapshot()
+                var total uint64
+                for i, c := range snap.Counts {
+                    total += c
+                    le := "+Inf"
+                    if i < len(snap.Bounds) {
+                        le = formatFloat(snap.Bounds[i])
+                    }
+                    writeSample(bw, name+"_bucket", s.labels, `le="`+le+`"`, float64(total))
+                }
+                writeSample(bw, name+"_sum", s.labels, "", snap.Sum)
+                writeSample(bw, name+"_count", s.labels, "", float64(snap.Count))
+            }
+        }
+    }
+    return bw.Flush()
+}
+
+func writeSample(w io.Writer, name, labels, extra string, v float64) {
+    if extra != "" {
+        if labels != "" {
+            labels += ","
+        }
+        labels += extra
+    }
+    if labels != "" {
+        fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(v))
+        return
+    }
+    fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+}
+
+func formatFloat(v float64) string {
+    switch {
+    case math.IsInf(v, 1):
+        return "+Inf"
+    case math.IsInf(v, -1):
+        return "-Inf"
+    case math.IsNaN(v):
+        return "NaN"
+    }
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    if err := m.WritePrometheus(w); err != nil {
+        log.Println(err)
+    }
+}
+
+// Admin serves operational endpoints on a listener of its own,
+// the metrics on /metrics
+type Admin struct {
+    mux    *http.ServeMux
+    server *http.Server
+}
+
+func NewAdmin(m *Metrics) *Admin {
+    a := &Admin{mux: http.NewServeMux()}
+    a.mux.Handle("/metrics", m)
+    return a
+}
+
+// Handle adds an endpoint, it must be called before Listen
+func (a *Admin) Handle(pattern string, h http.Handler) {
+    a.mux.Handle(pattern, h)
+}
+
+// Listen starts serving on addr in the background
+func (a *Admin) Listen(addr string) error {
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    a.server = &http.Server{Handler: a.mux}
+    go func() {
+        if err := a.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+            log.Println(err)
+        }
+    }()
+    return nil
+}
+
+func (a *Admin) Close() error {
+    if a.server == nil {
+        return nil
+    }
+    return a.server.Close()
+}
+
+// GCPolicy forces garbage collections at a fixed interval, which returns
+// memory to the OS sooner on hosts running many contexts. A zero Interval
+// leaves the collections to the Go runtime.
+type GCPolicy struct {
+    Interval time.Duration
+    // FreeOSMemory uses debug.FreeOSMemory instead of runtime.GC
+    FreeOSMemory bool
+}
+
+// DefaultGCPolicy is applied by WaitQuit
+var DefaultGCPolicy = GCPolicy{}
+
+func (p GCPolicy) run(done <-chan struct{}) {
+    if p.Interval <= 0 {
+        return
+    }
+    go func() {
+        ticker := time.NewTicker(p.Interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+            }
+            if p.FreeOSMemory {
+                debug.FreeOSMemory()
+            } else {
+                runtime.GC()
+            }
+        }
+    }()
+}
+
+// metricsCode exposes the metrics of the context to scripts,
+// e.g. metrics.counter("login"):inc()
+const metricsCode = `
+local lib = GoWrap(...)
+local error, setmetatable = error, setmetatable
+
+local function check(err)
+    if err then
+        error(err, 3)
+    end
+end
+
+local Counter, Gauge, Histogram = {}, {}, {}
+Counter.__index, Gauge.__index, Histogram.__index = Counter, Gauge, Histogram
+
+function Counter:inc(n)
+    check(lib.counter(self.name, self.labels, n or 1))
+end
+function Counter:add(n)
+    check(lib.counter(self.name, self.labels, n))
+end
+
+function Gauge:set(v)
+    check(lib.gauge(self.name, self.labels, v, true))
+end
+function Gauge:add(v)
+    check(lib.gauge(self.name, self.labels, v, false))
+end
+function Gauge:inc(n)
+    check(lib.gauge(self.name, self.labels, n or 1, false))
+end
+function Gauge:dec(n)
+    check(lib.gauge(self.name, self.labels, -(n or 1), false))
+end
+
+function Histogram:observe(v)
+    check(lib.observe(self.name, self.labels, self.bounds, v))
+end
+
+local metrics = {}
+
+function metrics.counter(name, labels)
+    check(lib.counter(name, labels, 0))
+    return setmetatable({ name = name, labels = labels }, Counter)
+end
+
+function metrics.gauge(name, labels)
+    check(lib.gauge(name, labels, 0, false))
+    return setmetatable({ name = name, labels = labels }, Gauge)
+end
+
+function metrics.histogram(name, bounds, labels)
+    check(lib.observe(name, labels, bounds))
+    return setmetatable({ name = name, labels = labels, bounds = bounds }, Histogram)
+end
+
+function metrics.help(name, text)
+    lib.help(name, text)
+end
+
+package.loaded['golualib.metrics'] = metrics
+return metrics
+`
+
+func (ctx *luaContext) initMetrics() error {
+    L := ctx.L
+    if err := loadString(L, metricsCode); err != nil {
+        return err
+    }
+    m := ctx.metrics
+    L.CreateTable(0, 4)
+    L.PushGoFunction(func(L *lua.State) int {
+        labels, err := checkLabels(L, 2)
+        var s *series
+        if err == nil {
+            s, err = m.lookup(L.CheckString(1), kindCounter, nil, labels)
+        }
+        if err != nil {
+            L.PushString(err.Error())
+            return 1
+        }
+        s.counter.Add(L.CheckNumber(3))
+        return 0
+    })
+    L.SetField(-2, "counter")
+    L.PushGoFunction(func(L *lua.State) int {
+        labels, err := checkLabels(L, 2)
+        var s *series
+        if err == nil {
+            s, err = m.lookup(L.CheckString(1), kindGauge, nil, labels)
+        }
+        if err != nil {
+            L.PushString(err.Error())
+            return 1
+        }
+        if L.ToBoolean(4) {
+            s.gauge.Set(L.CheckNumber(3))
+        } else {
+            s.gauge.Add(L.CheckNumber(3))
+        }
+        return 0
+    })
+    L.SetField(-2, "gauge")
+    L.PushGoFunction(func(L *lua.State) int {
+        labels, err := checkLabels(L, 2)
+        var bounds []float64
+        if err == nil && L.Type(3) == lua.LUA_TTABLE {
+            for i := 1; ; i++ {
+                L.RawGeti(3, i)
+                if L.IsNil(-1) {
+                    L.Pop(1)
+                    break
+                }
+                bounds = append(bounds, L.ToNumber(-1))
+                L.Pop(1)
+            }
+        }
+        if len(bounds) == 0 {
+            bounds = DefaultBuckets
+        }
+        var s *series
+        if err == nil {
+            s, err = m.lookup(L.CheckString(1), kindHistogram, bounds, labels)
+        }
+        if err != nil {
+            L.PushString(err.Error())
+            return 1
+        }
+        if L.Type(4) == lua.LUA_TNUMBER {
+            s.hist.Observe(L.ToNumber(4))
+        }
+        return 0
+    })
+    L.SetField(-2, "observe")
+    L.PushGoFunction(func(L *lua.State) int {
+        m.SetHelp(L.CheckString(1), L.CheckString(2))
+        return 0
+    })
+    L.SetField(-2, "help")
+    if err := L.Call(1, 1); err != nil {
+        return err
+    }
+    L.SetGlobal("metrics")
+    return nil
+}
+
+// checkLabels reads a table of label names to values at idx
+func checkLabels(L *lua.State, idx int) ([]string, error) {
+    if L.IsNoneOrNil(idx) {
+        return nil, nil
+    }
+    if L.Type(idx) != lua.LUA_TTABLE {
+        return nil, fmt.Errorf("metrics: labels must be a table")
+    }
+    var labels []string
+    L.PushNil()
+    for L.Next(idx) != 0 {
+        if L.Type(-2) != lua.LUA_TSTRING {
+            L.Pop(2)
+            return nil, fmt.Errorf("metrics: label names must be strings")
+        }
+        labels = append(labels, L.ToString(-2), L.ToString(-1))
+        L.Pop(1)
+    }
+    return labels, nil
+}
+
+// contextMetrics instruments the callbacks of a context
+type contextMetrics struct {
+    m         *Metrics
+    id        string
+    callbacks *Counter
+    errors    *Counter
+    duration  *Histogram
+    memory    *Gauge
+}
+
+var contextSeq int64
+
+func newContextMetrics(m *Metrics, ctx *luaContext) *contextMetrics {
+    id := strconv.FormatInt(atomic.AddInt64(&contextSeq, 1), 10)
+    m.SetHelp("golualib_callbacks_total", "Callbacks executed by the context.")
+    m.SetHelp("golualib_callback_errors_total", "Errors reported by the context.")
+    m.SetHelp("golualib_callback_duration_seconds", "Time spent running one callback.")
+    m.SetHelp("golualib_lua_memory_bytes", "Memory held by the Lua state.")
+    m.SetHelp("golualib_queue_depth", "Callbacks waiting in the queue of the context.")
+    cm := &contextMetrics{
+        m:         m,
+        id:        id,
+        callbacks: m.Counter("golualib_callbacks_total", "context", id),
+        errors:    m.Counter("golualib_callback_errors_total", "context", id),
+        duration:  m.Histogram("golualib_callback_duration_seconds", nil, "context", id),
+        memory:    m.Gauge("golualib_lua_memory_bytes", "context", id),
+    }
+    m.GaugeFunc("golualib_queue_depth", func() float64 {
+        return float64(atomic.LoadInt64(&ctx.queued))
+    }, "context", id)
+    return cm
+}
+
+func (cm *contextMetrics) observe(d time.Duration, memory int64) {
+    cm.callbacks.Inc()
+    cm.duration.Observe(d.Seconds())
+    cm.memory.Set(float64(memory))
+}
+
+func (cm *contextMetrics) remove() {
+    for _, name := range []string{
+        "golualib_callbacks_total", "golualib_callback_errors_total",
+        "golualib_callback_duration_seconds", "golualib_lua_memory_bytes",
+        "golualib_queue_depth",
+    } {
+        cm.m.Remove(name, "context", cm.id)
+    }
+}
+
+// ModuleRequest counts one request handled by module
+func ModuleRequest(ctx LuaContext, module string) {
+    ctx.Metrics().Counter("golualib_module_requests_total", "module", module).Inc()
+}
+
+// ModuleConnections tracks the open connections of module, delta is +1 when
+// one opens and -1 when it closes
+func ModuleConnections(ctx LuaContext, module string, delta float64) {
+    ctx.Metrics().Gauge("golualib_module_connections", "module", module).Add(delta)
+}
@@ -0,0 +1,243 @@
+package golualib
+
+import (
+    "errors"
+    "io"
+    "sort"
+    "sync"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+// ModulePrefix prefixes the names scripts pass to require, e.g. require("golualib.http")
+const ModulePrefix = "golualib."
+
+// Module is a library scripts load with require. A Module value belongs to
+// one context, Close releases every resource its scripts opened.
+type Module interface {
+    Name() string
+    // Open loads the module into the state of ctx and pushes its Lua table
+    Open(ctx LuaContext) error
+    Close() error
+}
+
+// ModuleFactory creates a Module for one context
+type ModuleFactory func() Module
+
+// Registry maps module names onto factories
+type Registry struct {
+    mutex     sync.RWMutex
+    factories map[string]ModuleFactory
+}
+
+var (
+    // DefaultRegistry is used by contexts created without WithRegistry,
+    // module packages add themselves to it when imported
+    DefaultRegistry = NewRegistry()
+
+    ErrModuleNotFound = errors.New("module not found")
+)
+
+func NewRegistry() *Registry {
+    return &Registry{factories: make(map[string]ModuleFactory)}
+}
+
+// Register adds the factory of the module name, which must be the Name of
+// the modules f creates
+func (r *Registry) Register(name string, f ModuleFactory) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.factories[name] = f
+}
+
+func (r *Registry) Lookup(name string) (ModuleFactory, bool) {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+    f, ok := r.factories[name]
+    return f, ok
+}
+
+func (r *Registry) Names() []string {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+    rs := make([]string, 0, len(r.factories))
+    for name := range r.factories {
+        rs = append(rs, name)
+    }
+    sort.Strings(rs)
+    return rs
+}
+
+// RegisterModule adds the factory of the module name to DefaultRegistry
+func RegisterModule(name string, f ModuleFactory) {
+    DefaultRegistry.Register(name, f)
+}
+
+// OpenModule opens m on ctx, stores its table in package.loaded so require
+// returns it and releases m with the context. The table is left on the stack.
+func OpenModule(ctx LuaContext, m Module) error {
+    L := ctx.LuaState()
+    top := L.GetTop()
+    if err := m.Open(ctx); err != nil {
+        L.SetTop(top)
+        _ = m.Close()
+        return err
+    }
+    ctx.AddCloser(m)
+    L.GetGlobal("package")
+    L.GetField(-1, "loaded")
+    L.PushValue(-3)
+    L.SetField(-2, ModulePrefix+m.Name())
+    L.Pop(2)
+    return nil
+}
+
+// OpenGlobals opens m on the context of L and copies fields of its table
+// into globals, keyed by global name. It backs the Register functions kept
+// for scripts written before require.
+func OpenGlobals(L *lua.State, m Module, globals map[string]string) error {
+    if err := OpenModule(CheckLuaContext(L), m); err != nil {
+        return err
+    }
+    for global, field := range globals {
+        L.GetField(-1, field)
+        L.SetGlobal(global)
+    }
+    L.Pop(1)
+    return nil
+}
+
+// Require pushes the table of the module name, opening it from the registry
+// of ctx the first time.
+func Require(ctx LuaContext, name string) error {
+    L := ctx.LuaState()
+    L.GetGlobal("package")
+    L.GetField(-1, "loaded")
+    L.GetField(-1, ModulePrefix+name)
+    L.Remove(-2)
+    L.Remove(-2)
+    if !L.IsNil(-1) {
+        return nil
+    }
+    L.Pop(1)
+    f, ok := registryOf(ctx).Lookup(name)
+    if !ok {
+        return ErrModuleNotFound
+    }
+    return OpenModule(ctx, f())
+}
+
+func registryOf(ctx LuaContext) *Registry {
+    if c, ok := ctx.(*luaContext); ok && c.registry != nil {
+        return c.registry
+    }
+    return DefaultRegistry
+}
+
+// LoadModule runs the Lua code of a module with a table of funcs as its
+// argument and pushes the value the code returns.
+func LoadModule(L *lua.State, name, code string, funcs map[string]lua.LuaGoFunction) error {
+    if L.Load([]byte(code), "="+ModulePrefix+name) != 0 {
+        err := errors.New(L.ToString(-1))
+        L.Pop(1)
+        return err
+    }
+    L.CreateTable(0, len(funcs))
+    for k, f := range funcs {
+        L.PushGoFunction(f)
+        L.SetField(-2, k)
+    }
+    return L.Call(1, 1)
+}
+
+// requireCode installs a package searcher for the modules of the registry
+const requireCode = `
+local has, open = ...
+table.insert(package.searchers, 2, function(name)
+    local short = name:match('^golualib%.(.+)$')
+    if not short then
+        return nil
+    end
+    if not has(short) then
+        return "\n\tno golualib module '" .. short .. "'"
+    end
+    return function()
+        local m, err = open(short)
+        if m == nil then
+            error(err, 2)
+        end
+        return m
+    end
+end)
+`
+
+func (ctx *luaContext) initRequire() error {
+    L := ctx.L
+    if L.LoadString(requireCode) != 0 {
+        err := errors.New(L.ToString(-1))
+        L.Pop(1)
+        return err
+    }
+    L.PushGoFunction(func(L *lua.State) int {
+        _, ok := registryOf(ctx).Lookup(L.CheckString(1))
+        L.PushBoolean(ok)
+        return 1
+    })
+    L.PushGoFunction(func(L *lua.State) int {
+        if err := Require(ctx, L.CheckString(1)); err != nil {
+            L.PushNil()
+            L.PushString(err.Error())
+            return 2
+        }
+        return 1
+    })
+    return L.Call(2, 0)
+}
+
+// Resources is a set of resources released together. Modules embed it to
+// close the clients and timers their scripts opened.
+type Resources struct {
+    mutex   sync.Mutex
+    closers []io.Closer
+    closed  bool
+}
+
+// Add registers c, it is closed right away if the set was already closed
+func (r *Resources) Add(c io.Closer) {
+    r.mutex.Lock()
+    if r.closed {
+        r.mutex.Unlock()
+        _ = c.Close()
+        return
+    }
+    r.closers = append(r.closers, c)
+    r.mutex.Unlock()
+}
+
+// Remove forgets c without closing it
+func (r *Resources) Remove(c io.Closer) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    for i, v := range r.closers {
+        if v == c {
+            r.closers = append(r.closers[:i], r.closers[i+1:]...)
+            return
+        }
+    }
+}
+
+// Close releases the resources in reverse order of registration
+func (r *Resources) Close() error {
+    r.mutex.Lock()
+    closers := r.closers
+    r.closers = nil
+    r.closed = true
+    r.mutex.Unlock()
+    var err error
+    for i := len(closers) - 1; i >= 0; i-- {
+        if e := closers[i].Close(); e != nil && err == nil {
+            err = e
+        }
+    }
+    return err
+}
@@ -0,0 +1,474 @@
+package golualib
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math"
+    "sort"
+    "unicode/utf8"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+var (
+    ErrMsgpackDepth = errors.New("msgpack: nesting too deep")
+    errMsgpackShort = errors.New("msgpack: data too short")
+)
+
+// msgpackCode exposes the MessagePack codec to scripts as
+// require('golualib.msgpack'), sharing null and arrays with golualib.json
+const msgpackCode = `
+local lib = GoWrap(...)
+local json = package.loaded['golualib.json']
+local type = type
+
+local msgpack = {
+    null        = json.null,
+    array       = json.array,
+    empty_array = json.empty_array,
+}
+
+-- encode returns the MessagePack bytes of v or nil, err. Valid UTF-8
+-- strings encode as str, others as bin.
+function msgpack.encode(v)
+    return lib.encode(v)
+end
+
+-- decode returns the value encoded by s or nil, err
+function msgpack.decode(s)
+    if type(s) ~= 'string' then
+        return nil, 'msgpack: string expected, got ' .. type(s)
+    end
+    local v, pos = lib.unpack(s, 1)
+    if v == nil then
+        return nil, pos
+    end
+    if pos <= #s then
+        return nil, 'msgpack: extra data after value'
+    end
+    return v
+end
+
+-- unpack returns the value at pos in s, 1 by default, and the position
+-- after it, or nil, err. It reads streams of concatenated values.
+function msgpack.unpack(s, pos)
+    if type(s) ~= 'string' then
+        return nil, 'msgpack: string expected, got ' .. type(s)
+    end
+    return lib.unpack(s, pos or 1)
+end
+
+package.loaded['golualib.msgpack'] = msgpack
+return msgpack
+`
+
+func initMsgpack(L *lua.State) error {
+    if err := loadString(L, msgpackCode); err != nil {
+        return err
+    }
+    L.CreateTable(0, 2)
+    L.PushGoFunction(func(L *lua.State) int {
+        data, err := EncodeMsgpack(L, 1)
+        if err != nil {
+            L.PushNil()
+            L.PushString(err.Error())
+            return 2
+        }
+        PushBytes(L, data)
+        return 1
+    })
+    L.SetField(-2, "encode")
+    L.PushGoFunction(func(L *lua.State) int {
+        data := L.ToBytes(1)
+        pos := int(L.ToInteger(2)) - 1
+        if pos < 0 || pos > len(data) {
+            L.PushNil()
+            L.PushString("msgpack: initial position out of string")
+            return 2
+        }
+        n, err := PushMsgpack(L, data[pos:])
+        if err != nil {
+            L.PushNil()
+            L.PushString(err.Error())
+            return 2
+        }
+        L.PushInteger(int64(pos + n + 1))
+        return 2
+    })
+    L.SetField(-2, "unpack")
+    return L.Call(1, 0)
+}
+
+// EncodeMsgpack encodes the Lua value at idx as MessagePack. Tables turn
+// into arrays and maps like EncodeJSON, map keys are sorted by their
+// encoding and integers take the smallest format holding them.
+func EncodeMsgpack(L *lua.State, idx int) ([]byte, error) {
+    if idx < 0 {
+        idx = L.GetTop() + idx + 1
+    }
+    e := &msgpackEncoder{jsonEncoder{L: L, seen: make(map[uintptr]bool)}}
+    top := L.GetTop()
+    err := e.encode(idx, 0)
+    L.SetTop(top)
+    if err != nil {
+        return nil, err
+    }
+    return e.buf.Bytes(), nil
+}
+
+// msgpackEncoder shares the table handling of jsonEncoder
+type msgpackEncoder struct {
+    jsonEncoder
+}
+
+func (e *msgpackEncoder) head(code byte, n uint64, size int) {
+    var b [8]byte
+    binary.BigEndian.PutUint64(b[:], n)
+    e.buf.WriteByte(code)
+    e.buf.Write(b[8-size:])
+}
+
+func (e *msgpackEncoder) integer(i int64) {
+    switch {
+    case i >= 0 && i < 128:
+        e.buf.WriteByte(byte(i))
+    case i >= -32 && i < 0:
+        e.buf.WriteByte(byte(i))
+    case i >= 0 && i <= math.MaxUint8:
+        e.head(0xcc, uint64(i), 1)
+    case i >= 0 && i <= math.MaxUint16:
+        e.head(0xcd, uint64(i), 2)
+    case i >= 0 && i <= math.MaxUint32:
+        e.head(0xce, uint64(i), 4)
+    case i >= 0:
+        e.head(0xcf, uint64(i), 8)
+    case i >= math.MinInt8:
+        e.head(0xd0, uint64(i), 1)
+    case i >= math.MinInt16:
+        e.head(0xd1, uint64(i), 2)
+    case i >= math.MinInt32:
+        e.head(0xd2, uint64(i), 4)
+    default:
+        e.head(0xd3, uint64(i), 8)
+    }
+}
+
+// length writes the header of a str, bin, array or map of n items, codes
+// holds the fix, 8, 16 and 32 bit formats, 0 when there is none
+func (e *msgpackEncoder) length(n int, fix byte, fixMax int, codes [3]byte) {
+    switch {
+    case fix != 0 && n <= fixMax:
+        e.buf.WriteByte(fix | byte(n))
+    case codes[0] != 0 && n <= math.MaxUint8:
+        e.head(codes[0], uint64(n), 1)
+    case n <= math.MaxUint16:
+        e.head(codes[1], uint64(n), 2)
+    default:
+        e.head(codes[2], uint64(n), 4)
+    }
+}
+
+func (e *msgpackEncoder) encode(idx int, depth int) error {
+    L := e.L
+    if depth > maxJSONDepth {
+        return ErrMsgpackDepth
+    }
+    switch L.Type(idx) {
+    case lua.LUA_TNIL, lua.LUA_TNONE:
+        e.buf.WriteByte(0xc0)
+    case lua.LUA_TBOOLEAN:
+        if L.ToBoolean(idx) {
+            e.buf.WriteByte(0xc3)
+        } else {
+            e.buf.WriteByte(0xc2)
+        }
+    case lua.LUA_TNUMBER:
+        if isInteger(L, idx) {
+            e.integer(int64(L.ToInteger(idx)))
+            return nil
+        }
+        e.head(0xcb, math.Float64bits(L.ToNumber(idx)), 8)
+    case lua.LUA_TSTRING:
+        s := L.ToString(idx)
+        if len(s) > math.MaxUint32 {
+            return errors.New("msgpack: string too long")
+        }
+        if utf8.ValidString(s) {
+            e.length(len(s), 0xa0, 31, [3]byte{0xd9, 0xda, 0xdb})
+        } else {
+            e.length(len(s), 0, 0, [3]byte{0xc4, 0xc5, 0xc6})
+        }
+        e.buf.WriteString(s)
+    case lua.LUA_TTABLE:
+        if e.is(idx, registryJSONNull) {
+            e.buf.WriteByte(0xc0)
+            return nil
+        }
+        p := L.ToPointer(idx)
+        if e.seen[p] {
+            return errors.New("msgpack: cannot encode a table containing itself")
+        }
+        e.seen[p] = true
+        defer delete(e.seen, p)
+        if !L.CheckStack(4) {
+            return ErrMsgpackDepth
+        }
+        return e.encodeTable(idx, depth)
+    default:
+        return fmt.Errorf("msgpack: cannot encode %s", L.LTypename(idx))
+    }
+    return nil
+}
+
+func (e *msgpackEncoder) encodeTable(idx int, depth int) error {
+    L := e.L
+    var (
+        n    = 0
+        ints = 0
+        max  int64
+    )
+    L.PushNil()
+    for L.Next(idx) != 0 {
+        L.Pop(1)
+        n++
+        if L.Type(-1) == lua.LUA_TNUMBER && isInteger(L, -1) {
+            if i := int64(L.ToInteger(-1)); i >= 1 {
+                ints++
+                if i > max {
+                    max = i
+                }
+            }
+        }
+    }
+    if e.isArray(idx) || (n > 0 && ints == n && int64(ints) == max) {
+        // arrays run to the last integer key, holes encode as nil
+        if max > math.MaxUint32 {
+            return errors.New("msgpack: array too long")
+        }
+        e.length(int(max), 0x90, 15, [3]byte{0, 0xdc, 0xdd})
+        for i := int64(1); i <= max; i++ {
+            L.RawGeti(idx, int(i))
+            if err := e.encode(L.GetTop(), depth+1); err != nil {
+                return err
+            }
+            L.Pop(1)
+        }
+        return nil
+    }
+
+    // pairs are encoded after the header, then sorted by their key bytes
+    e.length(n, 0x80, 15, [3]byte{0, 0xde, 0xdf})
+    type pair struct{ start, mid, end int }
+    var (
+        pairs = make([]pair, 0, n)
+        start = e.buf.Len()
+    )
+    L.PushNil()
+    for L.Next(idx) != 0 {
+        top := L.GetTop()
+        switch L.Type(-2) {
+        case lua.LUA_TNUMBER, lua.LUA_TSTRING, lua.LUA_TBOOLEAN:
+        default:
+            return fmt.Errorf("msgpack: cannot encode a %s key", L.LTypename(-2))
+        }
+        p := pair{start: e.buf.Len()}
+        if err := e.encode(top-1, depth+1); err != nil {
+            return err
+        }
+        p.mid = e.buf.Len()
+        if err := e.encode(top, depth+1); err != nil {
+            return err
+        }
+        p.end = e.buf.Len()
+        pairs = append(pairs, p)
+        L.SetTop(top - 1)
+    }
+    data := append([]byte(nil), e.buf.Bytes()[start:]...)
+    sort.Slice(pairs, func(i, j int) bool {
+        a, b := pairs[i], pairs[j]
+        return bytes.Compare(data[a.start-start:a.mid-start], data[b.start-start:b.mid-start]) < 0
+    })
+    e.buf.Truncate(start)
+    for _, p := range pairs {
+        e.buf.Write(data[p.start-start : p.end-start])
+    }
+    return nil
+}
+
+// PushMsgpack pushes the first MessagePack value of data and returns the
+// bytes it took. Maps turn into tables, arrays into tables marked by
+// json.array, nil into json.null and str and bin into strings.
+func PushMsgpack(L *lua.State, data []byte) (int, error) {
+    d := &msgpackDecoder{L: L, data: data}
+    top := L.GetTop()
+    if err := d.decode(0); err != nil {
+        L.SetTop(top)
+        return 0, err
+    }
+    return d.pos, nil
+}
+
+type msgpackDecoder struct {
+    L    *lua.State
+    data []byte
+    pos  int
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+    if n > len(d.data)-d.pos {
+        return nil, errMsgpackShort
+    }
+    b := d.data[d.pos : d.pos+n]
+    d.pos += n
+    return b, nil
+}
+
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+    b, err := d.read(size)
+    if err != nil {
+        return 0, err
+    }
+    return readUint(b, binary.BigEndian, size), nil
+}
+
+func (d *msgpackDecoder) decode(depth int) error {
+    L := d.L
+    if depth > maxJSONDepth || !L.CheckStack(3) {
+        return ErrMsgpackDepth
+    }
+    b, err := d.read(1)
+    if err != nil {
+        return err
+    }
+    c := b[0]
+    switch {
+    case c <= 0x7f:
+        L.PushInteger(int64(c))
+        return nil
+    case c >= 0xe0:
+        L.PushInteger(int64(int8(c)))
+        return nil
+    case c >= 0xa0 && c <= 0xbf:
+        return d.bytes(int(c & 0x1f))
+    case c >= 0x90 && c <= 0x9f:
+        return d.array(int(c&0x0f), depth)
+    case c >= 0x80 && c <= 0x8f:
+        return d.object(int(c&0x0f), depth)
+    }
+    switch c {
+    case 0xc0:
+        L.GetField(lua.LUA_REGISTRYINDEX, registryJSONNull)
+    case 0xc2, 0xc3:
+        L.PushBoolean(c == 0xc3)
+    case 0xcc, 0xcd, 0xce, 0xcf:
+        v, err := d.uint(1 << (c - 0xcc))
+        if err != nil {
+            return err
+        }
+        if v > math.MaxInt64 {
+            // beyond Lua integers, keep the magnitude
+            L.PushNumber(float64(v))
+        } else {
+            L.PushInteger(int64(v))
+        }
+    case 0xd0, 0xd1, 0xd2, 0xd3:
+        size := 1 << (c - 0xd0)
+        v, err := d.uint(size)
+        if err != nil {
+            return err
+        }
+        shift := uint(64 - 8*size)
+        L.PushInteger(int64(v<<shift) >> shift)
+    case 0xca:
+        v, err := d.uint(4)
+        if err != nil {
+            return err
+        }
+        L.PushNumber(float64(math.Float32frombits(uint32(v))))
+    case 0xcb:
+        v, err := d.uint(8)
+        if err != nil {
+            return err
+        }
+        L.PushNumber(math.Float64frombits(v))
+    case 0xd9, 0xda, 0xdb:
+        n, err := d.uint(1 << (c - 0xd9))
+        if err != nil {
+            return err
+        }
+        return d.bytes(int(n))
+    case 0xc4, 0xc5, 0xc6:
+        n, err := d.uint(1 << (c - 0xc4))
+        if err != nil {
+            return err
+        }
+        return d.bytes(int(n))
+    case 0xdc, 0xdd:
+        n, err := d.uint(2 << (c - 0xdc))
+        if err != nil {
+            return err
+        }
+        return d.array(int(n), depth)
+    case 0xde, 0xdf:
+        n, err := d.uint(2 << (c - 0xde))
+        if err != nil {
+            return err
+        }
+        return d.object(int(n), depth)
+    case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xc7, 0xc8, 0xc9:
+        return fmt.Errorf("msgpack: unsupported ext at offset %d", d.pos-1)
+    default:
+        return fmt.Errorf("msgpack: invalid code 0x%02x at offset %d", c, d.pos-1)
+    }
+    return nil
+}
+
+func (d *msgpackDecoder) bytes(n int) error {
+    b, err := d.read(n)
+    if err != nil {
+        return err
+    }
+    PushBytes(d.L, b)
+    return nil
+}
+
+func (d *msgpackDecoder) array(n int, depth int) error {
+    L := d.L
+    // every item takes a byte at least
+    if n > len(d.data)-d.pos {
+        return errMsgpackShort
+    }
+    L.CreateTable(n, 0)
+    for i := 1; i <= n; i++ {
+        if err := d.decode(depth + 1); err != nil {
+            return err
+        }
+        L.RawSeti(-2, i)
+    }
+    MarkJSONArray(L, -1)
+    return nil
+}
+
+func (d *msgpackDecoder) object(n int, depth int) error {
+    L := d.L
+    if n > (len(d.data)-d.pos)/2 {
+        return errMsgpackShort
+    }
+    L.CreateTable(0, n)
+    for i := 0; i < n; i++ {
+        at := d.pos
+        if err := d.decode(depth + 1); err != nil {
+            return err
+        }
+        if L.Type(-1) == lua.LUA_TTABLE || (L.Type(-1) == lua.LUA_TNUMBER && L.ToNumber(-1) != L.ToNumber(-1)) {
+            return fmt.Errorf("msgpack: invalid map key at offset %d", at)
+        }
+        if err := d.decode(depth + 1); err != nil {
+            return err
+        }
+        L.RawSet(-3)
+    }
+    return nil
+}
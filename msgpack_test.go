@@ -0,0 +1,141 @@
+package golualib
+
+import "testing"
+
+// binarySetup loads the binary codecs and hex helpers to compare their bytes
+const binarySetup = `
+json = require('golualib.json')
+msgpack = require('golualib.msgpack')
+struct = require('golualib.struct')
+function hex(s)
+    return (s:gsub('.', function(c) return string.format('%02x', c:byte()) end))
+end
+function unhex(h)
+    return (h:gsub('..', function(x) return string.char(tonumber(x, 16)) end))
+end
+function list(...)
+    local t = table.pack(...)
+    for i = 1, t.n do
+        t[i] = tostring(t[i])
+    end
+    return table.concat(t, ',')
+end
+`
+
+func TestMsgpackIntegers(t *testing.T) {
+    tests := []struct {
+        value, hex string
+    }{
+        {"0", "00"},
+        {"127", "7f"},
+        {"128", "cc80"},
+        {"255", "ccff"},
+        {"256", "cd0100"},
+        {"65535", "cdffff"},
+        {"65536", "ce00010000"},
+        {"4294967295", "ceffffffff"},
+        {"4294967296", "cf0000000100000000"},
+        {"math.maxinteger", "cf7fffffffffffffff"},
+        {"-1", "ff"},
+        {"-32", "e0"},
+        {"-33", "d0df"},
+        {"-128", "d080"},
+        {"-129", "d1ff7f"},
+        {"-32768", "d18000"},
+        {"-32769", "d2ffff7fff"},
+        {"-2147483648", "d280000000"},
+        {"-2147483649", "d3ffffffff7fffffff"},
+        {"math.mininteger", "d38000000000000000"},
+    }
+    var evals []evalTest
+    for _, test := range tests {
+        evals = append(evals,
+            evalTest{"hex(msgpack.encode(" + test.value + "))", test.hex},
+            evalTest{"list(msgpack.decode(unhex('" + test.hex + "')) == " + test.value + ", math.type(msgpack.decode(unhex('" + test.hex + "'))))", "true,integer"},
+        )
+    }
+    evals = append(evals,
+        // wider formats than needed decode too
+        evalTest{"msgpack.decode(unhex('cd0001'))", "1"},
+        evalTest{"msgpack.decode(unhex('d3ffffffffffffffff'))", "-1"},
+        // uint64 beyond Lua integers keeps its magnitude
+        evalTest{"msgpack.decode(unhex('cfffffffffffffffff'))", "1.844674407371e+19"},
+        evalTest{"hex(msgpack.encode(1.5))", "cb3ff8000000000000"},
+        evalTest{"math.type(msgpack.decode(msgpack.encode(1.0)))", "float"},
+        evalTest{"msgpack.decode(unhex('ca3fc00000'))", "1.5"},
+    )
+    evalTests(t, binarySetup, evals)
+}
+
+func TestMsgpackValues(t *testing.T) {
+    evalTests(t, binarySetup, []evalTest{
+        {"hex(msgpack.encode(nil))", "c0"},
+        {"hex(msgpack.encode(msgpack.null))", "c0"},
+        {"msgpack.decode(unhex('c0')) == msgpack.null", "true"},
+        {"hex(msgpack.encode(false)) .. hex(msgpack.encode(true))", "c2c3"},
+        // valid UTF-8 is str, the rest bin, both decode to strings
+        {"hex(msgpack.encode(''))", "a0"},
+        {"hex(msgpack.encode('abc'))", "a3616263"},
+        {"hex(msgpack.encode('日'))", "a3e697a5"},
+        {"hex(msgpack.encode(('a'):rep(31))):sub(1, 4)", "bf61"},
+        {"hex(msgpack.encode(('a'):rep(32))):sub(1, 6)", "d92061"},
+        {"hex(msgpack.encode(('a'):rep(256))):sub(1, 8)", "da010061"},
+        {"hex(msgpack.encode(('a'):rep(65536))):sub(1, 12)", "db0001000061"},
+        {"hex(msgpack.encode('\\xff'))", "c401ff"},
+        {"hex(msgpack.encode(('\\xff'):rep(256))):sub(1, 8)", "c50100ff"},
+        {"hex(msgpack.encode(('\\xff'):rep(65536))):sub(1, 12)", "c600010000ff"},
+        {"msgpack.decode(unhex('c401ff')) == '\\xff'", "true"},
+        {"msgpack.decode(unhex('d90461626364'))", "abcd"},
+        {"msgpack.decode(unhex('c400'))", ""},
+        // arrays and maps, map keys sorted by their encoding
+        {"hex(msgpack.encode({1, 2}))", "920102"},
+        {"hex(msgpack.encode({}))", "80"},
+        {"hex(msgpack.encode(msgpack.empty_array))", "90"},
+        {"hex(msgpack.encode(msgpack.array({[2] = true})))", "92c0c3"},
+        {"hex(msgpack.encode({b = 1, a = 2}))", "82a16102a16201"},
+        {"hex(msgpack.encode({1, a = 2}))", "820101a16102"},
+        {"hex(msgpack.encode({[true] = 1, [false] = 0, [-1] = 2, x = {}}))", "84a17880c200c301ff02"},
+        {"hex(msgpack.encode({1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})):sub(1, 8)", "dc001001"},
+        {"msgpack.encode(msgpack.decode(unhex('82a16201a16102'))) == unhex('82a16102a16201')", "true"},
+        {"getmetatable(msgpack.decode(unhex('90'))) == getmetatable(json.array())", "true"},
+        {"msgpack.decode(unhex('dd00000002a178a179'))[2]", "y"},
+        {"msgpack.decode(unhex('de0001a17801')).x", "1"},
+        // errors
+        {"select(2, msgpack.encode((function() local t = {}; t[1] = t; return t end)()))", "msgpack: cannot encode a table containing itself"},
+        {"select(2, msgpack.encode(print))", "msgpack: cannot encode function"},
+        {"select(2, msgpack.encode({[{}] = 1}))", "msgpack: cannot encode a table key"},
+        {"select(2, msgpack.decode(unhex('0102')))", "msgpack: extra data after value"},
+        {"select(2, msgpack.decode(unhex('cd01')))", "msgpack: data too short"},
+        {"select(2, msgpack.decode(unhex('93')))", "msgpack: data too short"},
+        {"select(2, msgpack.decode(''))", "msgpack: data too short"},
+        {"select(2, msgpack.decode(unhex('c1')))", "msgpack: invalid code 0xc1 at offset 0"},
+        {"select(2, msgpack.decode(unhex('d40000')))", "msgpack: unsupported ext at offset 0"},
+        {"select(2, msgpack.decode(unhex('819001')))", "msgpack: invalid map key at offset 1"},
+        {"select(2, msgpack.decode(1))", "msgpack: string expected, got number"},
+    })
+}
+
+func TestMsgpackUnpack(t *testing.T) {
+    evalTests(t, binarySetup+`
+stream = msgpack.encode(1) .. msgpack.encode('ab') .. msgpack.encode({x = 1}) .. msgpack.encode(nil)
+function values(s)
+    local out, pos = {}, 1
+    while pos <= #s do
+        local v
+        v, pos = msgpack.unpack(s, pos)
+        if v == nil then
+            return pos
+        end
+        out[#out + 1] = type(v) == 'table' and (v.x or 'null') or tostring(v)
+    end
+    return table.concat(out, ',')
+end
+`, []evalTest{
+        {"list(msgpack.unpack(stream))", "1,2"},
+        {"list(msgpack.unpack(stream, 2))", "ab,5"},
+        {"select(2, msgpack.unpack(stream, 5))", "9"},
+        {"values(stream)", "1,ab,1,null"},
+        {"values(stream:sub(1, 7))", "msgpack: data too short"},
+        {"list(msgpack.unpack(''))", "nil,msgpack: data too short"},
+    })
+}
@@ -0,0 +1,324 @@
+package golualib
+
+import (
+    "context"
+    "hash/fnv"
+    "io"
+    "log"
+    "sync"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+// Router maps a routing key onto one of n shards
+type Router func(key uint64, n int) int
+
+func ModRouter(key uint64, n int) int {
+    return int(key % uint64(n))
+}
+
+func HashKey(s string) uint64 {
+    h := fnv.New64a()
+    _, _ = h.Write([]byte(s))
+    return h.Sum64()
+}
+
+// ContextPool runs N independent Lua states, each on its own goroutine.
+// Listeners opened by the modules are shared between the states and every
+// event is routed to one of them by key.
+type ContextPool struct {
+    mutex    sync.Mutex
+    contexts []*luaContext
+    router   Router
+    shared   map[string]interface{}
+    closers  []io.Closer
+    doneChan chan struct{}
+    doneOnce sync.Once
+}
+
+// NewContextPool creates n contexts and calls init on each of them to
+// register modules and run the entry script.
+func NewContextPool(n int, init func(ctx LuaContext) error, opts ...Option) (*ContextPool, error) {
+    p := &ContextPool{
+        router:   ModRouter,
+        shared:   make(map[string]interface{}),
+        doneChan: make(chan struct{}),
+    }
+    for i := 0; i < n; i++ {
+        ctx := newContext(nil, opts...)
+        ctx.pool = p
+        ctx.shard = i
+        ctx.initializer = init
+        p.contexts = append(p.contexts, ctx)
+        if err := init(ctx); err != nil {
+            _ = p.Close(context.Background())
+            return nil, err
+        }
+    }
+    return p, nil
+}
+
+func (p *ContextPool) SetRouter(r Router) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    p.router = r
+}
+
+func (p *ContextPool) Size() int {
+    return len(p.contexts)
+}
+
+func (p *ContextPool) Context(i int) LuaContext {
+    return p.contexts[i]
+}
+
+func (p *ContextPool) Contexts() []LuaContext {
+    rs := make([]LuaContext, 0, len(p.contexts))
+    for _, ctx := range p.contexts {
+        rs = append(rs, ctx)
+    }
+    return rs
+}
+
+// Route returns the context responsible for key
+func (p *ContextPool) Route(key uint64) LuaContext {
+    return p.contexts[p.pick(key, len(p.contexts))]
+}
+
+func (p *ContextPool) pick(key uint64, n int) int {
+    p.mutex.Lock()
+    r := p.router
+    p.mutex.Unlock()
+    return r(key, n)
+}
+
+func (p *ContextPool) Stats() []ContextStats {
+    rs := make([]ContextStats, 0, len(p.contexts))
+    for _, ctx := range p.contexts {
+        rs = append(rs, ctx.Stats())
+    }
+    return rs
+}
+
+func (p *ContextPool) Start() {
+    for _, ctx := range p.contexts {
+        ctx.Start()
+    }
+}
+
+func (p *ContextPool) WaitQuit() {
+    p.Start()
+    if len(p.contexts) > 0 {
+        p.contexts[0].gcPolicy.run(p.doneChan)
+    }
+    if sig, ok := waitSignal(p.doneChan); ok {
+        timeoutCtx, cancel := timeoutContext(ShutdownTimeout)
+        defer cancel()
+        if err := p.shutdown(timeoutCtx, sig.String()); err != nil {
+            log.Println(err)
+        }
+    }
+}
+
+// Close shuts down every context of the pool concurrently
+func (p *ContextPool) Close(c context.Context) error {
+    return p.shutdown(c, "close")
+}
+
+func (p *ContextPool) shutdown(c context.Context, reason string) error {
+    var (
+        wg    sync.WaitGroup
+        mutex sync.Mutex
+        err   error
+    )
+    for _, ctx := range p.contexts {
+        wg.Add(1)
+        go func(ctx *luaContext) {
+            defer wg.Done()
+            if e := ctx.shutdown(c, reason); e != nil {
+                mutex.Lock()
+                if err == nil {
+                    err = e
+                }
+                mutex.Unlock()
+            }
+        }(ctx)
+    }
+    wg.Wait()
+
+    p.mutex.Lock()
+    closers := p.closers
+    p.closers = nil
+    p.mutex.Unlock()
+    for i := len(closers) - 1; i >= 0; i-- {
+        if e := closers[i].Close(); e != nil && err == nil {
+            err = e
+        }
+    }
+    p.doneOnce.Do(func() {
+        close(p.doneChan)
+    })
+    return err
+}
+
+// Shared returns the object registered under name for ctx, calling open the
+// first time. Contexts of a pool share the same objects. A nil result of open
+// is not remembered.
+func Shared(ctx LuaContext, name string, open func() interface{}) (v interface{}, created bool) {
+    mutex, shared := sharedOf(ctx)
+    if shared == nil {
+        return open(), true
+    }
+    mutex.Lock()
+    defer mutex.Unlock()
+    if v, ok := shared[name]; ok {
+        return v, false
+    }
+    v = open()
+    if v != nil {
+        shared[name] = v
+    }
+    return v, true
+}
+
+// AddSharedCloser registers a resource created by Shared. Inside a pool it is
+// released with the pool rather than with the context that opened it. Shared
+// resources are kept when the Lua state is restarted.
+func AddSharedCloser(ctx LuaContext, c io.Closer) {
+    lc, ok := ctx.(*luaContext)
+    if !ok {
+        ctx.AddCloser(c)
+        return
+    }
+    if lc.pool != nil {
+        lc.pool.mutex.Lock()
+        lc.pool.closers = append(lc.pool.closers, c)
+        lc.pool.mutex.Unlock()
+        return
+    }
+    lc.mutex.Lock()
+    if lc.released {
+        lc.mutex.Unlock()
+        _ = c.Close()
+        return
+    }
+    lc.sharedClosers = append(lc.sharedClosers, c)
+    lc.mutex.Unlock()
+}
+
+// Unshare forgets the object registered under name, typically once it is closed
+func Unshare(ctx LuaContext, name string) {
+    mutex, shared := sharedOf(ctx)
+    if shared == nil {
+        return
+    }
+    mutex.Lock()
+    defer mutex.Unlock()
+    delete(shared, name)
+}
+
+func sharedOf(ctx LuaContext) (*sync.Mutex, map[string]interface{}) {
+    c, ok := ctx.(*luaContext)
+    if !ok {
+        return nil, nil
+    }
+    if c.pool != nil {
+        return &c.pool.mutex, c.pool.shared
+    }
+    return &c.sharedMu, c.shared
+}
+
+// Route picks one of n handlers registered for a shared resource
+func Route(ctx LuaContext, key uint64, n int) int {
+    if n <= 1 {
+        return 0
+    }
+    if c, ok := ctx.(*luaContext); ok && c.pool != nil {
+        return c.pool.pick(key, n)
+    }
+    return ModRouter(key, n)
+}
+
+// Target is a Lua callback owned by one context
+type Target struct {
+    Ctx LuaContext
+    Ref int
+    gen int
+}
+
+func (t *Target) LuaState() *lua.State {
+    return t.Ctx.LuaState()
+}
+
+// Push pushes the callback onto the state of its context. It returns false
+// without pushing anything when the state was restarted since registration.
+// Push must be called on the goroutine of the context.
+func (t *Target) Push() bool {
+    if generationOf(t.Ctx) != t.gen {
+        return false
+    }
+    t.Ctx.LuaState().RawGeti(lua.LUA_REGISTRYINDEX, t.Ref)
+    return true
+}
+
+// Unref releases the callback on its own context goroutine
+func (t *Target) Unref() {
+    t.Ctx.Run(func() {
+        if generationOf(t.Ctx) == t.gen {
+            t.Ctx.LuaState().Unref(lua.LUA_REGISTRYINDEX, t.Ref)
+        }
+    })
+}
+
+func generationOf(ctx LuaContext) int {
+    if c, ok := ctx.(*luaContext); ok {
+        return c.generation()
+    }
+    return 0
+}
+
+// Targets is a set of callbacks registered on a shared resource,
+// one per context that opened it
+type Targets struct {
+    mutex   sync.RWMutex
+    targets []*Target
+}
+
+// Add registers the callback at ref for ctx. If ctx already has a callback
+// it is replaced in place, so connections bound to it see the new function.
+// Add must be called on the goroutine of ctx, it returns whether ctx is new.
+func (ts *Targets) Add(ctx LuaContext, ref int) bool {
+    ts.mutex.Lock()
+    defer ts.mutex.Unlock()
+    gen := generationOf(ctx)
+    for _, t := range ts.targets {
+        if t.Ctx != ctx {
+            continue
+        }
+        if t.gen == gen {
+            L := ctx.LuaState()
+            L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+            L.RawSeti(lua.LUA_REGISTRYINDEX, t.Ref)
+            L.Unref(lua.LUA_REGISTRYINDEX, ref)
+        } else {
+            t.Ref, t.gen = ref, gen
+        }
+        return false
+    }
+    ts.targets = append(ts.targets, &Target{Ctx: ctx, Ref: ref, gen: gen})
+    return true
+}
+
+func (ts *Targets) Pick(key uint64) *Target {
+    ts.mutex.RLock()
+    defer ts.mutex.RUnlock()
+    return ts.targets[Route(ts.targets[0].Ctx, key, len(ts.targets))]
+}
+
+func (ts *Targets) UnrefAll() {
+    ts.mutex.RLock()
+    defer ts.mutex.RUnlock()
+    for _, t := range ts.targets {
+        t.Unref()
+    }
+}
@@ -0,0 +1,279 @@
+package golualib
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+// OriginStats is the time and memory spent by the callbacks of one origin.
+// Origins are the sources given to Call, e.g. "looper.tick", "kcp.data" or
+// "http.request /login", "go" for callbacks that never entered Lua.
+type OriginStats struct {
+    Origin string
+    Count  int64
+    Wall   time.Duration
+    Max    time.Duration
+    // Alloc sums the growth of the Lua heap during the callbacks, memory
+    // collected while they ran is not counted
+    Alloc int64
+}
+
+type callbackProfiler struct {
+    mutex   sync.Mutex
+    origins map[string]*OriginStats
+}
+
+func newCallbackProfiler() *callbackProfiler {
+    return &callbackProfiler{origins: make(map[string]*OriginStats)}
+}
+
+func (p *callbackProfiler) record(origin string, d time.Duration, alloc int64) {
+    if origin == "" {
+        origin = "go"
+    }
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    s, ok := p.origins[origin]
+    if !ok {
+        s = &OriginStats{Origin: origin}
+        p.origins[origin] = s
+    }
+    s.Count++
+    s.Wall += d
+    if d > s.Max {
+        s.Max = d
+    }
+    if alloc > 0 {
+        s.Alloc += alloc
+    }
+}
+
+func (p *callbackProfiler) snapshot(reset bool) []OriginStats {
+    p.mutex.Lock()
+    rs := make([]OriginStats, 0, len(p.origins))
+    for _, s := range p.origins {
+        rs = append(rs, *s)
+    }
+    if reset {
+        p.origins = make(map[string]*OriginStats)
+    }
+    p.mutex.Unlock()
+    sort.Slice(rs, func(i, j int) bool {
+        return rs[i].Wall > rs[j].Wall
+    })
+    return rs
+}
+
+// CallbackProfile returns the time spent per origin by the callbacks of
+// ctx, slowest first. reset starts a new measurement.
+func CallbackProfile(ctx LuaContext, reset bool) []OriginStats {
+    if lc, ok := ctx.(*luaContext); ok {
+        return lc.profiler.snapshot(reset)
+    }
+    return nil
+}
+
+// SetOrigin names the callback running on ctx for the profiler. Call
+// does it with its source unless the callback already has an origin.
+func SetOrigin(ctx LuaContext, origin string) {
+    if lc, ok := ctx.(*luaContext); ok {
+        lc.origin = origin
+    }
+}
+
+func setDefaultOrigin(ctx LuaContext, origin string) {
+    if lc, ok := ctx.(*luaContext); ok && lc.origin == "" {
+        lc.origin = origin
+    }
+}
+
+func formatOrigins(rs []OriginStats) []string {
+    lines := make([]string, 0, len(rs))
+    for _, s := range rs {
+        avg := time.Duration(0)
+        if s.Count > 0 {
+            avg = s.Wall / time.Duration(s.Count)
+        }
+        lines = append(lines, fmt.Sprintf("%-32s count %d wall %v avg %v max %v alloc %dB",
+            s.Origin, s.Count, s.Wall, avg, s.Max, s.Alloc))
+    }
+    return lines
+}
+
+func luaMemory(L *lua.State) int64 {
+    return int64(L.GC(lua.LUA_GCCOUNT, 0))*1024 + int64(L.GC(lua.LUA_GCCOUNTB, 0))
+}
+
+const (
+    registryProfileStart = "_golualib_profile_start_"
+    registryProfileStop  = "_golualib_profile_stop_"
+    // spawn hooks the coroutines it creates while this is set
+    registryProfileHook = "_golualib_profile_hook_"
+
+    // DefaultProfilePeriod is the number of instructions between two samples
+    DefaultProfilePeriod = 1000
+)
+
+var ErrProfilerUnavailable = errors.New("lua profiler unavailable: the sandbox limits own the debug hook")
+
+// profilerCode samples the Lua stack every period instructions on the main
+// thread and on the coroutines started by Spawn while it runs
+const profilerCode = `
+local reg = debug.getregistry()
+local sethook, getinfo, running = debug.sethook, debug.getinfo, coroutine.running
+local concat, gsub, sort, tostring = table.concat, string.gsub, table.sort, tostring
+local main = running()
+local counts, period
+
+local function frame(info)
+    local name = info.name or (info.what == 'main' and 'main chunk') or '?'
+    local at = info.what == 'C' and '[C]' or (info.short_src .. ':' .. info.linedefined)
+    return gsub(name .. ' ' .. at, ';', ',')
+end
+
+local function sample()
+    local stack = {}
+    local level = 2
+    while true do
+        local info = getinfo(level, 'Sn')
+        if not info then
+            break
+        end
+        stack[#stack + 1] = frame(info)
+        level = level + 1
+    end
+    if running() ~= main then
+        stack[#stack + 1] = 'coroutine'
+    end
+    -- folded stacks list the root first
+    local n = #stack
+    for i = 1, n // 2 do
+        stack[i], stack[n - i + 1] = stack[n - i + 1], stack[i]
+    end
+    local key = concat(stack, ';')
+    counts[key] = (counts[key] or 0) + 1
+end
+
+local function hook(co)
+    sethook(co, sample, '', period)
+end
+
+reg._golualib_profile_start_ = function(p)
+    counts, period = {}, p
+    sethook(sample, '', period)
+    reg._golualib_profile_hook_ = hook
+end
+
+reg._golualib_profile_stop_ = function()
+    sethook()
+    reg._golualib_profile_hook_ = nil
+    local keys = {}
+    for k in pairs(counts or {}) do
+        keys[#keys + 1] = k
+    end
+    sort(keys)
+    local out = {}
+    for _, k in ipairs(keys) do
+        out[#out + 1] = k .. ' ' .. tostring(counts[k]) .. '\n'
+    end
+    counts = nil
+    return concat(out)
+end
+`
+
+// runWait runs fn on the context goroutine and waits for it
+func runWait(ctx LuaContext, fn func() error) error {
+    done := make(chan error, 1)
+    if err := ctx.RunPriority(PriorityHigh, func() {
+        done <- fn()
+    }); err != nil {
+        return err
+    }
+    select {
+    case err := <-done:
+        return err
+    case <-ctx.Done():
+        return ErrContextClosed
+    }
+}
+
+// StartLuaProfiler samples the Lua stacks of ctx every period instructions
+// until StopLuaProfiler. Coroutines started before are not sampled.
+func StartLuaProfiler(ctx LuaContext, period int) error {
+    if lc, ok := ctx.(*luaContext); ok && lc.sandbox != nil && lc.sandbox.hasLimits() {
+        return ErrProfilerUnavailable
+    }
+    if period <= 0 {
+        period = DefaultProfilePeriod
+    }
+    return runWait(ctx, func() error {
+        L := ctx.LuaState()
+        L.GetField(lua.LUA_REGISTRYINDEX, registryProfileStart)
+        L.PushInteger(int64(period))
+        return L.Call(1, 0)
+    })
+}
+
+// StopLuaProfiler stops sampling and writes the samples as folded stacks,
+// the input of flamegraph.pl
+func StopLuaProfiler(ctx LuaContext, w io.Writer) error {
+    var folded string
+    err := runWait(ctx, func() error {
+        L := ctx.LuaState()
+        L.GetField(lua.LUA_REGISTRYINDEX, registryProfileStop)
+        if err := L.Call(0, 1); err != nil {
+            return err
+        }
+        folded = L.ToString(-1)
+        L.Pop(1)
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    _, err = io.WriteString(w, folded)
+    return err
+}
+
+// ProfileHandler serves the Lua profile of ctx as folded stacks, sampling
+// for ?seconds= ( 10 by default ) every ?period= instructions
+func ProfileHandler(ctx LuaContext) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        seconds, err := strconv.ParseFloat(r.FormValue("seconds"), 64)
+        if err != nil || seconds <= 0 {
+            seconds = 10
+        }
+        period, _ := strconv.Atoi(r.FormValue("period"))
+        if err := StartLuaProfiler(ctx, period); err != nil {
+            http.Error(w, err.Error(), http.StatusServiceUnavailable)
+            return
+        }
+        select {
+        case <-time.After(time.Duration(seconds * float64(time.Second))):
+        case <-r.Context().Done():
+        }
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        if err := StopLuaProfiler(ctx, w); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+        }
+    })
+}
+
+// CallbackProfileHandler serves CallbackProfile of ctx, ?reset=1 starts a
+// new measurement
+func CallbackProfileHandler(ctx LuaContext) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        lines := formatOrigins(CallbackProfile(ctx, r.FormValue("reset") != ""))
+        _, _ = io.WriteString(w, strings.Join(lines, "\n")+"\n")
+    })
+}
@@ -0,0 +1,203 @@
+package golualib
+
+import (
+    "errors"
+    "sync"
+    "time"
+)
+
+// Priority selects the lane of a queued callback. Callbacks of a higher lane
+// always run before the ones of a lower lane.
+type Priority int
+
+const (
+    PriorityLow Priority = iota
+    PriorityNormal
+    PriorityHigh
+    numPriorities
+)
+
+func (p Priority) String() string {
+    switch p {
+    case PriorityLow:
+        return "low"
+    case PriorityHigh:
+        return "high"
+    }
+    return "normal"
+}
+
+// OverflowPolicy decides what Run does when the lane of a callback is full
+type OverflowPolicy int
+
+const (
+    // OverflowBlock waits until the context made room
+    OverflowBlock OverflowPolicy = iota
+    // OverflowDropOldest discards the oldest callback of the lane, which
+    // is never executed
+    OverflowDropOldest
+    // OverflowReject returns ErrQueueFull to the caller
+    OverflowReject
+)
+
+var (
+    ErrQueueFull = errors.New("lua context queue full")
+
+    // DefaultQueueOptions are used by new contexts
+    DefaultQueueOptions = QueueOptions{Size: 1024, Overflow: OverflowBlock}
+
+    queueDepthBounds = []float64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024, 2048, 4096}
+    queueWaitBounds  = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+)
+
+// QueueOptions configures the callback queue of a context.
+// Size is the capacity of each lane, 0 means unbounded.
+type QueueOptions struct {
+    Size     int
+    Overflow OverflowPolicy
+}
+
+// LaneStats describes one priority lane. Wait is the time in seconds
+// callbacks spent queued before running.
+type LaneStats struct {
+    Priority Priority
+    Depth    int
+    Dropped  int64
+    Rejected int64
+    Wait     HistogramSnapshot
+}
+
+type task struct {
+    cb func()
+    at time.Time
+}
+
+type callbackQueue struct {
+    mutex    sync.Mutex
+    notFull  *sync.Cond
+    signal   chan struct{}
+    lanes    [numPriorities][]task
+    options  QueueOptions
+    stopped  bool
+    depth    *Histogram
+    waits    [numPriorities]*Histogram
+    dropped  [numPriorities]int64
+    rejected [numPriorities]int64
+}
+
+func newCallbackQueue(options QueueOptions) *callbackQueue {
+    q := &callbackQueue{
+        signal:  make(chan struct{}, 1),
+        options: options,
+        depth:   NewHistogram(queueDepthBounds...),
+    }
+    q.notFull = sync.NewCond(&q.mutex)
+    for i := range q.waits {
+        q.waits[i] = NewHistogram(queueWaitBounds...)
+    }
+    return q
+}
+
+func (q *callbackQueue) setOptions(options QueueOptions) {
+    q.mutex.Lock()
+    q.options = options
+    q.mutex.Unlock()
+    q.notFull.Broadcast()
+}
+
+// push appends cb to lane p, force ignores the capacity. It returns the
+// number of callbacks dropped to make room.
+func (q *callbackQueue) push(p Priority, cb func(), force bool) (int, error) {
+    if p < PriorityLow || p >= numPriorities {
+        p = PriorityNormal
+    }
+    q.mutex.Lock()
+    dropped := 0
+    for {
+        if q.stopped {
+            q.mutex.Unlock()
+            return dropped, ErrContextClosed
+        }
+        if force || q.options.Size <= 0 || len(q.lanes[p]) < q.options.Size {
+            break
+        }
+        switch q.options.Overflow {
+        case OverflowReject:
+            q.rejected[p]++
+            q.mutex.Unlock()
+            return dropped, ErrQueueFull
+        case OverflowDropOldest:
+            q.lanes[p][0] = task{}
+            q.lanes[p] = q.lanes[p][1:]
+            q.dropped[p]++
+            dropped++
+        default:
+            q.notFull.Wait()
+        }
+    }
+    q.lanes[p] = append(q.lanes[p], task{cb: cb, at: time.Now()})
+    q.depth.Observe(float64(q.size()))
+    q.mutex.Unlock()
+
+    select {
+    case q.signal <- struct{}{}:
+    default:
+    }
+    return dropped, nil
+}
+
+// pop takes the oldest callback of the highest non-empty lane
+func (q *callbackQueue) pop() (func(), bool) {
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+    for p := numPriorities - 1; p >= PriorityLow; p-- {
+        if len(q.lanes[p]) == 0 {
+            continue
+        }
+        t := q.lanes[p][0]
+        q.lanes[p][0] = task{}
+        q.lanes[p] = q.lanes[p][1:]
+        q.waits[p].Observe(time.Since(t.at).Seconds())
+        q.notFull.Broadcast()
+        return t.cb, true
+    }
+    return nil, false
+}
+
+// stop discards the queued callbacks and wakes blocked producers,
+// it returns the number of discarded callbacks
+func (q *callbackQueue) stop() int {
+    q.mutex.Lock()
+    q.stopped = true
+    n := q.size()
+    for i := range q.lanes {
+        q.lanes[i] = nil
+    }
+    q.mutex.Unlock()
+    q.notFull.Broadcast()
+    return n
+}
+
+func (q *callbackQueue) size() int {
+    n := 0
+    for _, lane := range q.lanes {
+        n += len(lane)
+    }
+    return n
+}
+
+func (q *callbackQueue) stats() []LaneStats {
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+    rs := make([]LaneStats, 0, numPriorities)
+    for p := PriorityLow; p < numPriorities; p++ {
+        rs = append(rs, LaneStats{
+            Priority: p,
+            Depth:    len(q.lanes[p]),
+            Dropped:  q.dropped[p],
+            Rejected: q.rejected[p],
+            Wait:     q.waits[p].Snapshot(),
+        })
+    }
+    return rs
+}
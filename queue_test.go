@@ -0,0 +1,222 @@
+package golualib
+
+import (
+    "context"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// queueRecorder collects the names of the callbacks that ran
+type queueRecorder struct {
+    mutex sync.Mutex
+    names []string
+}
+
+func (r *queueRecorder) cb(name string) func() {
+    return func() {
+        r.mutex.Lock()
+        r.names = append(r.names, name)
+        r.mutex.Unlock()
+    }
+}
+
+func (r *queueRecorder) String() string {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return strings.Join(r.names, " ")
+}
+
+// blockedContext starts a context busy in a callback until release is
+// called, so the next callbacks stay queued
+func blockedContext(t *testing.T, options QueueOptions) (LuaContext, func()) {
+    t.Helper()
+    ctx := NewDefaultContext(nil, WithQueueOptions(options))
+    ctx.Start()
+    started, gate := make(chan struct{}), make(chan struct{})
+    if err := ctx.RunPriority(PriorityHigh, func() {
+        close(started)
+        <-gate
+    }); err != nil {
+        t.Fatal(err)
+    }
+    <-started
+    var once sync.Once
+    release := func() {
+        once.Do(func() { close(gate) })
+    }
+    t.Cleanup(func() {
+        release()
+        ctx.Close(context.Background())
+    })
+    return ctx, release
+}
+
+// drain runs the queued callbacks and closes ctx
+func drain(t *testing.T, ctx LuaContext, release func()) {
+    t.Helper()
+    release()
+    if err := ctx.Close(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestQueuePriorities(t *testing.T) {
+    ctx, release := blockedContext(t, QueueOptions{})
+    var rec queueRecorder
+    for _, c := range []struct {
+        p    Priority
+        name string
+    }{
+        {PriorityLow, "low1"}, {PriorityNormal, "normal1"}, {PriorityHigh, "high1"},
+        {PriorityLow, "low2"}, {PriorityNormal, "normal2"}, {PriorityHigh, "high2"},
+        // out of range lanes are normal
+        {Priority(7), "normal3"},
+    } {
+        if err := ctx.RunPriority(c.p, rec.cb(c.name)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    lanes := ctx.Stats().Lanes
+    if lanes[PriorityLow].Depth != 2 || lanes[PriorityNormal].Depth != 3 || lanes[PriorityHigh].Depth != 2 {
+        t.Errorf("lane depths %+v", lanes)
+    }
+    drain(t, ctx, release)
+    if got, want := rec.String(), "high1 high2 normal1 normal2 normal3 low1 low2"; got != want {
+        t.Errorf("ran %q, want %q", got, want)
+    }
+}
+
+func TestQueueReject(t *testing.T) {
+    ctx, release := blockedContext(t, QueueOptions{Size: 2, Overflow: OverflowReject})
+    var rec queueRecorder
+    for _, c := range []struct {
+        p    Priority
+        name string
+        err  error
+    }{
+        {PriorityNormal, "a", nil},
+        {PriorityNormal, "b", nil},
+        {PriorityNormal, "c", ErrQueueFull},
+        // each lane has its own capacity
+        {PriorityHigh, "h", nil},
+        {PriorityLow, "l1", nil},
+        {PriorityLow, "l2", nil},
+        {PriorityLow, "l3", ErrQueueFull},
+        {PriorityNormal, "d", ErrQueueFull},
+    } {
+        if err := ctx.RunPriority(c.p, rec.cb(c.name)); err != c.err {
+            t.Errorf("Run %s returned %v, want %v", c.name, err, c.err)
+        }
+    }
+    stats := ctx.Stats()
+    if stats.Queued != 5 {
+        t.Errorf("queued %d, want 5", stats.Queued)
+    }
+    if l := stats.Lanes[PriorityNormal]; l.Rejected != 2 || l.Depth != 2 || l.Dropped != 0 {
+        t.Errorf("normal lane %+v", l)
+    }
+    if l := stats.Lanes[PriorityLow]; l.Rejected != 1 || l.Depth != 2 {
+        t.Errorf("low lane %+v", l)
+    }
+    drain(t, ctx, release)
+    if got, want := rec.String(), "h a b l1 l2"; got != want {
+        t.Errorf("ran %q, want %q", got, want)
+    }
+}
+
+func TestQueueDropOldest(t *testing.T) {
+    ctx, release := blockedContext(t, QueueOptions{Size: 2, Overflow: OverflowDropOldest})
+    var rec queueRecorder
+    for _, name := range []string{"a", "b", "c", "d"} {
+        if err := ctx.Run(rec.cb(name)); err != nil {
+            t.Errorf("Run %s returned %v", name, err)
+        }
+    }
+    if err := ctx.RunPriority(PriorityLow, rec.cb("low")); err != nil {
+        t.Error(err)
+    }
+    stats := ctx.Stats()
+    if stats.Queued != 3 {
+        t.Errorf("queued %d, want 3", stats.Queued)
+    }
+    if l := stats.Lanes[PriorityNormal]; l.Dropped != 2 || l.Depth != 2 || l.Rejected != 0 {
+        t.Errorf("normal lane %+v", l)
+    }
+    drain(t, ctx, release)
+    // the dropped callbacks never run, Close does not wait for them
+    if got, want := rec.String(), "c d low"; got != want {
+        t.Errorf("ran %q, want %q", got, want)
+    }
+}
+
+func TestQueueBlock(t *testing.T) {
+    ctx, release := blockedContext(t, QueueOptions{Size: 1, Overflow: OverflowBlock})
+    var rec queueRecorder
+    if err := ctx.Run(rec.cb("a")); err != nil {
+        t.Fatal(err)
+    }
+    done := make(chan error, 1)
+    go func() {
+        done <- ctx.Run(rec.cb("b"))
+    }()
+    select {
+    case err := <-done:
+        t.Fatalf("Run on a full lane returned %v", err)
+    case <-time.After(50 * time.Millisecond):
+    }
+    release()
+    select {
+    case err := <-done:
+        if err != nil {
+            t.Fatal(err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Run stayed blocked after the lane made room")
+    }
+    drain(t, ctx, release)
+    if got, want := rec.String(), "a b"; got != want {
+        t.Errorf("ran %q, want %q", got, want)
+    }
+    if l := ctx.Stats().Lanes[PriorityNormal]; l.Dropped != 0 || l.Rejected != 0 {
+        t.Errorf("normal lane %+v", l)
+    }
+}
+
+func TestQueueOptionsChange(t *testing.T) {
+    ctx, release := blockedContext(t, QueueOptions{Size: 1, Overflow: OverflowBlock})
+    var rec queueRecorder
+    if err := ctx.Run(rec.cb("a")); err != nil {
+        t.Fatal(err)
+    }
+    done := make(chan error, 1)
+    go func() {
+        done <- ctx.Run(rec.cb("b"))
+    }()
+    select {
+    case err := <-done:
+        t.Fatalf("Run on a full lane returned %v", err)
+    case <-time.After(50 * time.Millisecond):
+    }
+    // a larger lane wakes the blocked producer
+    ctx.SetQueueOptions(QueueOptions{Size: 2, Overflow: OverflowReject})
+    select {
+    case err := <-done:
+        if err != nil {
+            t.Fatal(err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Run stayed blocked after the lane grew")
+    }
+    if err := ctx.Run(rec.cb("c")); err != ErrQueueFull {
+        t.Errorf("Run on a full lane returned %v, want %v", err, ErrQueueFull)
+    }
+    drain(t, ctx, release)
+    if got, want := rec.String(), "a b"; got != want {
+        t.Errorf("ran %q, want %q", got, want)
+    }
+    if err := ctx.Run(rec.cb("closed")); err != ErrContextClosed {
+        t.Errorf("Run after Close returned %v, want %v", err, ErrContextClosed)
+    }
+}
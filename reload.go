@@ -0,0 +1,265 @@
+package golualib
+
+import (
+    "errors"
+    "log"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+const reloadCode = `
+local entries, changed, abs, std, sources, run = ...
+local loaded, pcall = std.loaded, std.pcall
+local lpath = package and package.path or std.path
+local dirty = {}
+for _, path in ipairs(changed) do
+    dirty[path] = true
+end
+for name in pairs(loaded) do
+    if type(name) == 'string' then
+        -- modules of the context FS are matched by the path they came from
+        local source = sources and sources[name]
+        local path = not source and std.searchpath(name, lpath)
+        if (source and dirty[source]) or (path and dirty[abs(path)]) then
+            loaded[name] = nil
+            if source then
+                sources[name] = nil
+            end
+        end
+    end
+end
+run = run or function(path)
+    local ok, err = pcall(std.dofile, path)
+    if not ok then
+        return tostring(err)
+    end
+end
+for _, path in ipairs(entries) do
+    local err = run(path)
+    if err then
+        return err
+    end
+end
+if OnReload then
+    local ok, err = pcall(OnReload, changed)
+    if not ok then
+        return tostring(err)
+    end
+end
+`
+
+// Reloader re-executes the entry script of running contexts when the
+// scripts under its directory change. Listeners opened by the modules are
+// kept and rebound to the callbacks registered by the new code.
+type Reloader struct {
+    mutex     sync.Mutex
+    entry     string
+    dir       string
+    // fsys tells the contexts load the scripts of dir through WithFS, entry
+    // and the changed paths are then names in that FS
+    fsys      bool
+    contexts  []LuaContext
+    mtimes    map[string]time.Time
+    stopChan  chan struct{}
+    closeOnce sync.Once
+}
+
+func NewReloader(entry string, contexts ...LuaContext) *Reloader {
+    if abs, err := filepath.Abs(entry); err == nil {
+        entry = abs
+    }
+    r := &Reloader{
+        entry:    entry,
+        dir:      filepath.Dir(entry),
+        contexts: contexts,
+        mtimes:   make(map[string]time.Time),
+        stopChan: make(chan struct{}),
+    }
+    r.scan()
+    return r
+}
+
+// NewFSReloader reloads contexts created with WithFS(os.DirFS(dir)), entry
+// is the name of the entry script in that FS. The entry runs through DoFile
+// and the modules are invalidated by the FS path they were loaded from.
+func NewFSReloader(dir, entry string, contexts ...LuaContext) *Reloader {
+    r := &Reloader{
+        entry:    entry,
+        dir:      dir,
+        fsys:     true,
+        contexts: contexts,
+        mtimes:   make(map[string]time.Time),
+        stopChan: make(chan struct{}),
+    }
+    r.scan()
+    return r
+}
+
+// Reload clears the changed modules from package.loaded, re-executes the
+// entry script and calls the OnReload( changed ) Lua hook in every context.
+// The changed paths are names in the FS for a Reloader of NewFSReloader.
+func (r *Reloader) Reload(changed ...string) error {
+    var firstErr error
+    for _, ctx := range r.contexts {
+        if err := r.reload(ctx, changed); err != nil {
+            log.Println(err)
+            if firstErr == nil {
+                firstErr = err
+            }
+        }
+    }
+    return firstErr
+}
+
+func (r *Reloader) reload(ctx LuaContext, changed []string) error {
+    var (
+        err  error
+        done = make(chan struct{})
+    )
+    if e := ctx.Run(func() {
+        defer close(done)
+        L := ctx.LuaState()
+        if L.LoadString(reloadCode) != 0 {
+            err = errors.New(L.ToString(-1))
+            return
+        }
+        pushStrings(L, []string{r.entry})
+        pushStrings(L, changed)
+        L.PushGoFunction(func(L *lua.State) int {
+            path := L.CheckString(1)
+            if abs, err := filepath.Abs(path); err == nil {
+                path = abs
+            }
+            L.PushString(path)
+            return 1
+        })
+        L.GetField(lua.LUA_REGISTRYINDEX, registryStdlib)
+        L.GetField(lua.LUA_REGISTRYINDEX, registryFSSources)
+        if r.fsys {
+            L.PushGoFunction(func(L *lua.State) int {
+                if err := DoFile(ctx, L.CheckString(1)); err != nil {
+                    L.PushString(err.Error())
+                    return 1
+                }
+                return 0
+            })
+        } else {
+            L.PushNil()
+        }
+        if e := L.Call(6, 1); e != nil {
+            err = e
+            return
+        }
+        if L.Type(-1) == lua.LUA_TSTRING {
+            err = errors.New(L.ToString(-1))
+        }
+    }); e != nil {
+        return e
+    }
+    select {
+    case <-done:
+        return err
+    case <-ctx.Done():
+        return ErrContextClosed
+    }
+}
+
+// Watch polls the script directory every interval and reloads on changes
+func (r *Reloader) Watch(interval time.Duration) {
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-r.stopChan:
+                return
+            case <-r.done():
+                return
+            case <-ticker.C:
+                if changed := r.scan(); len(changed) > 0 {
+                    r.Reload(changed...)
+                }
+            }
+        }
+    }()
+}
+
+// WatchSignal reloads whenever the process receives SIGHUP
+func (r *Reloader) WatchSignal() {
+    c := make(chan os.Signal, 1)
+    signal.Notify(c, syscall.SIGHUP)
+    go func() {
+        defer signal.Stop(c)
+        for {
+            select {
+            case <-r.stopChan:
+                return
+            case <-r.done():
+                return
+            case <-c:
+                r.Reload(r.scan()...)
+            }
+        }
+    }()
+}
+
+func (r *Reloader) Close() error {
+    r.closeOnce.Do(func() {
+        close(r.stopChan)
+    })
+    return nil
+}
+
+func (r *Reloader) done() <-chan struct{} {
+    if len(r.contexts) == 0 {
+        return nil
+    }
+    return r.contexts[0].Done()
+}
+
+// scan returns the scripts modified since the previous scan
+func (r *Reloader) scan() []string {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    var changed []string
+    _ = filepath.Walk(r.dir, func(path string, info os.FileInfo, err error) error {
+        if err != nil || info.IsDir() || !strings.HasSuffix(path, ".lua") {
+            return nil
+        }
+        if last, ok := r.mtimes[path]; ok && !info.ModTime().After(last) {
+            return nil
+        }
+        if _, ok := r.mtimes[path]; ok {
+            changed = append(changed, r.name(path))
+        }
+        r.mtimes[path] = info.ModTime()
+        return nil
+    })
+    return changed
+}
+
+// name returns the path the contexts know the script at path by
+func (r *Reloader) name(path string) string {
+    if !r.fsys {
+        return path
+    }
+    if rel, err := filepath.Rel(r.dir, path); err == nil {
+        return filepath.ToSlash(rel)
+    }
+    return path
+}
+
+func pushStrings(L *lua.State, ss []string) {
+    L.CreateTable(len(ss), 0)
+    for i, s := range ss {
+        L.PushString(s)
+        L.RawSeti(-2, i+1)
+    }
+}
@@ -0,0 +1,70 @@
+package golualib
+
+import (
+    "context"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestFSReloaderInvalidatesFSModules(t *testing.T) {
+    dir, err := ioutil.TempDir("", "reload")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    write := func(name, code string, mtime time.Time) {
+        path := filepath.Join(dir, name)
+        if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := ioutil.WriteFile(path, []byte(code), 0644); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.Chtimes(path, mtime, mtime); err != nil {
+            t.Fatal(err)
+        }
+    }
+    past := time.Now().Add(-time.Hour)
+    write("main.lua", "value = require('lib.mod').v", past)
+    write("lib/mod.lua", "return { v = 1 }", past)
+
+    ctx := NewDefaultContext(nil, WithFS(os.DirFS(dir)))
+    ctx.Start()
+    defer ctx.Close(context.Background())
+    value := func() int64 {
+        var v int64
+        runSync(ctx, func() error {
+            L := ctx.LuaState()
+            L.GetGlobal("value")
+            v = int64(L.ToInteger(-1))
+            L.Pop(1)
+            return nil
+        })
+        return v
+    }
+    if err := runSync(ctx, func() error {
+        return DoFile(ctx, "main.lua")
+    }); err != nil {
+        t.Fatal(err)
+    }
+    if v := value(); v != 1 {
+        t.Fatalf("value = %d, want 1", v)
+    }
+
+    r := NewFSReloader(dir, "main.lua", ctx)
+    defer r.Close()
+    write("lib/mod.lua", "return { v = 2 }", time.Now())
+    changed := r.scan()
+    if len(changed) != 1 || changed[0] != "lib/mod.lua" {
+        t.Fatalf("changed = %v, want [lib/mod.lua]", changed)
+    }
+    if err := r.Reload(changed...); err != nil {
+        t.Fatal(err)
+    }
+    if v := value(); v != 2 {
+        t.Fatalf("value after reload = %d, want 2", v)
+    }
+}
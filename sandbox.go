@@ -0,0 +1,390 @@
+package golualib
+
+import (
+    "errors"
+    "log"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+// SandboxOptions restricts what the scripts of a context can do. The limits
+// apply to every callback run by the context; exceeding one aborts that
+// callback with a reported error and the context keeps running.
+type SandboxOptions struct {
+    // Whitelist lists the stdlib functions scripts may use, either one
+    // function ( "os.time" ), a whole library ( "string.*" ) or a base
+    // function ( "print" ). The other globals opened by golua, such as
+    // "socket.core" or "cjson", are removed as well, those of golualib are
+    // kept. Nil means DefaultSandboxWhitelist.
+    Whitelist []string
+    // InstructionLimit bounds the Lua instructions executed by one callback
+    InstructionLimit int
+    // Timeout bounds the wall-clock time of one callback
+    Timeout time.Duration
+    // MemoryLimit bounds the bytes held by the Lua state. The allocator of
+    // the state enforces it, an allocation past it fails with a memory error
+    // once a full collection could not make room.
+    MemoryLimit int64
+    // HookQuantum is the number of instructions between two limit checks,
+    // 1000 when zero
+    HookQuantum int
+}
+
+var DefaultSandboxWhitelist = []string{
+    "_G", "_VERSION", "assert", "error", "getmetatable", "ipairs", "next", "pairs", "pcall",
+    "print", "rawequal", "rawget", "rawlen", "rawset", "require", "select",
+    "setmetatable", "tonumber", "tostring", "type", "xpcall",
+    "coroutine.*", "math.*", "string.*", "table.*", "utf8.*",
+    "os.clock", "os.date", "os.difftime", "os.time",
+}
+
+// WithSandbox runs the scripts of the context in a sandbox
+func WithSandbox(options SandboxOptions) Option {
+    return func(ctx *luaContext) {
+        if options.Whitelist == nil {
+            options.Whitelist = DefaultSandboxWhitelist
+        }
+        if options.HookQuantum <= 0 {
+            options.HookQuantum = 1000
+        }
+        ctx.sandbox = &sandbox{options: options}
+    }
+}
+
+const (
+    registrySandboxReset = "_golualib_sandbox_reset_"
+    registryStdlib       = "_golualib_stdlib_"
+
+    sandboxErrorPrefix = "sandbox: "
+    // raised by the count hook of golua once the deadline passed
+    quantumExceeded = "Lua execution quantum exceeded"
+    // raised by Lua when the allocator fails
+    memoryExceeded = "not enough memory"
+)
+
+// stdlibCode keeps the stdlib functions golualib needs after the whitelist
+// removed them from scripts
+const stdlibCode = `
+debug.getregistry()._golualib_stdlib_ = {
+    dofile     = dofile,
+    pcall      = pcall,
+    searchpath = package.searchpath,
+    path       = package.path,
+    loaded     = package.loaded,
+    searchers  = { table.unpack(package.searchers) },
+    globals    = {},
+}
+-- the globals opened by golua, those set later come from golualib
+for k in pairs(_G) do
+    debug.getregistry()._golualib_stdlib_.globals[k] = true
+end
+`
+
+// sandboxLimitCode installs the count hook enforcing the limits on the main
+// thread and on every coroutine. Once the deadline passed the main thread
+// runs the count hook of golua instead, which coroutines notice.
+const sandboxLimitCode = `
+local quantum = ...
+local sethook, gethook, getinfo, error = debug.sethook, debug.gethook, debug.getinfo, error
+local handler = debug.getregistry()._golualib_traceback_
+local create, resume, pack, unpack = coroutine.create, coroutine.resume, table.pack, table.unpack
+local main = coroutine.running()
+local budget, tripped = math.huge, nil
+local hook
+
+local function trip(msg)
+    tripped = 'sandbox: ' .. msg
+    sethook(main, hook, '', 1)
+    sethook(hook, '', 1)
+    error(tripped, 0)
+end
+
+hook = function()
+    if tripped then
+        -- let the message handler of Call build the traceback
+        if getinfo(2, 'f').func ~= handler then
+            error(tripped, 0)
+        end
+        return
+    end
+    budget = budget - quantum
+    if budget < 0 then
+        trip('instruction limit exceeded')
+    end
+    if gethook(main) ~= hook then
+        trip('callback deadline exceeded')
+    end
+end
+
+debug.getregistry()._golualib_sandbox_reset_ = function(limit)
+    budget = limit > 0 and limit or math.huge
+    tripped = nil
+    sethook(hook, '', quantum)
+end
+
+function coroutine.create(fn)
+    local co = create(fn)
+    sethook(co, hook, '', quantum)
+    return co
+end
+
+function coroutine.wrap(fn)
+    local co = coroutine.create(fn)
+    return function(...)
+        local rs = pack(resume(co, ...))
+        if not rs[1] then
+            error(rs[2], 0)
+        end
+        return unpack(rs, 2, rs.n)
+    end
+end
+
+sethook(hook, '', quantum)
+`
+
+// sandboxFilterCode removes every global opened by golua missing from the
+// whitelist, such as the stdlib, socket.core or cjson, and keeps those set
+// by golualib
+const sandboxFilterCode = `
+local allowed = ...
+local reg = debug.getregistry()
+local stdlib = reg._golualib_stdlib_
+local load, loaded = load, stdlib.loaded
+
+-- require reads these from the package table
+local internal = { loaded = true, preload = true, searchers = true }
+-- golua calls it on every call from Go
+local keepGlobals = { golua_default_msghandler = true }
+
+-- only golualib modules and scripts of the context FS can be required
+local searchers, stock = package.searchers, stdlib.searchers
+for i = #searchers, 1, -1 do
+    for j = 2, #stock do
+        if searchers[i] == stock[j] then
+            table.remove(searchers, i)
+            break
+        end
+    end
+end
+
+for name in pairs(stdlib.globals) do
+    local lib = _G[name]
+    if keepGlobals[name] or allowed[name] or allowed[name .. '.*'] then
+        -- kept whole
+    elseif type(lib) == 'table' and lib ~= _G then
+        local keep = false
+        for k in pairs(lib) do
+            if allowed[name .. '.' .. tostring(k)] or (lib == package and internal[k]) then
+                keep = true
+            else
+                lib[k] = nil
+            end
+        end
+        if not keep then
+            _G[name] = nil
+            -- require must not find it either
+            loaded[name] = nil
+        end
+    else
+        _G[name] = nil
+        if loaded[name] == lib then
+            loaded[name] = nil
+        end
+    end
+end
+if allowed['load'] then
+    -- precompiled chunks can crash the VM
+    _G.load = function(chunk, name, mode, env)
+        return load(chunk, name, 't', env)
+    end
+end
+
+-- Go values are opaque handles
+local deny = function()
+    error('access to Go values is not allowed in the sandbox', 2)
+end
+for _, name in ipairs({ 'GoLua.GoInterface', 'GoLua.GoFunction' }) do
+    local mt = reg[name]
+    if mt then
+        mt.__metatable = false
+        if name == 'GoLua.GoInterface' then
+            mt.__index = deny
+            mt.__newindex = deny
+        end
+    end
+end
+`
+
+type sandbox struct {
+    options  SandboxOptions
+    mutex    sync.Mutex
+    L        *lua.State
+    timer    *time.Timer
+    token    int
+    expired  bool
+    reported bool
+    // memory holds the memory limit of each state, a restart briefly has two
+    memory map[*lua.State]*memoryLimit
+}
+
+// hasLimits tells whether the count hook enforces limits
+func (s *sandbox) hasLimits() bool {
+    o := s.options
+    return o.InstructionLimit > 0 || o.Timeout > 0
+}
+
+// initLimits runs right after the stdlib was opened so that golualib code
+// captures the wrapped coroutine functions
+func (s *sandbox) initLimits(L *lua.State) error {
+    if s.options.MemoryLimit > 0 {
+        s.mutex.Lock()
+        if s.memory == nil {
+            s.memory = make(map[*lua.State]*memoryLimit)
+        }
+        s.memory[L] = newMemoryLimit(L, s.options.MemoryLimit)
+        s.mutex.Unlock()
+    }
+    if !s.hasLimits() {
+        return nil
+    }
+    if err := loadString(L, sandboxLimitCode); err != nil {
+        return err
+    }
+    L.PushInteger(int64(s.options.HookQuantum))
+    return L.Call(1, 0)
+}
+
+// release frees what the limits of L hold once L is closed
+func (s *sandbox) release(L *lua.State) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if m, ok := s.memory[L]; ok {
+        m.free()
+        delete(s.memory, L)
+    }
+}
+
+// initFilter runs once golualib code captured what it needs
+func (s *sandbox) initFilter(L *lua.State) error {
+    if err := loadString(L, sandboxFilterCode); err != nil {
+        return err
+    }
+    L.CreateTable(0, len(s.options.Whitelist))
+    for _, name := range s.options.Whitelist {
+        L.PushBoolean(true)
+        L.SetField(-2, name)
+    }
+    return L.Call(1, 0)
+}
+
+// begin resets the limits before a callback of the context goroutine
+func (s *sandbox) begin(L *lua.State) {
+    s.mutex.Lock()
+    s.reported = false
+    if m, ok := s.memory[L]; ok {
+        m.reset()
+    }
+    if !s.hasLimits() {
+        s.mutex.Unlock()
+        return
+    }
+    s.L = L
+    s.token++
+    s.expired = false
+    s.mutex.Unlock()
+    s.reset(L, s.options.InstructionLimit)
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if s.options.Timeout > 0 {
+        token := s.token
+        s.timer = time.AfterFunc(s.options.Timeout, func() {
+            s.mutex.Lock()
+            defer s.mutex.Unlock()
+            if s.token == token {
+                s.expired = true
+                // lua_sethook may be called from another thread
+                s.L.SetExecutionLimit(1)
+            }
+        })
+    }
+}
+
+// reset clears a tripped limit and rearms the count hook with limit
+// instructions, 0 for none. The hook is removed first as a tripped one
+// would abort the reset itself.
+func (s *sandbox) reset(L *lua.State, limit int) {
+    clearHook(L)
+    top := L.GetTop()
+    L.GetField(lua.LUA_REGISTRYINDEX, registrySandboxReset)
+    L.PushInteger(int64(limit))
+    if err := L.Call(1, 0); err != nil {
+        log.Println(err)
+    }
+    L.SetTop(top)
+}
+
+// end stops the deadline of the callback started by begin
+func (s *sandbox) end() {
+    if !s.hasLimits() {
+        return
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.stop()
+}
+
+func (s *sandbox) stop() {
+    s.token++
+    if s.timer != nil {
+        s.timer.Stop()
+        s.timer = nil
+    }
+    if s.expired {
+        // disarm the count hook of golua until the next begin
+        s.L.SetExecutionLimit(0)
+        s.expired = false
+    }
+}
+
+// filter rewrites errors raised by the limits and drops the duplicates
+// raised while unwinding the aborted callback. The first one lifts the
+// limits so that error handlers can run.
+func (s *sandbox) filter(L *lua.State, e *CallbackError) bool {
+    s.mutex.Lock()
+    if s.expired && strings.Contains(e.Message, quantumExceeded) {
+        e.Message = sandboxErrorPrefix + "callback deadline exceeded"
+        e.Traceback = strings.Replace(e.Traceback, quantumExceeded, e.Message, 1)
+    }
+    if m, ok := s.memory[L]; ok && m.exceeded() && strings.Contains(e.Message, memoryExceeded) {
+        e.Message = sandboxErrorPrefix + "memory limit exceeded"
+        e.Traceback = strings.Replace(e.Traceback, memoryExceeded, e.Message, 1)
+    }
+    if !strings.Contains(e.Message, sandboxErrorPrefix) {
+        s.mutex.Unlock()
+        return true
+    }
+    if s.reported {
+        s.mutex.Unlock()
+        return false
+    }
+    s.reported = true
+    s.stop()
+    s.mutex.Unlock()
+    if s.hasLimits() {
+        s.reset(L, 0)
+    }
+    return true
+}
+
+func loadString(L *lua.State, code string) error {
+    if L.LoadString(code) != 0 {
+        err := errors.New(L.ToString(-1))
+        L.Pop(1)
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,135 @@
+package golualib
+
+import (
+    "context"
+    "strings"
+    "testing"
+    "time"
+)
+
+// newSandboxContext starts a sandboxed context running code, the errors it
+// reports are sent to the returned channel
+func newSandboxContext(t *testing.T, options SandboxOptions, code string) (LuaContext, chan *CallbackError) {
+    t.Helper()
+    ctx := NewDefaultContext(nil, WithSandbox(options))
+    errs := make(chan *CallbackError, 16)
+    ctx.SetErrorHandler(func(ctx LuaContext, err *CallbackError) {
+        errs <- err
+    })
+    ctx.Start()
+    t.Cleanup(func() {
+        ctx.Close(context.Background())
+    })
+    if err := runSync(ctx, func() error {
+        return ctx.LuaState().DoString(code)
+    }); err != nil {
+        t.Fatal(err)
+    }
+    return ctx, errs
+}
+
+func runSync(ctx LuaContext, cb func() error) error {
+    done := make(chan error, 1)
+    if err := ctx.Run(func() {
+        done <- cb()
+    }); err != nil {
+        return err
+    }
+    return <-done
+}
+
+// callGlobal calls the global name with arg through Call and returns the
+// error it reported, nil if none
+func callGlobal(t *testing.T, ctx LuaContext, errs chan *CallbackError, name string, arg float64) *CallbackError {
+    t.Helper()
+    err := runSync(ctx, func() error {
+        L := ctx.LuaState()
+        L.GetGlobal(name)
+        L.PushNumber(arg)
+        Call(ctx, 1, 0, "test")
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case e := <-errs:
+        return e
+    default:
+        return nil
+    }
+}
+
+const spinCode = `
+function spin(n)
+    local x = 0
+    for i = 1, n do x = x + i end
+    return x
+end
+function alloc(n)
+    big = string.rep('x', n)
+    big = nil
+end
+`
+
+func TestSandboxInstructionLimitRearms(t *testing.T) {
+    ctx, errs := newSandboxContext(t, SandboxOptions{InstructionLimit: 100000}, spinCode)
+    for i := 0; i < 3; i++ {
+        e := callGlobal(t, ctx, errs, "spin", 30e6)
+        if e == nil || !strings.Contains(e.Message, "instruction limit exceeded") {
+            t.Fatalf("callback %d: got %v, want instruction limit exceeded", i, e)
+        }
+        if e := callGlobal(t, ctx, errs, "spin", 1000); e != nil {
+            t.Fatalf("callback %d: small loop failed: %v", i, e)
+        }
+    }
+}
+
+func TestSandboxTimeoutRearms(t *testing.T) {
+    ctx, errs := newSandboxContext(t, SandboxOptions{
+        InstructionLimit: 1 << 40,
+        Timeout:          50 * time.Millisecond,
+    }, spinCode)
+    for i := 0; i < 3; i++ {
+        start := time.Now()
+        e := callGlobal(t, ctx, errs, "spin", 1e12)
+        if e == nil || !strings.Contains(e.Message, "callback deadline exceeded") {
+            t.Fatalf("callback %d: got %v, want callback deadline exceeded", i, e)
+        }
+        if d := time.Since(start); d > 2*time.Second {
+            t.Fatalf("callback %d: aborted after %v", i, d)
+        }
+    }
+}
+
+func TestSandboxMemoryLimit(t *testing.T) {
+    ctx, errs := newSandboxContext(t, SandboxOptions{MemoryLimit: 20 << 20}, spinCode)
+    for i := 0; i < 2; i++ {
+        e := callGlobal(t, ctx, errs, "alloc", 400<<20)
+        if e == nil || !strings.Contains(e.Message, "memory limit exceeded") {
+            t.Fatalf("callback %d: got %v, want memory limit exceeded", i, e)
+        }
+        if e := callGlobal(t, ctx, errs, "alloc", 1<<20); e != nil {
+            t.Fatalf("callback %d: small allocation failed: %v", i, e)
+        }
+    }
+}
+
+func TestSandboxRemovesGoluaGlobals(t *testing.T) {
+    ctx, _ := newSandboxContext(t, SandboxOptions{}, "")
+    err := runSync(ctx, func() error {
+        return ctx.LuaState().DoString(`
+for _, name in ipairs({ 'socket.core', 'mime.core', 'cjson', 'cjson_safe',
+        'cmsgpack', 'cmsgpack_safe', 'pb', 'serialize', 'io', 'debug', 'dofile', 'load' }) do
+    assert(_G[name] == nil, name .. ' is reachable')
+    assert(not pcall(require, name), name .. ' can be required')
+end
+assert(os.getenv == nil and os.time ~= nil)
+assert(string.format and table.concat and _G == _G._G)
+assert(type(Spawn) == 'function', 'golualib globals are kept')
+`)
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+}
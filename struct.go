@@ -0,0 +1,431 @@
+package golualib
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+// structCode exposes binary packing to scripts as require('golualib.struct').
+// The 4-byte big-endian frames of kcp connections are struct.frame(data),
+// or struct.pack('>s4', data), and struct.unframe(buf, pos).
+const structCode = `
+local lib = GoWrap(...)
+local error, type = error, type
+
+local struct = {}
+
+-- pack returns the values encoded by fmt:
+--   < > =    little, big, native (little) endian for what follows
+--   b B      int8, uint8            h H   int16, uint16
+--   i[n] I[n] signed, unsigned n-byte ints, n defaults to 4
+--   l L j J  int64, uint64          f d n float32, float64, float64
+--   v V      unsigned, zigzag signed varints
+--   s[n]     string with an n-byte length, n defaults to 4
+--   z        zero terminated string c[n] n-byte string, padded with zeros
+--   x        a zero byte
+function struct.pack(fmt, ...)
+    local s, err = lib.pack(fmt, ...)
+    if err then
+        error(err, 2)
+    end
+    return s
+end
+
+-- unpack returns the values of fmt read from data at pos, 1 by default,
+-- followed by the position after them, or nil, err
+function struct.unpack(fmt, data, pos)
+    if type(data) ~= 'string' then
+        return nil, 'struct: string expected, got ' .. type(data)
+    end
+    return lib.unpack(fmt, data, pos or 1)
+end
+
+-- size returns the bytes taken by fmt, nil when it has variable sizes
+function struct.size(fmt)
+    local n, err = lib.size(fmt)
+    if err then
+        error(err, 2)
+    end
+    return n
+end
+
+-- frame prefixes data with its 4-byte big-endian length
+function struct.frame(data)
+    return struct.pack('>s4', data)
+end
+
+-- unframe returns the payload of the frame at pos in buf and the position
+-- after it, nil when buf does not hold the whole frame yet
+function struct.unframe(buf, pos)
+    local data, nxt = struct.unpack('>s4', buf, pos)
+    if data == nil then
+        return nil
+    end
+    return data, nxt
+end
+
+package.loaded['golualib.struct'] = struct
+return struct
+`
+
+var errStructShort = errors.New("struct: data too short")
+
+func initStruct(L *lua.State) error {
+    if err := loadString(L, structCode); err != nil {
+        return err
+    }
+    L.CreateTable(0, 3)
+    L.PushGoFunction(func(L *lua.State) int {
+        data, err := PackStruct(L, L.ToString(1), 2)
+        if err != nil {
+            L.PushNil()
+            L.PushString(err.Error())
+            return 2
+        }
+        PushBytes(L, data)
+        return 1
+    })
+    L.SetField(-2, "pack")
+    L.PushGoFunction(func(L *lua.State) int {
+        pos := int(L.ToInteger(3))
+        n, err := UnpackStruct(L, L.ToString(1), L.ToBytes(2), pos-1)
+        if err != nil {
+            L.PushNil()
+            L.PushString(err.Error())
+            return 2
+        }
+        return n
+    })
+    L.SetField(-2, "unpack")
+    L.PushGoFunction(func(L *lua.State) int {
+        ops, err := parseStruct(L.ToString(1))
+        if err != nil {
+            L.PushNil()
+            L.PushString(err.Error())
+            return 2
+        }
+        size := 0
+        for _, op := range ops {
+            switch op.kind {
+            case 's', 'z', 'v', 'V':
+                return 0
+            }
+            size += op.size
+        }
+        L.PushInteger(int64(size))
+        return 1
+    })
+    L.SetField(-2, "size")
+    return L.Call(1, 0)
+}
+
+type structOp struct {
+    kind  byte
+    size  int
+    order binary.ByteOrder
+}
+
+func parseStruct(format string) ([]structOp, error) {
+    var (
+        ops   []structOp
+        order binary.ByteOrder = binary.LittleEndian
+    )
+    for i := 0; i < len(format); {
+        c := format[i]
+        i++
+        // an optional size follows some options
+        n, digits := 0, 0
+        for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+            n = n*10 + int(format[i]-'0')
+            i++
+            digits++
+            if n > math.MaxInt32 {
+                return nil, errors.New("struct: size too large")
+            }
+        }
+        size := func(def, max int) (int, error) {
+            if digits == 0 {
+                return def, nil
+            }
+            if n < 1 || n > max {
+                return 0, fmt.Errorf("struct: size %d of '%c' out of limits [1,%d]", n, c, max)
+            }
+            return n, nil
+        }
+        op := structOp{kind: c, order: order}
+        var err error
+        switch c {
+        case ' ':
+            continue
+        case '<', '=':
+            order = binary.LittleEndian
+            continue
+        case '>':
+            order = binary.BigEndian
+            continue
+        case 'b', 'B', 'x':
+            op.size = 1
+        case 'h', 'H':
+            op.size = 2
+        case 'i', 'I':
+            op.size, err = size(4, 8)
+        case 'l', 'L', 'j', 'J', 'd', 'n':
+            op.size = 8
+        case 'f':
+            op.size = 4
+        case 's':
+            op.size, err = size(4, 8)
+        case 'c':
+            if digits == 0 {
+                return nil, errors.New("struct: missing size for 'c'")
+            }
+            op.size = n
+        case 'z', 'v', 'V':
+        default:
+            return nil, fmt.Errorf("struct: invalid format option '%c'", c)
+        }
+        if err != nil {
+            return nil, err
+        }
+        ops = append(ops, op)
+    }
+    return ops, nil
+}
+
+// PackStruct encodes the values from stack index arg on as described by
+// format, see require('golualib.struct')
+func PackStruct(L *lua.State, format string, arg int) ([]byte, error) {
+    ops, err := parseStruct(format)
+    if err != nil {
+        return nil, err
+    }
+    var (
+        buf []byte
+        tmp [binary.MaxVarintLen64]byte
+    )
+    for _, op := range ops {
+        if op.kind == 'x' {
+            buf = append(buf, 0)
+            continue
+        }
+        if L.Type(arg) == lua.LUA_TNONE {
+            return nil, fmt.Errorf("struct: bad argument #%d to 'pack' (no value)", arg)
+        }
+        switch op.kind {
+        case 'b', 'B', 'h', 'H', 'i', 'I', 'l', 'L', 'j', 'J':
+            v, err := structInteger(L, arg)
+            if err != nil {
+                return nil, err
+            }
+            if op.size < 8 {
+                // unsigned options take the unsigned range, signed ones the signed
+                bits := uint(op.size * 8)
+                lim := int64(1) << (bits - 1)
+                switch op.kind {
+                case 'B', 'H', 'I':
+                    if v < 0 || v >= lim<<1 {
+                        return nil, fmt.Errorf("struct: bad argument #%d to 'pack' (unsigned overflow)", arg)
+                    }
+                default:
+                    if v < -lim || v >= lim {
+                        return nil, fmt.Errorf("struct: bad argument #%d to 'pack' (integer overflow)", arg)
+                    }
+                }
+            }
+            buf = appendUint(buf, op.order, uint64(v), op.size)
+        case 'f':
+            if L.Type(arg) != lua.LUA_TNUMBER {
+                return nil, structArgError(L, arg, "number")
+            }
+            buf = appendUint(buf, op.order, uint64(math.Float32bits(float32(L.ToNumber(arg)))), 4)
+        case 'd', 'n':
+            if L.Type(arg) != lua.LUA_TNUMBER {
+                return nil, structArgError(L, arg, "number")
+            }
+            buf = appendUint(buf, op.order, math.Float64bits(L.ToNumber(arg)), 8)
+        case 'v', 'V':
+            v, err := structInteger(L, arg)
+            if err != nil {
+                return nil, err
+            }
+            var n int
+            if op.kind == 'v' {
+                n = binary.PutUvarint(tmp[:], uint64(v))
+            } else {
+                n = binary.PutVarint(tmp[:], v)
+            }
+            buf = append(buf, tmp[:n]...)
+        case 's', 'z', 'c':
+            if L.Type(arg) != lua.LUA_TSTRING && L.Type(arg) != lua.LUA_TNUMBER {
+                return nil, structArgError(L, arg, "string")
+            }
+            s := L.ToString(arg)
+            switch op.kind {
+            case 's':
+                if op.size < 8 && uint64(len(s)) >= uint64(1)<<uint(op.size*8) {
+                    return nil, fmt.Errorf("struct: bad argument #%d to 'pack' (string length does not fit in given size)", arg)
+                }
+                buf = appendUint(buf, op.order, uint64(len(s)), op.size)
+                buf = append(buf, s...)
+            case 'z':
+                for i := 0; i < len(s); i++ {
+                    if s[i] == 0 {
+                        return nil, fmt.Errorf("struct: bad argument #%d to 'pack' (string contains zeros)", arg)
+                    }
+                }
+                buf = append(buf, s...)
+                buf = append(buf, 0)
+            case 'c':
+                if len(s) > op.size {
+                    return nil, fmt.Errorf("struct: bad argument #%d to 'pack' (string longer than given size)", arg)
+                }
+                buf = append(buf, s...)
+                for i := len(s); i < op.size; i++ {
+                    buf = append(buf, 0)
+                }
+            }
+        }
+        arg++
+    }
+    return buf, nil
+}
+
+func structArgError(L *lua.State, arg int, expected string) error {
+    return fmt.Errorf("struct: bad argument #%d to 'pack' (%s expected, got %s)", arg, expected, L.LTypename(arg))
+}
+
+func structInteger(L *lua.State, arg int) (int64, error) {
+    if L.Type(arg) != lua.LUA_TNUMBER {
+        return 0, structArgError(L, arg, "number")
+    }
+    if isInteger(L, arg) {
+        return int64(L.ToInteger(arg)), nil
+    }
+    f := L.ToNumber(arg)
+    if f != math.Trunc(f) || f < -(1<<63) || f >= 1<<63 {
+        return 0, fmt.Errorf("struct: bad argument #%d to 'pack' (number has no integer representation)", arg)
+    }
+    return int64(f), nil
+}
+
+func appendUint(buf []byte, order binary.ByteOrder, v uint64, size int) []byte {
+    var b [8]byte
+    order.PutUint64(b[:], v)
+    if order == binary.BigEndian {
+        return append(buf, b[8-size:]...)
+    }
+    return append(buf, b[:size]...)
+}
+
+// PushBytes pushes b as a string, unlike L.PushBytes it accepts an empty b
+func PushBytes(L *lua.State, b []byte) {
+    if len(b) == 0 {
+        L.PushString("")
+        return
+    }
+    L.PushBytes(b)
+}
+
+func readUint(data []byte, order binary.ByteOrder, size int) uint64 {
+    var v uint64
+    for i := 0; i < size; i++ {
+        b := data[i]
+        if order == binary.BigEndian {
+            v = v<<8 | uint64(b)
+        } else {
+            v |= uint64(b) << uint(8*i)
+        }
+    }
+    return v
+}
+
+// UnpackStruct pushes the values of format read from data at offset pos
+// and the 1-based position after them, it returns how many it pushed.
+// Strings are pushed straight from data without intermediate copies.
+func UnpackStruct(L *lua.State, format string, data []byte, pos int) (int, error) {
+    ops, err := parseStruct(format)
+    if err != nil {
+        return 0, err
+    }
+    if pos < 0 || pos > len(data) {
+        return 0, errors.New("struct: initial position out of string")
+    }
+    if !L.CheckStack(len(ops) + 1) {
+        return 0, errors.New("struct: too many results")
+    }
+    top := L.GetTop()
+    fail := func(err error) (int, error) {
+        L.SetTop(top)
+        return 0, err
+    }
+    for _, op := range ops {
+        if op.size > len(data)-pos {
+            return fail(errStructShort)
+        }
+        switch op.kind {
+        case 'x':
+            pos++
+            continue
+        case 'b', 'h', 'i', 'l', 'j':
+            v := readUint(data[pos:], op.order, op.size)
+            // sign extend
+            shift := uint(64 - 8*op.size)
+            L.PushInteger(int64(v<<shift) >> shift)
+        case 'B', 'H', 'I', 'L', 'J':
+            L.PushInteger(int64(readUint(data[pos:], op.order, op.size)))
+        case 'f':
+            L.PushNumber(float64(math.Float32frombits(uint32(readUint(data[pos:], op.order, 4)))))
+        case 'd', 'n':
+            L.PushNumber(math.Float64frombits(readUint(data[pos:], op.order, 8)))
+        case 'v', 'V':
+            var (
+                v int64
+                n int
+            )
+            if op.kind == 'v' {
+                u, un := binary.Uvarint(data[pos:])
+                v, n = int64(u), un
+            } else {
+                v, n = binary.Varint(data[pos:])
+            }
+            if n == 0 {
+                return fail(errStructShort)
+            }
+            if n < 0 {
+                return fail(errors.New("struct: varint overflows 64 bits"))
+            }
+            L.PushInteger(v)
+            pos += n
+            continue
+        case 's':
+            size := readUint(data[pos:], op.order, op.size)
+            pos += op.size
+            if size > uint64(len(data)-pos) {
+                return fail(errStructShort)
+            }
+            PushBytes(L, data[pos : pos+int(size)])
+            pos += int(size)
+            continue
+        case 'z':
+            end := pos
+            for end < len(data) && data[end] != 0 {
+                end++
+            }
+            if end == len(data) {
+                return fail(errors.New("struct: unfinished string for format 'z'"))
+            }
+            PushBytes(L, data[pos:end])
+            pos = end + 1
+            continue
+        case 'c':
+            PushBytes(L, data[pos : pos+op.size])
+        }
+        pos += op.size
+    }
+    L.PushInteger(int64(pos + 1))
+    return L.GetTop() - top, nil
+}
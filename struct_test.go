@@ -0,0 +1,151 @@
+package golualib
+
+import "testing"
+
+func TestStructPack(t *testing.T) {
+    evalTests(t, binarySetup, []evalTest{
+        {"hex(struct.pack('b', -1))", "ff"},
+        {"hex(struct.pack('B', 255))", "ff"},
+        {"hex(struct.pack('h', 1))", "0100"},
+        {"hex(struct.pack('>h', 1))", "0001"},
+        {"hex(struct.pack('=H', 65535))", "ffff"},
+        {"hex(struct.pack('i', 1))", "01000000"},
+        {"hex(struct.pack('>i3', -2))", "fffffe"},
+        {"hex(struct.pack('<I2', 258))", "0201"},
+        {"hex(struct.pack('>I8', 1))", "0000000000000001"},
+        {"hex(struct.pack('l', -1))", "ffffffffffffffff"},
+        {"hex(struct.pack('>j', 1))", "0000000000000001"},
+        {"hex(struct.pack('>L', math.mininteger))", "8000000000000000"},
+        {"hex(struct.pack('J', -1))", "ffffffffffffffff"},
+        {"hex(struct.pack('>f', 1.5))", "3fc00000"},
+        {"hex(struct.pack('>d', 1.5))", "3ff8000000000000"},
+        {"hex(struct.pack('n', 1.5))", "000000000000f83f"},
+        {"hex(struct.pack('s', 'ab'))", "020000006162"},
+        {"hex(struct.pack('>s2', 'ab'))", "00026162"},
+        {"hex(struct.pack('s1', ''))", "00"},
+        {"hex(struct.pack('z', 'ab'))", "616200"},
+        {"hex(struct.pack('c4', 'ab'))", "61620000"},
+        {"hex(struct.pack('s1', 12))", "023132"},
+        {"hex(struct.pack('x'))", "00"},
+        {"hex(struct.pack('>b x h', 1, 2))", "01000002"},
+        {"hex(struct.pack('b', 2.0))", "02"},
+        {"struct.size('>i3hxc2')", "8"},
+        {"struct.size('bs')", "nil"},
+        {"struct.size('')", "0"},
+    })
+}
+
+func TestStructUnpack(t *testing.T) {
+    evalTests(t, binarySetup, []evalTest{
+        {"list(struct.unpack('b', unhex('ff')))", "-1,2"},
+        {"list(struct.unpack('B', unhex('ff')))", "255,2"},
+        {"list(struct.unpack('>h', unhex('fffe')))", "-2,3"},
+        {"list(struct.unpack('<H', unhex('fffe')))", "65279,3"},
+        {"list(struct.unpack('>i3', unhex('fffffe')))", "-2,4"},
+        {"list(struct.unpack('>I3', unhex('fffffe')))", "16777214,4"},
+        {"list(struct.unpack('J', unhex('ffffffffffffffff')))", "-1,9"},
+        {"list(struct.unpack('>f d', unhex('3fc00000') .. unhex('3ff8000000000000')))", "1.5,1.5,13"},
+        {"list(struct.unpack('>s2 z c3', unhex('00026162') .. 'cd\\0efg'))", "ab,cd,efg,11"},
+        {"list(struct.unpack('x b', unhex('0001')))", "1,3"},
+        {"list(struct.unpack('b', unhex('0102'), 2))", "2,3"},
+        {"list(struct.unpack('s', unhex('00000000')))", ",5"},
+        // every option round-trips
+        {`list(struct.unpack('<bBhHi3I3ljJfdns1zc3xvV', struct.pack('<bBhHi3I3ljJfdns1zc3xvV',
+            -128, 255, -32768, 65535, -8388608, 16777215, math.mininteger, -5, -6, 0.5, 0.25, -1.5, 'ab', 'cd', 'e', 300, -300)))`,
+            "-128,255,-32768,65535,-8388608,16777215,-9223372036854775808,-5,-6,0.5,0.25,-1.5,ab,cd,e\x00\x00,300,-300,71"},
+    })
+}
+
+func TestStructErrors(t *testing.T) {
+    evalTests(t, binarySetup+`
+function packErr(...)
+    return select(2, pcall(struct.pack, ...))
+end
+`, []evalTest{
+        // signed and unsigned overflow
+        {"packErr('b', 128)", "struct: bad argument #2 to 'pack' (integer overflow)"},
+        {"packErr('b', -129)", "struct: bad argument #2 to 'pack' (integer overflow)"},
+        {"packErr('B', 256)", "struct: bad argument #2 to 'pack' (unsigned overflow)"},
+        {"packErr('B', -1)", "struct: bad argument #2 to 'pack' (unsigned overflow)"},
+        {"packErr('bh', 1, 32768)", "struct: bad argument #3 to 'pack' (integer overflow)"},
+        {"packErr('H', 65536)", "struct: bad argument #2 to 'pack' (unsigned overflow)"},
+        {"packErr('i3', 8388608)", "struct: bad argument #2 to 'pack' (integer overflow)"},
+        {"packErr('I3', 16777216)", "struct: bad argument #2 to 'pack' (unsigned overflow)"},
+        {"packErr('I', -1)", "struct: bad argument #2 to 'pack' (unsigned overflow)"},
+        {"hex(struct.pack('bB', -128, 0))", "8000"},
+        // arguments
+        {"packErr('b', 1.5)", "struct: bad argument #2 to 'pack' (number has no integer representation)"},
+        {"packErr('b', 2^63)", "struct: bad argument #2 to 'pack' (number has no integer representation)"},
+        {"packErr('b', 'x')", "struct: bad argument #2 to 'pack' (number expected, got string)"},
+        {"packErr('d', {})", "struct: bad argument #2 to 'pack' (number expected, got table)"},
+        {"packErr('s', true)", "struct: bad argument #2 to 'pack' (string expected, got boolean)"},
+        {"packErr('bb', 1)", "struct: bad argument #3 to 'pack' (no value)"},
+        {"packErr('s1', ('a'):rep(256))", "struct: bad argument #2 to 'pack' (string length does not fit in given size)"},
+        {"packErr('z', 'a\\0b')", "struct: bad argument #2 to 'pack' (string contains zeros)"},
+        {"packErr('c2', 'abc')", "struct: bad argument #2 to 'pack' (string longer than given size)"},
+        // formats
+        {"packErr('y', 1)", "struct: invalid format option 'y'"},
+        {"packErr('i9', 1)", "struct: size 9 of 'i' out of limits [1,8]"},
+        {"packErr('i0', 1)", "struct: size 0 of 'i' out of limits [1,8]"},
+        {"packErr('c', 'a')", "struct: missing size for 'c'"},
+        {"select(2, pcall(struct.size, 'q'))", "struct: invalid format option 'q'"},
+        // short data
+        {"list(struct.unpack('i', 'abc'))", "nil,struct: data too short"},
+        {"list(struct.unpack('bb', 'a'))", "nil,struct: data too short"},
+        {"list(struct.unpack('>s4', unhex('00000005') .. 'abc'))", "nil,struct: data too short"},
+        {"list(struct.unpack('>s4', unhex('000000')))", "nil,struct: data too short"},
+        {"list(struct.unpack('z', 'ab'))", "nil,struct: unfinished string for format 'z'"},
+        {"list(struct.unpack('c3', 'ab'))", "nil,struct: data too short"},
+        {"list(struct.unpack('b', 'a', 2))", "nil,struct: data too short"},
+        {"list(struct.unpack('b', 'a', 3))", "nil,struct: initial position out of string"},
+        {"list(struct.unpack('b', 'a', 0))", "nil,struct: initial position out of string"},
+        {"list(struct.unpack('b', 1))", "nil,struct: string expected, got number"},
+    })
+}
+
+func TestStructVarints(t *testing.T) {
+    evalTests(t, binarySetup, []evalTest{
+        {"hex(struct.pack('v', 0))", "00"},
+        {"hex(struct.pack('v', 127))", "7f"},
+        {"hex(struct.pack('v', 128))", "8001"},
+        {"hex(struct.pack('v', 300))", "ac02"},
+        {"hex(struct.pack('v', -1))", "ffffffffffffffffff01"},
+        {"hex(struct.pack('V', 0))", "00"},
+        {"hex(struct.pack('V', -1))", "01"},
+        {"hex(struct.pack('V', 1))", "02"},
+        {"hex(struct.pack('V', -64))", "7f"},
+        {"hex(struct.pack('V', 64))", "8001"},
+        {"list(struct.unpack('v', unhex('ac02')))", "300,3"},
+        {"list(struct.unpack('vV', unhex('ffffffffffffffffff01') .. unhex('7f')))", "-1,-64,12"},
+        {"list(struct.unpack('V', struct.pack('V', math.mininteger)))", "-9223372036854775808,11"},
+        {"list(struct.unpack('v', unhex('80')))", "nil,struct: data too short"},
+        {"list(struct.unpack('v', ''))", "nil,struct: data too short"},
+        {"list(struct.unpack('v', unhex('ffffffffffffffffff7f')))", "nil,struct: varint overflows 64 bits"},
+        {"list(struct.unpack('V', unhex('ffffffffffffffffffff01')))", "nil,struct: varint overflows 64 bits"},
+    })
+}
+
+func TestStructFrames(t *testing.T) {
+    evalTests(t, binarySetup+`
+function frames(buf)
+    local out, pos = {}, 1
+    while true do
+        local data, nxt = struct.unframe(buf, pos)
+        if data == nil then
+            return table.concat(out, ',') .. '|' .. buf:sub(pos)
+        end
+        out[#out + 1] = data
+        pos = nxt
+    end
+end
+`, []evalTest{
+        {"hex(struct.frame('abc'))", "00000003616263"},
+        {"struct.frame('abc') == struct.pack('>s4', 'abc')", "true"},
+        {"hex(struct.frame(''))", "00000000"},
+        {"list(struct.unframe(struct.frame('abc')))", "abc,8"},
+        {"frames(struct.frame('a') .. struct.frame('') .. struct.frame('bc'))", "a,,bc|"},
+        // a partial frame waits for more data
+        {"frames(struct.frame('a') .. struct.frame('bc'):sub(1, 5))", "a|\x00\x00\x00\x02b"},
+        {"frames(struct.frame('a') .. unhex('0000'))", "a|\x00\x00"},
+    })
+}
@@ -4,15 +4,15 @@ local x = {}
 function server.onEvent(eventType, id, client, msgType, msgData)
     print(eventType, id, client, msgType, msgData)
     if eventType == 1 then
-        server.SetTimeout(client, 5)
-        server.SetHead(client, true)
+        client:SetTimeout(5)
+        client:SetHead(true)
         return
     end
-    server.Send(client, 1, 'world')
+    client:Send('world')
     -- if not x[id] then
     --     x[id] = client
     --     Looper.AfterFunc(2, function( ... )
-    --         server.Close(client)
+    --         client:Close()
     --     end)
     -- end
 end
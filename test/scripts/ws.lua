@@ -6,11 +6,11 @@ local server = WSServer()
 local x = {}
 function server.onEvent(eventType, id, client, msgType, msgData)
     print(eventType, id, client, msgType, msgData)
-    server.Send(client, 1, 'world')
+    client:Send('world')
     if not x[id] then
         x[id] = client
         Looper.AfterFunc(2, function( ... )
-            server.Close(client)
+            client:Close()
         end)
     end
 end
@@ -1,127 +1,852 @@
 package golualib
 
-const LuaUtilsCode = `
-
-function table.tostring(data)
-    -- cache of tables already printed, to avoid infinite recursive loops
-    local tablecache = {}
-    local buffer = ""
-    local padder = "    "
-
-    local function dump(d, depth)
-        local t = type(d)
-        local str = tostring(d)
-        if (t == "table") then
-            if (tablecache[str]) then
-                -- table already dumped before, so we dont
-                -- dump it again, just mention it
-                buffer = buffer.."<"..str..">\n"
-            else
-                tablecache[str] = (tablecache[str] or 0) + 1
-                buffer = buffer.."("..str..") {\n"
-                for k, v in pairs(d) do
-                    buffer = buffer..string.rep(padder, depth + 1) .. "["..k.."] => "
-                    dump(v, depth + 1)
-                end
-                buffer = buffer..string.rep(padder, depth) .. "}\n"
+import (
+    "bytes"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+// utilsCode adds the table and string helpers, the ones taking callbacks
+// stay in Lua so that the callbacks may yield
+const utilsCode = `
+local lib = ...
+local raise = lib.raise
+local wrap = GoWrap or function(f) return f end
+local error, pairs, type, tostring = error, pairs, type, tostring
+local mathtype = math.type
+
+local function checked(name, f)
+    f = wrap(f)
+    local function check(r, ...)
+        if r == raise then
+            local n, msg = ...
+            if n == 0 then
+                error(msg, 2)
             end
-        elseif (t == "number") then
-            buffer = buffer.."("..t..") "..str.."\n"
-        else
-            buffer = buffer.."("..t..") \""..str.."\"\n"
+            error(("bad argument #%d to '%s' (%s)"):format(n, name, msg), 2)
         end
+        return r, ...
+    end
+    return function(...)
+        return check(f(...))
     end
-    dump(data, 0)
-    return buffer
 end
 
-function deepcopy(orig, copies)
-    copies = copies or {}
-    local orig_type = type(orig)
-    local copy
-    if orig_type == 'table' then
-        if copies[orig] then
-            copy = copies[orig]
-        else
-            copy = {}
-            copies[orig] = copy
-            for orig_key, orig_value in next, orig, nil do
-                copy[deepcopy(orig_key, copies)] = deepcopy(orig_value, copies)
-            end
-            setmetatable(copy, deepcopy(getmetatable(orig), copies))
-        end
-    else -- number, string, boolean, etc
-        copy = orig
-    end
-    return copy
+-- tostring dumps v with the type of every value, one per line, a table
+-- met again prints as <table: 0x...>
+local dump = checked('tostring', lib.dump)
+function table.tostring(v)
+    return dump(v, tostring)
 end
 
-function table.clone( tbl, to )
-    return deepcopy(tbl, to)
+-- pretty prints v as a Lua literal. opts.indent is a number of spaces or a
+-- string, '' prints on one line, opts.depth limits the nesting and
+-- opts.sort = false keeps the order of pairs.
+table.pretty = checked('pretty', lib.pretty)
+
+-- deepcopy copies tables with their keys and metatables, shared tables
+-- stay shared. copies maps the tables already copied to their copies.
+deepcopy = checked('deepcopy', lib.deepcopy)
+table.clone = deepcopy
+
+-- deepmerge merges a then b into out, or a new table, and returns it.
+-- Tables are merged key by key when both sides hold one, values of b win.
+function deepmerge(out, a, b)
+    return lib.merge(out or {}, a, b)
+end
+lib.merge = checked('deepmerge', lib.merge)
+
+function table.merge(a, b)
+    return lib.merge({}, a, b)
 end
-function deepmerge(out, a, b, copies)
-    local function fn()
-        local copies = {}
-        local m = deepcopy(a, copies)
-        -- 检查b中, 依赖项目
-        
-        return m
+
+-- replace replaces up to n, or all, plain occurrences of old by new
+string.replace = checked('replace', lib.replace)
+
+-- split splits s around the plain separator sep, or white space without
+-- sep, into at most n parts, the last one holding the rest. Empty fields
+-- are dropped. Non-strings give nil.
+string.split = checked('split', lib.split)
+
+-- trim removes the characters of chars, white space by default, from both
+-- ends of s, ltrim and rtrim from one
+string.trim = checked('trim', lib.trim)
+string.ltrim = checked('ltrim', lib.ltrim)
+string.rtrim = checked('rtrim', lib.rtrim)
+
+string.startswith = checked('startswith', lib.startswith)
+string.endswith = checked('endswith', lib.endswith)
+
+-- join concatenates the values of t[i..j] separated by sep, unlike
+-- table.concat values of any type are printed
+table.join = checked('join', lib.join)
+
+-- keys and values list the keys of t and their values, sorted by key
+table.keys = checked('keys', lib.keys)
+table.values = checked('values', lib.values)
+
+-- slice copies t[i..j], negative positions count from the end
+table.slice = checked('slice', lib.slice)
+
+-- filter keeps the values v of t for which fn(v, k) is true, the sequence
+-- of t is packed and the other keys are kept
+function table.filter(t, fn)
+    if type(t) ~= 'table' then
+        error(("bad argument #1 to 'filter' (table expected, got %s)"):format(type(t)), 2)
     end
-    out = out or fn()
-    copies = copies or {}
-    local orig_type = type(a)
-
-    if orig_type == 'table' then
-        if copies[a] then
-            out = copies[a]
-        elseif copies[b] then
-            out = copies[b]
-        else
-            for k,v in pairs(b) do
-                if type(v) == 'table' then
-                    out[k] = {}
-                    deepmerge(out[k], out[k], v)
-                else
-                    out[k] = v
-                end
-                
-            end
+    local out, n = {}, #t
+    for i = 1, n do
+        local v = t[i]
+        if fn(v, i) then
+            out[#out + 1] = v
         end
-    else -- number, string, boolean, etc
-        b = a
     end
-    return out
-end
-function table.merge(a, b )
-    return deepmerge(nil, a, b)
-end
-
-string.replace = function(s, pattern, repl)
-    local i,j = string.find(s, pattern, 1, true)
-    if i and j then
-        local ret = {}
-        local start = 1
-        while i and j do
-            table.insert(ret, string.sub(s, start, i - 1))
-            table.insert(ret, repl)
-            start = j + 1
-            i,j = string.find(s, pattern, start, true)
+    for k, v in pairs(t) do
+        if not (mathtype(k) == 'integer' and k >= 1 and k <= n) and fn(v, k) then
+            out[k] = v
         end
-        table.insert(ret, string.sub(s, start))
-        return table.concat(ret)
     end
-    return a
+    return out
 end
 
-function string.split (inputstr, sep)
-    if type(inputstr) ~= 'string' then return end
-    if sep == nil then
-        sep = "%s"
+-- map returns a table with the keys of t and the values fn(v, k)
+function table.map(t, fn)
+    if type(t) ~= 'table' then
+        error(("bad argument #1 to 'map' (table expected, got %s)"):format(type(t)), 2)
     end
-    local t = {}
-    for str in string.gmatch(inputstr, "([^"..sep.."]+)") do
-        table.insert(t, str)
+    local out = {}
+    for k, v in pairs(t) do
+        out[k] = fn(v, k)
     end
-    return t
+    return out
 end
 `
+
+// OpenUtils adds the table and string helpers to L, contexts open them on
+// their states
+func OpenUtils(L *lua.State) error {
+    if err := loadString(L, utilsCode); err != nil {
+        return err
+    }
+    if err := pushHandleLib(L); err != nil {
+        L.Pop(1)
+        return err
+    }
+    L.GetField(-1, "raise")
+    L.Remove(-2)
+    funcs := map[string]lua.LuaGoFunction{
+        "dump":       utilsDump,
+        "pretty":     utilsPretty,
+        "deepcopy":   utilsDeepCopy,
+        "merge":      utilsMerge,
+        "replace":    utilsReplace,
+        "split":      utilsSplit,
+        "trim":       utilsTrim(strings.Trim, func(s string) string { return strings.Trim(s, spaces) }),
+        "ltrim":      utilsTrim(strings.TrimLeft, func(s string) string { return strings.TrimLeft(s, spaces) }),
+        "rtrim":      utilsTrim(strings.TrimRight, func(s string) string { return strings.TrimRight(s, spaces) }),
+        "startswith": utilsAffix(strings.HasPrefix),
+        "endswith":   utilsAffix(strings.HasSuffix),
+        "join":       utilsJoin,
+        "keys":       utilsKeys(false),
+        "values":     utilsKeys(true),
+        "slice":      utilsSlice,
+    }
+    L.CreateTable(0, len(funcs)+1)
+    L.Insert(-2)
+    L.SetField(-2, "raise")
+    for name, f := range funcs {
+        L.PushGoFunction(f)
+        L.SetField(-2, name)
+    }
+    return L.Call(1, 0)
+}
+
+// spaces are the white space of the Lua %s class
+const spaces = " \t\n\v\f\r"
+
+// checkString tells whether the argument at idx is a string or a number
+func checkString(L *lua.State, idx int) bool {
+    t := L.Type(idx)
+    return t == lua.LUA_TSTRING || t == lua.LUA_TNUMBER
+}
+
+func utilsReplace(L *lua.State) int {
+    for _, idx := range []int{1, 2, 3} {
+        if !checkString(L, idx) {
+            return TypeError(L, idx, idx, "string")
+        }
+    }
+    s, old, repl := L.ToString(1), L.ToString(2), L.ToString(3)
+    n := -1
+    if L.Type(4) == lua.LUA_TNUMBER {
+        n = L.ToInteger(4)
+    }
+    if old == "" || n == 0 || !strings.Contains(s, old) {
+        L.PushValue(1)
+        return 1
+    }
+    L.PushString(strings.Replace(s, old, repl, n))
+    return 1
+}
+
+func utilsSplit(L *lua.State) int {
+    if L.Type(1) != lua.LUA_TSTRING {
+        return 0
+    }
+    s := L.ToString(1)
+    // cut returns the length of the separator at the start of s, 0 if none
+    cut := func(s string) int {
+        if strings.IndexByte(spaces, s[0]) >= 0 {
+            return 1
+        }
+        return 0
+    }
+    if !L.IsNoneOrNil(2) {
+        if !checkString(L, 2) {
+            return TypeError(L, 2, 2, "string")
+        }
+        sep := L.ToString(2)
+        if sep == "" {
+            return ArgError(L, 2, "empty separator")
+        }
+        cut = func(s string) int {
+            if strings.HasPrefix(s, sep) {
+                return len(sep)
+            }
+            return 0
+        }
+    }
+    n := -1
+    if L.Type(3) == lua.LUA_TNUMBER {
+        n = L.ToInteger(3)
+    }
+    var parts []string
+    for i := 0; i < len(s) && n != 0; {
+        if k := cut(s[i:]); k > 0 {
+            i += k
+            continue
+        }
+        if len(parts) == n-1 {
+            parts = append(parts, s[i:])
+            break
+        }
+        start := i
+        for i < len(s) && cut(s[i:]) == 0 {
+            i++
+        }
+        parts = append(parts, s[start:i])
+    }
+    L.CreateTable(len(parts), 0)
+    for i, part := range parts {
+        L.PushString(part)
+        L.RawSeti(-2, i+1)
+    }
+    return 1
+}
+
+func utilsTrim(cut func(s, cutset string) string, space func(s string) string) lua.LuaGoFunction {
+    return func(L *lua.State) int {
+        if !checkString(L, 1) {
+            return TypeError(L, 1, 1, "string")
+        }
+        s := L.ToString(1)
+        if L.IsNoneOrNil(2) {
+            L.PushString(space(s))
+            return 1
+        }
+        if !checkString(L, 2) {
+            return TypeError(L, 2, 2, "string")
+        }
+        L.PushString(cut(s, L.ToString(2)))
+        return 1
+    }
+}
+
+func utilsAffix(has func(s, affix string) bool) lua.LuaGoFunction {
+    return func(L *lua.State) int {
+        for _, idx := range []int{1, 2} {
+            if !checkString(L, idx) {
+                return TypeError(L, idx, idx, "string")
+            }
+        }
+        L.PushBoolean(has(L.ToString(1), L.ToString(2)))
+        return 1
+    }
+}
+
+// seqLen is the border of the sequence of the table at idx, # without __len
+func seqLen(L *lua.State, idx int) int {
+    n := 0
+    for {
+        L.RawGeti(idx, n+1)
+        end := L.IsNil(-1)
+        L.Pop(1)
+        if end {
+            return n
+        }
+        n++
+    }
+}
+
+// seqRange resolves the positions i and j at the stack indexes like
+// string.sub does for a sequence of length n
+func seqRange(L *lua.State, i, j, n int) (int, int) {
+    from, to := 1, n
+    if L.Type(i) == lua.LUA_TNUMBER {
+        from = L.ToInteger(i)
+    }
+    if L.Type(j) == lua.LUA_TNUMBER {
+        to = L.ToInteger(j)
+    }
+    if from < 0 {
+        from += n + 1
+    }
+    if to < 0 {
+        to += n + 1
+    }
+    if from < 1 {
+        from = 1
+    }
+    if to > n {
+        to = n
+    }
+    return from, to
+}
+
+func utilsJoin(L *lua.State) int {
+    if L.Type(1) != lua.LUA_TTABLE {
+        return TypeError(L, 1, 1, "table")
+    }
+    sep := ""
+    if !L.IsNoneOrNil(2) {
+        if !checkString(L, 2) {
+            return TypeError(L, 2, 2, "string")
+        }
+        sep = L.ToString(2)
+    }
+    from, to := seqRange(L, 3, 4, seqLen(L, 1))
+    var buf bytes.Buffer
+    for i := from; i <= to; i++ {
+        if i > from {
+            buf.WriteString(sep)
+        }
+        L.RawGeti(1, i)
+        if L.Type(-1) == lua.LUA_TSTRING {
+            buf.WriteString(L.ToString(-1))
+        } else {
+            buf.WriteString(formatScalar(L, -1))
+        }
+        L.Pop(1)
+    }
+    L.PushString(buf.String())
+    return 1
+}
+
+func utilsSlice(L *lua.State) int {
+    if L.Type(1) != lua.LUA_TTABLE {
+        return TypeError(L, 1, 1, "table")
+    }
+    from, to := seqRange(L, 2, 3, seqLen(L, 1))
+    size := 0
+    if to >= from {
+        size = to - from + 1
+    }
+    L.CreateTable(size, 0)
+    for i := 0; i < size; i++ {
+        L.RawGeti(1, from+i)
+        L.RawSeti(-2, i+1)
+    }
+    return 1
+}
+
+func utilsKeys(values bool) lua.LuaGoFunction {
+    return func(L *lua.State) int {
+        if L.Type(1) != lua.LUA_TTABLE {
+            return TypeError(L, 1, 1, "table")
+        }
+        keys, order := sortedKeys(L, 1)
+        L.CreateTable(len(order), 0)
+        for i, pos := range order {
+            L.RawGeti(keys, pos)
+            if values {
+                L.RawGet(1)
+            }
+            L.RawSeti(-2, i+1)
+        }
+        L.Remove(keys)
+        return 1
+    }
+}
+
+// tableKey orders keys: numbers, strings, booleans, then the others
+type tableKey struct {
+    pos   int
+    kind  int
+    isInt bool
+    i     int64
+    f     float64
+    s     string
+    p     uintptr
+}
+
+func (a tableKey) less(b tableKey) bool {
+    if a.kind != b.kind {
+        return a.kind < b.kind
+    }
+    switch a.kind {
+    case 0:
+        if a.isInt && b.isInt {
+            return a.i < b.i
+        }
+        return a.f < b.f
+    case 1:
+        return a.s < b.s
+    case 2:
+        return a.i < b.i
+    }
+    return a.p < b.p
+}
+
+// sortedKeys pushes a sequence of the keys of the table at idx and returns
+// its stack index and the positions of the keys in sorted order
+func sortedKeys(L *lua.State, idx int) (int, []int) {
+    L.NewTable()
+    keys := L.GetTop()
+    var list []tableKey
+    L.PushNil()
+    for L.Next(idx) != 0 {
+        L.Pop(1)
+        k := tableKey{pos: len(list) + 1}
+        switch L.Type(-1) {
+        case lua.LUA_TNUMBER:
+            k.isInt = isInteger(L, -1)
+            k.i, k.f = int64(L.ToInteger(-1)), L.ToNumber(-1)
+        case lua.LUA_TSTRING:
+            k.kind, k.s = 1, L.ToString(-1)
+        case lua.LUA_TBOOLEAN:
+            k.kind = 2
+            if L.ToBoolean(-1) {
+                k.i = 1
+            }
+        default:
+            k.kind, k.p = 3, L.ToPointer(-1)
+        }
+        list = append(list, k)
+        L.PushValue(-1)
+        L.RawSeti(keys, k.pos)
+    }
+    sort.SliceStable(list, func(i, j int) bool {
+        return list[i].less(list[j])
+    })
+    order := make([]int, len(list))
+    for i, k := range list {
+        order[i] = k.pos
+    }
+    return keys, order
+}
+
+func utilsDeepCopy(L *lua.State) int {
+    if L.Type(1) != lua.LUA_TTABLE {
+        L.SetTop(1)
+        return 1
+    }
+    if !L.IsNoneOrNil(2) && L.Type(2) != lua.LUA_TTABLE {
+        return TypeError(L, 2, 2, "table")
+    }
+    L.SetTop(2)
+    if L.IsNil(2) {
+        L.NewTable()
+        L.Replace(2)
+    }
+    if !deepCopy(L, 1, 2) {
+        return ArgError(L, 1, "table nested too deep")
+    }
+    return 1
+}
+
+// deepCopy pushes a copy of the value at idx, metatables included, the
+// table at copies maps the tables copied so far to their copies
+func deepCopy(L *lua.State, idx, copies int) bool {
+    if L.Type(idx) != lua.LUA_TTABLE {
+        L.PushValue(idx)
+        return true
+    }
+    L.PushValue(idx)
+    L.RawGet(copies)
+    if !L.IsNil(-1) {
+        return true
+    }
+    L.Pop(1)
+    if !L.CheckStack(4) {
+        return false
+    }
+    L.NewTable()
+    out := L.GetTop()
+    L.PushValue(idx)
+    L.PushValue(out)
+    L.RawSet(copies)
+    L.PushNil()
+    for L.Next(idx) != 0 {
+        top := L.GetTop()
+        if !deepCopy(L, top-1, copies) || !deepCopy(L, top, copies) {
+            L.SetTop(out - 1)
+            return false
+        }
+        L.RawSet(out)
+        L.Pop(1)
+    }
+    if L.GetMetaTable(idx) {
+        ok := deepCopy(L, L.GetTop(), copies)
+        L.Remove(-2)
+        if !ok {
+            L.SetTop(out - 1)
+            return false
+        }
+        L.SetMetaTable(out)
+    }
+    return true
+}
+
+func utilsMerge(L *lua.State) int {
+    if L.Type(1) != lua.LUA_TTABLE {
+        return TypeError(L, 1, 1, "table")
+    }
+    for _, idx := range []int{2, 3} {
+        if !L.IsNoneOrNil(idx) && L.Type(idx) != lua.LUA_TTABLE {
+            return TypeError(L, idx, idx, "table")
+        }
+    }
+    L.SetTop(3)
+    L.NewTable()
+    m := &merger{L: L, copies: 4, seen: make(map[[2]uintptr]bool)}
+    for _, idx := range []int{2, 3} {
+        if L.Type(idx) == lua.LUA_TTABLE && !m.merge(1, idx) {
+            return ArgError(L, idx, "table nested too deep")
+        }
+    }
+    L.SetTop(1)
+    return 1
+}
+
+type merger struct {
+    L      *lua.State
+    copies int
+    seen   map[[2]uintptr]bool
+}
+
+// merge copies the pairs of the table at src into the one at dst, merging
+// tables found on both sides
+func (m *merger) merge(dst, src int) bool {
+    L := m.L
+    pair := [2]uintptr{L.ToPointer(dst), L.ToPointer(src)}
+    if m.seen[pair] || pair[0] == pair[1] {
+        return true
+    }
+    m.seen[pair] = true
+    if !L.CheckStack(4) {
+        return false
+    }
+    L.PushNil()
+    for L.Next(src) != 0 {
+        top := L.GetTop()
+        if L.Type(top) == lua.LUA_TTABLE {
+            L.PushValue(top - 1)
+            L.RawGet(dst)
+            if L.Type(-1) == lua.LUA_TTABLE {
+                if !m.merge(L.GetTop(), top) {
+                    return false
+                }
+                L.SetTop(top - 1)
+                continue
+            }
+            L.Pop(1)
+        }
+        L.PushValue(top - 1)
+        if !deepCopy(L, top, m.copies) {
+            return false
+        }
+        L.RawSet(dst)
+        L.SetTop(top - 1)
+    }
+    return true
+}
+
+// utilsDump prints v in the format of the first table.tostring, the
+// function at index 2 is the tostring of Lua
+func utilsDump(L *lua.State) int {
+    L.SetTop(2)
+    d := &dumper{L: L, seen: make(map[string]bool)}
+    if err := d.dump(1, 0); err != nil {
+        return ArgError(L, 0, err.Error())
+    }
+    L.PushString(d.buf.String())
+    return 1
+}
+
+type dumper struct {
+    L    *lua.State
+    buf  bytes.Buffer
+    seen map[string]bool
+}
+
+// tostring calls the tostring of Lua on the value at idx
+func (d *dumper) tostring(idx int) (string, error) {
+    L := d.L
+    if idx < 0 {
+        idx += L.GetTop() + 1
+    }
+    L.PushValue(2)
+    L.PushValue(idx)
+    if err := L.Call(1, 1); err != nil {
+        return "", err
+    }
+    s := L.ToString(-1)
+    L.Pop(1)
+    return s, nil
+}
+
+func (d *dumper) dump(idx, depth int) error {
+    L := d.L
+    str, err := d.tostring(idx)
+    if err != nil {
+        return err
+    }
+    switch L.Type(idx) {
+    case lua.LUA_TTABLE:
+    case lua.LUA_TNUMBER:
+        d.buf.WriteString("(number) " + str + "\n")
+        return nil
+    default:
+        d.buf.WriteString("(" + L.LTypename(idx) + ") \"" + str + "\"\n")
+        return nil
+    }
+    if d.seen[str] {
+        d.buf.WriteString("<" + str + ">\n")
+        return nil
+    }
+    if !L.CheckStack(4) {
+        return fmt.Errorf("table nested too deep")
+    }
+    d.seen[str] = true
+    d.buf.WriteString("(" + str + ") {\n")
+    L.PushNil()
+    for L.Next(idx) != 0 {
+        k, err := d.tostring(-2)
+        if err != nil {
+            return err
+        }
+        d.buf.WriteString(strings.Repeat("    ", depth+1) + "[" + k + "] => ")
+        if err := d.dump(L.GetTop(), depth+1); err != nil {
+            return err
+        }
+        L.Pop(1)
+    }
+    d.buf.WriteString(strings.Repeat("    ", depth) + "}\n")
+    return nil
+}
+
+func utilsPretty(L *lua.State) int {
+    p := &prettyPrinter{L: L, indent: "    ", depth: -1, sort: true, seen: make(map[uintptr]bool)}
+    if L.Type(2) == lua.LUA_TTABLE {
+        L.GetField(2, "indent")
+        switch L.Type(-1) {
+        case lua.LUA_TNUMBER:
+            p.indent = strings.Repeat(" ", L.ToInteger(-1))
+        case lua.LUA_TSTRING:
+            p.indent = L.ToString(-1)
+        }
+        L.GetField(2, "depth")
+        if L.Type(-1) == lua.LUA_TNUMBER {
+            p.depth = L.ToInteger(-1)
+        }
+        L.GetField(2, "sort")
+        if L.Type(-1) == lua.LUA_TBOOLEAN {
+            p.sort = L.ToBoolean(-1)
+        }
+    } else if !L.IsNoneOrNil(2) {
+        return TypeError(L, 2, 2, "table")
+    }
+    L.SetTop(1)
+    if !p.print(1, 0) {
+        return ArgError(L, 1, "table nested too deep")
+    }
+    L.PushString(p.buf.String())
+    return 1
+}
+
+type prettyPrinter struct {
+    L      *lua.State
+    buf    bytes.Buffer
+    indent string
+    depth  int
+    sort   bool
+    seen   map[uintptr]bool
+}
+
+func (p *prettyPrinter) newline(level int) {
+    if p.indent == "" {
+        p.buf.WriteByte(' ')
+        return
+    }
+    p.buf.WriteByte('\n')
+    for i := 0; i < level; i++ {
+        p.buf.WriteString(p.indent)
+    }
+}
+
+func (p *prettyPrinter) print(idx int, level int) bool {
+    L := p.L
+    if L.Type(idx) != lua.LUA_TTABLE {
+        if L.Type(idx) == lua.LUA_TSTRING {
+            writeLuaString(&p.buf, L.ToString(idx))
+        } else {
+            p.buf.WriteString(formatScalar(L, idx))
+        }
+        return true
+    }
+    ptr := L.ToPointer(idx)
+    if p.seen[ptr] {
+        fmt.Fprintf(&p.buf, "<cycle %s>", formatScalar(L, idx))
+        return true
+    }
+    if p.depth >= 0 && level >= p.depth {
+        p.buf.WriteString("{...}")
+        return true
+    }
+    if !L.CheckStack(6) {
+        return false
+    }
+    p.seen[ptr] = true
+    defer delete(p.seen, ptr)
+
+    // the sequence prints without keys, then the other pairs
+    n := seqLen(L, idx)
+    keys, order := sortedKeys(L, idx)
+    if !p.sort {
+        sort.Ints(order)
+    }
+    count := 0
+    item := func() {
+        if count > 0 {
+            p.buf.WriteByte(',')
+        }
+        count++
+        p.newline(level + 1)
+    }
+    p.buf.WriteByte('{')
+    for i := 1; i <= n; i++ {
+        item()
+        L.RawGeti(idx, i)
+        if !p.print(L.GetTop(), level+1) {
+            return false
+        }
+        L.Pop(1)
+    }
+    for _, pos := range order {
+        L.RawGeti(keys, pos)
+        k := L.GetTop()
+        if L.Type(k) == lua.LUA_TNUMBER && isInteger(L, k) {
+            if i := L.ToInteger(k); i >= 1 && i <= n {
+                L.Pop(1)
+                continue
+            }
+        }
+        item()
+        if L.Type(k) == lua.LUA_TSTRING && isIdentifier(L.ToString(k)) {
+            p.buf.WriteString(L.ToString(k))
+        } else {
+            p.buf.WriteByte('[')
+            if !p.print(k, level+1) {
+                return false
+            }
+            p.buf.WriteByte(']')
+        }
+        p.buf.WriteString(" = ")
+        L.PushValue(k)
+        L.RawGet(idx)
+        if !p.print(L.GetTop(), level+1) {
+            return false
+        }
+        L.Pop(2)
+    }
+    L.Remove(keys)
+    if count > 0 {
+        p.newline(level)
+    }
+    p.buf.WriteByte('}')
+    return true
+}
+
+var luaKeywords = map[string]bool{
+    "and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+    "false": true, "for": true, "function": true, "goto": true, "if": true, "in": true,
+    "local": true, "nil": true, "not": true, "or": true, "repeat": true, "return": true,
+    "then": true, "true": true, "until": true, "while": true,
+}
+
+func isIdentifier(s string) bool {
+    if s == "" || luaKeywords[s] {
+        return false
+    }
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9') {
+            continue
+        }
+        return false
+    }
+    return true
+}
+
+// writeLuaString quotes s as a Lua literal
+func writeLuaString(buf *bytes.Buffer, s string) {
+    buf.WriteByte('"')
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        switch {
+        case c == '"' || c == '\\':
+            buf.WriteByte('\\')
+            buf.WriteByte(c)
+        case c == '\n':
+            buf.WriteString(`\n`)
+        case c == '\r':
+            buf.WriteString(`\r`)
+        case c == '\t':
+            buf.WriteString(`\t`)
+        case c < 0x20 || c == 0x7f:
+            fmt.Fprintf(buf, "\\%03d", c)
+        default:
+            buf.WriteByte(c)
+        }
+    }
+    buf.WriteByte('"')
+}
+
+// formatScalar prints the value at idx like tostring without __tostring,
+// userdata with a metatable __name show it
+func formatScalar(L *lua.State, idx int) string {
+    switch L.Type(idx) {
+    case lua.LUA_TNIL, lua.LUA_TNONE:
+        return "nil"
+    case lua.LUA_TBOOLEAN:
+        return strconv.FormatBool(L.ToBoolean(idx))
+    case lua.LUA_TNUMBER, lua.LUA_TSTRING:
+        L.PushValue(idx)
+        s := L.ToString(-1)
+        L.Pop(1)
+        return s
+    }
+    name := L.LTypename(idx)
+    if L.GetMetaTable(idx) {
+        L.GetField(-1, "__name")
+        if L.Type(-1) == lua.LUA_TSTRING {
+            name = L.ToString(-1)
+        }
+        L.Pop(2)
+    }
+    return fmt.Sprintf("%s: 0x%x", name, L.ToPointer(idx))
+}
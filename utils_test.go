@@ -0,0 +1,206 @@
+package golualib
+
+import (
+    "context"
+    "testing"
+
+    "github.com/DGHeroin/golua/lua"
+)
+
+type evalTest struct {
+    code, want string
+}
+
+// evalTests runs setup then compares the value of each expression, printed
+// with tostring, to its want
+func evalTests(t *testing.T, setup string, tests []evalTest) {
+    t.Helper()
+    ctx := NewDefaultContext(nil)
+    ctx.Start()
+    defer ctx.Close(context.Background())
+    if err := runSync(ctx, func() error {
+        return ctx.LuaState().DoString(setup)
+    }); err != nil {
+        t.Fatal(err)
+    }
+    for _, test := range tests {
+        var got string
+        err := runSync(ctx, func() error {
+            L := ctx.LuaState()
+            if err := L.DoString("_result = tostring(" + test.code + ")"); err != nil {
+                return err
+            }
+            L.GetGlobal("_result")
+            got = L.ToString(-1)
+            L.Pop(1)
+            return nil
+        })
+        if err != nil {
+            t.Fatalf("%s: %v", test.code, err)
+        }
+        if got != test.want {
+            t.Errorf("%s = %q, want %q", test.code, got, test.want)
+        }
+    }
+}
+
+func TestStringHelpers(t *testing.T) {
+    evalTests(t, "", []evalTest{
+        // replace returns the string alone
+        {"select('#', ('a.b.c'):replace('.', '/'))", "1"},
+        {"('a.b.c'):replace('.', '/')", "a/b/c"},
+        {"('a.b.c'):replace('.', '/', 1)", "a/b.c"},
+        {"('abc'):replace('x', 'y')", "abc"},
+        {"table.concat({('x'):replace('x', 'y')}, ',')", "y"},
+        // split drops the empty fields
+        {"table.concat(('a,,b,'):split(','), '|')", "a|b"},
+        {"table.concat((',a,b'):split(','), '|')", "a|b"},
+        {"table.concat(('a::b::::c'):split('::'), '|')", "a|b|c"},
+        {"table.concat(('a.b'):split('.'), '|')", "a|b"},
+        {"table.concat(('  a \\t b\\n'):split(), '|')", "a|b"},
+        {"#(''):split(',')", "0"},
+        {"#(',,'):split(',')", "0"},
+        // at most n parts, the last one holds the rest
+        {"table.concat(('a,,b,c'):split(',', 2), '|')", "a|b,c"},
+        {"table.concat(('a b  c'):split(nil, 2), '|')", "a|b  c"},
+        {"#('a,b'):split(',', 0)", "0"},
+        {"string.split(1)", "nil"},
+    })
+}
+
+func TestStringTrim(t *testing.T) {
+    evalTests(t, "", []evalTest{
+        {"'[' .. (' \\t a b \\n'):trim() .. ']'", "[a b]"},
+        {"'[' .. (' a '):ltrim() .. ']'", "[a ]"},
+        {"'[' .. (' a '):rtrim() .. ']'", "[ a]"},
+        {"('xxaxyx'):trim('xy')", "a"},
+        {"('xxaxyx'):ltrim('xy')", "axyx"},
+        {"('xxaxyx'):rtrim('xy')", "xxa"},
+        {"('-a-'):trim('')", "-a-"},
+        {"('abc'):startswith('ab'), ('abc'):endswith('bc')", "true"},
+        {"select(2, pcall(string.trim, {}))", "bad argument #1 to 'trim' (string expected, got table)"},
+    })
+}
+
+func TestTableToString(t *testing.T) {
+    evalTests(t, `
+function dump(v)
+    -- the addresses vary
+    return (table.tostring(v):gsub('0x%x+', 'P'))
+end
+`, []evalTest{
+        {"dump(1)", "(number) 1\n"},
+        {"dump('a')", "(string) \"a\"\n"},
+        {"dump(nil)", "(nil) \"nil\"\n"},
+        {"dump({x = true})", "(table: P) {\n    [x] => (boolean) \"true\"\n}\n"},
+        {"dump({{1.5}})", "(table: P) {\n    [1] => (table: P) {\n        [1] => (number) 1.5\n    }\n}\n"},
+        {"dump(setmetatable({}, {__tostring = function() return 'T' end}))", "(T) {\n}\n"},
+        // a table met again is not printed again
+        {"(function() local t = {}; t[1] = t; return dump(t) end)()", "(table: P) {\n    [1] => <table: P>\n}\n"},
+    })
+}
+
+func TestTablePretty(t *testing.T) {
+    evalTests(t, `
+nested = {1, 'two', {3}, x = {y = {z = 1}}, [true] = false, [2.5] = 'f'}
+cycle = {name = 'c'}
+cycle.self = cycle
+`, []evalTest{
+        {"table.pretty({})", "{}"},
+        {"table.pretty('s\\n')", `"s\n"`},
+        {"table.pretty({1, 2, a = 'b'}, {indent = ''})", `{ 1, 2, a = "b" }`},
+        {"table.pretty(nested, {indent = ''})", `{ 1, "two", { 3 }, [2.5] = "f", x = { y = { z = 1 } }, [true] = false }`},
+        {"table.pretty({a = {b = 1}}, {indent = 2})", "{\n  a = {\n    b = 1\n  }\n}"},
+        {"table.pretty({a = {b = 1}}, {indent = '\\t'})", "{\n\ta = {\n\t\tb = 1\n\t}\n}"},
+        // depth limit
+        {"table.pretty(nested, {indent = '', depth = 1})", `{ 1, "two", {...}, [2.5] = "f", x = {...}, [true] = false }`},
+        {"table.pretty(nested, {indent = '', depth = 0})", `{...}`},
+        // cycles
+        {"(table.pretty(cycle, {indent = ''}):gsub('0x%x+', 'P'))", `{ name = "c", self = <cycle table: P> }`},
+        // keys in the order of pairs
+        {`(function()
+            local t = {b = 1, a = 2, c = 3}
+            local order = {}
+            for k in pairs(t) do order[#order + 1] = k .. ' = ' .. t[k] end
+            return table.pretty(t, {indent = '', sort = false}) == '{ ' .. table.concat(order, ', ') .. ' }'
+        end)()`, "true"},
+        {"table.pretty({['a b'] = 1, ['end'] = 2}, {indent = ''})", `{ ["a b"] = 1, ["end"] = 2 }`},
+        {"select(2, pcall(table.pretty, {}, 1))", "bad argument #2 to 'pretty' (table expected, got number)"},
+    })
+}
+
+func TestTableCopyMerge(t *testing.T) {
+    evalTests(t, `
+shared = {1}
+mt = {__index = {kind = 'meta'}}
+orig = setmetatable({a = shared, b = shared, [shared] = 'key', n = {m = {2}}}, mt)
+orig.self = orig
+copy = deepcopy(orig)
+`, []evalTest{
+        {"copy ~= orig and copy.a ~= shared", "true"},
+        {"copy.a == copy.b and copy.a[1]", "1"},
+        {"copy[copy.a]", "key"},
+        {"copy.self == copy", "true"},
+        {"copy.n.m[1], copy.n ~= orig.n", "2"},
+        // the metatables are copied too
+        {"getmetatable(copy) ~= mt and copy.kind", "meta"},
+        {"deepcopy(5), deepcopy('s')", "5"},
+        // copies maps the tables copied so far
+        {"(function() local seen = {}; local c = table.clone(orig, seen); return seen[orig] == c and seen[shared] == c.a end)()", "true"},
+        {"(function() local pre = {}; return deepcopy({shared}, {[shared] = pre})[1] == pre end)()", "true"},
+        // nested tables merge key by key, values of b win
+        {"table.pretty(table.merge({a = 1, t = {x = 1, y = 1}}, {b = 2, t = {y = 2, z = {3}}}), {indent = ''})", `{ a = 1, b = 2, t = { x = 1, y = 2, z = { 3 } } }`},
+        {"table.pretty(table.merge({t = 1}, {t = {1}}), {indent = ''})", `{ t = { 1 } }`},
+        {"table.pretty(table.merge({t = {1}}, {t = 2}), {indent = ''})", `{ t = 2 }`},
+        {"(function() local b = {t = {1}}; local m = table.merge({}, b); return m.t ~= b.t end)()", "true"},
+        {"(function() local out = {keep = 1}; return deepmerge(out, {a = {1}}, {a = {[2] = 2}}) == out and table.pretty(out, {indent = ''}) end)()", `{ a = { 1, 2 }, keep = 1 }`},
+        {"table.pretty(deepmerge(nil, {1}, nil), {indent = ''})", `{ 1 }`},
+    })
+}
+
+func TestTableHelpers(t *testing.T) {
+    evalTests(t, `
+t = {10, 20, 30, 40, 50}
+m = {c = 3, a = 1, b = 2, [2] = 'two', [1] = 'one', [true] = 'yes'}
+`, []evalTest{
+        // keys and values are sorted by key: numbers, strings, booleans
+        {"table.concat(table.keys({c = 1, a = 2, b = 3}), ',')", "a,b,c"},
+        {"table.concat(table.values({c = 1, a = 2, b = 3}), ',')", "2,3,1"},
+        {"table.join(table.keys(m), ',')", "1,2,a,b,c,true"},
+        {"table.join(table.values(m), ',')", "one,two,1,2,3,yes"},
+        {"#table.keys({})", "0"},
+        // slice and join take positions like string.sub
+        {"table.concat(table.slice(t, 2, 3), ',')", "20,30"},
+        {"table.concat(table.slice(t, -2), ',')", "40,50"},
+        {"table.concat(table.slice(t, -4, -2), ',')", "20,30,40"},
+        {"table.concat(table.slice(t, 0, 100), ',')", "10,20,30,40,50"},
+        {"#table.slice(t, 4, 2)", "0"},
+        {"table.join(t, '-', -3)", "30-40-50"},
+        {"table.join(t, '-', 2, -2)", "20-30-40"},
+        {"table.join({1, true, 'a', 1.5})", "1truea1.5"},
+        {"table.join({}, ',')", ""},
+        // filter packs the sequence and keeps the other keys
+        {"table.pretty(table.filter({1, 2, 3, 4, x = 5, y = 6}, function(v) return v % 2 == 0 end), {indent = ''})", `{ 2, 4, y = 6 }`},
+        {"table.pretty(table.filter({1, 2, 3}, function(v, k) return k ~= 2 end), {indent = ''})", `{ 1, 3 }`},
+        {"table.pretty(table.map({1, 2, x = 3}, function(v, k) return v * 10 end), {indent = ''})", `{ 10, 20, x = 30 }`},
+        {"table.pretty(table.map({a = 1}, function(v, k) return k end), {indent = ''})", `{ a = "a" }`},
+        {"select(2, pcall(table.map, 1, print)):match('bad argument.*')", "bad argument #1 to 'map' (table expected, got number)"},
+    })
+}
+
+// embedders open the helpers on states without a context
+func TestOpenUtils(t *testing.T) {
+    L := lua.NewState()
+    L.OpenLibs()
+    defer L.Close()
+    if err := OpenUtils(L); err != nil {
+        t.Fatal(err)
+    }
+    if err := L.DoString(`_result = table.join(('b a'):split(), ',') .. table.tostring(1)`); err != nil {
+        t.Fatal(err)
+    }
+    L.GetGlobal("_result")
+    if got := L.ToString(-1); got != "b,a(number) 1\n" {
+        t.Fatalf("got %q", got)
+    }
+}